@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+const (
+	addrPolicyUnmap addrPolicy = iota
+	addrPolicyKeep
+	addrPolicyExtract
+	addrPolicyReject
+
+	defaultAddrPolicy = addrPolicyUnmap
+
+	// Label values of the address families that we keep track of.
+	familyIPv4   = "ipv4"
+	familyIPv6   = "ipv6"
+	familyMapped = "ipv4-mapped"
+	family6to4   = "6to4"
+	familyTeredo = "teredo"
+)
+
+var (
+	errEmbeddedIPv4  = errors.New("address embeds an IPv4 address")
+	errBadAddrPolicy = errors.New("unknown address policy")
+	addrPolicyNames  = map[addrPolicy]string{
+		addrPolicyKeep:    "keep",
+		addrPolicyUnmap:   "unmap",
+		addrPolicyExtract: "extract",
+		addrPolicyReject:  "reject",
+	}
+	prefix6to4   = netip.MustParsePrefix("2002::/16")
+	prefixTeredo = netip.MustParsePrefix("2001::/32")
+)
+
+// addrPolicy determines how we treat IPv6 addresses that embed an IPv4
+// address, i.e., IPv4-mapped, 6to4, and Teredo addresses:
+//
+//   - keep: Tokenize all addresses as they are.
+//   - unmap: Turn IPv4-mapped addresses into IPv4 addresses.  6to4 and Teredo
+//     addresses are tokenized as they are.
+//   - extract: Turn IPv4-mapped, 6to4, and Teredo addresses into the IPv4
+//     address that they embed.
+//   - reject: Refuse IPv4-mapped, 6to4, and Teredo addresses.
+type addrPolicy int
+
+func (p addrPolicy) String() string {
+	return addrPolicyNames[p]
+}
+
+// parseAddrPolicy turns the given policy name into an address policy.
+func parseAddrPolicy(name string) (addrPolicy, error) {
+	for p, n := range addrPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("%w %q; must be one of: %s", errBadAddrPolicy, name, addrPolicyList())
+}
+
+// addrPolicyList returns a comma-separated list of all address policies.
+func addrPolicyList() string {
+	var names []string
+	for _, n := range addrPolicyNames {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// addrFamily returns the family of the given address, for the sake of
+// metrics.
+func addrFamily(a netip.Addr) string {
+	switch {
+	case a.Is4():
+		return familyIPv4
+	case a.Is4In6():
+		return familyMapped
+	case prefix6to4.Contains(a):
+		return family6to4
+	case prefixTeredo.Contains(a):
+		return familyTeredo
+	default:
+		return familyIPv6
+	}
+}
+
+// embeddedIPv4 returns the IPv4 address that the given IPv4-mapped, 6to4, or
+// Teredo address embeds.  The boolean is false for all other addresses.
+func embeddedIPv4(a netip.Addr) (netip.Addr, bool) {
+	b := a.As16()
+	switch addrFamily(a) {
+	case familyMapped:
+		return a.Unmap(), true
+	case family6to4:
+		// 6to4 addresses carry the IPv4 address right after the prefix:
+		// https://www.rfc-editor.org/rfc/rfc3056#section-2
+		return netip.AddrFrom4([4]byte{b[2], b[3], b[4], b[5]}), true
+	case familyTeredo:
+		// Teredo addresses carry the client's obfuscated IPv4 address in
+		// their last 32 bits:
+		// https://www.rfc-editor.org/rfc/rfc4380#section-4
+		return netip.AddrFrom4([4]byte{^b[12], ^b[13], ^b[14], ^b[15]}), true
+	default:
+		return netip.Addr{}, false
+	}
+}
+
+// canonicalAddr returns the canonical representation of the given address,
+// which is what we tokenize.  The canonical representation has no zone and
+// treats embedded IPv4 addresses as the given policy mandates.
+func canonicalAddr(a netip.Addr, p addrPolicy) (netip.Addr, error) {
+	a = a.WithZone("")
+	embedded, ok := embeddedIPv4(a)
+	if !ok {
+		return a, nil
+	}
+	switch p {
+	case addrPolicyUnmap:
+		return a.Unmap(), nil
+	case addrPolicyExtract:
+		return embedded, nil
+	case addrPolicyReject:
+		return netip.Addr{}, errEmbeddedIPv4
+	default:
+		return a, nil
+	}
+}
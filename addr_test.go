@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestCanonicalAddr(t *testing.T) {
+	const (
+		mapped = "::ffff:192.0.2.1"
+		sixTo4 = "2002:c000:204::1"
+		// This Teredo address is taken from RFC 4380, Section 4.
+		teredo = "2001:0:4136:e378:8000:63bf:3fff:fdd2"
+	)
+	tests := []struct {
+		addr     string
+		policy   addrPolicy
+		expected string
+		err      error
+	}{
+		{"192.0.2.1", addrPolicyReject, "192.0.2.1", nil},
+		{"2001:db8::1", addrPolicyReject, "2001:db8::1", nil},
+		{"fe80::1%eth0", addrPolicyKeep, "fe80::1", nil},
+
+		{mapped, addrPolicyKeep, mapped, nil},
+		{mapped, addrPolicyUnmap, "192.0.2.1", nil},
+		{mapped, addrPolicyExtract, "192.0.2.1", nil},
+		{mapped, addrPolicyReject, "", errEmbeddedIPv4},
+
+		{sixTo4, addrPolicyKeep, sixTo4, nil},
+		{sixTo4, addrPolicyUnmap, sixTo4, nil},
+		{sixTo4, addrPolicyExtract, "192.0.2.4", nil},
+		{sixTo4, addrPolicyReject, "", errEmbeddedIPv4},
+
+		{teredo, addrPolicyKeep, teredo, nil},
+		{teredo, addrPolicyUnmap, teredo, nil},
+		{teredo, addrPolicyExtract, "192.0.2.45", nil},
+		{teredo, addrPolicyReject, "", errEmbeddedIPv4},
+	}
+	for _, test := range tests {
+		addr, err := canonicalAddr(netip.MustParseAddr(test.addr), test.policy)
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%s (%s): Expected error %v but got %v.", test.addr, test.policy, test.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		assertEqual(t, addr, netip.MustParseAddr(test.expected))
+	}
+}
+
+func TestAddrFamily(t *testing.T) {
+	assertEqual(t, addrFamily(netip.MustParseAddr("192.0.2.1")), familyIPv4)
+	assertEqual(t, addrFamily(netip.MustParseAddr("2001:db8::1")), familyIPv6)
+	assertEqual(t, addrFamily(netip.MustParseAddr("::ffff:192.0.2.1")), familyMapped)
+	assertEqual(t, addrFamily(netip.MustParseAddr("2002:c000:204::1")), family6to4)
+	assertEqual(t, addrFamily(netip.MustParseAddr("2001:0:4136:e378:8000:63bf:3fff:fdd2")), familyTeredo)
+}
+
+func TestParseAddrPolicy(t *testing.T) {
+	for p, name := range addrPolicyNames {
+		parsed, err := parseAddrPolicy(name)
+		if err != nil {
+			t.Fatalf("Failed to parse address policy %q: %v", name, err)
+		}
+		assertEqual(t, parsed, p)
+	}
+	if _, err := parseAddrPolicy("foo"); !errors.Is(err, errBadAddrPolicy) {
+		t.Fatalf("Expected error %v but got %v.", errBadAddrPolicy, err)
+	}
+}
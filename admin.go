@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	uuid "github.com/google/uuid"
+)
+
+const (
+	envAdminToken       = "ADMIN_API_TOKEN"
+	envDetokenizeToken  = "DETOKENIZE_API_TOKEN"
+	adminDetokenizePath = "/admin/detokenize"
+	adminRotateKeyPath  = "/admin/rotate-key"
+	adminFlushPath      = "/admin/flush"
+	adminStatusPath     = "/admin/status"
+	// The maximum size of a detokenize request, in bytes.
+	maxDetokenizeReqSize = 1 << 16
+)
+
+var (
+	errBadAuth          = errors.New("missing or invalid bearer token")
+	errNotReversible    = errors.New("tokenizer does not support detokenization")
+	errBadDetokenizeReq = errors.New("bad detokenize request")
+	errNotFlushable     = errors.New("aggregator does not support flushing")
+)
+
+// detokenizeRequest represents a request to turn the given token, which was
+// created using the key that's identified by the given key ID, back into its
+// original data.  The token is base64-encoded.
+type detokenizeRequest struct {
+	KeyID uuid.UUID `json:"keyid"`
+	Token []byte    `json:"token"`
+}
+
+// detokenizeResponse contains the (base64-encoded) data that a token was
+// created from.
+type detokenizeResponse struct {
+	Data []byte `json:"data"`
+}
+
+// rotateKeyResponse contains the ID of the key that a rotation resulted in.
+type rotateKeyResponse struct {
+	KeyID uuid.UUID `json:"keyid"`
+}
+
+// statusResponse describes our current key and the data that our aggregator
+// holds on to.  The key's age counts from the start of its epoch, if known.
+type statusResponse struct {
+	KeyID          uuid.UUID    `json:"keyid"`
+	KeyEpochStart  string       `json:"key_epoch_start,omitempty"`
+	KeyEpochEnd    string       `json:"key_epoch_end,omitempty"`
+	KeyAgeSeconds  int64        `json:"key_age_seconds"`
+	PendingWallets int          `json:"pending_wallets"`
+	PendingAddrs   int          `json:"pending_addrs"`
+	LastFlush      *flushResult `json:"last_flush"`
+}
+
+// newAdminRouter returns a router for our admin API, which operates on the
+// given tokenizer and aggregator.  All endpoints require a verified client
+// certificate or a bearer token.  Detokenization reveals the data that we
+// tokenize, so it has its own bearer token, and we only offer it if the
+// given TLS configuration isn't nil, i.e., if the admin API speaks HTTPS.
+func newAdminRouter(authToken, detokenizeToken string, tlsConf *tls.Config, t tokenizer, a aggregator) *chi.Mux {
+	r := chi.NewRouter()
+	r.Group(func(r chi.Router) {
+		r.Use(requireAuth(authToken))
+		r.Post(adminRotateKeyPath, rotateKeyHandler(t))
+		r.Post(adminFlushPath, flushHandler(a))
+		r.Get(adminStatusPath, statusHandler(t, a))
+	})
+	if tlsConf != nil {
+		r.With(requireAuth(detokenizeToken)).Post(adminDetokenizePath, detokenizeHandler(t))
+	}
+	return r
+}
+
+// requireAuth returns a middleware that rejects requests that neither come
+// with a client certificate that our TLS configuration verified nor contain
+// the given bearer token in their Authorization header.
+func requireAuth(authToken string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if authToken == "" || subtle.ConstantTimeCompare([]byte(given), []byte(authToken)) != 1 {
+				l.Printf("Rejected unauthorized admin request for %s.", r.URL.Path)
+				http.Error(w, errBadAuth.Error(), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// asDetokenizer returns the given tokenizer as a detokenizer, if it can
+// detokenize.  Chains and subnet tokenizers are unwrapped, so the tokenizer
+// that they wrap detokenizes their tokens.  The result is the data that the
+// wrapped tokenizer was given, e.g., a masked address.  A chain that
+// transforms tokens after tokenization cannot detokenize because we cannot
+// undo its transforms.
+func asDetokenizer(t tokenizer) (detokenizer, bool) {
+	for {
+		if d, ok := t.(detokenizer); ok {
+			return d, true
+		}
+		if c, ok := asChain(t); ok && len(c.post) == 0 {
+			t = c.tokenizer
+			continue
+		}
+		if s, ok := t.(*subnetTokenizer); ok {
+			t = s.tokenizer
+			continue
+		}
+		return nil, false
+	}
+}
+
+func detokenizeHandler(t tokenizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, ok := asDetokenizer(t)
+		if !ok {
+			http.Error(w, errNotReversible.Error(), http.StatusNotImplemented)
+			return
+		}
+
+		var req detokenizeRequest
+		body := http.MaxBytesReader(w, r.Body, maxDetokenizeReqSize)
+		if err := json.NewDecoder(body).Decode(&req); err != nil || len(req.Token) == 0 {
+			http.Error(w, errBadDetokenizeReq.Error(), http.StatusBadRequest)
+			return
+		}
+		// Every detokenization attempt ends up in our logs, for auditing.
+		l.Printf("Received detokenize request for key ID %s.", req.KeyID)
+
+		data, err := d.detokenize(token(req.Token), &keyID{UUID: req.KeyID})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&detokenizeResponse{Data: data}); err != nil {
+			l.Printf("Failed to encode detokenize response: %v", err)
+		}
+	}
+}
+
+func rotateKeyHandler(t tokenizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prev := t.keyID()
+		if err := t.resetKey(); err != nil {
+			l.Printf("Failed to rotate key via admin API: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		l.Printf("Rotated key %s via admin API.  New key ID: %s", prev, t.keyID())
+		writeAdminJSON(w, &rotateKeyResponse{KeyID: t.keyID().UUID})
+	}
+}
+
+func flushHandler(a aggregator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := a.(flusher)
+		if !ok {
+			http.Error(w, errNotFlushable.Error(), http.StatusNotImplemented)
+			return
+		}
+		l.Println("Flushing aggregator via admin API.")
+		if err := f.flush(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeAdminJSON(w, f.lastFlush())
+	}
+}
+
+func statusHandler(t tokenizer, a aggregator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := t.keyID()
+		status := &statusResponse{KeyID: id.UUID}
+		if e, ok := t.(epochTracker); ok {
+			if ep, ok := e.keyEpoch(id); ok {
+				status.KeyEpochStart = formatTime(ep.start)
+				status.KeyEpochEnd = formatTime(ep.end)
+				status.KeyAgeSeconds = int64(time.Since(ep.start).Seconds())
+			}
+		}
+		if f, ok := a.(flusher); ok {
+			status.PendingWallets, status.PendingAddrs = f.pending()
+			status.LastFlush = f.lastFlush()
+		}
+		writeAdminJSON(w, status)
+	}
+}
+
+// writeAdminJSON writes the given admin API response as JSON.
+func writeAdminJSON(w http.ResponseWriter, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		l.Printf("Failed to encode admin response: %v", err)
+	}
+}
+
+// newAdminTLSConfig returns the admin API's TLS configuration, which serves
+// the given certificate and, if a client CA file is given, verifies the
+// client certificates that clients present against the file's CAs.  Clients
+// that don't present a certificate still need a bearer token.
+func newAdminTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		caBundle, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, errBadCABundle
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return conf, nil
+}
+
+// exposeAdmin starts an HTTP server at the given port.  The server exposes our
+// admin API, which must never be publicly accessible.  If the given TLS
+// configuration isn't nil, the server speaks HTTPS.  Otherwise, it doesn't
+// offer detokenization.
+func exposeAdmin(port uint16, authToken, detokenizeToken string, tlsConf *tls.Config, t tokenizer, a aggregator) {
+	srv := &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   newAdminRouter(authToken, detokenizeToken, tlsConf, t, a),
+		TLSConfig: tlsConf,
+	}
+	if tlsConf != nil {
+		l.Printf("Exposing admin API at :%d via HTTPS.", port)
+		l.Fatal(srv.ListenAndServeTLS("", ""))
+	}
+	l.Printf("Exposing admin API at :%d without detokenization because it doesn't use HTTPS.", port)
+	l.Fatal(srv.ListenAndServe())
+}
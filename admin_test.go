@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testAdminToken      = "secret"
+	testDetokenizeToken = "detokenize-secret"
+)
+
+// newTLSAdminServer returns an HTTPS server that exposes our admin API,
+// including detokenization, for the given tokenizer and aggregator.
+func newTLSAdminServer(t tokenizer, a aggregator) *httptest.Server {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.TLS = &tls.Config{}
+	srv.Config.Handler = newAdminRouter(testAdminToken, testDetokenizeToken, srv.TLS, t, a)
+	srv.StartTLS()
+	return srv
+}
+
+func makeAdminReq(t *testing.T, s *httptest.Server, path, authToken string, body any) *http.Response {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("Failed to marshal request body: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL+path, bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Failed to create HTTP request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+authToken)
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make HTTP request: %v", err)
+	}
+	return resp
+}
+
+func TestAdminAuth(t *testing.T) {
+	srv := httptest.NewServer(newAdminRouter(testAdminToken, "", nil, newSIVTokenizer(), nil))
+	defer srv.Close()
+
+	resp := makeAdminReq(t, srv, adminRotateKeyPath, "wrong", nil)
+	assertEqual(t, resp.StatusCode, http.StatusUnauthorized)
+
+	// An empty token on the server side must never grant access.
+	srv = httptest.NewServer(newAdminRouter("", "", nil, newSIVTokenizer(), nil))
+	defer srv.Close()
+	resp = makeAdminReq(t, srv, adminRotateKeyPath, "", nil)
+	assertEqual(t, resp.StatusCode, http.StatusUnauthorized)
+
+	// The admin and detokenization tokens aren't interchangeable.
+	srv = newTLSAdminServer(newSIVTokenizer(), nil)
+	defer srv.Close()
+	resp = makeAdminReq(t, srv, adminDetokenizePath, testAdminToken, &detokenizeRequest{})
+	assertEqual(t, resp.StatusCode, http.StatusUnauthorized)
+	resp = makeAdminReq(t, srv, adminRotateKeyPath, testDetokenizeToken, nil)
+	assertEqual(t, resp.StatusCode, http.StatusUnauthorized)
+}
+
+func TestAdminDetokenizeRequiresTLS(t *testing.T) {
+	srv := httptest.NewServer(newAdminRouter(testAdminToken, testDetokenizeToken, nil, newSIVTokenizer(), nil))
+	defer srv.Close()
+
+	resp := makeAdminReq(t, srv, adminDetokenizePath, testDetokenizeToken, &detokenizeRequest{})
+	assertEqual(t, resp.StatusCode, http.StatusNotFound)
+}
+
+func TestAdminDetokenize(t *testing.T) {
+	tkzr := newSIVTokenizer()
+	_ = tkzr.resetKey()
+	srv := newTLSAdminServer(tkzr, nil)
+	defer srv.Close()
+
+	tkn, kID, err := tkzr.tokenizeAndKeyID(value1)
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	data, err := requestDetokenize(srv.Client(), srv.URL, testDetokenizeToken, &detokenizeRequest{
+		KeyID: kID.UUID,
+		Token: tkn,
+	})
+	if err != nil {
+		t.Fatalf("Failed to detokenize: %v", err)
+	}
+	if !bytes.Equal(data, value1) {
+		t.Fatalf("Expected %v but got %v.", value1, data)
+	}
+
+	// Unknown key IDs must be rejected.
+	_, err = requestDetokenize(srv.Client(), srv.URL, testDetokenizeToken, &detokenizeRequest{
+		KeyID: newV4(t),
+		Token: tkn,
+	})
+	assertEqual(t, err.Error(), errUnknownKeyID.Error())
+}
+
+func TestAdminDetokenizeNotReversible(t *testing.T) {
+	srv := newTLSAdminServer(newHmacTokenizer(), nil)
+	defer srv.Close()
+
+	resp := makeAdminReq(t, srv, adminDetokenizePath, testDetokenizeToken, &detokenizeRequest{
+		Token: []byte("foo"),
+	})
+	assertEqual(t, resp.StatusCode, http.StatusNotImplemented)
+}
+
+func TestAdminRotateKey(t *testing.T) {
+	tkzr := newHmacTokenizer()
+	_ = tkzr.resetKey()
+	prev := *tkzr.keyID()
+	srv := httptest.NewServer(newAdminRouter(testAdminToken, "", nil, tkzr, nil))
+	defer srv.Close()
+
+	resp := makeAdminReq(t, srv, adminRotateKeyPath, testAdminToken, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var rotated rotateKeyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rotated); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if rotated.KeyID == prev.UUID {
+		t.Fatal("Expected key rotation to result in a new key ID.")
+	}
+	assertEqual(t, rotated.KeyID, tkzr.keyID().UUID)
+}
+
+func TestAdminFlushAndStatus(t *testing.T) {
+	tkzr := newCryptoPAnTokenizer()
+	_ = tkzr.resetKey()
+	a := newAddrAggregator().(*addrAggregator)
+	a.use(tkzr)
+	outbox := make(chan token, 10)
+	a.connect(nil, outbox)
+	srv := httptest.NewServer(newAdminRouter(testAdminToken, "", nil, tkzr, a))
+	defer srv.Close()
+
+	getStatus := func() *statusResponse {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+adminStatusPath, nil)
+		if err != nil {
+			t.Fatalf("Failed to create HTTP request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make HTTP request: %v", err)
+		}
+		defer resp.Body.Close()
+		assertEqual(t, resp.StatusCode, http.StatusOK)
+		var status statusResponse
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return &status
+	}
+
+	wallet := newV4(t)
+	for _, addr := range []string{"1.2.3.4", "2.3.4.5"} {
+		if err := a.processRequest(&clientRequest{
+			Addr:   netip.MustParseAddr(addr),
+			Wallet: wallet,
+		}); err != nil {
+			t.Fatalf("Failed to process request: %v", err)
+		}
+	}
+	status := getStatus()
+	assertEqual(t, status.KeyID, tkzr.keyID().UUID)
+	assertEqual(t, status.PendingWallets, 1)
+	assertEqual(t, status.PendingAddrs, 2)
+	if status.LastFlush != nil {
+		t.Fatalf("Expected no flush but got %+v.", status.LastFlush)
+	}
+	if status.KeyEpochStart == "" || status.KeyAgeSeconds < 0 {
+		t.Fatalf("Expected key epoch and age but got %+v.", status)
+	}
+
+	resp := makeAdminReq(t, srv, adminFlushPath, testAdminToken, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	assertEqual(t, len(outbox), 1)
+
+	status = getStatus()
+	assertEqual(t, status.PendingWallets, 0)
+	assertEqual(t, status.PendingAddrs, 0)
+	if status.LastFlush == nil {
+		t.Fatal("Expected last flush but got none.")
+	}
+	assertEqual(t, status.LastFlush.Wallets, 1)
+	assertEqual(t, status.LastFlush.Addrs, 2)
+	assertEqual(t, status.LastFlush.Error, "")
+}
+
+func TestAdminFlushNotSupported(t *testing.T) {
+	srv := httptest.NewServer(newAdminRouter(testAdminToken, "", nil, newHmacTokenizer(), newSimpleAggregator()))
+	defer srv.Close()
+
+	resp := makeAdminReq(t, srv, adminFlushPath, testAdminToken, nil)
+	assertEqual(t, resp.StatusCode, http.StatusNotImplemented)
+}
+
+// newTestCert creates a certificate for the given template, which is signed
+// by the given parent and its key, or self-signed if the parent is nil.
+func newTestCert(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+// writeTestPEM writes the given PEM block to a new file in the given
+// directory and returns the file's path.
+func writeTestPEM(t *testing.T, dir, name string, block *pem.Block) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestAdminMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	ca, caKey := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tkzr test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	server, serverKey := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "tkzr"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	client, clientKey := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "operator"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	rawServerKey, err := x509.MarshalECPrivateKey(serverKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	tlsConf, err := newAdminTLSConfig(
+		writeTestPEM(t, dir, "cert.pem", &pem.Block{Type: "CERTIFICATE", Bytes: server.Raw}),
+		writeTestPEM(t, dir, "key.pem", &pem.Block{Type: "EC PRIVATE KEY", Bytes: rawServerKey}),
+		writeTestPEM(t, dir, "ca.pem", &pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create TLS configuration: %v", err)
+	}
+
+	tkzr := newSIVTokenizer()
+	_ = tkzr.resetKey()
+	srv := httptest.NewUnstartedServer(newAdminRouter("", "", tlsConf, tkzr, nil))
+	srv.TLS = tlsConf
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	newClient := func(certs []tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		}}}
+	}
+	get := func(c *http.Client) int {
+		resp, err := c.Get(srv.URL + adminStatusPath)
+		if err != nil {
+			t.Fatalf("Failed to make HTTP request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Without a client certificate or bearer token, we're turned away.
+	anonymous := newClient(nil)
+	assertEqual(t, get(anonymous), http.StatusUnauthorized)
+	operator := newClient([]tls.Certificate{{
+		Certificate: [][]byte{client.Raw},
+		PrivateKey:  clientKey,
+	}})
+	assertEqual(t, get(operator), http.StatusOK)
+
+	// The same goes for detokenization.
+	tkn, kID, err := tkzr.tokenizeAndKeyID(value1)
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	req := &detokenizeRequest{KeyID: kID.UUID, Token: tkn}
+	if _, err := requestDetokenize(anonymous, srv.URL, "", req); err == nil {
+		t.Fatal("Expected detokenization without client certificate to fail.")
+	}
+	data, err := requestDetokenize(operator, srv.URL, "", req)
+	if err != nil {
+		t.Fatalf("Failed to detokenize: %v", err)
+	}
+	if !bytes.Equal(data, value1) {
+		t.Fatalf("Expected %v but got %v.", value1, data)
+	}
+
+	if _, err := newAdminTLSConfig(
+		writeTestPEM(t, dir, "cert.pem", &pem.Block{Type: "CERTIFICATE", Bytes: server.Raw}),
+		writeTestPEM(t, dir, "key.pem", &pem.Block{Type: "EC PRIVATE KEY", Bytes: rawServerKey}),
+		writeTestPEM(t, dir, "bad-ca.pem", &pem.Block{Type: "FOO", Bytes: []byte("foo")}),
+	); !errors.Is(err, errBadCABundle) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadCABundle, err)
+	}
+}
+
+func TestAdminDetokenizeWrapped(t *testing.T) {
+	_, newChain, err := parseChain("normalize-email | siv")
+	if err != nil {
+		t.Fatalf("Failed to parse chain: %v", err)
+	}
+	chain := newChain()
+	_ = chain.resetKey()
+	tkn, kID, err := chain.tokenizeAndKeyID(blob("Alice@Example.com"))
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+
+	// Subnet tokenizers and chains must hand detokenize requests to the
+	// tokenizer they wrap.
+	srv := newTLSAdminServer(newSubnetTokenizer(chain, nil, nil), nil)
+	defer srv.Close()
+	data, err := requestDetokenize(srv.Client(), srv.URL, testDetokenizeToken, &detokenizeRequest{
+		KeyID: kID.UUID,
+		Token: tkn,
+	})
+	if err != nil {
+		t.Fatalf("Failed to detokenize: %v", err)
+	}
+	assertEqual(t, string(data), "alice@example.com")
+
+	// A chain whose tokens are transformed cannot detokenize.
+	_, newChain, err = parseChain("siv | hex")
+	if err != nil {
+		t.Fatalf("Failed to parse chain: %v", err)
+	}
+	srv = newTLSAdminServer(newChain(), nil)
+	defer srv.Close()
+	resp := makeAdminReq(t, srv, adminDetokenizePath, testDetokenizeToken, &detokenizeRequest{
+		Token: []byte("foo"),
+	})
+	assertEqual(t, resp.StatusCode, http.StatusNotImplemented)
+}
+
+func TestAdminDetokenizeTooLarge(t *testing.T) {
+	srv := newTLSAdminServer(newSIVTokenizer(), nil)
+	defer srv.Close()
+
+	resp := makeAdminReq(t, srv, adminDetokenizePath, testDetokenizeToken, &detokenizeRequest{
+		Token: make([]byte, maxDetokenizeReqSize),
+	})
+	assertEqual(t, resp.StatusCode, http.StatusBadRequest)
+}
+
+func TestAdminDetokenizeFlags(t *testing.T) {
+	t.Setenv(envAdminToken, testAdminToken)
+	t.Setenv(envDetokenizeToken, testDetokenizeToken)
+
+	// Detokenization tokens are useless without HTTPS, so we refuse them.
+	if _, _, err := parseFlags("tkzr", []string{"-expose-admin"}); err == nil {
+		t.Fatal("Expected detokenization token without certificate to be rejected.")
+	}
+}
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net"
 	"sync"
 	"time"
 
@@ -16,8 +14,13 @@ import (
 const (
 	schemaService = "ADS"
 	schemaSignal  = "ANON_IP_ADDRS"
+	// maxKeyAttempts is how often we try to process a batch of requests if
+	// the active keys keep changing underneath us.
+	maxKeyAttempts = 3
 )
 
+var errKeysRotated = errors.New("keys were rotated while processing requests")
+
 // The Avro codec that we use to encode data before sending it to Kafka.
 var ourCodec = func() *goavro.Codec {
 	codec, err := goavro.NewCodec(`{
@@ -50,21 +53,32 @@ type kafkaMessage struct {
 // addresses and their respective meta data.
 type addrAggregator struct {
 	sync.RWMutex
-	wg          sync.WaitGroup
-	fwdInterval time.Duration
-	keyExpiry   time.Duration
-	addrs       WalletsByKeyID
-	tokenizer   tokenizer
-	inbox       chan serializer
-	outbox      chan token
-	done        chan empty
+	wg           sync.WaitGroup
+	fwdInterval  time.Duration
+	keyExpiry    time.Duration
+	alignToClock bool
+	envelopes    bool
+	keyedName    string // The name of our tokenizer's keyed stage.
+	envelopeAlg  string // The spec of our printable tokenizer, if envelopes is set.
+	shadow       bool
+	stats        *pipelineMetrics
+	addrs        WalletsByKeyID
+	epochs       map[keyID]epoch
+	tokenizer    tokenizer
+	printable    tokenizer // Our tokenizer, followed by an encoding stage.
+	lastResult   *flushResult
+	inbox        chan serializer
+	outbox       chan token
+	done         chan empty
 }
 
 // newAddrAggregator returns a new address aggregator.
 func newAddrAggregator() aggregator {
 	return &addrAggregator{
-		done:  make(chan empty),
-		addrs: make(WalletsByKeyID),
+		done:   make(chan empty),
+		stats:  metricsFor(pipelinePrimary),
+		addrs:  make(WalletsByKeyID),
+		epochs: make(map[keyID]epoch),
 	}
 }
 
@@ -75,7 +89,14 @@ func (a *addrAggregator) setConfig(c *config) {
 
 	a.fwdInterval = c.fwdInterval
 	a.keyExpiry = c.keyExpiry
-	l.Printf("Forward interval: %s, key expiry: %s", a.fwdInterval, a.keyExpiry)
+	a.alignToClock = c.alignToClock
+	a.shadow = c.shadow
+	a.stats = c.metrics()
+	a.envelopes = c.envelopeTokens
+	a.keyedName = c.tokenizerName
+	a.updateEnvelopeAlg()
+	l.Printf("Forward interval: %s, key expiry: %s, aligned to clock: %t",
+		a.fwdInterval, a.keyExpiry, a.alignToClock)
 }
 
 // use sets the tokenizer that must be used.
@@ -84,6 +105,19 @@ func (a *addrAggregator) use(t tokenizer) {
 	defer a.Unlock()
 
 	a.tokenizer = t
+	a.printable = printable(t)
+	a.updateEnvelopeAlg()
+}
+
+// updateEnvelopeAlg sets the algorithm of our envelopes to the spec of the
+// chain that creates their payloads, including the encoding stage that makes
+// the payloads printable, e.g. "mask:/24|cryptopan|ip".  The caller must hold
+// the write lock.
+func (a *addrAggregator) updateEnvelopeAlg() {
+	a.envelopeAlg = ""
+	if a.envelopes && a.printable != nil {
+		a.envelopeAlg = chainSpecOf(a.printable, a.keyedName)
+	}
 }
 
 // connect sets the inbox to retrieve serialized data from and the outbox to
@@ -106,8 +140,8 @@ func (a *addrAggregator) start() {
 	go func() {
 		defer a.wg.Done()
 		a.RLock() // Protect read of fwdInterval and keyExpiry.
-		fwdTicker := time.NewTicker(a.fwdInterval)
-		keyTicker := time.NewTicker(a.keyExpiry)
+		fwdTimer := time.NewTimer(a.untilFlush())
+		keyTimer := time.NewTimer(a.untilKeyRotation())
 		a.RUnlock()
 
 		l.Println("Starting address aggregator loop.")
@@ -115,30 +149,55 @@ func (a *addrAggregator) start() {
 			select {
 			case <-a.done:
 				return
-			case <-fwdTicker.C:
+			case <-fwdTimer.C:
 				if err := a.flush(); err != nil {
 					l.Printf("Failed to forward addresses: %v", err)
+					a.countShadowError(shadowStageForward, err)
+				}
+				a.RLock()
+				fwdTimer.Reset(a.untilFlush())
+				a.RUnlock()
+			case <-keyTimer.C:
+				// The key may have been rotated via the admin API since we
+				// set the timer, in which case its epoch ends later.
+				a.RLock()
+				d := a.untilKeyRotation()
+				a.RUnlock()
+				if d > 0 {
+					keyTimer.Reset(d)
+					continue
 				}
-			case <-keyTicker.C:
 				if err := a.tokenizer.resetKey(); err != nil {
 					l.Fatalf("Failed to reset tokenizer key: %v", err)
 				}
+				a.RLock()
+				keyTimer.Reset(a.untilKeyRotation())
+				a.RUnlock()
 			case req := <-a.inbox:
-				switch v := req.(type) {
-				case *clientRequest:
-					if err := a.processRequest(v); err != nil {
-						l.Printf("Failed to process client request: %v", err)
+				// Whatever else is already waiting in our inbox is tokenized
+				// in the same batch.
+				reqs, other := splitBatch(drainInbox(req, a.inbox))
+				if len(reqs) > 0 {
+					if err := a.processRequests(reqs); err != nil {
+						l.Printf("Failed to process client request(s): %v", err)
+						a.countShadowError(shadowStageTokenize, err)
 					}
-					l.Printf("Processed request for wallet %s.", v.Wallet)
-				default:
+					l.Printf("Processed %d request(s).", len(reqs))
+				}
+				if len(other) > 0 {
 					// We are not prepared to process whatever data structure
 					// we were given.  Simply tokenize it and forward it right
 					// away, without aggregation.
-					t, err := a.tokenizer.tokenize(v)
+					tokens, _, err := a.tokenizer.tokenizeBatch(other, nil)
 					if err != nil {
-						l.Printf("Failed to tokenize blob: %v", err)
+						l.Printf("Failed to tokenize blob(s): %v", err)
+						a.countShadowError(shadowStageTokenize, err)
+					}
+					for _, t := range tokens {
+						if t != nil {
+							a.outbox <- t
+						}
 					}
-					a.outbox <- t
 					l.Println("Type not supported.  Forwarded.")
 				}
 			}
@@ -146,6 +205,70 @@ func (a *addrAggregator) start() {
 	}()
 }
 
+// splitBatch splits the given batch into client requests and other input.
+// Records are rejected because we would forward them without aggregation,
+// bypassing our Kafka messages' schema.
+func splitBatch(batch []serializer) ([]*clientRequest, []serializer) {
+	var (
+		reqs  []*clientRequest
+		other []serializer
+	)
+	for _, s := range batch {
+		switch v := s.(type) {
+		case *clientRequest:
+			reqs = append(reqs, v)
+		case jsonRecord:
+			l.Println("Rejected record.  The address aggregator doesn't process records.")
+		default:
+			other = append(other, s)
+		}
+	}
+	return reqs, other
+}
+
+// countShadowError counts the given error if we're the shadow pipeline's
+// aggregator.
+func (a *addrAggregator) countShadowError(stage string, err error) {
+	a.RLock()
+	defer a.RUnlock()
+
+	if a.shadow {
+		countShadowError(stage, err)
+	}
+}
+
+// untilKeyRotation returns the duration until the tokenizer's key must be
+// rotated next.  The caller must hold the read lock.
+func (a *addrAggregator) untilKeyRotation() time.Duration {
+	d, _ := untilKeyRotation(a.tokenizer, a.keyExpiry)
+	return d
+}
+
+// untilKeyRotation returns the duration until the given tokenizer's key must
+// be rotated next, and whether the tokenizer knows when its key's epoch ends
+// (e.g., because the key was reloaded from the key store or its epoch is
+// aligned to the clock).  If it does, we rotate at that time.  Otherwise, we
+// rotate after the given key expiry.
+func untilKeyRotation(t tokenizer, keyExpiry time.Duration) (time.Duration, bool) {
+	if e, ok := t.(epochTracker); ok {
+		if ep, ok := e.keyEpoch(t.keyID()); ok && !ep.end.IsZero() {
+			return time.Until(ep.end), true
+		}
+	}
+	return keyExpiry, false
+}
+
+// untilFlush returns the duration until we must flush next.  If our schedule
+// is aligned to the clock, we flush at the next multiple of the forward
+// interval, counting from the Unix epoch.  The caller must hold the read
+// lock.
+func (a *addrAggregator) untilFlush() time.Duration {
+	if a.alignToClock {
+		return time.Until(alignedEpoch(time.Now(), a.fwdInterval).end)
+	}
+	return a.fwdInterval
+}
+
 // stop stops the address aggregator.
 func (a *addrAggregator) stop() {
 	close(a.done)
@@ -155,66 +278,172 @@ func (a *addrAggregator) stop() {
 
 // processRequest processes an incoming client request.
 func (a *addrAggregator) processRequest(req *clientRequest) error {
+	return a.processRequests([]*clientRequest{req})
+}
+
+// processRequests processes a batch of incoming client requests.  Requests
+// that fail don't keep us from processing the others.
+func (a *addrAggregator) processRequests(reqs []*clientRequest) error {
 	a.Lock()
 	defer a.Unlock()
 	// Update metrics when we're done processing the request.
 	defer func() {
-		m.numWallets.Set(float64(a.addrs.numWallets()))
-		m.numAddrs.Set(float64(a.addrs.numAddrs()))
+		a.stats.numWallets.Set(float64(a.addrs.numWallets()))
+		a.stats.numAddrs.Set(float64(a.addrs.numAddrs()))
 	}()
 
-	rawToken, keyID, err := a.tokenizer.tokenizeAndKeyID(req)
-	if err != nil {
-		return err
+	// Our snapshot of the active keys may be outdated by the time we use it,
+	// e.g., because the key was rotated via the admin API.  If none of the
+	// snapshot's keys is still active, we take a new snapshot.
+	for attempt := 0; attempt < maxKeyAttempts; attempt++ {
+		ids := a.tokenizer.activeKeyIDs()
+		if len(ids) == 0 {
+			return errNoKey
+		}
+		used, err := a.processWithKeys(reqs, ids)
+		if used {
+			return err
+		}
+	}
+	a.stats.droppedRequests.Add(float64(len(reqs)))
+	return fmt.Errorf("%w: dropped %d request(s)", errKeysRotated, len(reqs))
+}
+
+// processWithKeys processes the given requests using each of the given keys.
+// During a key overlap, we tokenize the request under each active key and
+// record the result under each key ID, so that clients who straddle the
+// rotation can be correlated across both epochs.  We return false if none of
+// the keys was still active.  The caller must hold the lock.
+func (a *addrAggregator) processWithKeys(reqs []*clientRequest, ids []*keyID) (bool, error) {
+	var (
+		errs []error
+		used bool
+	)
+	for _, id := range ids {
+		addrs, err := a.tokenizeAddrs(reqs, id)
+		if errors.Is(err, errInactiveKeyID) {
+			// The key's overlap ended or the key was rotated in the
+			// meantime.
+			continue
+		}
+		used = true
+		if err != nil && addrs == nil {
+			return used, err
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+		added := false
+		for i, req := range reqs {
+			if addrs[i] == nil {
+				continue
+			}
+			if a.envelopeAlg != "" {
+				for j := range addrs[i] {
+					addrs[i][j] = newEnvelope(a.envelopeAlg, id, addrs[i][j]).String()
+				}
+			}
+			a.addrs.add(*id, req.Wallet, addrs[i])
+			added = true
+		}
+		if added {
+			a.trackEpoch(id)
+		}
+	}
+	return used, errors.Join(errs...)
+}
+
+// trackEpoch remembers the epoch of the given key ID, so we can include it in
+// our Kafka messages even if the key is no longer active when we flush.  The
+// caller must hold the lock.
+func (a *addrAggregator) trackEpoch(id *keyID) {
+	if _, exists := a.epochs[*id]; exists {
+		return
+	}
+	if e, ok := a.tokenizer.(epochTracker); ok {
+		if ep, ok := e.keyEpoch(id); ok {
+			a.epochs[*id] = ep
+		}
 	}
-	// The tokenized IP address may not be printable, so let's encode it.
-	token := base64.StdEncoding.EncodeToString(rawToken)
-
-	// If we're using a tokenizer that preserves the blob's length, we turn the
-	// byte slice back into an IP address.
-	if a.tokenizer.preservesLen() {
-		if len(rawToken) != net.IPv4len && len(rawToken) != net.IPv6len {
-			return errors.New("token is neither of length IPv4 nor IPv6")
+}
+
+// tokenizeAddrs tokenizes the given requests' addresses using the active key
+// with the given ID and returns each request's printable token(s).  The
+// token(s) of requests that failed are nil, in which case a batchError tells
+// us why.  If the entire batch failed, the returned slice is nil.  The caller
+// must hold the lock.
+func (a *addrAggregator) tokenizeAddrs(reqs []*clientRequest, id *keyID) ([][]string, error) {
+	var (
+		addrs = make([][]string, len(reqs))
+		errs  batchError
+	)
+	fail := func(i int, err error) {
+		if errs == nil {
+			errs = make(batchError)
 		}
-		token = net.IP(rawToken).String()
+		errs[i] = err
 	}
 
-	wallets, exists := a.addrs[*keyID]
-	if !exists {
-		// We're starting a new key ID epoch.
-		wallets := make(AddrsByWallet)
-		wallets[req.Wallet] = AddressSet{
-			token: empty{},
+	g, ok := a.printable.(granularTokenizer)
+	if !ok {
+		batch := make([]serializer, len(reqs))
+		for i, req := range reqs {
+			batch[i] = req
+		}
+		tokens, _, err := a.printable.tokenizeBatch(batch, id)
+		if err != nil && !errors.As(err, &errs) {
+			return nil, err
+		}
+		for i, t := range tokens {
+			if t != nil {
+				addrs[i] = []string{string(t)}
+			}
 		}
-		a.addrs[*keyID] = wallets
 	} else {
-		// We're adding to the existing epoch.
-		addrSet, exists := wallets[req.Wallet]
-		if !exists {
-			// We have no addresses for the given wallet yet.  Create a new
-			// address set.
-			wallets[req.Wallet] = AddressSet{
-				token: empty{},
+		for i, req := range reqs {
+			tokens, err := g.tokenizeGranular(req, id)
+			if errors.Is(err, errInactiveKeyID) || errors.Is(err, errNoKey) {
+				return nil, err
+			}
+			if err != nil {
+				fail(i, err)
+				continue
 			}
-		} else {
-			// Add address to the given wallet's address set.
-			addrSet[token] = empty{}
+			addrs[i] = labelGranular(tokens)
 		}
 	}
-	return nil
+	if errs != nil {
+		return addrs, errs
+	}
+	return addrs, nil
+}
+
+// labelGranular labels each of the given printable granular tokens with the
+// prefix length of the address that it was created from, e.g. "1.2.3.0/24".
+func labelGranular(tokens []granularToken) []string {
+	addrs := make([]string, len(tokens))
+	for i, t := range tokens {
+		addrs[i] = fmt.Sprintf("%s/%d", t.token, t.prefixLen)
+	}
+	return addrs
 }
 
 // compileKafkaMsg turns the given arguments into a byte slice that's ready to
 // be sent to our Kafka cluster.
-func compileKafkaMsg(keyID keyID, walletID uuid.UUID, addrs AddressSet) ([]byte, error) {
+func compileKafkaMsg(keyID keyID, e epoch, walletID uuid.UUID, addrs AddressSet) ([]byte, error) {
 	// We're abusing our schema's justification field by storing JSON in it.
 	// While not elegant, this lets us ingest anonymized IP addresses without
-	// modifying the schema.
+	// modifying the schema.  The key's epoch tells analysts which time
+	// interval the addresses belong to.  We omit unknown epoch boundaries.
 	justification := struct {
-		KeyID uuid.UUID `json:"keyid"`
-		Addrs []string  `json:"addrs"`
+		KeyID      uuid.UUID `json:"keyid"`
+		EpochStart string    `json:"epoch_start,omitempty"`
+		EpochEnd   string    `json:"epoch_end,omitempty"`
+		Addrs      []string  `json:"addrs"`
 	}{
-		KeyID: keyID.UUID,
+		KeyID:      keyID.UUID,
+		EpochStart: formatTime(e.start),
+		EpochEnd:   formatTime(e.end),
 	}
 
 	justification.Addrs = append(justification.Addrs, addrs.sorted()...)
@@ -239,31 +468,79 @@ func compileKafkaMsg(keyID keyID, walletID uuid.UUID, addrs AddressSet) ([]byte,
 	return avroEncode(ourCodec, jsonBytes)
 }
 
-// flush flushes the aggregator's addresses to the outbox.
+// formatTime formats the given time as an RFC 3339 timestamp in UTC.  The zero
+// time results in an empty string.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// flush flushes the aggregator's addresses to the outbox and remembers the
+// result, which the admin API reports.
 func (a *addrAggregator) flush() error {
 	a.Lock()
 	defer a.Unlock()
 
+	wallets, addrs, err := a.forward()
+	a.lastResult = &flushResult{
+		Time:    time.Now().UTC(),
+		Wallets: wallets,
+		Addrs:   addrs,
+	}
+	if err != nil {
+		a.lastResult.Error = err.Error()
+	}
+	return err
+}
+
+// forward sends the aggregator's addresses to the outbox and returns the
+// number of wallets and addresses that it forwarded.  The caller must hold
+// the lock.
+func (a *addrAggregator) forward() (int, int, error) {
 	if len(a.addrs) == 0 {
-		return nil
+		return 0, 0, nil
 	}
 
+	var numWallets, numAddrs int
 	for keyID, wallets := range a.addrs {
 		totalAddrs := 0
 		// Compile the anonymized IP addresses that we've seen for a given
 		// wallet ID.
 		for walletID, addrSet := range wallets {
 			totalAddrs += len(addrSet)
-			kafkaMsg, err := compileKafkaMsg(keyID, walletID, addrSet)
+			kafkaMsg, err := compileKafkaMsg(keyID, a.epochs[keyID], walletID, addrSet)
 			if err != nil {
-				return err
+				return numWallets, numAddrs, err
 			}
 			a.outbox <- token(kafkaMsg)
+			numWallets++
+			numAddrs += len(addrSet)
 		}
 		l.Printf("Forwarded %d addresses of %d wallets using key ID %s.",
 			totalAddrs, len(wallets), keyID)
 	}
 	a.addrs = make(WalletsByKeyID)
+	a.epochs = make(map[keyID]epoch)
+
+	return numWallets, numAddrs, nil
+}
+
+// pending returns the number of wallets and addresses that are waiting to be
+// flushed.
+func (a *addrAggregator) pending() (int, int) {
+	a.RLock()
+	defer a.RUnlock()
+
+	return a.addrs.numWallets(), a.addrs.numAddrs()
+}
+
+// lastFlush returns the result of our most recent flush, or nil if we haven't
+// flushed yet.
+func (a *addrAggregator) lastFlush() *flushResult {
+	a.RLock()
+	defer a.RUnlock()
 
-	return nil
+	return a.lastResult
 }
@@ -28,6 +28,28 @@ type AddrsByWallet map[uuid.UUID]AddressSet
 // begins, and our collection of wallet-to-address records begins afresh.
 type WalletsByKeyID map[keyID]AddrsByWallet
 
+// add adds the given addresses to the given wallet's address set under the
+// given key ID.  During a key overlap, the same wallet is added under more
+// than one key ID.
+func (w WalletsByKeyID) add(id keyID, wallet uuid.UUID, addrs []string) {
+	wallets, exists := w[id]
+	if !exists {
+		// We're starting a new key ID epoch.
+		wallets = make(AddrsByWallet)
+		w[id] = wallets
+	}
+	addrSet, exists := wallets[wallet]
+	if !exists {
+		// We have no addresses for the given wallet yet.  Create a new address
+		// set.
+		addrSet = make(AddressSet)
+		wallets[wallet] = addrSet
+	}
+	for _, addr := range addrs {
+		addrSet[addr] = empty{}
+	}
+}
+
 // sorted returns the address set's addresses as a sorted string slice.
 func (s AddressSet) sorted() []string {
 	addrs := []string{}
@@ -2,13 +2,15 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"net"
+	"net/netip"
 	"reflect"
 	"testing"
 	"time"
 
 	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestCompileKafkaMsg(t *testing.T) {
@@ -21,13 +23,19 @@ func TestCompileKafkaMsg(t *testing.T) {
 		addr2: empty{},
 	}
 
-	msg, err := compileKafkaMsg(keyID, walletID, addrs)
+	e := epoch{
+		start: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		end:   time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+	}
+
+	msg, err := compileKafkaMsg(keyID, e, walletID, addrs)
 	if err != nil {
 		t.Fatalf("Expected no error but got: %v", err)
 	}
 
 	justification := `{\"keyid\":\"` + keyID.String() +
-		`\",\"addrs\":[\"` + addr1 + `\",\"` + addr2 + `\",\"` + addr3 + `\"]}`
+		`\",\"epoch_start\":\"2024-01-01T00:00:00Z\",\"epoch_end\":\"2024-01-02T00:00:00Z\"` +
+		`,\"addrs\":[\"` + addr1 + `\",\"` + addr2 + `\",\"` + addr3 + `\"]}`
 	expectedJSON := fmt.Sprintf("{\"wallet_id\":\"%s\","+
 		"\"service\":\"%s\","+
 		"\"signal\":\"%s\","+
@@ -54,8 +62,8 @@ func TestCompileKafkaMsg(t *testing.T) {
 func TestAddrAggregatorProcess(t *testing.T) {
 	rawAddr1 := "1.2.3.4"
 	rawAddr2 := "2.3.4.5"
-	addr1 := net.ParseIP(rawAddr1)
-	addr2 := net.ParseIP(rawAddr2)
+	addr1 := netip.MustParseAddr(rawAddr1)
+	addr2 := netip.MustParseAddr(rawAddr2)
 	wallet1 := newV4(t)
 	tokenizer := newVerbatimTokenizer()
 	_ = tokenizer.resetKey()
@@ -116,3 +124,224 @@ func TestAddrAggregatorProcess(t *testing.T) {
 		}
 	}
 }
+
+func TestAddrAggregatorProcessGranular(t *testing.T) {
+	wallet := newV4(t)
+	tokenizer := newSubnetTokenizer(newVerbatimTokenizer(), []int{32, 24}, nil)
+	_ = tokenizer.resetKey()
+	a := newAddrAggregator().(*addrAggregator)
+	a.use(tokenizer)
+
+	for _, addr := range []string{"1.2.3.4", "1.2.3.5"} {
+		if err := a.processRequest(&clientRequest{
+			Addr:   netip.MustParseAddr(addr),
+			Wallet: wallet,
+		}); err != nil {
+			t.Fatalf("Failed to process request: %v", err)
+		}
+	}
+
+	expected := WalletsByKeyID{
+		*tokenizer.keyID(): AddrsByWallet{
+			wallet: AddressSet{
+				"1.2.3.4/32": empty{},
+				"1.2.3.5/32": empty{},
+				"1.2.3.0/24": empty{},
+			},
+		},
+	}
+	if !reflect.DeepEqual(a.addrs, expected) {
+		t.Fatalf("Expected %+v but got %+v.", expected, a.addrs)
+	}
+}
+
+func TestAddrAggregatorProcessBatch(t *testing.T) {
+	wallet1, wallet2, wallet3 := newV4(t), newV4(t), newV4(t)
+	tokenizer := newCryptoPAnTokenizer()
+	_ = tokenizer.resetKey()
+	a := newAddrAggregator().(*addrAggregator)
+	a.use(tokenizer)
+
+	// The second request lacks an address, which must not keep us from
+	// processing the others.
+	err := a.processRequests([]*clientRequest{
+		{Addr: netip.MustParseAddr("1.2.3.4"), Wallet: wallet1},
+		{Wallet: wallet2},
+		{Addr: netip.MustParseAddr("2.3.4.5"), Wallet: wallet3},
+	})
+	var errs batchError
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected batch error but got '%v'.", err)
+	}
+	assertEqual(t, errs[1], errBadBlobLen)
+
+	wallets := a.addrs[*tokenizer.keyID()]
+	assertEqual(t, len(wallets), 2)
+	assertEqual(t, len(wallets[wallet1]), 1)
+	assertEqual(t, len(wallets[wallet3]), 1)
+}
+
+func TestAddrAggregatorProcessOverlap(t *testing.T) {
+	wallet := newV4(t)
+	tokenizer := newHmacTokenizer()
+	tokenizer.(configurer).setConfig(&config{keyOverlap: time.Hour})
+	_ = tokenizer.resetKey()
+	oldKeyID := tokenizer.keyID()
+	_ = tokenizer.resetKey()
+	newKeyID := tokenizer.keyID()
+
+	a := newAddrAggregator().(*addrAggregator)
+	a.use(tokenizer)
+	if err := a.processRequest(&clientRequest{
+		Addr:   netip.MustParseAddr("1.2.3.4"),
+		Wallet: wallet,
+	}); err != nil {
+		t.Fatalf("Failed to process request: %v", err)
+	}
+
+	// The request must be recorded under both key IDs.
+	for _, id := range []*keyID{oldKeyID, newKeyID} {
+		wallets, exists := a.addrs[*id]
+		if !exists {
+			t.Fatalf("Expected addresses for key ID %s but got none.", id)
+		}
+		assertEqual(t, len(wallets[wallet]), 1)
+	}
+	assertEqual(t, a.addrs.numWallets(), 2)
+}
+
+func TestAddrAggregatorAlignToClock(t *testing.T) {
+	tokenizer := newHmacTokenizer()
+	tokenizer.(configurer).setConfig(&config{keyExpiry: 24 * time.Hour, alignToClock: true})
+	_ = tokenizer.resetKey()
+	a := newAddrAggregator().(*addrAggregator)
+	a.setConfig(&config{fwdInterval: time.Hour, keyExpiry: 24 * time.Hour, alignToClock: true})
+	a.use(tokenizer)
+
+	// We must flush on the hour and rotate keys at midnight.
+	now := time.Now().UTC()
+	assertEqual(t, now.Add(a.untilFlush()).Round(time.Second), now.Truncate(time.Hour).Add(time.Hour))
+	midnight := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+	assertEqual(t, now.Add(a.untilKeyRotation()).Round(time.Second), midnight)
+
+	// The key's epoch must be tracked, so we can include it in our messages.
+	if err := a.processRequest(&clientRequest{
+		Addr:   netip.MustParseAddr("1.2.3.4"),
+		Wallet: newV4(t),
+	}); err != nil {
+		t.Fatalf("Failed to process request: %v", err)
+	}
+	assertEqual(t, a.epochs[*tokenizer.keyID()].end, midnight)
+}
+
+func TestAddrAggregatorEnvelopeTokens(t *testing.T) {
+	wallet := newV4(t)
+	tokenizer := newSubnetTokenizer(newVerbatimTokenizer(), []int{24}, nil)
+	_ = tokenizer.resetKey()
+	a := newAddrAggregator().(*addrAggregator)
+	a.setConfig(&config{envelopeTokens: true, tokenizerName: tokenizerVerbatim})
+	a.use(tokenizer)
+
+	if err := a.processRequest(&clientRequest{
+		Addr:   netip.MustParseAddr("1.2.3.4"),
+		Wallet: wallet,
+	}); err != nil {
+		t.Fatalf("Failed to process request: %v", err)
+	}
+	id := tokenizer.keyID()
+	for addr := range a.addrs[*id][wallet] {
+		e, err := parseEnvelope(addr)
+		if err != nil {
+			t.Fatalf("Failed to parse envelope %q: %v", addr, err)
+		}
+		assertEqual(t, e.alg, tokenizerVerbatim+chainSeparator+stageIP)
+		assertEqual(t, e.payload, "1.2.3.0/24")
+		if err := e.matches(id); err != nil {
+			t.Fatalf("Expected envelope to match key ID but got: %v", err)
+		}
+	}
+}
+
+func TestAddrAggregatorEnvelopeChain(t *testing.T) {
+	name, newChain, err := parseChain("mask:/16 | verbatim | truncate:24")
+	if err != nil {
+		t.Fatalf("Failed to parse chain: %v", err)
+	}
+	chain := newChain()
+	_ = chain.resetKey()
+	a := newAddrAggregator().(*addrAggregator)
+	a.setConfig(&config{envelopeTokens: true, tokenizerName: name})
+	a.use(chain)
+
+	wallet := newV4(t)
+	if err := a.processRequest(&clientRequest{
+		Addr:   netip.MustParseAddr("1.2.3.4"),
+		Wallet: wallet,
+	}); err != nil {
+		t.Fatalf("Failed to process request: %v", err)
+	}
+	// The algorithm must describe the entire chain, including the encoding
+	// that makes the chain's tokens printable.
+	addrs := a.addrs[*chain.keyID()][wallet]
+	assertEqual(t, len(addrs), 1)
+	for addr := range addrs {
+		e, err := parseEnvelope(addr)
+		if err != nil {
+			t.Fatalf("Failed to parse envelope %q: %v", addr, err)
+		}
+		assertEqual(t, e.alg, "mask:/16|verbatim|truncate:24|base64")
+		assertEqual(t, e.payload, "AQIA")
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	req := &clientRequest{Addr: netip.MustParseAddr("1.2.3.4"), Wallet: newV4(t)}
+	reqs, other := splitBatch([]serializer{
+		req,
+		jsonRecord(`{"ts": 1}`),
+		blob("foo"),
+	})
+	assertEqual(t, len(reqs), 1)
+	assertEqual(t, reqs[0], req)
+	assertEqual(t, len(other), 1)
+	assertEqual(t, string(other[0].bytes()), "foo")
+}
+
+// staleKeyTokenizer reports outdated active key IDs for the given number of
+// calls, as if its key were rotated right after each call.
+type staleKeyTokenizer struct {
+	tokenizer
+	stale int
+}
+
+func (s *staleKeyTokenizer) activeKeyIDs() []*keyID {
+	if s.stale > 0 {
+		s.stale--
+		return []*keyID{{UUID: uuid.New()}}
+	}
+	return s.tokenizer.activeKeyIDs()
+}
+
+func TestAddrAggregatorKeyRotatedMidBatch(t *testing.T) {
+	req := &clientRequest{Addr: netip.MustParseAddr("1.2.3.4"), Wallet: newV4(t)}
+	tkzr := newCryptoPAnTokenizer()
+	_ = tkzr.resetKey()
+
+	// A single rotation must not cost us the batch.
+	a := newAddrAggregator().(*addrAggregator)
+	a.use(&staleKeyTokenizer{tokenizer: tkzr, stale: 1})
+	if err := a.processRequest(req); err != nil {
+		t.Fatalf("Failed to process request: %v", err)
+	}
+	assertEqual(t, a.addrs.numAddrs(), 1)
+
+	// If the key keeps rotating, we give up, but not silently.
+	a = newAddrAggregator().(*addrAggregator)
+	a.use(&staleKeyTokenizer{tokenizer: tkzr, stale: maxKeyAttempts})
+	before := testutil.ToFloat64(metricsFor(pipelinePrimary).droppedRequests)
+	if err := a.processRequest(req); !errors.Is(err, errKeysRotated) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errKeysRotated, err)
+	}
+	assertEqual(t, a.addrs.numAddrs(), 0)
+	assertEqual(t, testutil.ToFloat64(metricsFor(pipelinePrimary).droppedRequests)-before, float64(1))
+}
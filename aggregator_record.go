@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errNotARecord = errors.New("input is not a JSON object")
+
+// jsonRecord represents a JSON object whose fields we tokenize according to
+// our field policy.
+type jsonRecord []byte
+
+func (r jsonRecord) bytes() []byte {
+	return r
+}
+
+// recordKey identifies the key that one of our tokenizers used for a record's
+// fields, along with the key's epoch.  We omit unknown epoch boundaries.
+type recordKey struct {
+	KeyID      uuid.UUID `json:"keyid"`
+	EpochStart string    `json:"epoch_start,omitempty"`
+	EpochEnd   string    `json:"epoch_end,omitempty"`
+}
+
+// tokenizedRecord represents a record after we applied our field policy,
+// along with the keys that its tokens were created with, by tokenizer name.
+type tokenizedRecord struct {
+	Keys   map[string]*recordKey `json:"keys,omitempty"`
+	Record interface{}           `json:"record"`
+}
+
+// recordAggregator implements an aggregator that tokenizes the fields of JSON
+// records according to a field policy.  Each record results in a JSON object
+// that contains the fields that the policy keeps, in plain text, and the
+// fields that the policy tokenizes, as tokens, along with the keys that the
+// tokens were created with.  All other fields are dropped, so new fields never
+// leak by accident.
+type recordAggregator struct {
+	sync.RWMutex
+	wg         sync.WaitGroup
+	conf       *config
+	keyExpiry  time.Duration
+	addrPolicy addrPolicy
+	policy     fieldPolicy
+	tokenizer  tokenizer
+	// Our tokenizers, by name.  All fields whose chains share a tokenizer
+	// share the tokenizer's key, so their tokens can be joined.
+	keyed  map[string]tokenizer
+	fields map[string]tokenizer
+	inbox  chan serializer
+	outbox chan token
+	done   chan empty
+}
+
+// newRecordAggregator returns a new record aggregator.
+func newRecordAggregator() aggregator {
+	return &recordAggregator{
+		done:       make(chan empty),
+		addrPolicy: defaultAddrPolicy,
+	}
+}
+
+// setConfig sets the given configuration.
+func (a *recordAggregator) setConfig(c *config) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.conf = c
+	a.keyExpiry = c.keyExpiry
+	a.addrPolicy = c.addrPolicy
+	a.policy = c.fieldPolicy
+}
+
+// use sets the tokenizer that must be used for input that isn't a record.
+// Fields whose chain uses the same tokenizer share its key while all other
+// tokenizers of our field policy are created here.
+func (a *recordAggregator) use(t tokenizer) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.tokenizer = t
+	a.keyed = make(map[string]tokenizer)
+	if a.conf != nil {
+		a.keyed[a.conf.tokenizerName] = keyedStage(t)
+	}
+	a.fields = make(map[string]tokenizer)
+	for path, rule := range a.policy {
+		if rule.chain == nil {
+			continue
+		}
+		k, exists := a.keyed[rule.chain.keyed]
+		if !exists {
+			k = ourTokenizers[rule.chain.keyed]()
+			if c, ok := k.(configurer); ok && a.conf != nil {
+				c.setConfig(a.conf)
+			}
+			a.keyed[rule.chain.keyed] = k
+		}
+		a.fields[path] = rule.chain.around(k)
+	}
+}
+
+// connect sets the inbox to retrieve serialized data from and the outbox to
+// send tokens to.
+func (a *recordAggregator) connect(inbox chan serializer, outbox chan token) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.inbox = inbox
+	a.outbox = outbox
+}
+
+// resetKeys resets the keys of all of our tokenizers.
+func (a *recordAggregator) resetKeys() {
+	a.rotateKeys(false)
+}
+
+// rotateKeys resets the keys of our tokenizers.  If onlyDue is true, we skip
+// tokenizers whose key's epoch hasn't ended yet.
+func (a *recordAggregator) rotateKeys(onlyDue bool) {
+	a.RLock()
+	defer a.RUnlock()
+
+	due := func(t tokenizer) bool {
+		d, known := untilKeyRotation(t, a.keyExpiry)
+		return !onlyDue || !known || d <= 0
+	}
+	if due(a.tokenizer) {
+		if err := a.tokenizer.resetKey(); err != nil {
+			l.Fatalf("Failed to reset tokenizer key: %v", err)
+		}
+	}
+	for name, t := range a.keyed {
+		if t == keyedStage(a.tokenizer) || !due(t) {
+			continue
+		}
+		if err := t.resetKey(); err != nil {
+			l.Fatalf("Failed to reset %s tokenizer key: %v", name, err)
+		}
+	}
+}
+
+// untilKeyRotation returns the duration until the first of our tokenizers'
+// keys must be rotated next.  Each tokenizer's key is rotated when its epoch
+// ends, just like the address aggregator's.  The caller must hold the read
+// lock.
+func (a *recordAggregator) untilKeyRotation() time.Duration {
+	next, _ := untilKeyRotation(a.tokenizer, a.keyExpiry)
+	for _, t := range a.keyed {
+		if d, _ := untilKeyRotation(t, a.keyExpiry); d < next {
+			next = d
+		}
+	}
+	return next
+}
+
+// start starts the record aggregator.
+func (a *recordAggregator) start() {
+	a.resetKeys()
+	a.wg.Add(1)
+
+	go func() {
+		defer a.wg.Done()
+		a.RLock() // Protect read of keyExpiry.
+		keyTimer := time.NewTimer(a.untilKeyRotation())
+		a.RUnlock()
+
+		l.Println("Starting record aggregator loop.")
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-keyTimer.C:
+				// Keys may have been rotated via the admin API since we set
+				// the timer, in which case their epochs end later.
+				a.rotateKeys(true)
+				a.RLock()
+				keyTimer.Reset(a.untilKeyRotation())
+				a.RUnlock()
+			case s := <-a.inbox:
+				// Whatever else is already waiting in our inbox is processed
+				// in the same batch.
+				for _, t := range a.processRecords(drainInbox(s, a.inbox)) {
+					a.outbox <- t
+				}
+			}
+		}
+	}()
+}
+
+// stop stops the record aggregator.
+func (a *recordAggregator) stop() {
+	close(a.done)
+	a.wg.Wait()
+	l.Println("Stopped record aggregator.")
+}
+
+// processRecords applies our field policy to the given records and returns
+// the resulting records.  We are not prepared to process input that isn't a
+// JSON object, so we tokenize it as a whole.  Input that fails is dropped.
+func (a *recordAggregator) processRecords(ss []serializer) []token {
+	a.RLock()
+	defer a.RUnlock()
+
+	var (
+		tokens []token
+		other  []serializer
+	)
+	for _, s := range ss {
+		rec, err := a.processRecord(s.bytes())
+		if errors.Is(err, errNotARecord) {
+			other = append(other, s)
+			continue
+		}
+		if err != nil {
+			l.Printf("Failed to process record: %v", err)
+			m.numRecords.With(prometheus.Labels{outcome: failBecause(err)}).Inc()
+			continue
+		}
+		m.numRecords.With(prometheus.Labels{outcome: success}).Inc()
+		tokens = append(tokens, rec)
+	}
+	if len(tokens) > 0 {
+		l.Printf("Processed %d record(s).", len(tokens))
+	}
+	if len(other) > 0 {
+		otherTokens, _, err := a.tokenizer.tokenizeBatch(other, nil)
+		if err != nil {
+			l.Printf("Failed to tokenize blob(s): %v", err)
+		}
+		for _, t := range otherTokens {
+			if t != nil {
+				tokens = append(tokens, t)
+			}
+		}
+		l.Println("Type not supported.  Forwarded.")
+	}
+	return tokens
+}
+
+// processRecord applies our field policy to the given JSON object and returns
+// the resulting JSON object.  All fields that share a tokenizer are tokenized
+// using the same key, even if the key is rotated while we're at it.  The
+// caller must hold the read lock.
+func (a *recordAggregator) processRecord(b []byte) (token, error) {
+	var obj map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&obj); err != nil || obj == nil {
+		return nil, errNotARecord
+	}
+	ids := make(map[string]*keyID)
+	out, _, err := a.applyPolicy([]string{rootPath}, obj, rootPath, ids)
+	if err != nil {
+		return nil, err
+	}
+	rec := &tokenizedRecord{Record: out}
+	for name, id := range ids {
+		if rec.Keys == nil {
+			rec.Keys = make(map[string]*recordKey)
+		}
+		k := &recordKey{KeyID: id.UUID}
+		if e, ok := a.keyed[name].(epochTracker); ok {
+			if ep, ok := e.keyEpoch(id); ok {
+				k.EpochStart, k.EpochEnd = formatTime(ep.start), formatTime(ep.end)
+			}
+		}
+		rec.Keys[name] = k
+	}
+	return json.Marshal(rec)
+}
+
+// applyPolicy applies our field policy to the given value at the given path,
+// i.e., the field names that lead to the value.  The given rule path is the
+// path of the closest ancestor that has a rule, if any.  The given key IDs map
+// the names of the tokenizers that the record used so far to the keys that
+// they used.  We return the resulting value and whether it's part of the
+// resulting record.  The caller must hold the read lock.
+func (a *recordAggregator) applyPolicy(path []string, v interface{}, rulePath string, ids map[string]*keyID) (interface{}, bool, error) {
+	if p, exists := a.policy.ruleOf(path); exists {
+		rulePath = p
+	}
+	rule := a.policy[rulePath]
+	// Objects and arrays are kept if they contain anything that is kept, or
+	// if their rule keeps or tokenizes them.
+	keep := rule.action != "" && rule.action != actionDrop
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{})
+		for k, child := range v {
+			res, kept, err := a.applyPolicy(append(path[:len(path):len(path)], k), child, rulePath, ids)
+			if err != nil {
+				return nil, false, err
+			}
+			if kept {
+				out[k] = res
+			}
+		}
+		return out, keep || len(out) > 0, nil
+	case []interface{}:
+		out := []interface{}{}
+		for _, elem := range v {
+			res, kept, err := a.applyPolicy(path, elem, rulePath, ids)
+			if err != nil {
+				return nil, false, err
+			}
+			if kept {
+				out = append(out, res)
+			}
+		}
+		return out, keep || len(out) > 0, nil
+	}
+
+	switch {
+	case !keep:
+		return nil, false, nil
+	case rule.action == actionKeep || v == nil:
+		return v, true, nil
+	}
+	name := rule.chain.keyed
+	t, id, err := tokenizeField(a.fields[rulePath], v, ids[name], a.addrPolicy)
+	if err != nil {
+		return nil, false, err
+	}
+	ids[name] = id
+	return t, true, nil
+}
+
+// tokenizeField tokenizes the given string, number, or Boolean using the
+// active key with the given ID, or the current key if the ID is nil, and
+// returns the printable token and the ID of the key that was used.  Strings
+// that are IP addresses are tokenized as addresses, so address tokenizers can
+// tokenize them.  Addresses are canonicalized according to the given policy,
+// just like the addresses that the Web receiver receives.
+func tokenizeField(t tokenizer, v interface{}, id *keyID, policy addrPolicy) (string, *keyID, error) {
+	var (
+		input  []byte
+		isAddr bool
+	)
+	switch v := v.(type) {
+	case string:
+		if addr, err := netip.ParseAddr(v); err == nil {
+			if addr, err = canonicalAddr(addr, policy); err != nil {
+				return "", nil, err
+			}
+			input, isAddr = addr.AsSlice(), true
+		} else {
+			input = []byte(v)
+		}
+	case json.Number:
+		input = []byte(v.String())
+	case bool:
+		input = []byte(strconv.FormatBool(v))
+	}
+
+	var (
+		tkn token
+		err error
+	)
+	if id == nil {
+		tkn, id, err = t.tokenizeAndKeyID(blob(input))
+	} else {
+		tkn, err = t.tokenizeWithKeyID(blob(input), id)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if emitsText(t) {
+		return string(tkn), id, nil
+	}
+	// Tokenizers that preserve length turn addresses into addresses and
+	// printable strings into printable strings.  All other tokens may not be
+	// printable, so let's encode them.
+	if t.preservesLen() {
+		if addr, ok := netip.AddrFromSlice(tkn); ok && isAddr {
+			return addr.String(), id, nil
+		}
+		if !isAddr && utf8.Valid(tkn) {
+			return string(tkn), id, nil
+		}
+	}
+	return base64.StdEncoding.EncodeToString(tkn), id, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestRecordAggregator(t *testing.T, policy string) *recordAggregator {
+	t.Helper()
+	return newTestRecordAggregatorWithConfig(t, policy, &config{})
+}
+
+// newTestRecordAggregatorWithConfig returns a record aggregator that uses the
+// given field policy and configuration.
+func newTestRecordAggregatorWithConfig(t *testing.T, policy string, c *config) *recordAggregator {
+	t.Helper()
+	p, err := parseFieldPolicy(strings.NewReader(policy))
+	if err != nil {
+		t.Fatalf("Failed to parse field policy: %v", err)
+	}
+	c.fieldPolicy, c.tokenizerName = p, tokenizerHmac
+	tkzr := newHmacTokenizer()
+	tkzr.(configurer).setConfig(c)
+	a := newRecordAggregator().(*recordAggregator)
+	a.setConfig(c)
+	a.use(tkzr)
+	a.resetKeys()
+	return a
+}
+
+// decodeTestRecord decodes the given record that our aggregator emitted.
+func decodeTestRecord(t *testing.T, tkn token) (map[string]interface{}, map[string]*recordKey) {
+	t.Helper()
+	var out struct {
+		Keys   map[string]*recordKey  `json:"keys"`
+		Record map[string]interface{} `json:"record"`
+	}
+	if err := json.Unmarshal(tkn, &out); err != nil {
+		t.Fatalf("Failed to decode record: %v", err)
+	}
+	return out.Record, out.Keys
+}
+
+// processTestRecord applies the given aggregator's field policy to the given
+// record and returns the decoded result.
+func processTestRecord(t *testing.T, a *recordAggregator, record string) map[string]interface{} {
+	t.Helper()
+	tkn, err := a.processRecord([]byte(record))
+	if err != nil {
+		t.Fatalf("Failed to process record: %v", err)
+	}
+	out, _ := decodeTestRecord(t, tkn)
+	return out
+}
+
+func TestRecordPolicy(t *testing.T) {
+	a := newTestRecordAggregator(t, `
+$.client.ip: cryptopan
+$.user.email: normalize-email | hmac
+$.user.alias: hmac
+$.ts: keep
+$.ua: drop
+`)
+	out := processTestRecord(t, a, `{
+		"client": {"ip": "1.2.3.4", "port": 1234},
+		"user": {"email": "Alice@example.com", "alias": "alice@example.com"},
+		"ts": 1700000000,
+		"ua": "Mozilla/5.0",
+		"new": "unexpected PII"
+	}`)
+
+	// The address must be tokenized into another address while the port
+	// must be dropped because the policy doesn't mention it.
+	client := out["client"].(map[string]interface{})
+	assertEqual(t, len(client), 1)
+	addr, err := netip.ParseAddr(client["ip"].(string))
+	if err != nil {
+		t.Fatalf("Expected tokenized IP address but got %q.", client["ip"])
+	}
+	if addr.String() == "1.2.3.4" {
+		t.Fatal("Expected IP address to be tokenized.")
+	}
+	// Both fields use the same HMAC key, so the normalized email address
+	// and the alias result in the same token.
+	user := out["user"].(map[string]interface{})
+	assertEqual(t, user["email"], user["alias"])
+	if _, err := base64.StdEncoding.DecodeString(user["email"].(string)); err != nil {
+		t.Fatalf("Expected base64-encoded token but got %q.", user["email"])
+	}
+	assertEqual(t, out["ts"], float64(1700000000))
+	for _, field := range []string{"ua", "new"} {
+		if _, exists := out[field]; exists {
+			t.Fatalf("Expected field %q to be dropped.", field)
+		}
+	}
+}
+
+func TestRecordPolicyInheritance(t *testing.T) {
+	a := newTestRecordAggregator(t, `
+$: keep
+$.user: hmac | hex
+$.user.id: keep
+$.debug: drop
+`)
+	out := processTestRecord(t, a, `{
+		"user": {"id": 42, "names": ["alice", "bob"], "deleted": null},
+		"debug": {"trace": "foo"},
+		"new": "bar"
+	}`)
+
+	// Without a rule of their own, fields inherit the rule of their closest
+	// ancestor.
+	assertEqual(t, out["new"], "bar")
+	if _, exists := out["debug"]; exists {
+		t.Fatal("Expected field \"debug\" to be dropped.")
+	}
+	user := out["user"].(map[string]interface{})
+	assertEqual(t, user["id"], float64(42))
+	assertEqual(t, user["deleted"], nil)
+	names := user["names"].([]interface{})
+	assertEqual(t, len(names), 2)
+	for _, name := range names {
+		assertEqual(t, len(name.(string)), 64)
+	}
+}
+
+func TestRecordNotARecord(t *testing.T) {
+	a := newTestRecordAggregator(t, "$.ts: keep")
+	for _, input := range []string{"foo", "[1, 2]", "null", "42"} {
+		if _, err := a.processRecord([]byte(input)); !errors.Is(err, errNotARecord) {
+			t.Fatalf("Expected error '%v' but got '%v'.", errNotARecord, err)
+		}
+	}
+	// Input that isn't a record is tokenized as a whole.
+	tokens := a.processRecords([]serializer{blob("foo"), jsonRecord(`{"ts": 1}`)})
+	assertEqual(t, len(tokens), 2)
+	assertEqual(t, string(tokens[0]), `{"record":{"ts":1}}`)
+}
+
+func TestRecordKeyRotation(t *testing.T) {
+	p, err := parseFieldPolicy(strings.NewReader("$.client.ip: cryptopan"))
+	if err != nil {
+		t.Fatalf("Failed to parse field policy: %v", err)
+	}
+	c := &config{
+		fieldPolicy:   p,
+		tokenizerName: tokenizerHmac,
+		keyExpiry:     24 * time.Hour,
+		alignToClock:  true,
+	}
+	tkzr := newHmacTokenizer()
+	tkzr.(configurer).setConfig(c)
+	a := newRecordAggregator().(*recordAggregator)
+	a.setConfig(c)
+	a.use(tkzr)
+	a.resetKeys()
+
+	// Our keys' epochs are aligned to the clock, so they end at midnight
+	// rather than a key expiry from now.
+	midnight := time.Until(alignedEpoch(time.Now(), c.keyExpiry).end)
+	if d := a.untilKeyRotation(); d <= 0 || d > midnight {
+		t.Fatalf("Expected key rotation within %s but got %s.", midnight, d)
+	}
+
+	// Keys whose epoch hasn't ended yet are not rotated.
+	id := *a.keyed[tokenizerCryptoPAn].keyID()
+	a.rotateKeys(true)
+	assertEqual(t, *a.keyed[tokenizerCryptoPAn].keyID(), id)
+	a.resetKeys()
+	if *a.keyed[tokenizerCryptoPAn].keyID() == id {
+		t.Fatal("Expected new key but got old key.")
+	}
+}
+
+func TestRecordPathSeparator(t *testing.T) {
+	a := newTestRecordAggregator(t, `
+$: keep
+$.client.ip: hmac
+`)
+	out := processTestRecord(t, a, `{
+		"client.ip": "1.2.3.4",
+		"client": {"ip": "1.2.3.4"}
+	}`)
+
+	// Only the nested field matches the rule's path.  The field whose name
+	// contains the path separator inherits the root's rule.
+	assertEqual(t, out["client.ip"], "1.2.3.4")
+	client := out["client"].(map[string]interface{})
+	if client["ip"] == "1.2.3.4" {
+		t.Fatal("Expected nested field to be tokenized but it wasn't.")
+	}
+}
+
+func TestRecordMetrics(t *testing.T) {
+	a := newTestRecordAggregator(t, "$.ip: cryptopan")
+	bad := jsonRecord(`{"ip": "foo"}`)
+	_, err := a.processRecord(bad)
+	if err == nil {
+		t.Fatal("Expected error but got none.")
+	}
+	succeeded := m.numRecords.WithLabelValues(success)
+	failed := m.numRecords.WithLabelValues(failBecause(err))
+	beforeSucceeded, beforeFailed := testutil.ToFloat64(succeeded), testutil.ToFloat64(failed)
+
+	tokens := a.processRecords([]serializer{jsonRecord(`{"ip": "1.2.3.4"}`), bad})
+	assertEqual(t, len(tokens), 1)
+	assertEqual(t, testutil.ToFloat64(succeeded)-beforeSucceeded, float64(1))
+	assertEqual(t, testutil.ToFloat64(failed)-beforeFailed, float64(1))
+}
+
+func TestRecordKeyIDs(t *testing.T) {
+	a := newTestRecordAggregatorWithConfig(t, `
+$.ip: cryptopan
+$.user: hmac
+$.ts: keep
+`, &config{keyExpiry: time.Hour})
+	tkn, err := a.processRecord([]byte(`{"ip": "1.2.3.4", "user": ["alice", "bob"], "ts": 1}`))
+	if err != nil {
+		t.Fatalf("Failed to process record: %v", err)
+	}
+
+	// Each tokenizer that the record used must tell us its key and epoch.
+	_, keys := decodeTestRecord(t, tkn)
+	assertEqual(t, len(keys), 2)
+	for _, name := range []string{tokenizerCryptoPAn, tokenizerHmac} {
+		k, exists := keys[name]
+		if !exists {
+			t.Fatalf("Expected key of tokenizer %q but got none.", name)
+		}
+		assertEqual(t, k.KeyID, a.keyed[name].keyID().UUID)
+		if k.EpochStart == "" || k.EpochEnd == "" {
+			t.Fatalf("Expected epoch of tokenizer %q but got %+v.", name, k)
+		}
+	}
+
+	// Records without tokens have no keys.
+	tkn, err = a.processRecord([]byte(`{"ts": 1}`))
+	if err != nil {
+		t.Fatalf("Failed to process record: %v", err)
+	}
+	if _, keys := decodeTestRecord(t, tkn); keys != nil {
+		t.Fatalf("Expected no keys but got %v.", keys)
+	}
+}
+
+func TestRecordAddrPolicy(t *testing.T) {
+	// A 6to4 address that embeds 1.2.3.4.
+	const record = `{"ip": "2002:102:304::1"}`
+
+	a := newTestRecordAggregatorWithConfig(t, "$.ip: verbatim", &config{addrPolicy: addrPolicyExtract})
+	out := processTestRecord(t, a, record)
+	assertEqual(t, out["ip"], "1.2.3.4")
+
+	a = newTestRecordAggregatorWithConfig(t, "$.ip: verbatim", &config{addrPolicy: addrPolicyReject})
+	if _, err := a.processRecord([]byte(record)); !errors.Is(err, errEmbeddedIPv4) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errEmbeddedIPv4, err)
+	}
+}
@@ -4,6 +4,7 @@ package main
 // incoming data.
 type simpleAggregator struct {
 	t      tokenizer
+	shadow bool
 	inbox  chan serializer
 	outbox chan token
 	done   chan empty
@@ -15,7 +16,9 @@ func newSimpleAggregator() aggregator {
 	}
 }
 
-func (s *simpleAggregator) setConfig(c *config) {}
+func (s *simpleAggregator) setConfig(c *config) {
+	s.shadow = c.shadow
+}
 
 func (s *simpleAggregator) use(t tokenizer) {
 	s.t = t
@@ -37,14 +40,23 @@ func (s *simpleAggregator) start() {
 			case <-s.done:
 				return
 			case b := <-s.inbox:
-				token, err := s.t.tokenize(b)
+				// Whatever else is already waiting in our inbox is tokenized
+				// in the same batch.
+				tokens, _, err := s.t.tokenizeBatch(drainInbox(b, s.inbox), nil)
 				if err != nil {
-					l.Printf("Failed to tokenize blob: %v", err)
-					continue
+					l.Printf("Failed to tokenize blob(s): %v", err)
+					if s.shadow {
+						countShadowError(shadowStageTokenize, err)
+					}
+				}
+				for _, token := range tokens {
+					if token == nil {
+						continue
+					}
+					l.Println("Tokenized blob.")
+					s.outbox <- token
+					l.Println("Sent token to forwarder.")
 				}
-				l.Println("Tokenized blob.")
-				s.outbox <- token
-				l.Println("Sent token to forwarder.")
 			}
 		}
 	}()
@@ -0,0 +1,68 @@
+package main
+
+import "fmt"
+
+const (
+	// maxBatchSize is the maximum number of inbox items that our aggregators
+	// tokenize at once.
+	maxBatchSize = 64
+	// inboxSize is the capacity of our receivers' inboxes.  Receivers don't
+	// wait for the aggregator as long as there's room in the inbox, so
+	// whenever the aggregator falls behind, a full batch is waiting for it.
+	inboxSize = maxBatchSize
+)
+
+// batchError is returned by tokenizeBatch if some of a batch's items couldn't
+// be tokenized.  It maps the indices of the failed items to their errors.
+// The tokens of the other items are valid.
+type batchError map[int]error
+
+func (e batchError) Error() string {
+	first := -1
+	for i := range e {
+		if first == -1 || i < first {
+			first = i
+		}
+	}
+	return fmt.Sprintf("failed to tokenize %d item(s) of batch, first item %d: %v", len(e), first, e[first])
+}
+
+// tokenizeEach tokenizes each of the given serializers using the given
+// function.  Failed items result in a nil token and a batchError.
+func tokenizeEach(ss []serializer, tokenize func(serializer) (token, error)) ([]token, error) {
+	var (
+		tokens = make([]token, len(ss))
+		errs   batchError
+	)
+	for i, s := range ss {
+		t, err := tokenize(s)
+		if err != nil {
+			if errs == nil {
+				errs = make(batchError)
+			}
+			errs[i] = err
+			continue
+		}
+		tokens[i] = t
+	}
+	if errs != nil {
+		return tokens, errs
+	}
+	return tokens, nil
+}
+
+// drainInbox returns the given item along with the items that are already
+// waiting in the given inbox, up to maxBatchSize items in total.  It never
+// blocks.
+func drainInbox(first serializer, inbox chan serializer) []serializer {
+	batch := []serializer{first}
+	for len(batch) < maxBatchSize {
+		select {
+		case s := <-inbox:
+			batch = append(batch, s)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
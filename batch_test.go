@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// newBenchmarkBatch returns a full batch of IPv4 addresses.  Batch
+// benchmarks count each address as one operation, so their results can be
+// compared to those of single-address benchmarks.
+func newBenchmarkBatch() []serializer {
+	batch := make([]serializer, maxBatchSize)
+	for i := range batch {
+		batch[i] = blob([]byte{1, 2, 3, byte(i)})
+	}
+	return batch
+}
+
+// benchmarkBatch compares tokenizing a full batch at once to tokenizing the
+// same batch one item at a time, using the same tokenizer and key.
+func benchmarkBatch(b *testing.B, t tokenizer) {
+	if err := t.resetKey(); err != nil {
+		b.Fatalf("Failed to reset key: %v", err)
+	}
+	batch := newBenchmarkBatch()
+
+	b.Run("each", func(b *testing.B) {
+		for i := 0; i < b.N; i += len(batch) {
+			for _, s := range batch {
+				_, _ = t.tokenize(s)
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i += len(batch) {
+			_, _, _ = t.tokenizeBatch(batch, nil)
+		}
+	})
+}
+
+func TestDrainInbox(t *testing.T) {
+	inbox := make(chan serializer, maxBatchSize+1)
+	assertEqual(t, len(drainInbox(value1, inbox)), 1)
+
+	for i := 0; i < maxBatchSize+1; i++ {
+		inbox <- value2
+	}
+	assertEqual(t, len(drainInbox(value1, inbox)), maxBatchSize)
+	assertEqual(t, len(inbox), 2)
+}
+
+func TestBatchError(t *testing.T) {
+	err := batchError{3: errBadBlobLen, 1: errNoKey}
+	expected := "failed to tokenize 2 item(s) of batch, first item 1: " + errNoKey.Error()
+	assertEqual(t, err.Error(), expected)
+}
+
+func TestTokenizeBatchFailures(t *testing.T) {
+	c := newCryptoPAnTokenizer()
+	if _, _, err := c.tokenizeBatch([]serializer{value1}, nil); !errors.Is(err, errNoKey) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errNoKey, err)
+	}
+	_ = c.resetKey()
+
+	tokens, _, err := c.tokenizeBatch([]serializer{value1, blob{0}, value2}, nil)
+	var errs batchError
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected batch error but got '%v'.", err)
+	}
+	assertEqual(t, len(errs), 1)
+	assertEqual(t, errs[1], errBadBlobLen)
+	assertEqual(t, len(tokens), 3)
+	if tokens[0] == nil || tokens[1] != nil || tokens[2] == nil {
+		t.Fatal("Expected tokens for valid items only.")
+	}
+}
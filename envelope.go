@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	envelopeVersion   = "tk1"
+	envelopeSeparator = "."
+	// envelopeKeyIDPrefixLen is the number of hex characters of the key ID
+	// that we include in envelopes, i.e., the key ID's first group.
+	envelopeKeyIDPrefixLen = 8
+)
+
+var (
+	errBadEnvelope         = errors.New("token is not a valid envelope")
+	errBadEnvelopeVersion  = errors.New("envelope version not supported")
+	errEnvelopeKeyMismatch = errors.New("envelope's key ID prefix does not match key ID")
+)
+
+// envelope represents a self-describing token of the form:
+//
+//	tk1.<alg>.<keyid-prefix>.<payload>
+//
+// The algorithm is the spec of the tokenizer chain that created the payload,
+// e.g. "cryptopan|ip", and the key ID prefix identifies the key that was used.  The payload is the token as
+// the aggregator encodes it, e.g., an IP address for length-preserving
+// tokenizers or base64 otherwise.  The payload may contain the separator, but
+// the algorithm must not.
+type envelope struct {
+	alg         string
+	keyIDPrefix string
+	payload     string
+}
+
+// newEnvelope returns a new envelope for the given algorithm, key ID, and
+// payload.
+func newEnvelope(alg string, id *keyID, payload string) *envelope {
+	return &envelope{
+		alg:         alg,
+		keyIDPrefix: id.String()[:envelopeKeyIDPrefixLen],
+		payload:     payload,
+	}
+}
+
+// String returns the envelope's string representation.
+func (e *envelope) String() string {
+	return strings.Join([]string{envelopeVersion, e.alg, e.keyIDPrefix, e.payload}, envelopeSeparator)
+}
+
+// matches returns nil if the envelope's key ID prefix belongs to the given key
+// ID.  Consumers can use this to detect tokens that were mixed across keys.
+func (e *envelope) matches(id *keyID) error {
+	if id.String()[:envelopeKeyIDPrefixLen] != e.keyIDPrefix {
+		return errEnvelopeKeyMismatch
+	}
+	return nil
+}
+
+// parseEnvelope parses the given string representation of an envelope.
+func parseEnvelope(s string) (*envelope, error) {
+	fields := strings.SplitN(s, envelopeSeparator, 4)
+	if len(fields) != 4 {
+		return nil, errBadEnvelope
+	}
+	if fields[0] != envelopeVersion {
+		// Unsupported versions are bad envelopes too, so callers can tell
+		// raw tokens from envelopes by checking for errBadEnvelope alone.
+		return nil, fmt.Errorf("%w: %w: %q", errBadEnvelope, errBadEnvelopeVersion, fields[0])
+	}
+	e := &envelope{
+		alg:         fields[1],
+		keyIDPrefix: fields[2],
+		payload:     fields[3],
+	}
+	if e.alg == "" || len(e.keyIDPrefix) != envelopeKeyIDPrefixLen || e.payload == "" {
+		return nil, errBadEnvelope
+	}
+	return e, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	uuid "github.com/google/uuid"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	id := &keyID{UUID: uuid.MustParse("024752c9-7090-4123-939e-67b08042d7d7")}
+	for _, payload := range []string{
+		"1.2.3.4",
+		"1.2.3.0/24",
+		"2001:db8::1",
+		"q83vEjRWeJA=",
+	} {
+		e := newEnvelope(tokenizerCryptoPAn, id, payload)
+		s := e.String()
+		assertEqual(t, s, "tk1.cryptopan.024752c9."+payload)
+
+		parsed, err := parseEnvelope(s)
+		if err != nil {
+			t.Fatalf("Failed to parse envelope %q: %v", s, err)
+		}
+		assertEqual(t, *parsed, *e)
+		if err := parsed.matches(id); err != nil {
+			t.Fatalf("Expected envelope to match key ID but got: %v", err)
+		}
+	}
+}
+
+func TestEnvelopeKeyMismatch(t *testing.T) {
+	e := newEnvelope(tokenizerHmac, &keyID{UUID: uuid.New()}, "foo")
+	if err := e.matches(&keyID{UUID: uuid.New()}); !errors.Is(err, errEnvelopeKeyMismatch) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errEnvelopeKeyMismatch, err)
+	}
+}
+
+func TestParseBadEnvelope(t *testing.T) {
+	for _, bad := range []string{
+		"",
+		"1.2.3.4",
+		"tk1.hmac.024752c9",
+		"tk1..024752c9.foo",
+		"tk1.hmac.0247.foo",
+		"tk1.hmac.024752c9.",
+	} {
+		if _, err := parseEnvelope(bad); !errors.Is(err, errBadEnvelope) {
+			t.Fatalf("Expected error '%v' for %q but got '%v'.", errBadEnvelope, bad, err)
+		}
+	}
+	if _, err := parseEnvelope("tk2.hmac.024752c9.foo"); !errors.Is(err, errBadEnvelopeVersion) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadEnvelopeVersion, err)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	uuid "github.com/google/uuid"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	escrowVersion = 1
+	// escrowInfo is HKDF's info parameter when deriving the key that seals a
+	// custodian's share.
+	escrowInfo    = "tkzr escrow"
+	escrowFileExt = ".escrow"
+	// defaultEscrowThreshold is the number of custodians who must cooperate
+	// to reconstruct an escrowed key.
+	defaultEscrowThreshold = 2
+)
+
+var (
+	errBadCustodianKey   = errors.New("custodian key must be a hex-encoded X25519 key")
+	errBadEscrowBundle   = errors.New("escrow bundle is malformed or was tampered with")
+	errNoMatchingShare   = errors.New("escrow bundle contains no share for the given custodian key")
+	errEscrowKeyMismatch = errors.New("reconstructed key does not match escrow bundle's key ID")
+)
+
+// escrowBundle represents an escrowed key as it's serialized.  The key
+// material is split into one share per custodian using Shamir's secret
+// sharing scheme, and each share is sealed to its custodian's X25519 public
+// key.  Everything but the shares is in plain text, so custodians can tell
+// what a bundle is for before they agree to open it.
+type escrowBundle struct {
+	Version      int            `json:"version"`
+	Tokenizer    string         `json:"tokenizer"`
+	KeyID        uuid.UUID      `json:"key_id"`
+	ContextLabel string         `json:"context_label"`
+	Created      time.Time      `json:"created"`
+	Starts       time.Time      `json:"starts"`
+	Expires      time.Time      `json:"expires"`
+	Threshold    int            `json:"threshold"`
+	Shares       []*escrowShare `json:"shares"`
+}
+
+// escrowShare represents a share that's sealed to a custodian.  We derive
+// the sealing key from an ephemeral X25519 key pair and the custodian's
+// public key using HKDF-SHA256, and seal the share using AES-256-GCM.
+type escrowShare struct {
+	Index     byte   `json:"index"`
+	Custodian []byte `json:"custodian"`
+	Ephemeral []byte `json:"ephemeral"`
+	Sealed    []byte `json:"sealed"`
+}
+
+// keyEscrow escrows each new key that our tokenizers create, so that tokens
+// can be re-identified after the fact, but only if several custodians
+// cooperate.  No single custodian, and no tkzr instance, can reconstruct an
+// escrowed key on its own.
+type keyEscrow struct {
+	custodians []*ecdh.PublicKey
+	threshold  int
+	// The directory that we write bundles to.  If empty, we emit bundles as
+	// control messages in our log instead.
+	dir string
+}
+
+// newKeyEscrow returns a new key escrow that splits keys among the given
+// custodians, the given threshold of whom must cooperate to reconstruct a
+// key.
+func newKeyEscrow(custodians []*ecdh.PublicKey, threshold int, dir string) (*keyEscrow, error) {
+	if len(custodians) > shamirMaxShares {
+		return nil, errTooManyShares
+	}
+	if threshold < 2 || threshold > len(custodians) {
+		return nil, errBadThreshold
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &keyEscrow{custodians: custodians, threshold: threshold, dir: dir}, nil
+}
+
+// loadCustodians loads the custodians' public keys from the given file, which
+// contains one hex-encoded X25519 public key per line.  Blank lines and lines
+// that start with "#" are ignored.
+func loadCustodians(path string) ([]*ecdh.PublicKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var custodians []*ecdh.PublicKey
+	s := bufio.NewScanner(f)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, errBadCustodianKey)
+		}
+		pub, err := ecdh.X25519().NewPublicKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, errBadCustodianKey)
+		}
+		custodians = append(custodians, pub)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return custodians, nil
+}
+
+// deposit escrows the given key of the given tokenizer.  Key providers call
+// this before they start using a new key, so a key that cannot be escrowed is
+// never used.
+func (e *keyEscrow) deposit(name, label string, key *epochKey) error {
+	b, err := e.seal(name, label, key)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	if e.dir == "" {
+		l.Printf("Escrowed %s key %s: %s", name, b.KeyID, encoded)
+		return nil
+	}
+	return writeFileAtomically(e.dir, name+"-"+b.KeyID.String()+escrowFileExt, encoded)
+}
+
+// seal splits the given key's material among our custodians and returns the
+// resulting bundle.
+func (e *keyEscrow) seal(name, label string, key *epochKey) (*escrowBundle, error) {
+	id, err := keyIDOf(key.material, label)
+	if err != nil {
+		return nil, err
+	}
+	b := &escrowBundle{
+		Version:      escrowVersion,
+		Tokenizer:    name,
+		KeyID:        id.UUID,
+		ContextLabel: label,
+		Created:      key.created,
+		Starts:       key.starts,
+		Expires:      key.expires,
+		Threshold:    e.threshold,
+	}
+	shares, err := shamirSplit(key.material, len(e.custodians), e.threshold)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range shares {
+		sealed, err := b.sealShare(s, e.custodians[i])
+		zeroize(s.y)
+		if err != nil {
+			return nil, err
+		}
+		b.Shares = append(b.Shares, sealed)
+	}
+	return b, nil
+}
+
+// sealShare seals the given share to the given custodian.
+func (b *escrowBundle) sealShare(s *shamirShare, custodian *ecdh.PublicKey) (*escrowShare, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sealed := &escrowShare{
+		Index:     s.x,
+		Custodian: custodian.Bytes(),
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+	}
+	shared, err := ephemeral.ECDH(custodian)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := sealed.aead(shared)
+	zeroize(shared)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed.Sealed = aead.Seal(nonce, nonce, s.y, b.associatedData(sealed))
+	return sealed, nil
+}
+
+// openShare opens the share that's sealed to the given custodian.
+func (b *escrowBundle) openShare(identity *ecdh.PrivateKey) (*shamirShare, error) {
+	pub := identity.PublicKey().Bytes()
+	for _, sealed := range b.Shares {
+		if string(sealed.Custodian) != string(pub) {
+			continue
+		}
+		ephemeral, err := ecdh.X25519().NewPublicKey(sealed.Ephemeral)
+		if err != nil {
+			return nil, errBadEscrowBundle
+		}
+		shared, err := identity.ECDH(ephemeral)
+		if err != nil {
+			return nil, errBadEscrowBundle
+		}
+		aead, err := sealed.aead(shared)
+		zeroize(shared)
+		if err != nil {
+			return nil, err
+		}
+		nonceSize := aead.NonceSize()
+		if len(sealed.Sealed) < nonceSize {
+			return nil, errBadEscrowBundle
+		}
+		y, err := aead.Open(nil, sealed.Sealed[:nonceSize], sealed.Sealed[nonceSize:], b.associatedData(sealed))
+		if err != nil {
+			return nil, errBadEscrowBundle
+		}
+		return &shamirShare{x: sealed.Index, y: y}, nil
+	}
+	return nil, errNoMatchingShare
+}
+
+// recover reconstructs the escrowed key material using the given custodians'
+// private keys and makes sure that it matches the bundle's key ID.
+func (b *escrowBundle) recover(identities []*ecdh.PrivateKey) ([]byte, error) {
+	if len(identities) < b.Threshold {
+		return nil, fmt.Errorf("%w: got %d of %d", errTooFewShares, len(identities), b.Threshold)
+	}
+	var shares []*shamirShare
+	defer func() {
+		for _, s := range shares {
+			zeroize(s.y)
+		}
+	}()
+	for _, identity := range identities {
+		s, err := b.openShare(identity)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, s)
+	}
+	material, err := shamirCombine(shares)
+	if err != nil {
+		return nil, err
+	}
+	id, err := keyIDOf(material, b.ContextLabel)
+	if err != nil {
+		zeroize(material)
+		return nil, err
+	}
+	if id.UUID != b.KeyID {
+		zeroize(material)
+		return nil, errEscrowKeyMismatch
+	}
+	return material, nil
+}
+
+// associatedData returns the associated data of the given share, which binds
+// the share to the bundle's metadata.  A share therefore cannot be moved to
+// another bundle, nor can the bundle's metadata be changed.
+func (b *escrowBundle) associatedData(s *escrowShare) []byte {
+	ad, _ := json.Marshal(struct {
+		Version      int       `json:"version"`
+		Tokenizer    string    `json:"tokenizer"`
+		KeyID        uuid.UUID `json:"key_id"`
+		ContextLabel string    `json:"context_label"`
+		Created      time.Time `json:"created"`
+		Starts       time.Time `json:"starts"`
+		Expires      time.Time `json:"expires"`
+		Threshold    int       `json:"threshold"`
+		Index        byte      `json:"index"`
+		Custodian    []byte    `json:"custodian"`
+	}{b.Version, b.Tokenizer, b.KeyID, b.ContextLabel, b.Created, b.Starts,
+		b.Expires, b.Threshold, s.Index, s.Custodian})
+	return ad
+}
+
+// aead returns the AEAD that seals the share, given the X25519 shared secret
+// of the share's ephemeral key pair and its custodian.
+func (s *escrowShare) aead(shared []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	defer zeroize(key)
+	salt := append(append([]byte{}, s.Ephemeral...), s.Custodian...)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(escrowInfo)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadEscrowBundle loads the escrow bundle in the given file.
+func loadEscrowBundle(path string) (*escrowBundle, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var b escrowBundle
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadEscrowBundle, err)
+	}
+	if b.Version != escrowVersion || b.Threshold < 2 || b.Threshold > len(b.Shares) {
+		return nil, errBadEscrowBundle
+	}
+	return &b, nil
+}
+
+// loadIdentity loads the custodian's hex-encoded X25519 private key in the
+// given file.
+func loadIdentity(path string) (*ecdh.PrivateKey, error) {
+	raw, err := loadHexSecret(path, "")
+	if err != nil {
+		return nil, err
+	}
+	defer zeroize(raw)
+	return ecdh.X25519().NewPrivateKey(raw)
+}
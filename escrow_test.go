@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestCustodians(t *testing.T, n int) ([]*ecdh.PrivateKey, []*ecdh.PublicKey) {
+	t.Helper()
+	var (
+		identities []*ecdh.PrivateKey
+		custodians []*ecdh.PublicKey
+	)
+	for i := 0; i < n; i++ {
+		identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to create custodian key: %v", err)
+		}
+		identities = append(identities, identity)
+		custodians = append(custodians, identity.PublicKey())
+	}
+	return identities, custodians
+}
+
+// newTestBundle makes the HMAC tokenizer escrow a new key and returns the
+// tokenizer and the escrow bundle.
+func newTestBundle(t *testing.T, custodians []*ecdh.PublicKey, threshold int) (tokenizer, *escrowBundle) {
+	t.Helper()
+	dir := t.TempDir()
+	e, err := newKeyEscrow(custodians, threshold, dir)
+	if err != nil {
+		t.Fatalf("Failed to create key escrow: %v", err)
+	}
+	h := newHmacTokenizer()
+	h.(configurer).setConfig(&config{contextLabel: "test", keyEscrow: e})
+	if err := h.resetKey(); err != nil {
+		t.Fatalf("Failed to reset key: %v", err)
+	}
+	b, err := loadEscrowBundle(filepath.Join(dir, tokenizerHmac+"-"+h.keyID().String()+escrowFileExt))
+	if err != nil {
+		t.Fatalf("Failed to load escrow bundle: %v", err)
+	}
+	return h, b
+}
+
+func TestEscrowRoundTrip(t *testing.T) {
+	identities, custodians := newTestCustodians(t, 3)
+	h, b := newTestBundle(t, custodians, 2)
+	assertEqual(t, b.Tokenizer, tokenizerHmac)
+	assertEqual(t, b.KeyID, h.keyID().UUID)
+	assertEqual(t, len(b.Shares), 3)
+
+	for _, some := range [][]*ecdh.PrivateKey{identities[:2], identities[1:], identities} {
+		material, err := b.recover(some)
+		if err != nil {
+			t.Fatalf("Failed to recover key: %v", err)
+		}
+		id, err := keyIDOf(material, b.ContextLabel)
+		if err != nil {
+			t.Fatalf("Failed to compute key ID: %v", err)
+		}
+		assertEqual(t, *id, *h.keyID())
+	}
+
+	if _, err := b.recover(identities[:1]); !errors.Is(err, errTooFewShares) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errTooFewShares, err)
+	}
+	strangers, _ := newTestCustodians(t, 1)
+	if _, err := b.recover(append(strangers, identities[0])); !errors.Is(err, errNoMatchingShare) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errNoMatchingShare, err)
+	}
+}
+
+func TestEscrowTampering(t *testing.T) {
+	identities, custodians := newTestCustodians(t, 2)
+	_, b := newTestBundle(t, custodians, 2)
+
+	// Shares are bound to the bundle's metadata.
+	b.Tokenizer = tokenizerCryptoPAn
+	if _, err := b.recover(identities); !errors.Is(err, errBadEscrowBundle) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadEscrowBundle, err)
+	}
+	b.Tokenizer = tokenizerHmac
+
+	// Swapping shares' indices results in the wrong key.
+	b.Shares[0].Index, b.Shares[1].Index = b.Shares[1].Index, b.Shares[0].Index
+	if _, err := b.recover(identities); !errors.Is(err, errBadEscrowBundle) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadEscrowBundle, err)
+	}
+}
+
+func TestEscrowFailureBlocksKey(t *testing.T) {
+	_, custodians := newTestCustodians(t, 2)
+	dir := t.TempDir()
+	e, err := newKeyEscrow(custodians, 2, dir)
+	if err != nil {
+		t.Fatalf("Failed to create key escrow: %v", err)
+	}
+	h := newHmacTokenizer()
+	h.(configurer).setConfig(&config{keyEscrow: e})
+	// Without a writable escrow directory, the tokenizer must not get a key.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("Failed to remove escrow directory: %v", err)
+	}
+	if err := h.resetKey(); err == nil {
+		t.Fatal("Expected key reset to fail without escrow.")
+	}
+	if _, err := h.tokenize(blob("foo")); !errors.Is(err, errNoKey) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errNoKey, err)
+	}
+}
+
+func TestNewKeyEscrow(t *testing.T) {
+	_, custodians := newTestCustodians(t, 3)
+	for _, threshold := range []int{1, 4} {
+		if _, err := newKeyEscrow(custodians, threshold, ""); !errors.Is(err, errBadThreshold) {
+			t.Fatalf("Expected error '%v' for threshold %d but got '%v'.", errBadThreshold, threshold, err)
+		}
+	}
+}
+
+func TestLoadCustodians(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "custodians")
+	content := "# Alice\n" +
+		"de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f\n\n" +
+		"# Bob\n" +
+		"8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write custodian file: %v", err)
+	}
+	custodians, err := loadCustodians(path)
+	if err != nil {
+		t.Fatalf("Failed to load custodians: %v", err)
+	}
+	assertEqual(t, len(custodians), 2)
+
+	if err := os.WriteFile(path, []byte("not hex\n"), 0600); err != nil {
+		t.Fatalf("Failed to write custodian file: %v", err)
+	}
+	if _, err := loadCustodians(path); !errors.Is(err, errBadCustodianKey) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadCustodianKey, err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+)
+
+const (
+	// NIST SP 800-38G requires radix^minlen >= 1,000,000.
+	ff1MinDomainSize = 1000000
+	ff1MaxRadix      = 1 << 16
+)
+
+var (
+	errFF1BadRadix    = errors.New("FF1 radix must be in interval [2, 65536]")
+	errFF1BadInputLen = errors.New("FF1 input is too short for the given radix")
+)
+
+// ff1 implements the FF1 format-preserving encryption mode as specified in
+// NIST SP 800-38G.  FF1 encrypts a string of numerals in the given radix into
+// a string of numerals of the same length and radix.
+type ff1 struct {
+	// key is the AES key.  It lives in locked memory.
+	key    []byte
+	radix  int
+	minLen int
+}
+
+// newFF1 returns a new FF1 instance using a copy of the given AES key and the
+// given radix.
+func newFF1(key []byte, radix int) (*ff1, error) {
+	if radix < 2 || radix > ff1MaxRadix {
+		return nil, errFF1BadRadix
+	}
+	if k := len(key); k != 16 && k != 24 && k != 32 {
+		return nil, aes.KeySizeError(k)
+	}
+	c, err := locked.copyOf(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ff1{key: c, radix: radix, minLen: ff1MinLen(radix)}, nil
+}
+
+// ff1MinLen returns the minimum number of numerals that FF1 accepts for the
+// given radix.
+func ff1MinLen(radix int) int {
+	minLen := int(math.Ceil(math.Log(ff1MinDomainSize) / math.Log(float64(radix))))
+	if minLen < 2 {
+		minLen = 2
+	}
+	return minLen
+}
+
+// free zeroizes and frees the key.
+func (f *ff1) free() {
+	locked.free(f.key)
+	f.key = nil
+}
+
+// encrypt encrypts the given numeral string using the given tweak.
+func (f *ff1) encrypt(x []uint16, tweak []byte) ([]uint16, error) {
+	n := len(x)
+	if n < f.minLen {
+		return nil, errFF1BadInputLen
+	}
+	// Like AES-SIV, we expand the key for each operation instead of keeping
+	// its key schedule around on Go's heap.
+	block, err := aes.NewCipher(f.key)
+	if err != nil {
+		return nil, err
+	}
+	u, v := n/2, n-n/2
+	a, b := x[:u], x[u:]
+
+	// Step 3 and 4: b is the number of bytes that we need to represent the
+	// numerals of the right half, and d is the number of bytes that we derive
+	// from the PRF's output.
+	byteLen := int(math.Ceil(math.Ceil(float64(v)*math.Log2(float64(f.radix))) / 8))
+	d := 4*((byteLen+3)/4) + 4
+
+	// Step 5: The fixed block P.
+	p := make([]byte, aes.BlockSize)
+	p[0], p[1], p[2] = 1, 2, 1
+	p[3] = byte(f.radix >> 16)
+	p[4] = byte(f.radix >> 8)
+	p[5] = byte(f.radix)
+	p[6], p[7] = 10, byte(u%256)
+	binary.BigEndian.PutUint32(p[8:], uint32(n))
+	binary.BigEndian.PutUint32(p[12:], uint32(len(tweak)))
+
+	// Q consists of the tweak, zero padding, the round number, and the right
+	// half's numerical value.
+	padLen := (16 - (len(tweak)+byteLen+1)%16) % 16
+	q := make([]byte, len(tweak)+padLen+1+byteLen)
+	copy(q, tweak)
+
+	radix := big.NewInt(int64(f.radix))
+	modU := new(big.Int).Exp(radix, big.NewInt(int64(u)), nil)
+	modV := new(big.Int).Exp(radix, big.NewInt(int64(v)), nil)
+	s := make([]byte, ((d+aes.BlockSize-1)/aes.BlockSize)*aes.BlockSize)
+	y, c := new(big.Int), new(big.Int)
+
+	for i := 0; i < 10; i++ {
+		q[len(tweak)+padLen] = byte(i)
+		numB := f.num(b).Bytes()
+		numBytes := q[len(q)-byteLen:]
+		for j := range numBytes {
+			numBytes[j] = 0
+		}
+		copy(numBytes[byteLen-len(numB):], numB)
+
+		// Step 6.ii and 6.iii: R = PRF(P || Q), and S consists of R followed
+		// by encryptions of R XOR [j].
+		r := prf(block, append(append([]byte{}, p...), q...))
+		copy(s, r)
+		for j := 1; j*aes.BlockSize < d; j++ {
+			blk := s[j*aes.BlockSize : (j+1)*aes.BlockSize]
+			copy(blk, r)
+			ctr := blk[aes.BlockSize-8:]
+			binary.BigEndian.PutUint64(ctr, binary.BigEndian.Uint64(ctr)^uint64(j))
+			block.Encrypt(blk, blk)
+		}
+		y.SetBytes(s[:d])
+
+		m, mod := u, modU
+		if i%2 == 1 {
+			m, mod = v, modV
+		}
+		c.Add(f.num(a), y)
+		c.Mod(c, mod)
+		a, b = b, f.str(c, m)
+	}
+	return append(append([]uint16{}, a...), b...), nil
+}
+
+// prf implements FF1's pseudorandom function, i.e., AES-CBC-MAC with a zero
+// IV.  The given input must be a multiple of the block size.
+func prf(block cipher.Block, in []byte) []byte {
+	y := make([]byte, aes.BlockSize)
+	for i := 0; i < len(in); i += aes.BlockSize {
+		for j := 0; j < aes.BlockSize; j++ {
+			y[j] ^= in[i+j]
+		}
+		block.Encrypt(y, y)
+	}
+	return y
+}
+
+// num returns the number that the given numeral string represents, with the
+// most significant numeral first.
+func (f *ff1) num(x []uint16) *big.Int {
+	radix, n := big.NewInt(int64(f.radix)), new(big.Int)
+	for _, numeral := range x {
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(numeral)))
+	}
+	return n
+}
+
+// str returns the m-numeral representation of the given number.
+func (f *ff1) str(n *big.Int, m int) []uint16 {
+	radix, rest, mod := big.NewInt(int64(f.radix)), new(big.Int).Set(n), new(big.Int)
+	x := make([]uint16, m)
+	for i := m - 1; i >= 0; i-- {
+		rest.DivMod(rest, radix, mod)
+		x[i] = uint16(mod.Int64())
+	}
+	return x
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFF1Vectors(t *testing.T) {
+	// Test vectors are taken from NIST's FF1 samples:
+	// https://csrc.nist.gov/CSRC/media/Projects/Cryptographic-Standards-and-Guidelines/documents/examples/FF1samples.pdf
+	tests := []struct {
+		key, alphabet, tweak, plaintext, ciphertext string
+	}{
+		{
+			"2b7e151628aed2a6abf7158809cf4f3c",
+			"0123456789",
+			"",
+			"0123456789",
+			"2433477484",
+		},
+		{
+			"2b7e151628aed2a6abf7158809cf4f3c",
+			"0123456789",
+			"39383736353433323130",
+			"0123456789",
+			"6124200773",
+		},
+		{
+			"2b7e151628aed2a6abf7158809cf4f3c",
+			"0123456789abcdefghijklmnopqrstuvwxyz",
+			"3737373770717273373737",
+			"0123456789abcdefghi",
+			"a9tv40mll9kdu509eum",
+		},
+		{
+			"2b7e151628aed2a6abf7158809cf4f3cef4359d8d580aa4f7f036d6f04fc6a94",
+			"0123456789",
+			"",
+			"0123456789",
+			"6657667009",
+		},
+	}
+	for _, test := range tests {
+		a, err := newAlphabet(test.alphabet)
+		if err != nil {
+			t.Fatalf("Failed to create alphabet: %v", err)
+		}
+		f, err := newFF1(mustDecodeHex(t, test.key), len(a.symbols))
+		if err != nil {
+			t.Fatalf("Failed to create FF1: %v", err)
+		}
+		defer f.free()
+		x, err := a.toNumerals(test.plaintext)
+		if err != nil {
+			t.Fatalf("Failed to turn plaintext into numerals: %v", err)
+		}
+		y, err := f.encrypt(x, mustDecodeHex(t, test.tweak))
+		if err != nil {
+			t.Fatalf("Failed to encrypt: %v", err)
+		}
+		assertEqual(t, a.toString(y), test.ciphertext)
+	}
+}
+
+func TestFF1BadInput(t *testing.T) {
+	key := make([]byte, 16)
+	if _, err := newFF1(key, 1); !errors.Is(err, errFF1BadRadix) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errFF1BadRadix, err)
+	}
+
+	// With radix 10, the domain must consist of at least six numerals.
+	f, _ := newFF1(key, 10)
+	defer f.free()
+	if _, err := f.encrypt([]uint16{1, 2, 3, 4, 5}, nil); !errors.Is(err, errFF1BadInputLen) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errFF1BadInputLen, err)
+	}
+	if _, err := f.encrypt([]uint16{1, 2, 3, 4, 5, 6}, nil); err != nil {
+		t.Fatalf("Expected no error but got: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// The path of a record's root object.
+	rootPath = "$"
+	// The separator of a path's field names, e.g. "$.client.ip".
+	pathSeparator = "."
+
+	actionKeep = "keep"
+	actionDrop = "drop"
+)
+
+var (
+	errBadFieldPath   = errors.New("field path must be of the form $.field.subfield")
+	errBadFieldRule   = errors.New("field rule must be of the form <path>: <action>")
+	errDuplicateField = errors.New("field path appears more than once")
+	errNoFieldPolicy  = errors.New("record aggregator requires a field policy")
+)
+
+// fieldRule determines what happens to the fields at a given path of a record:
+// we either keep them as they are, drop them, or tokenize them using a
+// tokenizer chain.
+type fieldRule struct {
+	action string
+	chain  *chainSpec
+}
+
+func (r fieldRule) String() string {
+	return r.action
+}
+
+// fieldPolicy maps the paths of a record's fields, e.g. "$.client.ip", to
+// their rules.  A rule applies to the field at its path and to all nested
+// fields that don't have a rule of their own.  Fields without a rule are
+// dropped, unless the policy has a rule for the root path "$".  Paths don't
+// refer to array indices, i.e., the rule of an array's path applies to each
+// of the array's elements.
+type fieldPolicy map[string]fieldRule
+
+// ruleOf returns the path of the rule for the field at the given path, i.e.,
+// the field names that lead to the field, if the policy has a rule for it.
+// We match paths name by name, so a field whose name contains the path
+// separator, e.g. "client.ip", never matches a rule for a nested field, e.g.
+// "$.client.ip".  Such fields have no rule of their own.
+func (p fieldPolicy) ruleOf(path []string) (string, bool) {
+	for _, name := range path[1:] {
+		if name == "" || strings.Contains(name, pathSeparator) {
+			return "", false
+		}
+	}
+	rulePath := strings.Join(path, pathSeparator)
+	_, exists := p[rulePath]
+	return rulePath, exists
+}
+
+// loadFieldPolicy loads the field policy in the given file.
+func loadFieldPolicy(path string) (fieldPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseFieldPolicy(f)
+}
+
+// parseFieldPolicy parses the given field policy, which consists of one rule
+// per line, e.g. "$.client.ip: cryptopan" or "$.ts: keep".  Blank lines and
+// lines that start with "#" are ignored.
+func parseFieldPolicy(r io.Reader) (fieldPolicy, error) {
+	p := make(fieldPolicy)
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		path, action, found := strings.Cut(line, ":")
+		path, action = strings.TrimSpace(path), strings.TrimSpace(action)
+		if !found || action == "" {
+			return nil, fmt.Errorf("line %d: %w", lineNum, errBadFieldRule)
+		}
+		if err := checkFieldPath(path); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if _, exists := p[path]; exists {
+			return nil, fmt.Errorf("line %d: %w: %s", lineNum, errDuplicateField, path)
+		}
+		rule := fieldRule{action: action}
+		if action != actionKeep && action != actionDrop {
+			chain, err := parseChainSpec(action)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			rule.chain = chain
+		}
+		p[path] = rule
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// checkFieldPath returns an error if the given path isn't the root path
+// followed by zero or more non-empty field names.
+func checkFieldPath(path string) error {
+	fields := strings.Split(path, pathSeparator)
+	if fields[0] != rootPath {
+		return errBadFieldPath
+	}
+	for _, f := range fields[1:] {
+		if f == "" {
+			return errBadFieldPath
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseFieldPolicy(t *testing.T) {
+	p, err := parseFieldPolicy(strings.NewReader(`
+# Our clients' data.
+$.client.ip: mask:/24 | cryptopan
+$.user.email:normalize-email | hmac
+$.ts: keep
+
+$.ua: drop
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse field policy: %v", err)
+	}
+	assertEqual(t, len(p), 4)
+	assertEqual(t, p["$.client.ip"].chain.keyed, tokenizerCryptoPAn)
+	assertEqual(t, p["$.user.email"].chain.keyed, tokenizerHmac)
+	assertEqual(t, p["$.ts"].action, actionKeep)
+	if p["$.ua"].chain != nil {
+		t.Fatal("Expected drop rule not to have a chain.")
+	}
+
+	for policy, expected := range map[string]error{
+		"$.ts":                   errBadFieldRule,
+		"$.ts:":                  errBadFieldRule,
+		"ts: keep":               errBadFieldPath,
+		"$..ts: keep":            errBadFieldPath,
+		"$.ts.: keep":            errBadFieldPath,
+		"$.ts: keep\n$.ts: drop": errDuplicateField,
+		"$.ts: foo":              errNoSuchStage,
+	} {
+		if _, err := parseFieldPolicy(strings.NewReader(policy)); !errors.Is(err, expected) {
+			t.Fatalf("Expected error '%v' for policy %q but got '%v'.", expected, policy, err)
+		}
+	}
+}
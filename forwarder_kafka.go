@@ -81,6 +81,8 @@ type kafkaForwarder struct {
 	sync.RWMutex
 	tokenCache *cache
 	conf       *kafkaConfig
+	shadow     bool
+	stats      *pipelineMetrics
 	writer     kafkaWriter
 	out        chan token
 	done       chan empty
@@ -89,6 +91,7 @@ type kafkaForwarder struct {
 func newKafkaForwarder() forwarder {
 	return &kafkaForwarder{
 		tokenCache: newCache(),
+		stats:      metricsFor(pipelinePrimary),
 		out:        make(chan token),
 		done:       make(chan empty),
 	}
@@ -100,6 +103,8 @@ func (k *kafkaForwarder) setConfig(c *config) {
 
 	k.tokenCache.conf = c.kafkaConfig
 	k.conf = c.kafkaConfig
+	k.shadow = c.shadow
+	k.stats = c.metrics()
 }
 
 func (k *kafkaForwarder) outbox() chan token {
@@ -149,12 +154,19 @@ func (k *kafkaForwarder) maybeFlush() {
 		l := prometheus.Labels{
 			outcome: failBecause(fmt.Errorf("failed to forward tokens: %v", err)),
 		}
-		m.numForwarded.With(l).Add(float64(batchSize))
+		k.stats.numForwarded.With(l).Add(float64(batchSize))
+		// The shadow pipeline also counts its failures alongside its other
+		// errors.
+		if k.shadow {
+			m.shadowErrors.With(prometheus.Labels{
+				shadowStage: shadowStageForward,
+			}).Add(float64(batchSize))
+		}
 		return
 	}
 
 	l.Printf("Flushed %d tokens to Kafka.", batchSize)
-	m.numForwarded.With(prometheus.Labels{
+	k.stats.numForwarded.With(prometheus.Labels{
 		outcome: success,
 	}).Add(float64(batchSize))
 }
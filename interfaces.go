@@ -34,16 +34,48 @@ type config struct {
 	kafkaConfig      *kafkaConfig
 	fwdInterval      time.Duration
 	keyExpiry        time.Duration
+	keyOverlap       time.Duration
+	alignToClock     bool
+	contextLabel     string
+	tokenizerName    string
+	aggregatorName   string
+	forwarderName    string
+	envelopeTokens   bool
+	shadow           bool // If we're the shadow pipeline's configuration.
 	port             uint16
 	prometheusPort   uint16
 	exposePrometheus bool
+	adminPort        uint16
+	exposeAdmin      bool
+	adminCertFile    string
+	adminKeyFile     string
+	adminClientCA    string
+	sivRetainedKeys  int
+	ff1Alphabet      string
+	ff1Tweak         []byte
+	hmacFamily       string
+	hmacKeySize      int
+	hmacBits         int
+	clkQ             int
+	clkK             int
+	clkM             int
+	emailDomainMode  string
+	ipv4Prefixes     []int
+	ipv6Prefixes     []int
+	addrPolicy       addrPolicy
+	fieldPolicy      fieldPolicy
+	keySource        keySource
+	keyStore         *keyStore
+	keyEscrow        *keyEscrow
+	keyLog           *keyLog
 }
 
 type components struct {
-	r receiver
-	a aggregator
-	t tokenizer
-	f forwarder
+	r      receiver
+	a      aggregator
+	t      tokenizer
+	f      forwarder
+	shadow *shadowPipeline // Nil unless we run a shadow tokenizer.
 }
 
 type keyID struct {
@@ -84,16 +116,91 @@ type aggregator interface {
 	configurer
 }
 
+// flusher is implemented by aggregators that hold on to data until they
+// flush it, which they do periodically and on demand.
+type flusher interface {
+	flush() error
+	pending() (wallets, addrs int)
+	lastFlush() *flushResult
+}
+
+// flushResult represents the outcome of a flush: when it happened, how many
+// wallets and addresses it forwarded, and why it failed, if it did.
+type flushResult struct {
+	Time    time.Time `json:"time"`
+	Wallets int       `json:"wallets"`
+	Addrs   int       `json:"addrs"`
+	Error   string    `json:"error,omitempty"`
+}
+
 // tokenizer turns a serializer object into tokens, which typically involves a
 // secret key.
+//
+// During a key overlap, a tokenizer has more than one active key.  The
+// current key is used by tokenize and tokenizeAndKeyID while
+// tokenizeWithKeyID lets the caller pick any of the active keys.
+//
+// tokenizeBatch tokenizes several serializers at once using the active key
+// with the given ID, or the current key if the ID is nil.  The key is
+// acquired only once per batch.  If some items fail, the returned error is a
+// batchError and the tokens of the failed items are nil.
 type tokenizer interface {
 	keyID() *keyID
+	activeKeyIDs() []*keyID
 	tokenize(serializer) (token, error)
 	tokenizeAndKeyID(serializer) (token, *keyID, error)
+	tokenizeWithKeyID(serializer, *keyID) (token, error)
+	tokenizeBatch([]serializer, *keyID) ([]token, *keyID, error)
 	resetKey() error
 	preservesLen() bool
 }
 
+// granularTokenizer turns a serializer object into several tokens, each of
+// which represents the input at a different granularity.  All tokens are
+// created using the active key with the given ID.
+type granularTokenizer interface {
+	tokenizeGranular(serializer, *keyID) ([]granularToken, error)
+}
+
+// textTokenizer is implemented by tokenizers whose tokens are printable text,
+// e.g., because they preserve the format of their input.  Such tokens don't
+// need to be encoded before we forward them.
+type textTokenizer interface {
+	emitsText() bool
+}
+
+// epoch represents the time interval during which a key is current.  A zero
+// end means that the key doesn't expire on its own.
+type epoch struct {
+	start time.Time
+	end   time.Time
+}
+
+// epochTracker is implemented by tokenizers that know the epochs of their
+// active keys.
+type epochTracker interface {
+	keyEpoch(*keyID) (epoch, bool)
+}
+
+// detokenizer turns tokens back into the data that they were created from.
+// Only reversible tokenizers implement this interface.
+type detokenizer interface {
+	detokenize(token, *keyID) ([]byte, error)
+}
+
+// blindEvaluator evaluates an oblivious PRF on elements that clients blinded,
+// using the current key.  Only the OPRF tokenizer implements this interface.
+type blindEvaluator interface {
+	blindEvaluate(blinded [][]byte) (*oprfEvaluation, *oprfPublicKey, error)
+	publicKey() (*oprfPublicKey, error)
+}
+
+// tokenizerUser is implemented by components that use the tokenizer, e.g.,
+// receivers that expose tokenizer functionality to clients.
+type tokenizerUser interface {
+	use(tokenizer)
+}
+
 // forwarder sends tokens somewhere.  Anywhere, really.
 type forwarder interface {
 	outbox() chan token
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+const (
+	envKeyLogSigningKey = "KEY_LOG_SIGNING_KEY"
+	// keyLogCommitmentInfo is the message that we MAC using a key to commit to
+	// the key.
+	keyLogCommitmentInfo = "tkzr key commitment"
+	// keyLogMaxLineSize is the maximum size of a serialized log entry, in
+	// bytes.
+	keyLogMaxLineSize = 1 << 16
+)
+
+var (
+	errBadSigningKey    = fmt.Errorf("key log signing key must be a hex-encoded %d-byte Ed25519 seed", ed25519.SeedSize)
+	errBadKeyLogEntry   = errors.New("key log entry is malformed")
+	errKeyLogSignature  = errors.New("key log entry has an invalid signature")
+	errKeyLogChain      = errors.New("key log entry does not extend the hash chain")
+	errKeyLogPrevKeyID  = errors.New("key log entry's previous key ID does not match the tokenizer's previous entry")
+	errKeyLogUnverified = errors.New("key log cannot be appended to because it failed verification")
+)
+
+// keyLogEntry represents a key rotation.  The entry commits to the new key,
+// and names the key that it replaces, if any, which is retired once the key
+// overlap is over.  Each entry contains the hash of the previous entry, so
+// entries cannot be removed, reordered, or changed without breaking the chain.
+type keyLogEntry struct {
+	Seq        uint64     `json:"seq"`
+	Time       time.Time  `json:"time"`
+	Tokenizer  string     `json:"tokenizer"`
+	KeyID      uuid.UUID  `json:"key_id"`
+	PrevKeyID  *uuid.UUID `json:"prev_key_id,omitempty"`
+	Starts     time.Time  `json:"starts"`
+	Expires    time.Time  `json:"expires"`
+	Commitment []byte     `json:"commitment"`
+	PrevHash   []byte     `json:"prev_hash"`
+	// The hash of the entry's encoding, which is what its signature covers
+	// and what the next entry refers to.
+	hash []byte
+}
+
+// signedKeyLogEntry represents a log entry as it's serialized: one JSON object
+// per line.  The signature covers the entry's exact bytes, so verifiers don't
+// need to re-encode entries.
+type signedKeyLogEntry struct {
+	Entry     json.RawMessage `json:"entry"`
+	Signature []byte          `json:"signature"`
+}
+
+// keyLog implements an append-only, hash-chained log of key rotations, whose
+// entries are signed using a long-lived Ed25519 key.  The log lives in a file
+// that we only ever append to.  Consumers of our tokens can use the log to
+// check that a key ID existed and when it was replaced, and auditors can check
+// that keys rotate on schedule.
+type keyLog struct {
+	sync.Mutex
+	path     string
+	signer   ed25519.PrivateKey
+	seq      uint64
+	lastHash []byte
+	// The ID of each tokenizer's most recent key.
+	lastKeys map[string]uuid.UUID
+}
+
+// newKeyLog returns a new key log that appends to the given file, whose
+// entries must verify under the given signing key's public key, and signs new
+// entries using the given signing key.
+func newKeyLog(path string, signer ed25519.PrivateKey) (*keyLog, error) {
+	k := &keyLog{
+		path:     path,
+		signer:   signer,
+		lastHash: make([]byte, sha256.Size),
+		lastKeys: make(map[string]uuid.UUID),
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := verifyKeyLog(f, signer.Public().(ed25519.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errKeyLogUnverified, err)
+	}
+	for _, e := range entries {
+		k.track(e)
+	}
+	return k, nil
+}
+
+// append appends a new entry for the given tokenizer's given new key, whose
+// subkeys are derived using the given context label.  Key providers call this
+// before they start using a new key, so every key that's ever used is logged.
+func (k *keyLog) append(name, label string, key *epochKey) error {
+	id, err := keyIDOf(key.material, label)
+	if err != nil {
+		return err
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	e := &keyLogEntry{
+		Seq:        k.seq,
+		Time:       time.Now().UTC(),
+		Tokenizer:  name,
+		KeyID:      id.UUID,
+		Starts:     key.starts,
+		Expires:    key.expires,
+		Commitment: keyCommitment(key.material),
+		PrevHash:   k.lastHash,
+	}
+	if prev, exists := k.lastKeys[name]; exists {
+		e.PrevKeyID = &prev
+	}
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256(raw)
+	e.hash = h[:]
+	line, err := json.Marshal(&signedKeyLogEntry{
+		Entry:     raw,
+		Signature: ed25519.Sign(k.signer, raw),
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(k.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	k.track(e)
+	l.Printf("Logged %s key %s as key log entry %d.", name, id, e.Seq)
+	return nil
+}
+
+// track makes the given entry the log's most recent entry.  The caller must
+// hold the lock, if necessary.
+func (k *keyLog) track(e *keyLogEntry) {
+	k.seq = e.Seq + 1
+	k.lastHash = e.hash
+	k.lastKeys[e.Tokenizer] = e.KeyID
+}
+
+// writeTo writes the entire log to the given writer.
+func (k *keyLog) writeTo(w io.Writer) error {
+	k.Lock()
+	defer k.Unlock()
+
+	f, err := os.Open(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// verifyKeyLog reads the log from the given reader and verifies each entry's
+// signature under the given public key, its sequence number, its place in the
+// hash chain, and its previous key ID.  We return the log's entries.
+func verifyKeyLog(r io.Reader, pub ed25519.PublicKey) ([]*keyLogEntry, error) {
+	var (
+		entries  []*keyLogEntry
+		lastHash = make([]byte, sha256.Size)
+		lastKeys = make(map[string]uuid.UUID)
+	)
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 4096), keyLogMaxLineSize)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		var signed signedKeyLogEntry
+		if err := json.Unmarshal(s.Bytes(), &signed); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, errBadKeyLogEntry)
+		}
+		if !ed25519.Verify(pub, signed.Entry, signed.Signature) {
+			return nil, fmt.Errorf("line %d: %w", lineNum, errKeyLogSignature)
+		}
+		var e keyLogEntry
+		if err := json.Unmarshal(signed.Entry, &e); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, errBadKeyLogEntry)
+		}
+		if e.Seq != uint64(len(entries)) || !bytes.Equal(e.PrevHash, lastHash) {
+			return nil, fmt.Errorf("line %d: %w", lineNum, errKeyLogChain)
+		}
+		prev, exists := lastKeys[e.Tokenizer]
+		if exists != (e.PrevKeyID != nil) || (exists && prev != *e.PrevKeyID) {
+			return nil, fmt.Errorf("line %d: %w", lineNum, errKeyLogPrevKeyID)
+		}
+		h := sha256.Sum256(signed.Entry)
+		e.hash = h[:]
+		lastHash = e.hash
+		lastKeys[e.Tokenizer] = e.KeyID
+		entries = append(entries, &e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// keyCommitment returns our commitment to the given key material.  The
+// commitment reveals nothing about the key, but whoever holds the key, e.g.,
+// after reconstructing it from escrow, can check that it's the logged key.
+func keyCommitment(material []byte) []byte {
+	mac := hmac.New(sha256.New, material)
+	mac.Write([]byte(keyLogCommitmentInfo))
+	return mac.Sum(nil)
+}
+
+// loadSigningKey loads the key log's hex-encoded Ed25519 seed from the given
+// file or, if no file is given, from an environment variable.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	seed, err := loadHexSecret(path, envKeyLogSigningKey)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroize(seed)
+	if len(seed) != ed25519.SeedSize {
+		return nil, errBadSigningKey
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+var testSigningKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x42}, ed25519.SeedSize))
+
+func newTestKeyLog(t *testing.T, path string) *keyLog {
+	t.Helper()
+	k, err := newKeyLog(path, testSigningKey)
+	if err != nil {
+		t.Fatalf("Failed to open key log: %v", err)
+	}
+	return k
+}
+
+func readTestKeyLog(t *testing.T, path string) ([]*keyLogEntry, error) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open key log: %v", err)
+	}
+	defer f.Close()
+	return verifyKeyLog(f, testSigningKey.Public().(ed25519.PublicKey))
+}
+
+func TestKeyLogRotations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keylog")
+	c := &config{keyExpiry: time.Hour, keyLog: newTestKeyLog(t, path)}
+	h, p := newHmacTokenizer(), newCryptoPAnTokenizer()
+	h.(configurer).setConfig(c)
+	p.(configurer).setConfig(c)
+
+	var ids []*keyID
+	for _, tkzr := range []tokenizer{h, p, h} {
+		if err := tkzr.resetKey(); err != nil {
+			t.Fatalf("Failed to reset key: %v", err)
+		}
+		ids = append(ids, tkzr.keyID())
+	}
+
+	// Simulate a restart.  The reopened log must continue the chain.
+	c.keyLog = newTestKeyLog(t, path)
+	h.(configurer).setConfig(c)
+	if err := h.resetKey(); err != nil {
+		t.Fatalf("Failed to reset key: %v", err)
+	}
+	ids = append(ids, h.keyID())
+
+	entries, err := readTestKeyLog(t, path)
+	if err != nil {
+		t.Fatalf("Failed to verify key log: %v", err)
+	}
+	assertEqual(t, len(entries), 4)
+	for i, e := range entries {
+		assertEqual(t, e.Seq, uint64(i))
+		assertEqual(t, e.KeyID, ids[i].UUID)
+	}
+	assertEqual(t, entries[1].Tokenizer, tokenizerCryptoPAn)
+	if entries[0].PrevKeyID != nil || entries[1].PrevKeyID != nil {
+		t.Fatal("Expected first keys to have no previous key.")
+	}
+	assertEqual(t, *entries[2].PrevKeyID, ids[0].UUID)
+	assertEqual(t, *entries[3].PrevKeyID, ids[2].UUID)
+	assertEqual(t, entries[3].Expires.Sub(entries[3].Starts), time.Hour)
+}
+
+func TestKeyLogCommitment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keylog")
+	k := newTestKeyLog(t, path)
+	material := bytes.Repeat([]byte{0x23}, hmacKeySize)
+	if err := k.append(tokenizerHmac, "", &epochKey{material: material}); err != nil {
+		t.Fatalf("Failed to append to key log: %v", err)
+	}
+
+	entries, err := readTestKeyLog(t, path)
+	if err != nil {
+		t.Fatalf("Failed to verify key log: %v", err)
+	}
+	if !bytes.Equal(entries[0].Commitment, keyCommitment(material)) {
+		t.Fatal("Expected commitment to match key.")
+	}
+	if bytes.Contains(entries[0].Commitment, material) {
+		t.Fatal("Expected commitment not to reveal key.")
+	}
+}
+
+func TestKeyLogTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keylog")
+	k := newTestKeyLog(t, path)
+	for i := 0; i < 3; i++ {
+		material := bytes.Repeat([]byte{byte(i)}, hmacKeySize)
+		if err := k.append(tokenizerHmac, "", &epochKey{material: material}); err != nil {
+			t.Fatalf("Failed to append to key log: %v", err)
+		}
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read key log: %v", err)
+	}
+	lines := strings.SplitAfter(string(raw), "\n")
+
+	for _, test := range []struct {
+		log string
+		err error
+	}{
+		{strings.Replace(string(raw), `"tokenizer":"hmac"`, `"tokenizer":"siv"`, 1), errKeyLogSignature},
+		{lines[0] + lines[2], errKeyLogChain},
+		{lines[1] + lines[2], errKeyLogChain},
+		{lines[0] + lines[2] + lines[1], errKeyLogChain},
+		{"foo\n", errBadKeyLogEntry},
+	} {
+		if err := os.WriteFile(path, []byte(test.log), 0644); err != nil {
+			t.Fatalf("Failed to write key log: %v", err)
+		}
+		if _, err := readTestKeyLog(t, path); !errors.Is(err, test.err) {
+			t.Fatalf("Expected error '%v' but got '%v'.", test.err, err)
+		}
+		// We refuse to append to a log that doesn't verify.
+		if _, err := newKeyLog(path, testSigningKey); !errors.Is(err, errKeyLogUnverified) {
+			t.Fatalf("Expected error '%v' but got '%v'.", errKeyLogUnverified, err)
+		}
+	}
+
+	// Entries must verify under our public key.
+	other := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x43}, ed25519.SeedSize))
+	_, err = verifyKeyLog(bytes.NewReader(raw), other.Public().(ed25519.PublicKey))
+	if !errors.Is(err, errKeyLogSignature) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errKeyLogSignature, err)
+	}
+}
+
+func TestLateRotations(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a, b, c := uuid.New(), uuid.New(), uuid.New()
+	entries := []*keyLogEntry{
+		{KeyID: a, Time: start, Expires: start.Add(time.Hour)},
+		// Replaces a on time.
+		{KeyID: b, PrevKeyID: &a, Time: start.Add(time.Hour), Expires: start.Add(2 * time.Hour)},
+		// Replaces b too late.
+		{KeyID: c, PrevKeyID: &b, Time: start.Add(3 * time.Hour), Expires: start.Add(4 * time.Hour)},
+	}
+	late := lateRotations(entries, start.Add(3*time.Hour))
+	assertEqual(t, len(late), 1)
+	assertEqual(t, late[0].KeyID, b)
+
+	// Once c expires without being replaced, it's late as well.
+	late = lateRotations(entries, start.Add(5*time.Hour))
+	assertEqual(t, len(late), 2)
+}
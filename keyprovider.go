@@ -0,0 +1,520 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/hkdf"
+)
+
+// subkeyInfoPrefix is the prefix of HKDF's info parameter when deriving
+// subkeys for context labels.
+const subkeyInfoPrefix = "tkzr subkey"
+
+var (
+	errInactiveKeyID = errors.New("key ID is not active")
+	errNoKeyWrapper  = errors.New("stored key is wrapped but key source cannot unwrap keys")
+)
+
+// epochKey represents a tokenizer's key material along with its lifetime and
+// whatever state the tokenizer derives from the key material, e.g.,
+// initialized block ciphers.  Tokenizers never use the key material directly.
+// Instead, they use a subkey that's derived from the key material and the
+// context label.
+type epochKey struct {
+	id       *keyID
+	material []byte
+	subkey   []byte
+	wrapped  *wrappedKey // If our key source wraps keys.
+	created  time.Time
+	starts   time.Time
+	expires  time.Time
+	state    interface{}
+}
+
+// epoch returns the key's epoch.  Keys that were persisted before we kept
+// track of epoch starts begin their epoch when they were created.
+func (k *epochKey) epoch() epoch {
+	if k.starts.IsZero() {
+		return epoch{start: k.created, end: k.expires}
+	}
+	return epoch{start: k.starts, end: k.expires}
+}
+
+// expired returns true if the key has expired.  Keys whose expiry is the zero
+// time don't expire.
+func (k *epochKey) expired() bool {
+	return !k.expires.IsZero() && !time.Now().Before(k.expires)
+}
+
+// free zeroizes and frees the key's material and subkey, and drops its
+// derived state.  Derived state that manages its own memory is freed as well.
+func (k *epochKey) free() {
+	locked.free(k.material)
+	locked.free(k.subkey)
+	if f, ok := k.state.(freer); ok {
+		f.free()
+	}
+	k.material, k.subkey, k.state = nil, nil, nil
+}
+
+// freer is implemented by derived state that manages its own memory.
+type freer interface {
+	free()
+}
+
+// deriveFunc derives a tokenizer's state from the given key material.
+type deriveFunc func(material []byte) (interface{}, error)
+
+// keyProvider manages a tokenizer's key.  Tokenizers embed a key provider
+// instead of holding their own key.  Whenever the key is rotated, the key
+// provider obtains fresh key material from its key source and, if configured,
+// persists the key in a sealed key store, so that a restart doesn't start a
+// new epoch.  If a key escrow or key log is configured, each new key is
+// escrowed or logged before it's used.
+//
+// If a key overlap is configured, the previous key remains active for the
+// duration of the overlap, so inputs can be tokenized under both keys.  Once
+// the overlap is over, the previous key is zeroized.
+type keyProvider struct {
+	mu      sync.RWMutex
+	name    string
+	size    int
+	derive  deriveFunc
+	expiry  time.Duration
+	overlap time.Duration
+	align   bool
+	label   string
+	src     keySource
+	store   *keyStore
+	escrow  *keyEscrow
+	log     *keyLog
+	cur     *epochKey
+	prev    *epochKey
+	restore bool
+	// The metrics of our tokenizer's pipeline.  Tokenizers update them while
+	// holding a key, so they must not need our lock.
+	stats atomic.Pointer[pipelineMetrics]
+}
+
+// newKeyProvider returns a new key provider for the tokenizer with the given
+// name, which requires keys of the given size.  If the given derive function
+// isn't nil, the key provider calls it for each new key and keeps the result
+// alongside the key.
+func newKeyProvider(name string, size int, derive deriveFunc) *keyProvider {
+	k := &keyProvider{
+		name:    name,
+		size:    size,
+		derive:  derive,
+		restore: true,
+	}
+	k.stats.Store(metricsFor(pipelinePrimary))
+	return k
+}
+
+// setConfig sets the key provider's key source, key store, key escrow, key
+// log, key expiry, key overlap, context label, and whether epochs are aligned
+// to the clock.
+func (k *keyProvider) setConfig(c *config) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.label = c.contextLabel
+	k.src = c.keySource
+	k.store = c.keyStore
+	k.escrow = c.keyEscrow
+	k.log = c.keyLog
+	k.expiry = c.keyExpiry
+	k.overlap = c.keyOverlap
+	k.align = c.alignToClock
+	k.stats.Store(c.metrics())
+}
+
+// useMetrics makes our tokenizer report to the given metrics.
+func (k *keyProvider) useMetrics(p *pipelineMetrics) {
+	k.stats.Store(p)
+}
+
+// metrics returns the metrics of our tokenizer's pipeline.
+func (k *keyProvider) metrics() *pipelineMetrics {
+	return k.stats.Load()
+}
+
+// tokenized returns the counter of inputs that our tokenizer tokenized with
+// the given outcome.
+func (k *keyProvider) tokenized(result string) prometheus.Counter {
+	return k.stats.Load().tokenized(result)
+}
+
+// setKeySize sets the size of keys that the key provider creates from now on.
+// A stored key of a different size is rotated when it's reloaded.
+func (k *keyProvider) setKeySize(size int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.size = size
+}
+
+// keyID returns the ID of the current key.
+func (k *keyProvider) keyID() *keyID {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.cur == nil {
+		return keyIDFor(nil, k.label)
+	}
+	return k.cur.id
+}
+
+// activeKeyIDs returns the IDs of all active keys, starting with the current
+// key.  During a key overlap, the previous key's ID follows.
+func (k *keyProvider) activeKeyIDs() []*keyID {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	var ids []*keyID
+	for _, key := range []*epochKey{k.cur, k.prev} {
+		if key != nil {
+			ids = append(ids, key.id)
+		}
+	}
+	return ids
+}
+
+// keyEpoch returns the epoch of the active key with the given ID.
+func (k *keyProvider) keyEpoch(id *keyID) (epoch, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range []*epochKey{k.cur, k.prev} {
+		if key != nil && *key.id == *id {
+			return key.epoch(), true
+		}
+	}
+	return epoch{}, false
+}
+
+// acquireKey returns the active key with the given ID or, if the ID is nil,
+// the current key.  On success, the caller must call the returned function
+// once it's done using the key, which prevents the key from being zeroized
+// while it's in use.  The caller must not call other methods of the key
+// provider in the meantime.
+func (k *keyProvider) acquireKey(id *keyID) (*epochKey, func(), error) {
+	k.mu.RLock()
+	if k.cur == nil {
+		k.mu.RUnlock()
+		return nil, nil, errNoKey
+	}
+	for _, key := range []*epochKey{k.cur, k.prev} {
+		if key != nil && (id == nil || *key.id == *id) {
+			return key, k.mu.RUnlock, nil
+		}
+	}
+	k.mu.RUnlock()
+	return nil, nil, errInactiveKeyID
+}
+
+// resetKey rotates the key.
+func (k *keyProvider) resetKey() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.store != nil && k.restore {
+		k.restore = false
+		key, err := k.store.load(k.name)
+		if err == nil && key.wrapped != nil {
+			err = k.unwrap(key)
+		}
+		switch {
+		case err == nil && len(key.material) == k.size && !key.expired():
+			if err := k.install(key); err != nil {
+				return err
+			}
+			l.Printf("Reloaded %s key from key store; it expires at %s.", k.name, key.expires)
+			return nil
+		case err == nil:
+			l.Printf("Stored %s key expired at %s.  Rotating.", k.name, key.expires)
+		case !errors.Is(err, fs.ErrNotExist):
+			l.Printf("Failed to reload %s key from key store: %v", k.name, err)
+		}
+		// We're not going to use the stored key, so don't leave its material
+		// lying around on the heap.
+		if key != nil {
+			zeroize(key.material)
+		}
+	}
+
+	var (
+		material []byte
+		wrapped  *wrappedKey
+		err      error
+	)
+	if w, ok := k.src.(keyWrapper); ok {
+		material, wrapped, err = w.newWrappedKey(k.name, k.size)
+	} else {
+		material, err = newKey(k.src, k.name, k.size)
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	e := k.epochAt(now)
+	key := &epochKey{
+		material: material,
+		wrapped:  wrapped,
+		created:  now,
+		starts:   e.start,
+		expires:  e.end,
+	}
+	if err := k.prepare(key); err != nil {
+		return err
+	}
+	// Reloaded keys were escrowed, logged, and stored when they were
+	// created, but new keys must be escrowed, logged, and stored before we
+	// use them.  Otherwise, a restart could lose a key that we already
+	// tokenized data with.  We only escrow and log keys that we managed to
+	// prepare.  If we then fail to store the key, we discard it and keep
+	// using the current key, so the escrow and log may contain a key that we
+	// never used, but we never use a key that they don't contain.
+	if k.escrow != nil {
+		if err := k.escrow.deposit(k.name, k.label, key); err != nil {
+			key.free()
+			return fmt.Errorf("failed to escrow %s key: %w", k.name, err)
+		}
+	}
+	if k.log != nil {
+		if err := k.log.append(k.name, k.label, key); err != nil {
+			key.free()
+			return fmt.Errorf("failed to log %s key: %w", k.name, err)
+		}
+	}
+	if k.store != nil {
+		if err := k.store.save(k.name, key); err != nil {
+			key.free()
+			return fmt.Errorf("failed to store %s key: %w", k.name, err)
+		}
+	}
+	k.activate(key)
+	return nil
+}
+
+// unwrap asks our key source to unwrap the given key's wrapped form.  The
+// caller must hold the write lock.
+func (k *keyProvider) unwrap(key *epochKey) error {
+	w, ok := k.src.(keyWrapper)
+	if !ok {
+		return errNoKeyWrapper
+	}
+	material, err := w.unwrapKey(k.name, key.wrapped)
+	if err != nil {
+		return err
+	}
+	key.material = material
+	return nil
+}
+
+// useKey installs the given key material as the current key.  The key is
+// neither persisted nor does it expire.  This is useful for known-answer
+// tests.
+func (k *keyProvider) useKey(material []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now().UTC()
+	return k.install(&epochKey{
+		material: append([]byte{}, material...),
+		created:  now,
+		starts:   now,
+	})
+}
+
+// install prepares the given key and makes it the current key.  The caller
+// must hold the write lock.
+func (k *keyProvider) install(key *epochKey) error {
+	if err := k.prepare(key); err != nil {
+		return err
+	}
+	k.activate(key)
+	return nil
+}
+
+// prepare moves the given key's material into locked memory and derives the
+// key's subkey and state.  If that fails, the key's memory is freed.  The
+// caller must hold the write lock.
+func (k *keyProvider) prepare(key *epochKey) (err error) {
+	material, err := locked.copyOf(key.material)
+	zeroize(key.material)
+	if err != nil {
+		return err
+	}
+	key.material = material
+	defer func() {
+		if err != nil {
+			key.free()
+		}
+	}()
+	// Should a key get lost without being retired, e.g., because its
+	// tokenizer is no longer used, we still free its memory.
+	runtime.SetFinalizer(key, (*epochKey).free)
+
+	subkey, err := deriveSubkey(key.material, k.label)
+	if err != nil {
+		return err
+	}
+	key.subkey, err = locked.copyOf(subkey)
+	zeroize(subkey)
+	if err != nil {
+		return err
+	}
+	if k.derive != nil {
+		state, err := k.derive(key.subkey)
+		if err != nil {
+			return err
+		}
+		key.state = state
+	}
+	key.id = keyIDFor(key.subkey, k.label)
+	return nil
+}
+
+// activate makes the given prepared key the current key.  The previous
+// current key either remains active for the key overlap or is retired right
+// away.  The caller must hold the write lock.
+func (k *keyProvider) activate(key *epochKey) {
+	// There's at most one previous key, so a previous key whose overlap
+	// isn't over yet is retired early.
+	k.retire(k.prev)
+	k.prev = nil
+	if k.cur != nil && k.overlap > 0 {
+		prev := k.cur
+		k.prev = prev
+		time.AfterFunc(k.overlap, func() {
+			k.mu.Lock()
+			defer k.mu.Unlock()
+
+			if k.prev == prev {
+				k.retire(prev)
+				k.prev = nil
+				l.Printf("Key overlap is over.  Retired %s key %s.", k.name, prev.id)
+			}
+		})
+	} else {
+		k.retire(k.cur)
+	}
+	k.cur = key
+}
+
+// rederive derives the state of all active keys anew, which is necessary if
+// the state depends on configuration that has changed.
+func (k *keyProvider) rederive() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.derive == nil {
+		return nil
+	}
+	for _, key := range []*epochKey{k.cur, k.prev} {
+		if key == nil {
+			continue
+		}
+		state, err := k.derive(key.subkey)
+		if err != nil {
+			return err
+		}
+		if f, ok := key.state.(freer); ok {
+			f.free()
+		}
+		key.state = state
+	}
+	return nil
+}
+
+// retire zeroizes and frees the given key's material, subkey, and derived
+// state.  Derived state keeps its keys in locked memory and expands them for
+// each operation, so no key schedule outlives a key on Go's heap.  The caller
+// must hold the write lock.
+func (k *keyProvider) retire(key *epochKey) {
+	if key == nil {
+		return
+	}
+	key.free()
+}
+
+// epochAt returns the epoch of a key that's created at the given time.  Keys
+// of an epoch key source and keys whose epochs are aligned to the clock live
+// from one multiple of the key expiry (counting from the Unix epoch) to the
+// next.  Other keys live for the key expiry, starting at their creation.  The
+// caller must hold the lock.
+func (k *keyProvider) epochAt(created time.Time) epoch {
+	if e, ok := k.src.(*epochKeySource); ok {
+		next := e.nextEpoch()
+		return epoch{start: next.Add(-e.epochLen), end: next}
+	}
+	if k.expiry == 0 {
+		return epoch{start: created}
+	}
+	if k.align {
+		return alignedEpoch(created, k.expiry)
+	}
+	return epoch{start: created, end: created.Add(k.expiry)}
+}
+
+// zeroize overwrites the given byte slice with zeros.
+func zeroize(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// deriveSubkey derives a subkey from the given key material and context
+// label using HKDF-SHA256.  The subkey has the same size as the key material.
+// Tokens that were created using subkeys of different context labels cannot
+// be joined.  Without a context label, the subkey is a copy of the key
+// material.
+func deriveSubkey(material []byte, label string) ([]byte, error) {
+	if label == "" {
+		return append([]byte{}, material...), nil
+	}
+	subkey := make([]byte, len(material))
+	info := []byte(subkeyInfoPrefix + " " + label)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, material, nil, info), subkey); err != nil {
+		return nil, err
+	}
+	return subkey, nil
+}
+
+// keyIDOf returns the key ID of the given key material under the given
+// context label, i.e., the key ID that our key provider assigns the key.
+func keyIDOf(material []byte, label string) (*keyID, error) {
+	subkey, err := deriveSubkey(material, label)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroize(subkey)
+	return keyIDFor(subkey, label), nil
+}
+
+// keyIDFor returns the key ID of the given key material and context label.
+func keyIDFor(key []byte, label string) *keyID {
+	// A v5 UUID is supposed to hash the given name (in our case: the key)
+	// using SHA-1 but let's be extra careful and hash the key using SHA-256
+	// before handing it over to the uuid package.  The context label is
+	// length-prefixed, so a label cannot be confused with key material.
+	h := sha256.New()
+	if label != "" {
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(label))))
+		h.Write([]byte(label))
+	}
+	h.Write(key)
+	return &keyID{UUID: uuid.NewSHA1(uuidNamespace, h.Sum(nil))}
+}
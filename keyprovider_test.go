@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyProviderReload(t *testing.T) {
+	c := &config{
+		keyExpiry: time.Hour,
+		keyStore:  newTestKeyStore(t, t.TempDir()),
+	}
+
+	for name, newTokenizer := range map[string]func() tokenizer{
+		tokenizerHmac:      newHmacTokenizer,
+		tokenizerCryptoPAn: newCryptoPAnTokenizer,
+		tokenizerVerbatim:  newVerbatimTokenizer,
+	} {
+		// Simulate a restart by creating two tokenizers that share a key
+		// store.  The second one must pick up the first one's key.
+		t1, t2 := newTokenizer(), newTokenizer()
+		for _, tkzr := range []tokenizer{t1, t2} {
+			tkzr.(configurer).setConfig(c)
+			if err := tkzr.resetKey(); err != nil {
+				t.Fatalf("%s: Failed to reset key: %v", name, err)
+			}
+		}
+		if *t1.keyID() != *t2.keyID() {
+			t.Fatalf("%s: Expected identical key IDs but got %s and %s.",
+				name, t1.keyID(), t2.keyID())
+		}
+		e1, _ := t1.(epochTracker).keyEpoch(t1.keyID())
+		e2, _ := t2.(epochTracker).keyEpoch(t2.keyID())
+		assertEqual(t, e1, e2)
+
+		// Subsequent rotations must result in a new key.
+		if err := t2.resetKey(); err != nil {
+			t.Fatalf("%s: Failed to reset key: %v", name, err)
+		}
+		if *t1.keyID() == *t2.keyID() {
+			t.Fatalf("%s: Expected different key IDs after rotation.", name)
+		}
+	}
+}
+
+func TestKeyProviderExpiredKey(t *testing.T) {
+	s := newTestKeyStore(t, t.TempDir())
+	created := time.Now().Add(-2 * time.Hour)
+	expired := &epochKey{
+		material: make([]byte, hmacKeySize),
+		created:  created,
+		expires:  created.Add(time.Hour),
+	}
+	if err := s.save(tokenizerHmac, expired); err != nil {
+		t.Fatalf("Failed to save key: %v", err)
+	}
+
+	h := newHmacTokenizer()
+	h.(configurer).setConfig(&config{keyExpiry: time.Hour, keyStore: s})
+	if err := h.resetKey(); err != nil {
+		t.Fatalf("Failed to reset key: %v", err)
+	}
+	if *h.keyID() == *keyIDFor(expired.material, "") {
+		t.Fatal("Expected expired key to be rotated but it was reloaded.")
+	}
+
+	// The new key must have replaced the expired key in the key store.
+	stored, err := s.load(tokenizerHmac)
+	if err != nil {
+		t.Fatalf("Failed to load key: %v", err)
+	}
+	if *h.keyID() != *keyIDFor(stored.material, "") {
+		t.Fatal("Expected rotated key to be persisted in key store.")
+	}
+}
+
+func TestKeyProviderEpoch(t *testing.T) {
+	// Without a key expiry, keys don't expire on their own.
+	h := newHmacTokenizer()
+	_ = h.resetKey()
+	if ep, _ := h.(epochTracker).keyEpoch(h.keyID()); !ep.end.IsZero() {
+		t.Fatalf("Expected zero expiry but got %s.", ep.end)
+	}
+
+	// Epoch keys expire at the end of their epoch.
+	e := newTestEpochKeySource(t, time.Date(2024, 1, 1, 12, 45, 0, 0, time.UTC))
+	h = newHmacTokenizer()
+	h.(configurer).setConfig(&config{keyExpiry: time.Hour, keySource: e})
+	_ = h.resetKey()
+	ep, _ := h.(epochTracker).keyEpoch(h.keyID())
+	assertEqual(t, ep.start, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	assertEqual(t, ep.end, e.nextEpoch())
+
+	// Keys whose epochs are aligned to the clock begin and end at multiples
+	// of the key expiry.
+	h = newHmacTokenizer()
+	h.(configurer).setConfig(&config{keyExpiry: 24 * time.Hour, alignToClock: true})
+	_ = h.resetKey()
+	ep, _ = h.(epochTracker).keyEpoch(h.keyID())
+	midnight := time.Now().UTC().Truncate(24 * time.Hour)
+	assertEqual(t, ep.start, midnight)
+	assertEqual(t, ep.end, midnight.Add(24*time.Hour))
+
+	// We know nothing about inactive keys.
+	if _, ok := h.(epochTracker).keyEpoch(&keyID{}); ok {
+		t.Fatal("Expected no epoch for unknown key ID.")
+	}
+}
+
+func TestKeyProviderOverlap(t *testing.T) {
+	wiped := watchWipes(t)
+	h := newHmacTokenizer()
+	h.(configurer).setConfig(&config{keyOverlap: 50 * time.Millisecond})
+	_ = h.resetKey()
+	oldKeyID := h.keyID()
+	oldKey, release, err := h.(*hmacTokenizer).acquireKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to acquire key: %v", err)
+	}
+	oldMaterial, oldSubkey := oldKey.material, oldKey.subkey
+	release()
+	_ = h.resetKey()
+
+	// During the overlap, both keys must be active and result in different
+	// tokens.
+	ids := h.activeKeyIDs()
+	assertEqual(t, len(ids), 2)
+	assertEqual(t, *ids[0], *h.keyID())
+	assertEqual(t, *ids[1], *oldKeyID)
+	t1, err := h.tokenizeWithKeyID(value1, ids[0])
+	if err != nil {
+		t.Fatalf("Failed to tokenize using current key: %v", err)
+	}
+	t2, err := h.tokenizeWithKeyID(value1, ids[1])
+	if err != nil {
+		t.Fatalf("Failed to tokenize using previous key: %v", err)
+	}
+	if bytes.Equal(t1, t2) {
+		t.Fatal("Expected different tokens for different keys.")
+	}
+
+	// After the overlap, the previous key must be inactive and zeroized.
+	time.Sleep(100 * time.Millisecond)
+	assertEqual(t, len(h.activeKeyIDs()), 1)
+	if _, err := h.tokenizeWithKeyID(value1, oldKeyID); !errors.Is(err, errInactiveKeyID) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errInactiveKeyID, err)
+	}
+	if !wiped(oldMaterial) || !wiped(oldSubkey) {
+		t.Fatal("Expected previous key to be zeroized.")
+	}
+}
+
+func TestKeyProviderNoOverlap(t *testing.T) {
+	h := newHmacTokenizer()
+	_ = h.resetKey()
+	oldKeyID := h.keyID()
+	_ = h.resetKey()
+
+	ids := h.activeKeyIDs()
+	assertEqual(t, len(ids), 1)
+	if _, err := h.tokenizeWithKeyID(value1, oldKeyID); !errors.Is(err, errInactiveKeyID) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errInactiveKeyID, err)
+	}
+}
+
+func TestKeyProviderContextLabel(t *testing.T) {
+	e := newTestEpochKeySource(t, time.Date(2024, 1, 1, 12, 45, 0, 0, time.UTC))
+	newLabeledTokenizer := func(label string) tokenizer {
+		h := newHmacTokenizer()
+		h.(configurer).setConfig(&config{keySource: e, contextLabel: label})
+		if err := h.resetKey(); err != nil {
+			t.Fatalf("Failed to reset key: %v", err)
+		}
+		return h
+	}
+	h1 := newLabeledTokenizer(defaultContextLabel)
+	h2 := newLabeledTokenizer(defaultContextLabel)
+	h3 := newLabeledTokenizer("ADS/OTHER_SIGNAL")
+
+	t1, _ := h1.tokenize(value1)
+	t2, _ := h2.tokenize(value1)
+	t3, _ := h3.tokenize(value1)
+	if !bytes.Equal(t1, t2) || *h1.keyID() != *h2.keyID() {
+		t.Fatal("Expected identical tokens and key IDs for identical context labels.")
+	}
+	if bytes.Equal(t1, t3) || *h1.keyID() == *h3.keyID() {
+		t.Fatal("Expected different tokens and key IDs for different context labels.")
+	}
+
+	// The context label must be part of the key ID, even for identical key
+	// material.
+	key := make([]byte, hmacKeySize)
+	if *keyIDFor(key, "") == *keyIDFor(key, defaultContextLabel) {
+		t.Fatal("Expected context label to affect key ID.")
+	}
+}
+
+func TestKeyProviderDeriveFailure(t *testing.T) {
+	wiped := watchWipes(t)
+	path := filepath.Join(t.TempDir(), "keylog")
+	errDerive := errors.New("derive failed")
+	var subkey []byte
+	k := newKeyProvider("test", hmacKeySize, func(key []byte) (interface{}, error) {
+		subkey = key
+		return nil, errDerive
+	})
+	k.setConfig(&config{keyLog: newTestKeyLog(t, path)})
+
+	if err := k.resetKey(); !errors.Is(err, errDerive) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errDerive, err)
+	}
+	// The key we failed to install must be gone, and must not have been
+	// logged.
+	if !wiped(subkey) {
+		t.Fatal("Expected subkey of failed key to be wiped.")
+	}
+	if _, _, err := k.acquireKey(nil); !errors.Is(err, errNoKey) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errNoKey, err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected error '%v' but got '%v'.", fs.ErrNotExist, err)
+	}
+}
+
+// testWrappingKeySource implements a key source that "wraps" keys by
+// hex-encoding them.  It remembers the material of the keys it unwraps.
+type testWrappingKeySource struct {
+	unwrapped [][]byte
+}
+
+func (s *testWrappingKeySource) newKey(name string, size int) ([]byte, error) {
+	return newKey(nil, name, size)
+}
+
+func (s *testWrappingKeySource) newWrappedKey(name string, size int) ([]byte, *wrappedKey, error) {
+	material, err := s.newKey(name, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	return material, &wrappedKey{Ciphertext: hex.EncodeToString(material), Size: size}, nil
+}
+
+func (s *testWrappingKeySource) unwrapKey(name string, w *wrappedKey) ([]byte, error) {
+	material, err := hex.DecodeString(w.Ciphertext)
+	if err != nil {
+		return nil, errBadWrappedKey
+	}
+	s.unwrapped = append(s.unwrapped, material)
+	return material, nil
+}
+
+func TestKeyProviderWipesRejectedKey(t *testing.T) {
+	now := time.Now()
+	for name, stored := range map[string]*epochKey{
+		"expired": {
+			created: now.Add(-2 * time.Hour),
+			expires: now.Add(-time.Hour),
+			wrapped: &wrappedKey{
+				Ciphertext: hex.EncodeToString(bytes.Repeat([]byte{0x42}, hmacKeySize)),
+				Size:       hmacKeySize,
+			},
+		},
+		"wrong size": {
+			created: now,
+			expires: now.Add(time.Hour),
+			wrapped: &wrappedKey{
+				Ciphertext: hex.EncodeToString(bytes.Repeat([]byte{0x42}, hmacKeySize/2)),
+				Size:       hmacKeySize / 2,
+			},
+		},
+	} {
+		s := newTestKeyStore(t, t.TempDir())
+		if err := s.save(tokenizerHmac, stored); err != nil {
+			t.Fatalf("%s: Failed to save key: %v", name, err)
+		}
+		src := &testWrappingKeySource{}
+		h := newHmacTokenizer()
+		h.(configurer).setConfig(&config{keyExpiry: time.Hour, keyStore: s, keySource: src})
+		if err := h.resetKey(); err != nil {
+			t.Fatalf("%s: Failed to reset key: %v", name, err)
+		}
+		// The stored key must have been rejected and its material wiped.
+		if len(src.unwrapped) != 1 {
+			t.Fatalf("%s: Expected 1 unwrapped key but got %d.", name, len(src.unwrapped))
+		}
+		if !bytes.Equal(src.unwrapped[0], make([]byte, len(src.unwrapped[0]))) {
+			t.Fatalf("%s: Expected rejected key material to be wiped.", name)
+		}
+	}
+}
+
+func TestKeyProviderSaveFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	h := newHmacTokenizer()
+	h.(configurer).setConfig(&config{keyExpiry: time.Hour, keyStore: newTestKeyStore(t, dir)})
+	if err := h.resetKey(); err != nil {
+		t.Fatalf("Failed to reset key: %v", err)
+	}
+	id, regions := h.keyID(), liveRegions()
+
+	// If we cannot store the new key, we must keep using the current key,
+	// which is the one that a restart would reload, and free the new key.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("Failed to remove key store: %v", err)
+	}
+	if err := h.resetKey(); err == nil {
+		t.Fatal("Expected error but got none.")
+	}
+	if *h.keyID() != *id {
+		t.Fatalf("Expected key ID %s but got %s.", id, h.keyID())
+	}
+	if liveRegions() != regions {
+		t.Fatalf("Expected %d live regions but got %d.", regions, liveRegions())
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	envMasterSecret     = "MASTER_SECRET"
+	minMasterSecretSize = 32 // In bytes.
+	// hkdfInfoPrefix is the prefix of HKDF's info parameter, which separates
+	// our keys from keys that are derived from the same master secret by
+	// other applications.
+	hkdfInfoPrefix = "tkzr epoch key"
+)
+
+var (
+	errMasterSecretTooShort = fmt.Errorf("master secret must be at least %d bytes long", minMasterSecretSize)
+	errBadEpochLen          = errors.New("epoch length must be at least one second")
+)
+
+// keySource provides tokenizers with key material whenever they reset their
+// key.  The given name identifies the tokenizer.
+type keySource interface {
+	newKey(name string, size int) ([]byte, error)
+}
+
+// newKey returns a new key of the given size from the given key source.  If
+// the key source is nil, the key is drawn from crypto/rand.
+func newKey(src keySource, name string, size int) ([]byte, error) {
+	if src == nil {
+		src = randKeySource{}
+	}
+	return src.newKey(name, size)
+}
+
+// randKeySource implements a key source that draws keys from crypto/rand.
+// This is our default key source.
+type randKeySource struct{}
+
+func (r randKeySource) newKey(_ string, size int) ([]byte, error) {
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// epochKeySource implements a key source that derives keys from a master
+// secret and the current epoch number using HKDF-SHA256.  Epochs are aligned
+// to the Unix epoch, so all tkzr instances that share the master secret and
+// the epoch length agree on keys (and therefore key IDs) without talking to
+// each other.
+type epochKeySource struct {
+	master   []byte
+	epochLen time.Duration
+	now      func() time.Time
+}
+
+// newEpochKeySource returns a new epoch key source for the given master
+// secret and epoch length.
+func newEpochKeySource(master []byte, epochLen time.Duration) (*epochKeySource, error) {
+	if len(master) < minMasterSecretSize {
+		return nil, errMasterSecretTooShort
+	}
+	if epochLen < time.Second {
+		return nil, errBadEpochLen
+	}
+	return &epochKeySource{
+		master:   master,
+		epochLen: epochLen,
+		now:      time.Now,
+	}, nil
+}
+
+func (e *epochKeySource) newKey(name string, size int) ([]byte, error) {
+	return e.deriveKey(name, size, epochAt(e.now(), e.epochLen))
+}
+
+// deriveKey derives a key of the given size for the given tokenizer name and
+// epoch number.
+func (e *epochKeySource) deriveKey(name string, size int, epoch uint64) ([]byte, error) {
+	info := []byte(hkdfInfoPrefix + " " + name)
+	info = binary.BigEndian.AppendUint64(info, epoch)
+
+	key := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, e.master, nil, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// nextEpoch returns the time at which the next epoch begins, which is when
+// the keys of the current epoch expire.
+func (e *epochKeySource) nextEpoch() time.Time {
+	return epochStart(epochAt(e.now(), e.epochLen)+1, e.epochLen)
+}
+
+// epochAt returns the number of the epoch that the given time falls into.
+func epochAt(t time.Time, epochLen time.Duration) uint64 {
+	return uint64(t.Unix()) / uint64(epochLen/time.Second)
+}
+
+// alignedEpoch returns the epoch of the given length that the given time falls
+// into.  Epochs are aligned to the Unix epoch, so a length of 24 hours results
+// in epochs that begin at 00:00 UTC.
+func alignedEpoch(t time.Time, epochLen time.Duration) epoch {
+	start := epochStart(epochAt(t, epochLen), epochLen)
+	return epoch{start: start, end: start.Add(epochLen)}
+}
+
+// epochStart returns the time at which the given epoch begins.
+func epochStart(epoch uint64, epochLen time.Duration) time.Time {
+	return time.Unix(int64(epoch*uint64(epochLen/time.Second)), 0).UTC()
+}
+
+// loadMasterSecret loads our hex-encoded master secret from the given file or,
+// if no file is given, from an environment variable.
+func loadMasterSecret(path string) ([]byte, error) {
+	return loadHexSecret(path, envMasterSecret)
+}
+
+// loadHexSecret loads a hex-encoded secret from the given file or, if no file
+// is given, from the given environment variable.
+func loadHexSecret(path, envVar string) ([]byte, error) {
+	var rawSecret string
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		rawSecret = string(content)
+	} else {
+		var exists bool
+		rawSecret, exists = os.LookupEnv(envVar)
+		if !exists {
+			return nil, fmt.Errorf("%s: %w", envVar, errEnvVarUnset)
+		}
+	}
+	return hex.DecodeString(strings.TrimSpace(rawSecret))
+}
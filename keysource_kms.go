@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	envVaultToken = "VAULT_TOKEN"
+	// The default mount path of Vault's transit secrets engine and the
+	// default name of the transit key that wraps our data keys.
+	defaultKMSMount = "transit"
+	defaultKMSKey   = "tkzr"
+	// The size of the data keys that we request from the KMS, in bits.  We
+	// derive keys of whatever size our tokenizers need from them.
+	kmsDataKeyBits = 256
+	// kmsInfoPrefix is the prefix of HKDF's info parameter when deriving a
+	// tokenizer's key from a data key.
+	kmsInfoPrefix = "tkzr kms key"
+	kmsTimeout    = 10 * time.Second
+)
+
+var (
+	errBadCABundle   = errors.New("CA bundle contains no PEM-encoded certificates")
+	errKMSResponse   = errors.New("KMS returned an unexpected response")
+	errBadWrappedKey = errors.New("wrapped key is not a Vault transit ciphertext")
+)
+
+// keyWrapper is implemented by key sources whose keys come along with a
+// wrapped form that only the key source can unwrap.  Key providers persist
+// the wrapped form instead of the key.
+type keyWrapper interface {
+	newWrappedKey(name string, size int) ([]byte, *wrappedKey, error)
+	unwrapKey(name string, w *wrappedKey) ([]byte, error)
+}
+
+// wrappedKey represents the wrapped form of a key of the given size.
+type wrappedKey struct {
+	Ciphertext string `json:"ciphertext"`
+	Size       int    `json:"size"`
+}
+
+// kmsKeySource implements a key source that obtains keys from a KMS that
+// speaks the HashiCorp Vault transit API.  For each new key, the KMS generates
+// a data key and returns it in plain text and wrapped under a transit key
+// that never leaves the KMS.  We derive the tokenizer's key from the data key
+// and keep nothing but the wrapped data key, which anyone with access to the
+// transit key, e.g., another tkzr instance, can unwrap.  Each request shows
+// up in the KMS's audit log.
+type kmsKeySource struct {
+	addr   string
+	mount  string
+	key    string
+	token  string
+	rotate bool
+	client *http.Client
+}
+
+// vaultResponse represents the response of the Vault transit API's
+// endpoints.  Vault reports errors in the "errors" field.
+type vaultResponse struct {
+	Data struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// newKMSKeySource returns a new key source for the KMS at the given address,
+// e.g. "https://vault:8200", whose transit secrets engine is mounted at the
+// given path.  Data keys are wrapped under the given transit key.  We
+// authenticate using the given token and, if the given CA bundle isn't empty,
+// trust only the bundle's certificates.  If rotate is true, the transit key
+// is rotated before each new data key, so each epoch's key is wrapped under a
+// new version of the transit key.
+func newKMSKeySource(addr, mount, key, token string, caBundle []byte, rotate bool) (*kmsKeySource, error) {
+	if _, err := url.ParseRequestURI(addr); err != nil {
+		return nil, fmt.Errorf("failed to parse KMS address: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(caBundle) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, errBadCABundle
+		}
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+	return &kmsKeySource{
+		addr:   strings.TrimSuffix(addr, "/"),
+		mount:  strings.Trim(mount, "/"),
+		key:    key,
+		token:  token,
+		rotate: rotate,
+		client: &http.Client{Timeout: kmsTimeout, Transport: transport},
+	}, nil
+}
+
+func (k *kmsKeySource) newKey(name string, size int) ([]byte, error) {
+	key, _, err := k.newWrappedKey(name, size)
+	return key, err
+}
+
+// newWrappedKey returns a new key of the given size for the given tokenizer
+// name, along with the wrapped data key that the key is derived from.
+func (k *kmsKeySource) newWrappedKey(name string, size int) ([]byte, *wrappedKey, error) {
+	if k.rotate {
+		if err := k.rotateKey(); err != nil {
+			return nil, nil, fmt.Errorf("failed to rotate transit key: %w", err)
+		}
+	}
+	dataKey, ciphertext, err := k.generateDataKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	defer zeroize(dataKey)
+	key, err := deriveKMSKey(dataKey, name, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, &wrappedKey{Ciphertext: ciphertext, Size: size}, nil
+}
+
+// unwrapKey asks the KMS to unwrap the given data key and derives the given
+// tokenizer's key from it.
+func (k *kmsKeySource) unwrapKey(name string, w *wrappedKey) ([]byte, error) {
+	dataKey, err := k.decrypt(w.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	defer zeroize(dataKey)
+	return deriveKMSKey(dataKey, name, w.Size)
+}
+
+// generateDataKey asks the KMS for a new data key and returns it in plain text
+// and wrapped.
+func (k *kmsKeySource) generateDataKey() ([]byte, string, error) {
+	resp, err := k.post("datakey/plaintext/"+url.PathEscape(k.key), map[string]int{
+		"bits": kmsDataKeyBits,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil || len(dataKey) != kmsDataKeyBits/8 || resp.Data.Ciphertext == "" {
+		return nil, "", errKMSResponse
+	}
+	return dataKey, resp.Data.Ciphertext, nil
+}
+
+// decrypt asks the KMS to unwrap the given data key.
+func (k *kmsKeySource) decrypt(ciphertext string) ([]byte, error) {
+	if !strings.HasPrefix(ciphertext, "vault:") {
+		return nil, errBadWrappedKey
+	}
+	resp, err := k.post("decrypt/"+url.PathEscape(k.key), map[string]string{
+		"ciphertext": ciphertext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil || len(dataKey) != kmsDataKeyBits/8 {
+		return nil, errKMSResponse
+	}
+	return dataKey, nil
+}
+
+// rotateKey asks the KMS to rotate our transit key.  Data keys that were
+// wrapped under previous versions of the transit key can still be unwrapped,
+// unless the KMS was told otherwise.
+func (k *kmsKeySource) rotateKey() error {
+	_, err := k.post("keys/"+url.PathEscape(k.key)+"/rotate", nil)
+	return err
+}
+
+// post sends the given request body to the given path of our transit secrets
+// engine and returns the decoded response.  Note that Vault responds to
+// requests without response data, e.g., key rotation, with 204.
+func (k *kmsKeySource) post(path string, body interface{}) (*vaultResponse, error) {
+	var reqBody io.Reader = http.NoBody
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(http.MethodPost, k.addr+"/v1/"+k.mount+"/"+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", k.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var decoded vaultResponse
+	if resp.StatusCode == http.StatusNoContent {
+		return &decoded, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("%w: %w", errKMSResponse, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("KMS responded with %d: %s", resp.StatusCode, strings.Join(decoded.Errors, "; "))
+	}
+	return &decoded, nil
+}
+
+// deriveKMSKey derives a key of the given size for the given tokenizer name
+// from the given data key using HKDF-SHA256.  Tokenizers that share a data
+// key therefore don't share keys.
+func deriveKMSKey(dataKey []byte, name string, size int) ([]byte, error) {
+	key := make([]byte, size)
+	info := []byte(kmsInfoPrefix + " " + name)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dataKey, nil, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// loadVaultToken loads the KMS's token from the given file or, if no file is
+// given, from an environment variable.
+func loadVaultToken(path string) (string, error) {
+	if path == "" {
+		token, exists := os.LookupEnv(envVaultToken)
+		if !exists {
+			return "", fmt.Errorf("%s: %w", envVaultToken, errEnvVarUnset)
+		}
+		return token, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testVaultToken = "s.test-token"
+
+// stubVault implements the subset of the Vault transit API that we use.  It
+// "wraps" data keys by remembering them under a random ciphertext.
+type stubVault struct {
+	sync.Mutex
+	version  int
+	wrapped  map[string][]byte
+	requests map[string]int
+}
+
+func newStubVault() *stubVault {
+	return &stubVault{
+		version:  1,
+		wrapped:  make(map[string][]byte),
+		requests: make(map[string]int),
+	}
+}
+
+func (v *stubVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.Lock()
+	defer v.Unlock()
+
+	writeJSON := func(status int, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(body)
+	}
+	if r.Header.Get("X-Vault-Token") != testVaultToken {
+		writeJSON(http.StatusForbidden, map[string][]string{"errors": {"permission denied"}})
+		return
+	}
+	v.requests[r.URL.Path]++
+
+	switch r.URL.Path {
+	case "/v1/transit/datakey/plaintext/tkzr":
+		var req struct {
+			Bits int `json:"bits"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(http.StatusBadRequest, map[string][]string{"errors": {err.Error()}})
+			return
+		}
+		dataKey := make([]byte, req.Bits/8)
+		_, _ = rand.Read(dataKey)
+		nonce := make([]byte, 16)
+		_, _ = rand.Read(nonce)
+		ciphertext := fmt.Sprintf("vault:v%d:%s", v.version, base64.StdEncoding.EncodeToString(nonce))
+		v.wrapped[ciphertext] = dataKey
+		writeJSON(http.StatusOK, map[string]interface{}{"data": map[string]string{
+			"plaintext":  base64.StdEncoding.EncodeToString(dataKey),
+			"ciphertext": ciphertext,
+		}})
+	case "/v1/transit/decrypt/tkzr":
+		var req struct {
+			Ciphertext string `json:"ciphertext"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		dataKey, exists := v.wrapped[req.Ciphertext]
+		if !exists {
+			writeJSON(http.StatusBadRequest, map[string][]string{"errors": {"invalid ciphertext"}})
+			return
+		}
+		writeJSON(http.StatusOK, map[string]interface{}{"data": map[string]string{
+			"plaintext": base64.StdEncoding.EncodeToString(dataKey),
+		}})
+	case "/v1/transit/keys/tkzr/rotate":
+		v.version++
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(http.StatusNotFound, map[string][]string{"errors": {}})
+	}
+}
+
+func newTestKMS(t *testing.T, v *stubVault, rotate bool) *kmsKeySource {
+	t.Helper()
+	srv := httptest.NewServer(v)
+	t.Cleanup(srv.Close)
+	k, err := newKMSKeySource(srv.URL, defaultKMSMount, defaultKMSKey, testVaultToken, nil, rotate)
+	if err != nil {
+		t.Fatalf("Failed to create KMS key source: %v", err)
+	}
+	return k
+}
+
+func TestKMSWrapUnwrap(t *testing.T) {
+	k := newTestKMS(t, newStubVault(), false)
+
+	key, wrapped, err := k.newWrappedKey(tokenizerHmac, hmacKeySize)
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	assertEqual(t, len(key), hmacKeySize)
+	assertEqual(t, wrapped.Size, hmacKeySize)
+	if !strings.HasPrefix(wrapped.Ciphertext, "vault:v1:") {
+		t.Fatalf("Expected Vault ciphertext but got %q.", wrapped.Ciphertext)
+	}
+
+	unwrapped, err := k.unwrapKey(tokenizerHmac, wrapped)
+	if err != nil {
+		t.Fatalf("Failed to unwrap key: %v", err)
+	}
+	assertEqual(t, fmt.Sprintf("%x", unwrapped), fmt.Sprintf("%x", key))
+
+	// Another tokenizer derives a different key from the same data key.
+	other, err := k.unwrapKey(tokenizerCryptoPAn, wrapped)
+	if err != nil {
+		t.Fatalf("Failed to unwrap key: %v", err)
+	}
+	if fmt.Sprintf("%x", other) == fmt.Sprintf("%x", key) {
+		t.Fatal("Expected tokenizers to derive different keys.")
+	}
+
+	if _, err := k.unwrapKey(tokenizerHmac, &wrappedKey{Ciphertext: "garbage"}); !errors.Is(err, errBadWrappedKey) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadWrappedKey, err)
+	}
+}
+
+func TestKMSRotate(t *testing.T) {
+	v := newStubVault()
+	k := newTestKMS(t, v, true)
+
+	for i := 2; i <= 3; i++ {
+		_, wrapped, err := k.newWrappedKey(tokenizerHmac, hmacKeySize)
+		if err != nil {
+			t.Fatalf("Failed to create key: %v", err)
+		}
+		prefix := fmt.Sprintf("vault:v%d:", i)
+		if !strings.HasPrefix(wrapped.Ciphertext, prefix) {
+			t.Fatalf("Expected ciphertext with prefix %q but got %q.", prefix, wrapped.Ciphertext)
+		}
+	}
+	assertEqual(t, v.requests["/v1/transit/keys/tkzr/rotate"], 2)
+}
+
+func TestKMSBadToken(t *testing.T) {
+	k := newTestKMS(t, newStubVault(), false)
+	k.token = "s.wrong"
+
+	_, err := k.newKey(tokenizerHmac, hmacKeySize)
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("Expected permission error but got '%v'.", err)
+	}
+}
+
+func TestKMSCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(newStubVault())
+	defer srv.Close()
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	k, err := newKMSKeySource(srv.URL, defaultKMSMount, defaultKMSKey, testVaultToken, caBundle, false)
+	if err != nil {
+		t.Fatalf("Failed to create KMS key source: %v", err)
+	}
+	if _, err := k.newKey(tokenizerHmac, hmacKeySize); err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+
+	// Without the CA bundle, we don't trust the KMS's certificate.
+	k, err = newKMSKeySource(srv.URL, defaultKMSMount, defaultKMSKey, testVaultToken, nil, false)
+	if err != nil {
+		t.Fatalf("Failed to create KMS key source: %v", err)
+	}
+	if _, err := k.newKey(tokenizerHmac, hmacKeySize); err == nil {
+		t.Fatal("Expected untrusted certificate to be rejected.")
+	}
+
+	if _, err := newKMSKeySource(srv.URL, defaultKMSMount, defaultKMSKey, testVaultToken, []byte("foo"), false); !errors.Is(err, errBadCABundle) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadCABundle, err)
+	}
+}
+
+func TestKeyProviderWrappedKeys(t *testing.T) {
+	v := newStubVault()
+	dir := t.TempDir()
+	s, err := newKeyStore(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to create key store: %v", err)
+	}
+	c := &config{
+		keyExpiry: time.Hour,
+		keySource: newTestKMS(t, v, false),
+		keyStore:  s,
+	}
+
+	// Simulate a restart.  The second tokenizer must unwrap the first one's
+	// key.
+	t1, t2 := newHmacTokenizer(), newHmacTokenizer()
+	for _, tkzr := range []tokenizer{t1, t2} {
+		tkzr.(configurer).setConfig(c)
+		if err := tkzr.resetKey(); err != nil {
+			t.Fatalf("Failed to reset key: %v", err)
+		}
+	}
+	assertEqual(t, *t1.keyID(), *t2.keyID())
+	assertEqual(t, v.requests["/v1/transit/datakey/plaintext/tkzr"], 1)
+	assertEqual(t, v.requests["/v1/transit/decrypt/tkzr"], 1)
+
+	// The key store must contain nothing but the wrapped key.
+	raw, err := os.ReadFile(filepath.Join(dir, tokenizerHmac+keyStoreFileExt))
+	if err != nil {
+		t.Fatalf("Failed to read key file: %v", err)
+	}
+	var stored storedKey
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		t.Fatalf("Failed to decode key file: %v", err)
+	}
+	if stored.Key != nil || stored.Wrapped == nil {
+		t.Fatal("Expected key file to contain wrapped key only.")
+	}
+
+	// A key store without secret refuses unwrapped keys.
+	if err := s.save(tokenizerHmac, &epochKey{material: make([]byte, hmacKeySize)}); !errors.Is(err, errUnwrappedKey) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errUnwrappedKey, err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testMasterSecret = bytes.Repeat([]byte{0x42}, minMasterSecretSize)
+
+func newTestEpochKeySource(t *testing.T, now time.Time) *epochKeySource {
+	t.Helper()
+	e, err := newEpochKeySource(testMasterSecret, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create epoch key source: %v", err)
+	}
+	e.now = func() time.Time { return now }
+	return e
+}
+
+func TestEpochKeySource(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+	e1 := newTestEpochKeySource(t, now)
+	e2 := newTestEpochKeySource(t, now.Add(29*time.Minute))
+
+	// Two key sources must agree on keys within the same epoch.
+	k1, _ := e1.newKey(tokenizerHmac, hmacKeySize)
+	k2, _ := e2.newKey(tokenizerHmac, hmacKeySize)
+	if !bytes.Equal(k1, k2) {
+		t.Fatal("Expected identical keys within the same epoch.")
+	}
+
+	// Keys must differ across tokenizers.
+	k3, _ := e1.newKey(tokenizerCryptoPAn, hmacKeySize)
+	if bytes.Equal(k1, k3) {
+		t.Fatal("Expected different keys for different tokenizers.")
+	}
+
+	// Keys must differ across epochs.
+	e3 := newTestEpochKeySource(t, now.Add(30*time.Minute))
+	k4, _ := e3.newKey(tokenizerHmac, hmacKeySize)
+	if bytes.Equal(k1, k4) {
+		t.Fatal("Expected different keys for different epochs.")
+	}
+}
+
+func TestEpochKeySourceTokenizers(t *testing.T) {
+	// Two tokenizers (think: two replicas) that share a master secret must
+	// agree on key IDs and tokens.
+	e := newTestEpochKeySource(t, time.Now())
+	for name, newTokenizer := range ourTokenizers {
+		t1, t2 := newTokenizer(), newTokenizer()
+		for _, tkzr := range []tokenizer{t1, t2} {
+			tkzr.(configurer).setConfig(&config{keySource: e})
+			if err := tkzr.resetKey(); err != nil {
+				t.Fatalf("%s: Failed to reset key: %v", name, err)
+			}
+		}
+		if *t1.keyID() != *t2.keyID() {
+			t.Fatalf("%s: Expected identical key IDs but got %s and %s.",
+				name, t1.keyID(), t2.keyID())
+		}
+	}
+}
+
+func TestNextEpoch(t *testing.T) {
+	e := newTestEpochKeySource(t, time.Date(2024, 1, 1, 12, 45, 0, 0, time.UTC))
+	assertEqual(t, e.nextEpoch(), time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC))
+	assertEqual(t,
+		epochStart(epochAt(e.now(), e.epochLen), e.epochLen),
+		time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+	)
+}
+
+func TestNewEpochKeySource(t *testing.T) {
+	if _, err := newEpochKeySource([]byte("short"), time.Hour); !errors.Is(err, errMasterSecretTooShort) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errMasterSecretTooShort, err)
+	}
+	if _, err := newEpochKeySource(testMasterSecret, time.Millisecond); !errors.Is(err, errBadEpochLen) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadEpochLen, err)
+	}
+}
+
+func TestLoadMasterSecret(t *testing.T) {
+	t.Setenv(envMasterSecret, "00ff")
+	secret, err := loadMasterSecret("")
+	if err != nil {
+		t.Fatalf("Failed to load master secret: %v", err)
+	}
+	assertEqual(t, len(secret), 2)
+
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("0102ff\n"), 0600); err != nil {
+		t.Fatalf("Failed to write master secret: %v", err)
+	}
+	secret, err = loadMasterSecret(path)
+	if err != nil {
+		t.Fatalf("Failed to load master secret: %v", err)
+	}
+	assertEqual(t, len(secret), 3)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	envKeyStoreSecret = "KEY_STORE_SECRET"
+	keyStoreSecretLen = 32 // In bytes, for AES-256-GCM.
+	keyStoreFileExt   = ".key"
+)
+
+var (
+	errBadKeyStoreSecret = fmt.Errorf("key store secret must be %d bytes long", keyStoreSecretLen)
+	errKeyStoreCorrupt   = errors.New("key store file is corrupt or was sealed with another secret")
+	errUnwrappedKey      = errors.New("key store without secret accepts wrapped keys only")
+)
+
+// storedKey represents a key as it's serialized in the key store.
+type storedKey struct {
+	Key     []byte      `json:"key,omitempty"`
+	Wrapped *wrappedKey `json:"wrapped,omitempty"`
+	Created time.Time   `json:"created"`
+	Starts  time.Time   `json:"starts"`
+	Expires time.Time   `json:"expires"`
+}
+
+// keyStore implements a sealed on-disk key store.  Each tokenizer's current
+// key is stored in its own file, which is encrypted and authenticated using
+// AES-256-GCM.  The tokenizer's name is used as associated data, so a key
+// file cannot be swapped for another tokenizer's key file.
+//
+// Keys whose key source wraps them are stored in their wrapped form only.  A
+// key store without a secret stores nothing else, in plain text, because only
+// the key source can unwrap its keys.
+type keyStore struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+// newKeyStore returns a new key store that keeps its files in the given
+// directory and seals them using the given secret.  If the secret is nil, the
+// key store accepts wrapped keys only and doesn't seal them.
+func newKeyStore(dir string, secret []byte) (*keyStore, error) {
+	if secret == nil {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		return &keyStore{dir: dir}, nil
+	}
+	if len(secret) != keyStoreSecretLen {
+		return nil, errBadKeyStoreSecret
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &keyStore{dir: dir, aead: aead}, nil
+}
+
+// pathFor returns the path of the given tokenizer's key file.
+func (s *keyStore) pathFor(name string) string {
+	return filepath.Join(s.dir, name+keyStoreFileExt)
+}
+
+// save seals the given key and writes it to the given tokenizer's key file.
+func (s *keyStore) save(name string, k *epochKey) error {
+	stored := &storedKey{
+		Wrapped: k.wrapped,
+		Created: k.created,
+		Starts:  k.starts,
+		Expires: k.expires,
+	}
+	if k.wrapped == nil {
+		if s.aead == nil {
+			return errUnwrappedKey
+		}
+		stored.Key = k.material
+	}
+	plaintext, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	defer zeroize(plaintext)
+	if s.aead == nil {
+		return writeFileAtomically(s.dir, name+keyStoreFileExt, plaintext)
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := s.aead.Seal(nonce, nonce, plaintext, []byte(name))
+	return writeFileAtomically(s.dir, name+keyStoreFileExt, sealed)
+}
+
+// load reads and unseals the given tokenizer's key file.  If the file doesn't
+// exist, the returned error wraps fs.ErrNotExist.
+func (s *keyStore) load(name string) (*epochKey, error) {
+	sealed, err := os.ReadFile(s.pathFor(name))
+	if err != nil {
+		return nil, err
+	}
+	plaintext := sealed
+	if s.aead != nil {
+		nonceSize := s.aead.NonceSize()
+		if len(sealed) < nonceSize {
+			return nil, errKeyStoreCorrupt
+		}
+		plaintext, err = s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(name))
+		if err != nil {
+			return nil, errKeyStoreCorrupt
+		}
+	}
+	defer zeroize(plaintext)
+	var k storedKey
+	if err := json.Unmarshal(plaintext, &k); err != nil {
+		return nil, errKeyStoreCorrupt
+	}
+	if s.aead == nil && k.Wrapped == nil {
+		zeroize(k.Key)
+		return nil, errUnwrappedKey
+	}
+	return &epochKey{
+		material: k.Key,
+		wrapped:  k.Wrapped,
+		created:  k.Created,
+		starts:   k.Starts,
+		expires:  k.Expires,
+	}, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+	"time"
+)
+
+var testKeyStoreSecret = bytes.Repeat([]byte{0x23}, keyStoreSecretLen)
+
+func newTestKeyStore(t *testing.T, dir string) *keyStore {
+	t.Helper()
+	s, err := newKeyStore(dir, testKeyStoreSecret)
+	if err != nil {
+		t.Fatalf("Failed to create key store: %v", err)
+	}
+	return s
+}
+
+func TestKeyStoreRoundTrip(t *testing.T) {
+	s := newTestKeyStore(t, t.TempDir())
+	now := time.Now().UTC().Truncate(time.Second)
+	k := &epochKey{
+		material: []byte("0123456789abcdefghij"),
+		created:  now,
+		expires:  now.Add(time.Hour),
+	}
+	if err := s.save(tokenizerHmac, k); err != nil {
+		t.Fatalf("Failed to save key: %v", err)
+	}
+	loaded, err := s.load(tokenizerHmac)
+	if err != nil {
+		t.Fatalf("Failed to load key: %v", err)
+	}
+	if !bytes.Equal(loaded.material, k.material) {
+		t.Fatal("Expected loaded key material to equal saved key material.")
+	}
+	assertEqual(t, loaded.created, k.created)
+	assertEqual(t, loaded.expires, k.expires)
+
+	// The key file must not contain the key in plaintext.
+	sealed, err := os.ReadFile(s.pathFor(tokenizerHmac))
+	if err != nil {
+		t.Fatalf("Failed to read key file: %v", err)
+	}
+	if bytes.Contains(sealed, k.material) {
+		t.Fatal("Expected key file to be sealed but it contains the key.")
+	}
+}
+
+func TestKeyStoreErrors(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestKeyStore(t, dir)
+
+	if _, err := s.load(tokenizerHmac); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected error '%v' but got '%v'.", fs.ErrNotExist, err)
+	}
+
+	k := &epochKey{material: []byte("foo"), created: time.Now()}
+	if err := s.save(tokenizerHmac, k); err != nil {
+		t.Fatalf("Failed to save key: %v", err)
+	}
+
+	// A key store with a different secret must not be able to unseal the key.
+	other, err := newKeyStore(dir, bytes.Repeat([]byte{0x24}, keyStoreSecretLen))
+	if err != nil {
+		t.Fatalf("Failed to create key store: %v", err)
+	}
+	if _, err := other.load(tokenizerHmac); !errors.Is(err, errKeyStoreCorrupt) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errKeyStoreCorrupt, err)
+	}
+
+	// A key file must not be usable for another tokenizer.
+	if err := os.Rename(s.pathFor(tokenizerHmac), s.pathFor(tokenizerCryptoPAn)); err != nil {
+		t.Fatalf("Failed to rename key file: %v", err)
+	}
+	if _, err := s.load(tokenizerCryptoPAn); !errors.Is(err, errKeyStoreCorrupt) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errKeyStoreCorrupt, err)
+	}
+
+	if _, err := newKeyStore(dir, []byte("short")); !errors.Is(err, errBadKeyStoreSecret) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadKeyStoreSecret, err)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"testing"
+)
+
+func TestKiasuBCWithoutTweak(t *testing.T) {
+	// With an all-zero tweak, KIASU-BC must be identical to AES-128.
+	key := []byte("0123456789abcdef")
+	pt := []byte("fedcba9876543210")
+	tweak := make([]byte, kiasuTweakSize)
+
+	k, err := newKiasuBC(key)
+	if err != nil {
+		t.Fatalf("Failed to create KIASU-BC: %v", err)
+	}
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("Failed to create AES cipher: %v", err)
+	}
+
+	ct1, ct2 := make([]byte, aes.BlockSize), make([]byte, aes.BlockSize)
+	k.encrypt(ct1, pt, tweak)
+	c.Encrypt(ct2, pt)
+	if !bytes.Equal(ct1, ct2) {
+		t.Fatalf("Expected ciphertext %x but got %x.", ct2, ct1)
+	}
+}
+
+func TestKiasuBCBadKeySize(t *testing.T) {
+	if _, err := newKiasuBC([]byte{1, 2, 3}); err != errBadKiasuKeySize {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadKiasuKeySize, err)
+	}
+}
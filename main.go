@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
@@ -15,9 +17,20 @@ import (
 )
 
 const (
-	tokenizerCryptoPAn = "cryptopan"
-	tokenizerHmac      = "hmac"
-	tokenizerVerbatim  = "verbatim"
+	tokenizerCryptoPAn  = "cryptopan"
+	tokenizerHmac       = "hmac"
+	tokenizerVerbatim   = "verbatim"
+	tokenizerIPCryptDet = "ipcrypt-deterministic"
+	tokenizerIPCryptPfx = "ipcrypt-pfx"
+	tokenizerIPCryptND  = "ipcrypt-nd"
+	tokenizerIPCryptNDX = "ipcrypt-ndx"
+	tokenizerSIV        = "siv"
+	tokenizerFF1        = "ff1"
+	tokenizerCLK        = "clk"
+	tokenizerOPRF       = "oprf"
+	tokenizerEmail      = "email"
+	tokenizerPhone      = "phone"
+	tokenizerMAC        = "mac"
 
 	forwarderStdout = "stdout"
 	forwarderKafka  = "kafka"
@@ -27,11 +40,19 @@ const (
 
 	aggregatorSimple = "simple"
 	aggregatorAddr   = "address"
+	aggregatorRecord = "record"
+
+	subcommandDetokenize = "detokenize"
+	subcommandEscrow     = "escrow"
+	subcommandKeyLog     = "keylog"
 
 	defaultTokenizer  = tokenizerHmac
 	defaultForwarder  = forwarderStdout
 	defaultReceiver   = receiverStdin
 	defaultAggregator = aggregatorSimple
+	// By default, our context label reflects the signal that the address
+	// aggregator reports.
+	defaultContextLabel = schemaService + "/" + schemaSignal
 )
 
 var (
@@ -46,33 +67,87 @@ var (
 	ourAggregators = map[string]func() aggregator{
 		aggregatorSimple: newSimpleAggregator,
 		aggregatorAddr:   newAddrAggregator,
+		aggregatorRecord: newRecordAggregator,
 	}
 	ourForwarders = map[string]func() forwarder{
 		forwarderStdout: newStdoutForwarder,
 		forwarderKafka:  newKafkaForwarder,
 	}
 	ourTokenizers = map[string]func() tokenizer{
-		tokenizerHmac:      newHmacTokenizer,
-		tokenizerCryptoPAn: newCryptoPAnTokenizer,
-		tokenizerVerbatim:  newVerbatimTokenizer,
+		tokenizerHmac:       newHmacTokenizer,
+		tokenizerCryptoPAn:  newCryptoPAnTokenizer,
+		tokenizerVerbatim:   newVerbatimTokenizer,
+		tokenizerIPCryptDet: newIPCryptDeterministicTokenizer,
+		tokenizerIPCryptPfx: newIPCryptPfxTokenizer,
+		tokenizerIPCryptND:  newIPCryptNDTokenizer,
+		tokenizerIPCryptNDX: newIPCryptNDXTokenizer,
+		tokenizerSIV:        newSIVTokenizer,
+		tokenizerFF1:        newFF1Tokenizer,
+		tokenizerCLK:        newCLKTokenizer,
+		tokenizerOPRF:       newOPRFTokenizer,
+		tokenizerEmail:      newEmailTokenizer,
+		tokenizerPhone:      newPhoneTokenizer,
+		tokenizerMAC:        newMACTokenizer,
+	}
+	ourSubcommands = map[string]func(string, []string) error{
+		subcommandDetokenize: runDetokenize,
+		subcommandEscrow:     runEscrow,
+		subcommandKeyLog:     runKeyLog,
 	}
 	m = metrics{}
 )
 
 func bootstrap(c *config, comp *components, done chan empty) {
+	// Before we touch any data, make sure that our tokenizers compute what
+	// they claim.  If they don't, we refuse to start but keep running, so the
+	// failure remains visible via our metrics.
+	if err := runKnownAnswerTests(); err != nil {
+		l.Printf("Refusing to start because known-answer tests failed: %v", err)
+		<-done
+		return
+	}
+
 	// Propagate our configuration to all components.
 	comp.a.setConfig(c)
 	comp.r.setConfig(c)
 	comp.f.setConfig(c)
+	// Only some tokenizers are configurable.
+	if t, ok := comp.t.(configurer); ok {
+		t.setConfig(c)
+	}
 
 	// Tell the aggregator what tokenizer to use.
 	comp.a.use(comp.t)
+	// Some receivers let clients use the tokenizer directly.
+	if r, ok := comp.r.(tokenizerUser); ok {
+		r.use(comp.t)
+	}
+	// The shadow pipeline, if any, starts first because it must see all
+	// input.  If it fails to start, we carry on without it.
+	inbox := comp.r.inbox()
+	if comp.shadow != nil {
+		if err := comp.shadow.start(); err != nil {
+			l.Printf("Not running shadow tokenizer because production key check failed: %v", err)
+		} else {
+			defer comp.shadow.stop()
+			inbox = comp.shadow.tee(inbox)
+		}
+	}
 	// Tell the aggregator where to get data and where to send it to.
-	comp.a.connect(comp.r.inbox(), comp.f.outbox())
+	comp.a.connect(inbox, comp.f.outbox())
 
 	// Start all components.
 	comp.a.start()
 	defer comp.a.stop()
+	// The aggregator has set the tokenizer's production key by now.  A chain's
+	// transforms may reject our probe, so we check the chain's tokenizer.
+	err := checkProductionKey(keyedStage(comp.t), c)
+	reportSelfTest(c.tokenizerName, selfTestProduction, err)
+	if err != nil {
+		l.Printf("Refusing to start because production key check failed: %v", err)
+		<-done
+		return
+	}
 	comp.r.start()
 	defer comp.r.stop()
 	comp.f.start()
@@ -84,9 +159,18 @@ func bootstrap(c *config, comp *components, done chan empty) {
 
 func parseFlags(progname string, args []string) (*components, *config, error) {
 	var err error
-	var exposePrometheus bool
+	var exposePrometheus, exposeAdmin, epochKeys, alignToClock, envelopeTokens, kmsRotate bool
 	var tokenizer, forwarder, aggregator, receiver string
-	var rawFwdInterval, rawKeyExpiry, port, prometheusPort int
+	var shadowTokenizer, shadowForwarder, shadowKafkaTopic string
+	var ff1Alphabet, ff1Tweak, ipv4Prefixes, ipv6Prefixes, masterSecretFile string
+	var keyStoreDir, keyStoreSecretFile, contextLabel, addrPolicy, fieldPolicyFile string
+	var escrowCustodiansFile, escrowDir, keyLogFile, keyLogSigningKeyFile string
+	var kmsAddr, kmsMount, kmsKey, kmsTokenFile, kmsCAFile string
+	var adminCertFile, adminKeyFile, adminClientCAFile string
+	var rawFwdInterval, rawKeyExpiry, rawKeyOverlap, port, prometheusPort, adminPort int
+	var sivRetainedKeys, hmacKeyLen, hmacBits, escrowThreshold int
+	var hmacFamily, emailDomainMode string
+	var clkQ, clkK, clkM int
 
 	fs := flag.NewFlagSet(progname, flag.ContinueOnError)
 
@@ -94,16 +178,98 @@ func parseFlags(progname string, args []string) (*components, *config, error) {
 		"Expose Prometheus metrics.")
 	fs.IntVar(&prometheusPort, "prometheus-port", 9090,
 		"Make Prometheus metrics available at http://0.0.0.0:<port>/metrics.")
+	fs.BoolVar(&exposeAdmin, "expose-admin", false,
+		fmt.Sprintf("Expose the admin API.  Requires the environment variable %s unless -admin-client-ca-file is set.", envAdminToken))
+	fs.IntVar(&adminPort, "admin-port", 8081,
+		"Make the admin API available at http://0.0.0.0:<port>/admin/.")
+	fs.StringVar(&adminCertFile, "admin-tls-cert-file", "",
+		fmt.Sprintf("File containing the admin API's PEM-encoded certificate chain.  If set, the admin API speaks HTTPS and offers detokenization, which requires the environment variable %s or a client certificate.", envDetokenizeToken))
+	fs.StringVar(&adminKeyFile, "admin-tls-key-file", "",
+		"File containing the private key of the admin API's certificate.")
+	fs.StringVar(&adminClientCAFile, "admin-client-ca-file", "",
+		"File containing the PEM-encoded CA certificates that authenticate admin API clients via mutual TLS.")
+	fs.IntVar(&sivRetainedKeys, "siv-retained-keys", 0,
+		"Number of previous keys that the AES-SIV tokenizer retains for detokenization.")
+	fs.StringVar(&ff1Alphabet, "ff1-alphabet", defaultFF1Alphabet,
+		"The alphabet of the FF1 tokenizer's input and output.")
+	fs.StringVar(&ff1Tweak, "ff1-tweak", "",
+		"The hex-encoded tweak of the FF1 tokenizer.")
+	fs.StringVar(&hmacFamily, "hmac-family", defaultHmacFamily,
+		fmt.Sprintf("The keyed-hash family of the HMAC tokenizer: %s.", hmacFamilyList()))
+	fs.IntVar(&hmacKeyLen, "hmac-key-size", hmacKeySize,
+		"The key size of the HMAC tokenizer in bytes.")
+	fs.IntVar(&hmacBits, "hmac-bits", hmacOutputBits,
+		"Truncate the HMAC tokenizer's tokens to the given number of bits.  Shorter tokens deliberately collide.")
+	fs.IntVar(&clkQ, "clk-q", defaultCLKQ,
+		"The number of symbols per q-gram of the CLK tokenizer.")
+	fs.IntVar(&clkK, "clk-k", defaultCLKK,
+		"The number of hash functions of the CLK tokenizer.")
+	fs.IntVar(&clkM, "clk-m", defaultCLKM,
+		"The length in bits of the CLK tokenizer's Bloom filters.")
+	fs.StringVar(&emailDomainMode, "email-domain", defaultEmailDomainMode,
+		"Whether the email tokenizer keeps or tokenizes domains: \"keep\" or \"tokenize\".")
+	fs.StringVar(&ipv4Prefixes, "ipv4-prefixes", "",
+		"Comma-separated list of prefix lengths that IPv4 addresses are masked to before tokenization, e.g. \"32,24\".")
+	fs.StringVar(&ipv6Prefixes, "ipv6-prefixes", "",
+		"Comma-separated list of prefix lengths that IPv6 addresses are masked to before tokenization, e.g. \"64,48\".")
+	fs.StringVar(&fieldPolicyFile, "field-policy", "",
+		"File containing the record aggregator's field policy, one rule per line, e.g. \"$.client.ip: cryptopan\".")
+	fs.StringVar(&addrPolicy, "embedded-ipv4-policy", defaultAddrPolicy.String(),
+		fmt.Sprintf("How to treat IPv4-mapped, 6to4, and Teredo addresses: %s.", addrPolicyList()))
+	fs.BoolVar(&epochKeys, "epoch-keys", false,
+		"Derive keys from a master secret and the current epoch, whose length is the key expiry.")
+	fs.StringVar(&masterSecretFile, "master-secret-file", "",
+		fmt.Sprintf("File containing the hex-encoded master secret.  If unset, the secret is read from %s.", envMasterSecret))
+	fs.StringVar(&kmsAddr, "kms-addr", "",
+		"Obtain keys from the KMS at the given address, e.g. \"https://vault:8200\", which must speak the Vault transit API.")
+	fs.StringVar(&kmsMount, "kms-mount", defaultKMSMount,
+		"The mount path of the KMS's transit secrets engine.")
+	fs.StringVar(&kmsKey, "kms-key", defaultKMSKey,
+		"The name of the KMS's transit key that wraps our data keys.")
+	fs.StringVar(&kmsTokenFile, "kms-token-file", "",
+		fmt.Sprintf("File containing the KMS's token.  If unset, the token is read from %s.", envVaultToken))
+	fs.StringVar(&kmsCAFile, "kms-ca-file", "",
+		"File containing the PEM-encoded CA certificates that the KMS's certificate must chain to.  If unset, the system's CAs are used.")
+	fs.BoolVar(&kmsRotate, "kms-rotate", false,
+		"Rotate the KMS's transit key before each new data key.")
+	fs.StringVar(&keyStoreDir, "key-store-dir", "",
+		"Persist keys in a sealed key store in the given directory, so they survive restarts.")
+	fs.StringVar(&keyStoreSecretFile, "key-store-secret-file", "",
+		fmt.Sprintf("File containing the hex-encoded secret that seals the key store.  If unset, the secret is read from %s.", envKeyStoreSecret))
+	fs.StringVar(&escrowCustodiansFile, "escrow-custodians", "",
+		"Escrow each new key to the custodians whose hex-encoded X25519 public keys are in the given file, one per line.")
+	fs.IntVar(&escrowThreshold, "escrow-threshold", defaultEscrowThreshold,
+		"The number of custodians who must cooperate to reconstruct an escrowed key.")
+	fs.StringVar(&escrowDir, "escrow-dir", "",
+		"Write escrow bundles to the given directory.  If unset, escrow bundles are logged.")
+	fs.StringVar(&keyLogFile, "key-log-file", "",
+		"Append each new key to the signed key log in the given file, which the Web receiver serves.")
+	fs.StringVar(&keyLogSigningKeyFile, "key-log-signing-key-file", "",
+		fmt.Sprintf("File containing the hex-encoded Ed25519 seed that signs the key log.  If unset, the seed is read from %s.", envKeyLogSigningKey))
 	fs.IntVar(&rawFwdInterval, "forward-interval", 60*5,
 		"Number of seconds after which data is forwarded to backend.")
 	fs.IntVar(&rawKeyExpiry, "key-expiry", 60*60*24*30*6,
 		"Number of seconds after which keys are rotated.")
+	fs.StringVar(&contextLabel, "context-label", defaultContextLabel,
+		"Label of the pipeline's purpose.  Tokenizers derive subkeys from it, so tokens of different purposes cannot be joined.")
+	fs.BoolVar(&envelopeTokens, "envelope-tokens", false,
+		"Wrap the address aggregator's tokens in self-describing envelopes of the form tk1.<alg>.<keyid-prefix>.<payload>.")
+	fs.BoolVar(&alignToClock, "align-to-clock", false,
+		"Rotate keys and forward data at multiples of -key-expiry and -forward-interval since 00:00 UTC, e.g., daily at midnight and on the hour.")
+	fs.IntVar(&rawKeyOverlap, "key-overlap", 0,
+		"Number of seconds for which the previous key remains active after a rotation.  Inputs are tokenized under both keys in the meantime.")
 	fs.IntVar(&port, "port", 8080,
 		"Port the Web receiver should listen on.")
 	fs.StringVar(&tokenizer, "tokenizer", defaultTokenizer,
-		"The name of the tokenizer to use.")
+		"The tokenizer to use, optionally as a chain of transforms, e.g. \"mask:/24 | cryptopan | ip\".")
 	fs.StringVar(&forwarder, "forwarder", defaultForwarder,
 		"The name of the forwarder to use.")
+	fs.StringVar(&shadowTokenizer, "shadow-tokenizer", "",
+		"Also tokenize all input using the given tokenizer, or chain, and forward its tokens separately, e.g., to validate a new tokenizer before switching to it.")
+	fs.StringVar(&shadowForwarder, "shadow-forwarder", "",
+		"The name of the forwarder that the shadow tokenizer's tokens are sent to.  Required with -shadow-tokenizer.")
+	fs.StringVar(&shadowKafkaTopic, "shadow-kafka-topic", "",
+		"The Kafka topic that the shadow tokenizer's tokens are sent to if the shadow forwarder is kafka.")
 	fs.StringVar(&aggregator, "aggregator", defaultAggregator,
 		"The name of the aggregator to use.")
 	fs.StringVar(&receiver, "receiver", defaultReceiver,
@@ -122,11 +288,21 @@ func parseFlags(progname string, args []string) (*components, *config, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to parse key expiration: %w", err)
 	}
+	c.keyOverlap, err = time.ParseDuration(fmt.Sprintf("%ds", rawKeyOverlap))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse key overlap: %w", err)
+	}
+	c.alignToClock = alignToClock
+	c.contextLabel = contextLabel
+	c.envelopeTokens = envelopeTokens
+	if c.keyOverlap < 0 || c.keyOverlap >= c.keyExpiry {
+		return nil, nil, errors.New("key overlap must be non-negative and shorter than key expiry")
+	}
 	c.fwdInterval, err = time.ParseDuration(fmt.Sprintf("%ds", rawFwdInterval))
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to parse forward interval: %w", err)
 	}
-	if forwarder == forwarderKafka {
+	if forwarder == forwarderKafka || (shadowTokenizer != "" && shadowForwarder == forwarderKafka) {
 		c.kafkaConfig, err = loadKafkaConfig()
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to parse Kafka config: %w", err)
@@ -140,12 +316,165 @@ func parseFlags(progname string, args []string) (*components, *config, error) {
 	}
 	c.prometheusPort = uint16(prometheusPort)
 	c.exposePrometheus = exposePrometheus
+	if adminPort < 1 || adminPort > math.MaxUint16 {
+		return nil, nil, fmt.Errorf("admin port must be in interval [1, %d]", math.MaxUint16)
+	}
+	if exposeAdmin && (adminPort == port || adminPort == prometheusPort) {
+		return nil, nil, errors.New("admin port must differ from Web receiver and Prometheus port")
+	}
+	if (adminCertFile == "") != (adminKeyFile == "") {
+		return nil, nil, errors.New("admin API's certificate and private key must be set together")
+	}
+	if adminClientCAFile != "" && adminCertFile == "" {
+		return nil, nil, errors.New("mutual TLS requires the admin API's certificate")
+	}
+	// We don't store the admin API's bearer token in our configuration
+	// because we log the configuration.  Clients that authenticate via mutual
+	// TLS don't need the token.
+	if exposeAdmin && adminClientCAFile == "" && os.Getenv(envAdminToken) == "" {
+		return nil, nil, fmt.Errorf("%s: %w", envAdminToken, errEnvVarUnset)
+	}
+	// We only offer detokenization via HTTPS.
+	if exposeAdmin && adminCertFile == "" && os.Getenv(envDetokenizeToken) != "" {
+		return nil, nil, errors.New("detokenization requires the admin API's certificate")
+	}
+	c.adminPort = uint16(adminPort)
+	c.exposeAdmin = exposeAdmin
+	c.adminCertFile = adminCertFile
+	c.adminKeyFile = adminKeyFile
+	c.adminClientCA = adminClientCAFile
+	if sivRetainedKeys < 0 {
+		return nil, nil, errors.New("number of retained keys must not be negative")
+	}
+	c.sivRetainedKeys = sivRetainedKeys
+	if _, err := newAlphabet(ff1Alphabet); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse FF1 alphabet: %w", err)
+	}
+	c.ff1Alphabet = ff1Alphabet
+	if ff1Tweak != "" {
+		c.ff1Tweak, err = hex.DecodeString(ff1Tweak)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse FF1 tweak: %w", err)
+		}
+	}
+	if err := checkHmacConfig(hmacFamily, hmacKeyLen, hmacBits); err != nil {
+		return nil, nil, err
+	}
+	c.hmacFamily = hmacFamily
+	c.hmacKeySize = hmacKeyLen
+	c.hmacBits = hmacBits
+	if err := checkCLKConfig(clkQ, clkK, clkM); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CLK parameters: %w", err)
+	}
+	c.clkQ, c.clkK, c.clkM = clkQ, clkK, clkM
+	if emailDomainMode != emailDomainKeep && emailDomainMode != emailDomainTokenize {
+		return nil, nil, errBadEmailDomainMode
+	}
+	c.emailDomainMode = emailDomainMode
+
+	c.ipv4Prefixes, err = parsePrefixes(ipv4Prefixes, ipv4Len*8)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse IPv4 prefixes: %w", err)
+	}
+	c.ipv6Prefixes, err = parsePrefixes(ipv6Prefixes, ipv6Len*8)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse IPv6 prefixes: %w", err)
+	}
+	c.addrPolicy, err = parseAddrPolicy(addrPolicy)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fieldPolicyFile != "" {
+		c.fieldPolicy, err = loadFieldPolicy(fieldPolicyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load field policy: %w", err)
+		}
+	}
+	if aggregator == aggregatorRecord && len(c.fieldPolicy) == 0 {
+		return nil, nil, errNoFieldPolicy
+	}
+
+	if epochKeys {
+		secret, err := loadMasterSecret(masterSecretFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load master secret: %w", err)
+		}
+		c.keySource, err = newEpochKeySource(secret, c.keyExpiry)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create epoch key source: %w", err)
+		}
+	}
+	if kmsAddr != "" {
+		if epochKeys {
+			return nil, nil, errors.New("epoch keys and KMS are mutually exclusive")
+		}
+		token, err := loadVaultToken(kmsTokenFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load KMS token: %w", err)
+		}
+		var caBundle []byte
+		if kmsCAFile != "" {
+			caBundle, err = os.ReadFile(kmsCAFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to load KMS CA bundle: %w", err)
+			}
+		}
+		c.keySource, err = newKMSKeySource(kmsAddr, kmsMount, kmsKey, token, caBundle, kmsRotate)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create KMS key source: %w", err)
+		}
+	}
+	if keyStoreDir != "" {
+		var secret []byte
+		// Our KMS wraps its keys, so we don't need to seal them unless we're
+		// given a secret.
+		_, wraps := c.keySource.(keyWrapper)
+		if _, exists := os.LookupEnv(envKeyStoreSecret); !wraps || keyStoreSecretFile != "" || exists {
+			secret, err = loadHexSecret(keyStoreSecretFile, envKeyStoreSecret)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to load key store secret: %w", err)
+			}
+		}
+		c.keyStore, err = newKeyStore(keyStoreDir, secret)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create key store: %w", err)
+		}
+	}
+
+	if escrowCustodiansFile != "" {
+		custodians, err := loadCustodians(escrowCustodiansFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load escrow custodians: %w", err)
+		}
+		c.keyEscrow, err = newKeyEscrow(custodians, escrowThreshold, escrowDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create key escrow: %w", err)
+		}
+	}
+
+	if keyLogFile != "" {
+		signer, err := loadSigningKey(keyLogSigningKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load key log signing key: %w", err)
+		}
+		c.keyLog, err = newKeyLog(keyLogFile, signer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open key log: %w", err)
+		}
+		l.Printf("Signing key log using Ed25519 public key %x.", signer.Public())
+	}
 
 	// Initialize the chosen receiver, tokenizer, aggregator, and forwarder.
-	newTokenizer, exists := ourTokenizers[tokenizer]
-	if !exists {
-		return nil, nil, errors.New("tokenizer does not exist")
+	// The tokenizer may be a chain of transforms around a tokenizer, in which
+	// case we refer to the chain by its tokenizer's name.
+	tokenizerName, newTokenizer, err := parseChain(tokenizer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse tokenizer: %w", err)
 	}
+	c.tokenizerName = tokenizerName
+	c.aggregatorName = aggregator
+	c.forwarderName = forwarder
 	newForwarder, exists := ourForwarders[forwarder]
 	if !exists {
 		return nil, nil, errors.New("forwarder does not exist")
@@ -167,6 +496,17 @@ func parseFlags(progname string, args []string) (*components, *config, error) {
 		r: newReceiver(),
 		t: newTokenizer(),
 	}
+	if c.ipv4Prefixes != nil || c.ipv6Prefixes != nil {
+		l.Printf("Masking addresses to IPv4 prefixes %v and IPv6 prefixes %v.",
+			c.ipv4Prefixes, c.ipv6Prefixes)
+		comp.t = newSubnetTokenizer(comp.t, c.ipv4Prefixes, c.ipv6Prefixes)
+	}
+	if shadowTokenizer != "" {
+		comp.shadow, err = newShadowPipeline(c, shadowTokenizer, aggregator, shadowForwarder, shadowKafkaTopic)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 	return comp, c, nil
 }
 
@@ -184,6 +524,23 @@ func exposeMetrics(port uint16) {
 }
 
 func main() {
+	// Parsing flags and running subcommands may load secrets, so we must not
+	// dump core from here on.
+	if err := disableCoreDumps(); err != nil {
+		l.Fatalf("Failed to disable core dumps: %v", err)
+	}
+	if len(os.Args) > 1 {
+		if run, exists := ourSubcommands[os.Args[1]]; exists {
+			if err := run(os.Args[0], os.Args[2:]); err != nil {
+				if errors.Is(err, flag.ErrHelp) {
+					os.Exit(1)
+				}
+				l.Fatal(err)
+			}
+			return
+		}
+	}
+
 	comp, conf, err := parseFlags(os.Args[0], os.Args[1:])
 	if err != nil {
 		if errors.Is(err, flag.ErrHelp) {
@@ -194,6 +551,17 @@ func main() {
 	if conf.exposePrometheus {
 		go exposeMetrics(conf.prometheusPort)
 	}
+	if conf.exposeAdmin {
+		var tlsConf *tls.Config
+		if conf.adminCertFile != "" {
+			tlsConf, err = newAdminTLSConfig(conf.adminCertFile, conf.adminKeyFile, conf.adminClientCA)
+			if err != nil {
+				l.Fatalf("Failed to load admin API's TLS configuration: %v", err)
+			}
+		}
+		go exposeAdmin(conf.adminPort, os.Getenv(envAdminToken), os.Getenv(envDetokenizeToken), tlsConf, comp.t, comp.a)
+	}
+	go wipeOnSignal()
 	if err := maxSoftFdLimit(); err != nil {
 		l.Printf("Failed to maximize soft fd limit: %v", err)
 	}
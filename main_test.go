@@ -24,10 +24,46 @@ func TestParseFlags(t *testing.T) {
 		{
 			[]string{"-forward-interval", "1", "-key-expiry", "2", "-port", "80"},
 			&config{
-				fwdInterval:    time.Second,
-				keyExpiry:      time.Second * 2,
-				port:           80,
-				prometheusPort: 9090,
+				fwdInterval:     time.Second,
+				keyExpiry:       time.Second * 2,
+				port:            80,
+				prometheusPort:  9090,
+				adminPort:       8081,
+				ff1Alphabet:     defaultFF1Alphabet,
+				hmacFamily:      defaultHmacFamily,
+				hmacKeySize:     hmacKeySize,
+				hmacBits:        hmacOutputBits,
+				clkQ:            defaultCLKQ,
+				clkK:            defaultCLKK,
+				clkM:            defaultCLKM,
+				emailDomainMode: defaultEmailDomainMode,
+				contextLabel:    defaultContextLabel,
+				tokenizerName:   defaultTokenizer,
+				aggregatorName:  defaultAggregator,
+				forwarderName:   defaultForwarder,
+			},
+		},
+		{
+			[]string{"-key-expiry", "2", "-key-overlap", "1"},
+			&config{
+				fwdInterval:     time.Minute * 5,
+				keyExpiry:       time.Second * 2,
+				keyOverlap:      time.Second,
+				port:            8080,
+				prometheusPort:  9090,
+				adminPort:       8081,
+				ff1Alphabet:     defaultFF1Alphabet,
+				hmacFamily:      defaultHmacFamily,
+				hmacKeySize:     hmacKeySize,
+				hmacBits:        hmacOutputBits,
+				clkQ:            defaultCLKQ,
+				clkK:            defaultCLKK,
+				clkM:            defaultCLKM,
+				emailDomainMode: defaultEmailDomainMode,
+				contextLabel:    defaultContextLabel,
+				tokenizerName:   defaultTokenizer,
+				aggregatorName:  defaultAggregator,
+				forwarderName:   defaultForwarder,
 			},
 		},
 	}
@@ -52,7 +88,7 @@ func TestBootstrap(t *testing.T) {
 	done := make(chan empty)
 	go func() {
 		bootstrap(
-			&config{},
+			&config{tokenizerName: tokenizerVerbatim},
 			&components{
 				a: newSimpleAggregator(),
 				r: newStdinReceiver(),
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/gtank/ristretto255"
+)
+
+const (
+	// The ciphersuite of our oblivious PRF.
+	oprfSuite = "ristretto255-SHA512"
+	// Our oblivious PRF is verifiable, i.e., each evaluation comes with a
+	// proof that it was computed using the key that belongs to the public key.
+	oprfModeVerifiable = 0x01
+	// The sizes of serialized elements and scalars, in bytes.
+	oprfElementSize = 32
+	oprfScalarSize  = 32
+	// The size of uniformly random bytes that are mapped to an element or a
+	// scalar.
+	oprfUniformSize = 64
+)
+
+var (
+	errBadOPRFElement = errors.New("invalid ristretto255 element")
+	errBadOPRFInput   = errors.New("OPRF input must not exceed 65535 bytes")
+	errDeriveOPRFKey  = errors.New("failed to derive OPRF key pair")
+
+	// oprfContext is the context string of our ciphersuite and mode.
+	oprfContext = fmt.Sprintf("OPRFV1-%c-%s", oprfModeVerifiable, oprfSuite)
+)
+
+// oprfKey represents a key pair of the verifiable oblivious PRF (VOPRF) that
+// RFC 9497 specifies, using the ristretto255-SHA512 ciphersuite.  Clients
+// blind their input, we evaluate the PRF on the blinded element, and clients
+// unblind the result and hash it into their PRF output.  We never see the
+// client's input, and clients never see our private key.  Clients verify
+// that we used the private key that belongs to our public key using the
+// proof that accompanies each evaluation.
+type oprfKey struct {
+	sk *ristretto255.Scalar
+	pk *ristretto255.Element
+}
+
+// oprfEvaluation represents the result of a blind evaluation: one evaluated
+// element per blinded element, and a proof that covers all of them.
+type oprfEvaluation struct {
+	elements [][]byte
+	proof    []byte
+}
+
+// deriveOPRFKey deterministically derives a key pair from the given seed and
+// info, as specified in RFC 9497, section 3.2.1.
+func deriveOPRFKey(seed, info []byte) (*oprfKey, error) {
+	if len(info) > 0xffff {
+		return nil, errBadOPRFInput
+	}
+	input := append(append([]byte{}, seed...), lengthPrefixed(info)...)
+	dst := []byte("DeriveKeyPair" + oprfContext)
+	zero := ristretto255.NewScalar()
+	for counter := 0; counter < 256; counter++ {
+		sk := oprfHashToScalar(append(input, byte(counter)), dst)
+		if sk.Equal(zero) == 0 {
+			return &oprfKey{
+				sk: sk,
+				pk: ristretto255.NewElement().ScalarBaseMult(sk),
+			}, nil
+		}
+	}
+	return nil, errDeriveOPRFKey
+}
+
+// free zeroizes the private key.  The scalar lives on Go's heap, so we can't
+// lock it, but we don't leave it behind for the garbage collector.
+func (k *oprfKey) free() {
+	k.sk.Zero()
+}
+
+// publicKey returns the serialized public key.
+func (k *oprfKey) publicKey() []byte {
+	return k.pk.Encode(nil)
+}
+
+// evaluate returns the PRF output of the given input, as specified in RFC
+// 9497, section 3.3.2.  A client that blinds the same input, has us evaluate
+// it, and finalizes the result obtains the same output.
+func (k *oprfKey) evaluate(input []byte) ([]byte, error) {
+	if len(input) > 0xffff {
+		return nil, errBadOPRFInput
+	}
+	p := oprfHashToGroup(input)
+	issued := ristretto255.NewElement().ScalarMult(k.sk, p)
+	return oprfFinalize(input, issued), nil
+}
+
+// blindEvaluate evaluates the PRF on the given serialized blinded elements
+// and proves that it did so using our private key, as specified in RFC 9497,
+// section 3.3.2.
+func (k *oprfKey) blindEvaluate(blinded [][]byte) (*oprfEvaluation, error) {
+	var buf [oprfUniformSize]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, err
+	}
+	return k.blindEvaluateWithNonce(blinded, ristretto255.NewScalar().FromUniformBytes(buf[:]))
+}
+
+// blindEvaluateWithNonce is like blindEvaluate but uses the given nonce for
+// the proof.  Only known-answer tests should use a fixed nonce.
+func (k *oprfKey) blindEvaluateWithNonce(blinded [][]byte, r *ristretto255.Scalar) (*oprfEvaluation, error) {
+	var cs, ds []*ristretto255.Element
+	e := &oprfEvaluation{}
+	for _, b := range blinded {
+		c, err := decodeOPRFElement(b)
+		if err != nil {
+			return nil, err
+		}
+		d := ristretto255.NewElement().ScalarMult(k.sk, c)
+		cs, ds = append(cs, c), append(ds, d)
+		e.elements = append(e.elements, d.Encode(nil))
+	}
+	e.proof = k.prove(cs, ds, r)
+	return e, nil
+}
+
+// prove returns a proof that log_G(pk) equals log_C[i](D[i]) for all i, as
+// specified in RFC 9497, section 2.2.1.
+func (k *oprfKey) prove(cs, ds []*ristretto255.Element, r *ristretto255.Scalar) []byte {
+	m, z := k.computeComposites(cs, ds)
+	t2 := ristretto255.NewElement().ScalarBaseMult(r)
+	t3 := ristretto255.NewElement().ScalarMult(r, m)
+
+	var transcript []byte
+	for _, e := range []*ristretto255.Element{k.pk, m, z, t2, t3} {
+		transcript = append(transcript, lengthPrefixed(e.Encode(nil))...)
+	}
+	transcript = append(transcript, "Challenge"...)
+	c := oprfHashToScalar(transcript, nil)
+	s := ristretto255.NewScalar().Subtract(r, ristretto255.NewScalar().Multiply(c, k.sk))
+	return s.Encode(c.Encode(nil))
+}
+
+// computeComposites combines the given elements into a single pair of
+// composite elements, as specified in RFC 9497, section 2.2.1.  We know the
+// private key, so we compute the second composite using the key.
+func (k *oprfKey) computeComposites(cs, ds []*ristretto255.Element) (*ristretto255.Element, *ristretto255.Element) {
+	seedTranscript := append(lengthPrefixed(k.pk.Encode(nil)), lengthPrefixed([]byte("Seed-"+oprfContext))...)
+	seed := sha512.Sum512(seedTranscript)
+
+	m := ristretto255.NewElement()
+	for i := range cs {
+		var transcript []byte
+		transcript = append(transcript, lengthPrefixed(seed[:])...)
+		transcript = binary.BigEndian.AppendUint16(transcript, uint16(i))
+		transcript = append(transcript, lengthPrefixed(cs[i].Encode(nil))...)
+		transcript = append(transcript, lengthPrefixed(ds[i].Encode(nil))...)
+		transcript = append(transcript, "Composite"...)
+		d := oprfHashToScalar(transcript, nil)
+		m.Add(m, ristretto255.NewElement().ScalarMult(d, cs[i]))
+	}
+	z := ristretto255.NewElement().ScalarMult(k.sk, m)
+	return m, z
+}
+
+// oprfFinalize hashes the given input and unblinded element into the PRF
+// output.
+func oprfFinalize(input []byte, unblinded *ristretto255.Element) []byte {
+	h := sha512.New()
+	h.Write(lengthPrefixed(input))
+	h.Write(lengthPrefixed(unblinded.Encode(nil)))
+	h.Write([]byte("Finalize"))
+	return h.Sum(nil)
+}
+
+// decodeOPRFElement deserializes the given element.  Like RFC 9497 requires,
+// we reject the identity element.
+func decodeOPRFElement(b []byte) (*ristretto255.Element, error) {
+	e := ristretto255.NewElement()
+	if err := e.Decode(b); err != nil {
+		return nil, errBadOPRFElement
+	}
+	if e.Equal(ristretto255.NewElement()) == 1 {
+		return nil, errBadOPRFElement
+	}
+	return e, nil
+}
+
+// oprfHashToGroup maps the given input to an element, as specified in RFC
+// 9496, section 4.3.4.
+func oprfHashToGroup(input []byte) *ristretto255.Element {
+	uniform := expandMessageXMD(input, []byte("HashToGroup-"+oprfContext), oprfUniformSize)
+	return ristretto255.NewElement().FromUniformBytes(uniform)
+}
+
+// oprfHashToScalar maps the given input to a scalar using the given domain
+// separation tag, or our default tag if the given tag is nil.
+func oprfHashToScalar(input, dst []byte) *ristretto255.Scalar {
+	if dst == nil {
+		dst = []byte("HashToScalar-" + oprfContext)
+	}
+	uniform := expandMessageXMD(input, dst, oprfUniformSize)
+	return ristretto255.NewScalar().FromUniformBytes(uniform)
+}
+
+// expandMessageXMD implements expand_message_xmd using SHA-512, as specified
+// in RFC 9380, section 5.3.1.  Our callers never ask for more than 255 blocks
+// and never use a domain separation tag that exceeds 255 bytes.
+func expandMessageXMD(msg, dst []byte, n int) []byte {
+	dstPrime := append(append([]byte{}, dst...), byte(len(dst)))
+	ell := (n + sha512.Size - 1) / sha512.Size
+
+	h := sha512.New()
+	h.Write(make([]byte, h.BlockSize()))
+	h.Write(msg)
+	h.Write([]byte{byte(n >> 8), byte(n), 0})
+	h.Write(dstPrime)
+	b0 := h.Sum(nil)
+
+	var out, bi []byte
+	for i := 1; i <= ell; i++ {
+		h.Reset()
+		if i == 1 {
+			h.Write(b0)
+		} else {
+			x := make([]byte, len(b0))
+			for j := range x {
+				x[j] = b0[j] ^ bi[j]
+			}
+			h.Write(x)
+		}
+		h.Write([]byte{byte(i)})
+		h.Write(dstPrime)
+		bi = h.Sum(nil)
+		out = append(out, bi...)
+	}
+	return out[:n]
+}
+
+// lengthPrefixed returns the given byte slice, prefixed with its length as a
+// 2-byte big-endian integer.  The caller must make sure that the slice
+// doesn't exceed 65535 bytes.
+func lengthPrefixed(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...)
+}
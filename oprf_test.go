@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"errors"
+	"testing"
+
+	"github.com/gtank/ristretto255"
+)
+
+// oprfVector represents one of RFC 9497's test vectors for the
+// ristretto255-SHA512 ciphersuite in verifiable mode, see appendix A.1.2.
+type oprfVector struct {
+	input, blind, blinded, evaluated, proof, output string
+}
+
+var (
+	oprfVectorSeed  = "a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3"
+	oprfVectorInfo  = "74657374206b6579"
+	oprfVectorSk    = "e6f73f344b79b379f1a0dd37e07ff62e38d9f71345ce62ae3a9bc60b04ccd909"
+	oprfVectorPk    = "c803e2cc6b05fc15064549b5920659ca4a77b2cca6f04f6b357009335476ad4e"
+	oprfVectorNonce = "222a5e897cf59db8145db8d16e597e8facb80ae7d4e26d9881aa6f61d645fc0e"
+	oprfVectors     = []oprfVector{
+		{
+			input:     "00",
+			blind:     "64d37aed22a27f5191de1c1d69fadb899d8862b58eb4220029e036ec4c1f6706",
+			blinded:   "863f330cc1a1259ed5a5998a23acfd37fb4351a793a5b3c090b642ddc439b945",
+			evaluated: "aa8fa048764d5623868679402ff6108d2521884fa138cd7f9c7669a9a014267e",
+			proof: "ddef93772692e535d1a53903db24367355cc2cc78de93b3be5a8ffcc6985dd06" +
+				"6d4346421d17bf5117a2a1ff0fcb2a759f58a539dfbe857a40bce4cf49ec600d",
+			output: "b58cfbe118e0cb94d79b5fd6a6dafb98764dff49c14e1770b566e42402da1a7d" +
+				"a4d8527693914139caee5bd03903af43a491351d23b430948dd50cde10d32b3c",
+		},
+		{
+			input:     "5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a",
+			blind:     "64d37aed22a27f5191de1c1d69fadb899d8862b58eb4220029e036ec4c1f6706",
+			blinded:   "cc0b2a350101881d8a4cba4c80241d74fb7dcbfde4a61fde2f91443c2bf9ef0c",
+			evaluated: "60a59a57208d48aca71e9e850d22674b611f752bed48b36f7a91b372bd7ad468",
+			proof: "401a0da6264f8cf45bb2f5264bc31e109155600babb3cd4e5af7d181a2c9dc0a" +
+				"67154fabf031fd936051dec80b0b6ae29c9503493dde7393b722eafdf5a50b02",
+			output: "8a9a2f3c7f085b65933594309041fc1898d42d0858e59f90814ae90571a6df60" +
+				"356f4610bf816f27afdd84f47719e480906d27ecd994985890e5f539e7ea74b6",
+		},
+	}
+)
+
+// oprfBlind blinds the given input using the given blind, like a client
+// would.
+func oprfBlind(input []byte, blind *ristretto255.Scalar) []byte {
+	return ristretto255.NewElement().ScalarMult(blind, oprfHashToGroup(input)).Encode(nil)
+}
+
+// oprfUnblind unblinds the given evaluated element and finalizes it into the
+// PRF output, like a client would.
+func oprfUnblind(t *testing.T, input, evaluated []byte, blind *ristretto255.Scalar) []byte {
+	t.Helper()
+	e, err := decodeOPRFElement(evaluated)
+	if err != nil {
+		t.Fatalf("Failed to decode evaluated element: %v", err)
+	}
+	inv := ristretto255.NewScalar().Invert(blind)
+	return oprfFinalize(input, ristretto255.NewElement().ScalarMult(inv, e))
+}
+
+// oprfVerify verifies the proof of the given evaluation, like a client would.
+// Unlike the server, the client doesn't know the private key, so it computes
+// the second composite element using the evaluated elements.
+func oprfVerify(t *testing.T, pk []byte, blinded [][]byte, e *oprfEvaluation) bool {
+	t.Helper()
+	b, err := decodeOPRFElement(pk)
+	if err != nil {
+		t.Fatalf("Failed to decode public key: %v", err)
+	}
+	seed := sha512.Sum512(append(lengthPrefixed(pk), lengthPrefixed([]byte("Seed-"+oprfContext))...))
+	m, z := ristretto255.NewElement(), ristretto255.NewElement()
+	for i := range blinded {
+		var transcript []byte
+		transcript = append(transcript, lengthPrefixed(seed[:])...)
+		transcript = append(transcript, byte(i>>8), byte(i))
+		transcript = append(transcript, lengthPrefixed(blinded[i])...)
+		transcript = append(transcript, lengthPrefixed(e.elements[i])...)
+		transcript = append(transcript, "Composite"...)
+		d := oprfHashToScalar(transcript, nil)
+		c, _ := decodeOPRFElement(blinded[i])
+		dd, _ := decodeOPRFElement(e.elements[i])
+		m.Add(m, ristretto255.NewElement().ScalarMult(d, c))
+		z.Add(z, ristretto255.NewElement().ScalarMult(d, dd))
+	}
+
+	c, s := ristretto255.NewScalar(), ristretto255.NewScalar()
+	if c.Decode(e.proof[:oprfScalarSize]) != nil || s.Decode(e.proof[oprfScalarSize:]) != nil {
+		return false
+	}
+	t2 := ristretto255.NewElement().Add(
+		ristretto255.NewElement().ScalarBaseMult(s),
+		ristretto255.NewElement().ScalarMult(c, b))
+	t3 := ristretto255.NewElement().Add(
+		ristretto255.NewElement().ScalarMult(s, m),
+		ristretto255.NewElement().ScalarMult(c, z))
+	var transcript []byte
+	for _, e := range []*ristretto255.Element{b, m, z, t2, t3} {
+		transcript = append(transcript, lengthPrefixed(e.Encode(nil))...)
+	}
+	transcript = append(transcript, "Challenge"...)
+	return oprfHashToScalar(transcript, nil).Equal(c) == 1
+}
+
+func newTestOPRFKey(t *testing.T) *oprfKey {
+	t.Helper()
+	k, err := deriveOPRFKey(unhex(oprfVectorSeed), unhex(oprfVectorInfo))
+	if err != nil {
+		t.Fatalf("Failed to derive key: %v", err)
+	}
+	return k
+}
+
+func TestOPRFVectors(t *testing.T) {
+	k := newTestOPRFKey(t)
+	assertEqual(t, string(k.sk.Encode(nil)), string(unhex(oprfVectorSk)))
+	assertEqual(t, string(k.publicKey()), string(unhex(oprfVectorPk)))
+
+	nonce := ristretto255.NewScalar()
+	if err := nonce.Decode(unhex(oprfVectorNonce)); err != nil {
+		t.Fatalf("Failed to decode nonce: %v", err)
+	}
+	for _, v := range oprfVectors {
+		blind := ristretto255.NewScalar()
+		if err := blind.Decode(unhex(v.blind)); err != nil {
+			t.Fatalf("Failed to decode blind: %v", err)
+		}
+		blinded := oprfBlind(unhex(v.input), blind)
+		assertEqual(t, string(blinded), string(unhex(v.blinded)))
+
+		e, err := k.blindEvaluateWithNonce([][]byte{blinded}, nonce)
+		if err != nil {
+			t.Fatalf("Failed to evaluate: %v", err)
+		}
+		assertEqual(t, string(e.elements[0]), string(unhex(v.evaluated)))
+		assertEqual(t, string(e.proof), string(unhex(v.proof)))
+
+		output := oprfUnblind(t, unhex(v.input), e.elements[0], blind)
+		assertEqual(t, string(output), string(unhex(v.output)))
+		// The server-side evaluation must agree with the client.
+		output, err = k.evaluate(unhex(v.input))
+		if err != nil {
+			t.Fatalf("Failed to evaluate: %v", err)
+		}
+		assertEqual(t, string(output), string(unhex(v.output)))
+	}
+}
+
+func TestOPRFBatchProof(t *testing.T) {
+	k := newTestOPRFKey(t)
+	var blinded [][]byte
+	for _, v := range oprfVectors {
+		blinded = append(blinded, unhex(v.blinded))
+	}
+	e, err := k.blindEvaluate(blinded)
+	if err != nil {
+		t.Fatalf("Failed to evaluate: %v", err)
+	}
+	assertEqual(t, len(e.elements), len(blinded))
+	if !oprfVerify(t, k.publicKey(), blinded, e) {
+		t.Fatal("Expected proof to verify.")
+	}
+
+	// A proof must not verify for another key.
+	other, _ := deriveOPRFKey(unhex(oprfVectorSeed), nil)
+	if oprfVerify(t, other.publicKey(), blinded, e) {
+		t.Fatal("Expected proof not to verify for another key.")
+	}
+}
+
+func TestOPRFBadElement(t *testing.T) {
+	k := newTestOPRFKey(t)
+	for _, bad := range [][]byte{
+		make([]byte, oprfElementSize), // The identity.
+		bytes.Repeat([]byte{0xff}, oprfElementSize),
+		[]byte("foo"),
+	} {
+		if _, err := k.blindEvaluate([][]byte{bad}); !errors.Is(err, errBadOPRFElement) {
+			t.Fatalf("Expected error '%v' but got '%v'.", errBadOPRFElement, err)
+		}
+	}
+}
+
+func TestExpandMessageXMD(t *testing.T) {
+	// RFC 9380, appendix K.3, expand_message_xmd(SHA-512).
+	dst := []byte("QUUX-V01-CS02-with-expander-SHA512-256")
+	assertEqual(t,
+		string(expandMessageXMD([]byte(""), dst, 0x20)),
+		string(unhex("6b9a7312411d92f921c6f68ca0b6380730a1a4d982c507211a90964c394179ba")))
+	assertEqual(t,
+		string(expandMessageXMD([]byte("abc"), dst, 0x20)),
+		string(unhex("0da749f12fbe5483eb066a5f595055679b976e93abe9be6f0f6318bce7aca8dc")))
+}
@@ -13,6 +13,17 @@ const (
 	httpBody = "body"
 	outcome  = "outcome"
 	success  = "success"
+	family   = "family"
+
+	tokenizerLabel = "tokenizer"
+	selfTestLabel  = "test"
+	shadowStage    = "stage"
+	pipelineLabel  = "pipeline"
+
+	// The values of the pipeline label.
+	pipelinePrimary  = "primary"
+	pipelineShadow   = "shadow"
+	pipelineSelfTest = "self-test"
 
 	// Our Prometheus namespace.
 	ns = "tokenizer"
@@ -21,14 +32,66 @@ const (
 // metrics contains Prometheus metrics for the components we use in production,
 // i.e., the Web receiver, the IP address aggregator, the Crypto-PAn tokenizer,
 // and the Kafka forwarder.
+//
+// Metrics of components that the shadow pipeline runs as well carry a
+// pipeline label.  Components use them via pipelineMetrics.
 type metrics struct {
 	// The number of addresses and wallets that our address aggregator is
 	// currently waiting to flush.
-	numWallets   prometheus.Gauge
-	numAddrs     prometheus.Gauge
-	webResponses *prometheus.CounterVec
-	numForwarded *prometheus.CounterVec
-	numTokenized *prometheus.CounterVec
+	numWallets      *prometheus.GaugeVec
+	numAddrs        *prometheus.GaugeVec
+	webResponses    *prometheus.CounterVec
+	receivedAddrs   *prometheus.CounterVec
+	numForwarded    *prometheus.CounterVec
+	droppedRequests *prometheus.CounterVec
+	numTokenized    *prometheus.CounterVec
+	numDetokenized  *prometheus.CounterVec
+	numRecords      *prometheus.CounterVec
+	selfTests       *prometheus.GaugeVec
+	shadowErrors    *prometheus.CounterVec
+	// The estimated fraction of distinct inputs whose truncated token
+	// collides with another input's token in the current epoch.
+	tokenCollisionRate *prometheus.GaugeVec
+}
+
+// pipelineMetrics contains the metrics of one of our pipelines, i.e., the
+// primary pipeline or the shadow pipeline.  All of them carry the pipeline's
+// label, so the shadow pipeline never touches the primary pipeline's metrics.
+type pipelineMetrics struct {
+	numWallets         prometheus.Gauge
+	numAddrs           prometheus.Gauge
+	numForwarded       *prometheus.CounterVec
+	droppedRequests    prometheus.Counter
+	numTokenized       *prometheus.CounterVec
+	tokenCollisionRate prometheus.Gauge
+}
+
+// metricsFor returns the metrics of the given pipeline.
+func metricsFor(pipeline string) *pipelineMetrics {
+	labels := prometheus.Labels{pipelineLabel: pipeline}
+	return &pipelineMetrics{
+		numWallets:         m.numWallets.With(labels),
+		numAddrs:           m.numAddrs.With(labels),
+		numForwarded:       m.numForwarded.MustCurryWith(labels),
+		droppedRequests:    m.droppedRequests.With(labels),
+		numTokenized:       m.numTokenized.MustCurryWith(labels),
+		tokenCollisionRate: m.tokenCollisionRate.With(labels),
+	}
+}
+
+// metrics returns the metrics of the pipeline that the configuration belongs
+// to.
+func (c *config) metrics() *pipelineMetrics {
+	if c.shadow {
+		return metricsFor(pipelineShadow)
+	}
+	return metricsFor(pipelinePrimary)
+}
+
+// tokenized returns the counter of inputs that were tokenized with the given
+// outcome.
+func (p *pipelineMetrics) tokenized(result string) prometheus.Counter {
+	return p.numTokenized.With(prometheus.Labels{outcome: result})
 }
 
 // failBecause turns the given error into a string that's ready to be used as a
@@ -40,16 +103,22 @@ func failBecause(err error) string {
 
 // init initializes our Prometheus metrics.
 func init() {
-	m.numWallets = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: ns,
-		Name:      "num_wallets",
-		Help:      "The number of wallets that the address aggregator currently stores",
-	})
-	m.numAddrs = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: ns,
-		Name:      "num_addrs",
-		Help:      "The number of addresses that the address aggregator currently stores",
-	})
+	m.numWallets = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: ns,
+			Name:      "num_wallets",
+			Help:      "The number of wallets that the address aggregator currently stores",
+		},
+		[]string{pipelineLabel},
+	)
+	m.numAddrs = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: ns,
+			Name:      "num_addrs",
+			Help:      "The number of addresses that the address aggregator currently stores",
+		},
+		[]string{pipelineLabel},
+	)
 
 	m.webResponses = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -59,13 +128,29 @@ func init() {
 		},
 		[]string{httpCode, httpBody},
 	)
+	m.receivedAddrs = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "received_addrs",
+			Help:      "Addresses that the Web receiver received, by address family",
+		},
+		[]string{family},
+	)
+	m.droppedRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "dropped_requests",
+			Help:      "Client requests that the address aggregator dropped because its keys were rotated while processing them",
+		},
+		[]string{pipelineLabel},
+	)
 	m.numForwarded = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: ns,
 			Name:      "num_forwarded",
 			Help:      "(Un)successfully forwarded tokens using Kafka",
 		},
-		[]string{outcome},
+		[]string{outcome, pipelineLabel},
 	)
 	m.numTokenized = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -73,6 +158,46 @@ func init() {
 			Name:      "num_tokenized",
 			Help:      "Crypto-PAn's (un)successfully tokenize'd blobs",
 		},
+		[]string{outcome, pipelineLabel},
+	)
+	m.numDetokenized = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "num_detokenized",
+			Help:      "(Un)successfully detokenize'd tokens",
+		},
+		[]string{outcome},
+	)
+	m.numRecords = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "num_records",
+			Help:      "(Un)successfully processed records of the record aggregator",
+		},
 		[]string{outcome},
 	)
+	m.selfTests = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: ns,
+			Name:      "self_test_passed",
+			Help:      "Whether a tokenizer's self-test passed (1) or failed (0)",
+		},
+		[]string{tokenizerLabel, selfTestLabel},
+	)
+	m.shadowErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "shadow_errors",
+			Help:      "Errors of the shadow tokenizer's pipeline, by stage",
+		},
+		[]string{shadowStage},
+	)
+	m.tokenCollisionRate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: ns,
+			Name:      "token_collision_rate",
+			Help:      "The estimated fraction of distinct inputs whose truncated HMAC token collides with another input's token in the current epoch",
+		},
+		[]string{pipelineLabel},
+	)
 }
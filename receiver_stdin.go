@@ -13,7 +13,7 @@ type stdinReceiver struct {
 
 func newStdinReceiver() receiver {
 	return &stdinReceiver{
-		i:    make(chan serializer),
+		i:    make(chan serializer, inboxSize),
 		done: make(chan empty),
 	}
 }
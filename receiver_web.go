@@ -3,9 +3,10 @@ package main
 import (
 	"errors"
 	"fmt"
-	"net"
 	"net/http"
+	"net/netip"
 	"strconv"
+	"sync"
 
 	"github.com/go-chi/chi/v5"
 	uuid "github.com/google/uuid"
@@ -25,33 +26,40 @@ var (
 	errBadWalletFmt        = errors.New("wallet ID has bad format")
 	errNoFastlyHeader      = fmt.Errorf("found no %q header", fastlyClientIP)
 	errBadFastlyAddrFormat = fmt.Errorf("bad IP address format in %q header", fastlyClientIP)
+	errEmbeddedFastlyAddr  = fmt.Errorf("IP address in %q header embeds an IPv4 address", fastlyClientIP)
 )
 
 // clientRequest represents a client's confirmation token request.  It contains
-// the client's IP address and wallet ID.
+// the client's canonical IP address and wallet ID.  IPv4 addresses serialize
+// to 4 bytes and IPv6 addresses to 16 bytes.
 type clientRequest struct {
-	Addr   net.IP    `json:"addr"`
-	Wallet uuid.UUID `json:"wallet"`
+	Addr   netip.Addr `json:"addr"`
+	Wallet uuid.UUID  `json:"wallet"`
 }
 
 func (c *clientRequest) bytes() []byte {
-	return c.Addr
+	return c.Addr.AsSlice()
 }
 
 // webReceiver implements a receiver that exposes an HTTP API to receive data.
 type webReceiver struct {
-	done   chan empty
-	in     chan serializer
-	router *chi.Mux
-	port   uint16
+	sync.RWMutex
+	done       chan empty
+	in         chan serializer
+	router     *chi.Mux
+	port       uint16
+	addrPolicy addrPolicy
+	evaluator  blindEvaluator
+	log        *keyLog
 }
 
 func newWebReceiver() receiver {
 	w := &webReceiver{
-		in:   make(chan serializer),
-		done: make(chan empty),
+		in:         make(chan serializer, inboxSize),
+		done:       make(chan empty),
+		addrPolicy: defaultAddrPolicy,
 	}
-	w.router = newRouter(w.in)
+	w.router = newRouter(w.in, w.policy, w.oprfEvaluator, w.rotationLog, false)
 
 	return w
 }
@@ -68,15 +76,68 @@ func isValidApiVersion(v string) bool {
 	return num >= 1 && num <= 4
 }
 
-func newRouter(inbox chan serializer) *chi.Mux {
+// newRouter returns a router that sends client requests to the given inbox.
+// The given functions return the address policy that's currently in effect,
+// the tokenizer that evaluates our oblivious PRF, if any, and our key log, if
+// any.  Records are only accepted if the given records flag is set, i.e., if
+// the record aggregator processes our inbox.  Other aggregators would forward
+// them without aggregation.
+func newRouter(inbox chan serializer, policy func() addrPolicy, evaluator func() blindEvaluator, log func() *keyLog, records bool) *chi.Mux {
 	r := chi.NewRouter()
-	r.Get("/v{version}/confirmation/token/{walletID}", getConfTokenHandler(inbox))
+	r.Get("/v{version}/confirmation/token/{walletID}", getConfTokenHandler(inbox, policy))
+	r.Get(oprfKeyPath, oprfKeyHandler(evaluator))
+	r.Post(oprfEvaluatePath, oprfEvaluateHandler(evaluator))
+	if records {
+		r.Post(recordPath, recordHandler(inbox))
+	}
+	r.Get(keyLogPath, keyLogHandler(log))
 	r.Get("/", indexHandler)
 	return r
 }
 
 func (w *webReceiver) setConfig(c *config) {
+	w.Lock()
+	defer w.Unlock()
+
 	w.port = c.port
+	w.addrPolicy = c.addrPolicy
+	w.log = c.keyLog
+	w.router = newRouter(w.in, w.policy, w.oprfEvaluator, w.rotationLog,
+		c.aggregatorName == aggregatorRecord)
+}
+
+// policy returns the address policy that's currently in effect.
+func (w *webReceiver) policy() addrPolicy {
+	w.RLock()
+	defer w.RUnlock()
+
+	return w.addrPolicy
+}
+
+// use lets clients evaluate our oblivious PRF if the given tokenizer supports
+// it.
+func (w *webReceiver) use(t tokenizer) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.evaluator, _ = t.(blindEvaluator)
+}
+
+// oprfEvaluator returns the tokenizer that evaluates our oblivious PRF, or nil
+// if our tokenizer doesn't support it.
+func (w *webReceiver) oprfEvaluator() blindEvaluator {
+	w.RLock()
+	defer w.RUnlock()
+
+	return w.evaluator
+}
+
+// rotationLog returns our key log, or nil if we don't keep one.
+func (w *webReceiver) rotationLog() *keyLog {
+	w.RLock()
+	defer w.RUnlock()
+
+	return w.log
 }
 
 func (w *webReceiver) inbox() chan serializer {
@@ -102,18 +163,19 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, indexPage)
 }
 
-func getConfTokenHandler(inbox chan serializer) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		errAndReport := func(body string, code int) {
-			http.Error(w, body, code)
-			m.webResponses.With(prometheus.Labels{
-				httpCode: fmt.Sprintf("%d", code),
-				httpBody: body,
-			}).Inc()
-		}
+// reportError sends the given error to the client and counts the response.
+func reportError(w http.ResponseWriter, body string, code int) {
+	http.Error(w, body, code)
+	m.webResponses.With(prometheus.Labels{
+		httpCode: fmt.Sprintf("%d", code),
+		httpBody: body,
+	}).Inc()
+}
 
+func getConfTokenHandler(inbox chan serializer, policy func() addrPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		if !isValidApiVersion(chi.URLParam(r, "version")) {
-			errAndReport(errBadApiVersion.Error(), http.StatusBadRequest)
+			reportError(w, errBadApiVersion.Error(), http.StatusBadRequest)
 			return
 		}
 		// Make sure that the wallet ID is a valid UUID.
@@ -121,20 +183,26 @@ func getConfTokenHandler(inbox chan serializer) http.HandlerFunc {
 
 		walletID, err := uuid.Parse(rawWalletID)
 		if err != nil {
-			errAndReport(errBadWalletFmt.Error(), http.StatusBadRequest)
+			reportError(w, errBadWalletFmt.Error(), http.StatusBadRequest)
 			return
 		}
 
 		rawAddr := r.Header.Get(fastlyClientIP)
 		if rawAddr == "" {
-			errAndReport(errNoFastlyHeader.Error(), http.StatusBadRequest)
+			reportError(w, errNoFastlyHeader.Error(), http.StatusBadRequest)
 			return
 		}
 
 		// Fetch the client's IP address from Fastly's proprietary header.
-		addr := net.ParseIP(rawAddr)
-		if addr == nil {
-			errAndReport(errBadFastlyAddrFormat.Error(), http.StatusBadRequest)
+		addr, err := netip.ParseAddr(rawAddr)
+		if err != nil {
+			reportError(w, errBadFastlyAddrFormat.Error(), http.StatusBadRequest)
+			return
+		}
+		m.receivedAddrs.With(prometheus.Labels{family: addrFamily(addr)}).Inc()
+		addr, err = canonicalAddr(addr, policy())
+		if err != nil {
+			reportError(w, errEmbeddedFastlyAddr.Error(), http.StatusBadRequest)
 			return
 		}
 
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const keyLogPath = "/v1/keylog"
+
+var errNoKeyLog = errors.New("key log is not enabled")
+
+// keyLogHandler serves our entire key log, one signed entry per line.  The
+// log is public: it contains key IDs and commitments but no keys.
+func keyLogHandler(log func() *keyLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		k := log()
+		if k == nil {
+			reportError(w, errNoKeyLog.Error(), http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if err := k.writeTo(w); err != nil {
+			l.Printf("Failed to serve key log: %v", err)
+			return
+		}
+		m.webResponses.With(prometheus.Labels{httpCode: "200", httpBody: ""}).Inc()
+	}
+}
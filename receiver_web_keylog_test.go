@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyLogHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keylog")
+	k := newTestKeyLog(t, path)
+	if err := k.append(tokenizerHmac, "", &epochKey{material: make([]byte, hmacKeySize)}); err != nil {
+		t.Fatalf("Failed to append to key log: %v", err)
+	}
+	srv := httptest.NewServer(newRouter(make(chan serializer), defaultPolicy, noEvaluator, func() *keyLog { return k }, false))
+	defer srv.Close()
+
+	resp := makeReq(t, srv, http.MethodGet, keyLogPath, nil)
+	defer resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	entries, err := verifyKeyLog(resp.Body, testSigningKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatalf("Failed to verify served key log: %v", err)
+	}
+	assertEqual(t, len(entries), 1)
+
+	noSrv := httptest.NewServer(newRouter(make(chan serializer), defaultPolicy, noEvaluator, noKeyLog, false))
+	defer noSrv.Close()
+	resp = makeReq(t, noSrv, http.MethodGet, keyLogPath, nil)
+	defer resp.Body.Close()
+	assertEqual(t, resp.StatusCode, http.StatusNotImplemented)
+}
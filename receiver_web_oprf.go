@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	oprfEvaluatePath = "/v1/oprf/evaluate"
+	oprfKeyPath      = "/v1/oprf/key"
+	// The maximum size of an evaluation request's body, in bytes.
+	maxOPRFRequestSize = 1 << 16
+)
+
+var (
+	errNoOPRF          = errors.New("tokenizer does not support oblivious evaluation")
+	errBadOPRFRequest  = errors.New("bad OPRF evaluation request")
+	errTooManyElements = errors.New("too many blinded elements")
+	errOPRFUnavailable = errors.New("OPRF key is not available")
+)
+
+// oprfEvaluateRequest contains the (base64-encoded) elements that a client
+// blinded and wants us to evaluate.
+type oprfEvaluateRequest struct {
+	Blinded [][]byte `json:"blinded"`
+}
+
+// oprfKeyResponse contains the ciphersuite and (base64-encoded) public key of
+// our current OPRF key, along with its key ID and, if it expires, the time it
+// expires.
+type oprfKeyResponse struct {
+	Suite   string     `json:"suite"`
+	PubKey  []byte     `json:"pubkey"`
+	KeyID   uuid.UUID  `json:"keyid"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// oprfEvaluateResponse contains one (base64-encoded) evaluated element per
+// blinded element, a proof that covers all of them, and the key that the
+// elements were evaluated with.
+type oprfEvaluateResponse struct {
+	Evaluated [][]byte `json:"evaluated"`
+	Proof     []byte   `json:"proof"`
+	oprfKeyResponse
+}
+
+func newOPRFKeyResponse(pk *oprfPublicKey) oprfKeyResponse {
+	r := oprfKeyResponse{
+		Suite:  oprfSuite,
+		PubKey: pk.key,
+		KeyID:  pk.id.UUID,
+	}
+	if !pk.epoch.end.IsZero() {
+		r.Expires = &pk.epoch.end
+	}
+	return r
+}
+
+// reportJSON sends the given response to the client and counts the response.
+func reportJSON(w http.ResponseWriter, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		l.Printf("Failed to encode OPRF response: %v", err)
+		return
+	}
+	m.webResponses.With(prometheus.Labels{httpCode: "200", httpBody: ""}).Inc()
+}
+
+// oprfErrorCode returns the HTTP status code of the given evaluation error.
+func oprfErrorCode(err error) int {
+	if errors.Is(err, errNoKey) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+func oprfKeyHandler(evaluator func() blindEvaluator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := evaluator()
+		if e == nil {
+			reportError(w, errNoOPRF.Error(), http.StatusNotImplemented)
+			return
+		}
+		pk, err := e.publicKey()
+		if err != nil {
+			reportError(w, errOPRFUnavailable.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		reportJSON(w, newOPRFKeyResponse(pk))
+	}
+}
+
+func oprfEvaluateHandler(evaluator func() blindEvaluator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := evaluator()
+		if e == nil {
+			reportError(w, errNoOPRF.Error(), http.StatusNotImplemented)
+			return
+		}
+
+		var req oprfEvaluateRequest
+		body := http.MaxBytesReader(w, r.Body, maxOPRFRequestSize)
+		if err := json.NewDecoder(body).Decode(&req); err != nil || len(req.Blinded) == 0 {
+			reportError(w, errBadOPRFRequest.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.Blinded) > maxBatchSize {
+			reportError(w, errTooManyElements.Error(), http.StatusBadRequest)
+			return
+		}
+
+		eval, pk, err := e.blindEvaluate(req.Blinded)
+		if err != nil {
+			reportError(w, err.Error(), oprfErrorCode(err))
+			return
+		}
+		reportJSON(w, oprfEvaluateResponse{
+			Evaluated:       eval.elements,
+			Proof:           eval.proof,
+			oprfKeyResponse: newOPRFKeyResponse(pk),
+		})
+	}
+}
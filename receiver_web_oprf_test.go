@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gtank/ristretto255"
+)
+
+func newOPRFServer(t *testing.T, e blindEvaluator) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(newRouter(
+		make(chan serializer),
+		defaultPolicy,
+		func() blindEvaluator { return e },
+		noKeyLog,
+		false,
+	))
+}
+
+func postOPRF(t *testing.T, srv *httptest.Server, body string) *http.Response {
+	t.Helper()
+	resp, err := http.Post(srv.URL+oprfEvaluatePath, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to make HTTP request: %v", err)
+	}
+	return resp
+}
+
+func TestOPRFEndpoints(t *testing.T) {
+	o := newOPRFTokenizer()
+	_ = o.resetKey()
+	srv := newOPRFServer(t, o.(blindEvaluator))
+	defer srv.Close()
+
+	// Fetch our public key.
+	resp := makeReq(t, srv, http.MethodGet, oprfKeyPath, nil)
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var key oprfKeyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	assertEqual(t, key.Suite, oprfSuite)
+	assertEqual(t, key.KeyID, o.keyID().UUID)
+
+	// Have two blinded elements evaluated.
+	inputs := [][]byte{[]byte("foo"), []byte("bar")}
+	blind := ristretto255.NewScalar().FromUniformBytes(bytes.Repeat([]byte{0x42}, oprfUniformSize))
+	req := oprfEvaluateRequest{}
+	for _, input := range inputs {
+		req.Blinded = append(req.Blinded, oprfBlind(input, blind))
+	}
+	body, _ := json.Marshal(req)
+	resp = postOPRF(t, srv, string(body))
+	assertEqual(t, resp.StatusCode, http.StatusOK)
+	var eval oprfEvaluateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&eval); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	assertEqual(t, len(eval.Evaluated), len(inputs))
+	if !bytes.Equal(eval.PubKey, key.PubKey) {
+		t.Fatal("Expected evaluation to use the published key.")
+	}
+	e := &oprfEvaluation{elements: eval.Evaluated, proof: eval.Proof}
+	if !oprfVerify(t, key.PubKey, req.Blinded, e) {
+		t.Fatal("Expected proof to verify.")
+	}
+	for i, input := range inputs {
+		tkn, _ := o.tokenize(blob(input))
+		if !bytes.Equal(oprfUnblind(t, input, eval.Evaluated[i], blind), tkn) {
+			t.Fatal("Expected client's output to equal token.")
+		}
+	}
+}
+
+func TestOPRFBadRequests(t *testing.T) {
+	o := newOPRFTokenizer()
+	srv := newOPRFServer(t, o.(blindEvaluator))
+	defer srv.Close()
+
+	// Without a key, we cannot evaluate anything.
+	resp := makeReq(t, srv, http.MethodGet, oprfKeyPath, nil)
+	assertEqual(t, resp.StatusCode, http.StatusServiceUnavailable)
+	_ = o.resetKey()
+
+	tooMany, _ := json.Marshal(oprfEvaluateRequest{Blinded: make([][]byte, maxBatchSize+1)})
+	for body, code := range map[string]int{
+		"":                      http.StatusBadRequest,
+		"{}":                    http.StatusBadRequest,
+		`{"blinded": ["Zm9v"]}`: http.StatusBadRequest,
+		string(tooMany):         http.StatusBadRequest,
+	} {
+		resp := postOPRF(t, srv, body)
+		assertEqual(t, resp.StatusCode, code)
+	}
+
+	// Tokenizers that don't support the OPRF result in an error.
+	noSrv := httptest.NewServer(newRouter(make(chan serializer), defaultPolicy, noEvaluator, noKeyLog, false))
+	defer noSrv.Close()
+	resp = makeReq(t, noSrv, http.MethodGet, oprfKeyPath, nil)
+	assertEqual(t, resp.StatusCode, http.StatusNotImplemented)
+}
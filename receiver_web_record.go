@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	recordPath = "/v1/records"
+	// The maximum size of a record, in bytes.
+	maxRecordSize = 1 << 20
+)
+
+var errBadRecord = errors.New("request body must be a JSON object")
+
+// recordHandler sends the JSON object in the request body to the given inbox,
+// so the record aggregator tokenizes its fields.
+func recordHandler(inbox chan serializer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRecordSize))
+		if err != nil {
+			reportError(w, errBadRecord.Error(), http.StatusBadRequest)
+			return
+		}
+		var obj map[string]json.RawMessage
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&obj); err != nil || obj == nil {
+			reportError(w, errBadRecord.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m.webResponses.With(prometheus.Labels{httpCode: "200", httpBody: ""}).Inc()
+		inbox <- jsonRecord(body)
+	}
+}
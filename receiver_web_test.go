@@ -3,9 +3,9 @@ package main
 import (
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"strings"
 	"testing"
 )
@@ -14,6 +14,18 @@ const (
 	ipv4Addr = "1.2.3.4"
 )
 
+func defaultPolicy() addrPolicy {
+	return defaultAddrPolicy
+}
+
+func noEvaluator() blindEvaluator {
+	return nil
+}
+
+func noKeyLog() *keyLog {
+	return nil
+}
+
 func makeReq(t *testing.T, s *httptest.Server, method, path string, h http.Header) *http.Response {
 	req, err := http.NewRequest(method, s.URL+path, nil)
 	if err != nil {
@@ -30,7 +42,7 @@ func makeReq(t *testing.T, s *httptest.Server, method, path string, h http.Heade
 
 func TestIndexRequest(t *testing.T) {
 	inbox := make(chan serializer, 10) // We're using a buffered channel to prevent a deadlock.
-	srv := httptest.NewServer(newRouter(inbox))
+	srv := httptest.NewServer(newRouter(inbox, defaultPolicy, noEvaluator, noKeyLog, false))
 	defer srv.Close()
 
 	resp := makeReq(t, srv, http.MethodGet, "/", nil)
@@ -46,12 +58,12 @@ func TestIndexRequest(t *testing.T) {
 func TestGoodRequest(t *testing.T) {
 	walletID := newV4(t)
 	expected := clientRequest{
-		Addr:   net.ParseIP(ipv4Addr),
+		Addr:   netip.MustParseAddr(ipv4Addr),
 		Wallet: walletID,
 	}
 	inbox := make(chan serializer, 10) // We're using a buffered channel to prevent a deadlock.
 	path := fmt.Sprintf("/v2/confirmation/token/%s", walletID)
-	srv := httptest.NewServer(newRouter(inbox))
+	srv := httptest.NewServer(newRouter(inbox, defaultPolicy, noEvaluator, noKeyLog, false))
 	defer srv.Close()
 
 	resp := makeReq(t, srv, http.MethodGet, path, http.Header{fastlyClientIP: []string{ipv4Addr}})
@@ -62,7 +74,7 @@ func TestGoodRequest(t *testing.T) {
 
 	r := <-inbox
 	received := r.(*clientRequest)
-	if !net.IP.Equal(received.Addr, expected.Addr) {
+	if received.Addr != expected.Addr {
 		t.Fatalf("Expected address %q but got %q.", expected.Addr, received.Addr)
 	}
 	if received.Wallet != expected.Wallet {
@@ -71,7 +83,7 @@ func TestGoodRequest(t *testing.T) {
 }
 
 func TestBadWalletId(t *testing.T) {
-	srv := httptest.NewServer(newRouter(make(chan serializer)))
+	srv := httptest.NewServer(newRouter(make(chan serializer), defaultPolicy, noEvaluator, noKeyLog, false))
 	defer srv.Close()
 	badPath := "/v2/confirmation/token/foobar"
 
@@ -88,7 +100,7 @@ func TestBadWalletId(t *testing.T) {
 }
 
 func TestNoFastlyHeader(t *testing.T) {
-	srv := httptest.NewServer(newRouter(make(chan serializer)))
+	srv := httptest.NewServer(newRouter(make(chan serializer), defaultPolicy, noEvaluator, noKeyLog, false))
 	defer srv.Close()
 	path := fmt.Sprintf("/v2/confirmation/token/%s", newV4(t))
 
@@ -105,7 +117,7 @@ func TestNoFastlyHeader(t *testing.T) {
 }
 
 func TestBadFastlyAddr(t *testing.T) {
-	srv := httptest.NewServer(newRouter(make(chan serializer)))
+	srv := httptest.NewServer(newRouter(make(chan serializer), defaultPolicy, noEvaluator, noKeyLog, false))
 	defer srv.Close()
 	path := fmt.Sprintf("/v2/confirmation/token/%s", newV4(t))
 
@@ -121,6 +133,33 @@ func TestBadFastlyAddr(t *testing.T) {
 	}
 }
 
+func TestEmbeddedFastlyAddr(t *testing.T) {
+	inbox := make(chan serializer, 10) // We're using a buffered channel to prevent a deadlock.
+	path := fmt.Sprintf("/v2/confirmation/token/%s", newV4(t))
+	h := http.Header{fastlyClientIP: []string{"::ffff:" + ipv4Addr}}
+
+	// By default, IPv4-mapped addresses are turned into IPv4 addresses.
+	srv := httptest.NewServer(newRouter(inbox, defaultPolicy, noEvaluator, noKeyLog, false))
+	defer srv.Close()
+	resp := makeReq(t, srv, http.MethodGet, path, h)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected HTTP status code %d but got %d.", http.StatusOK, resp.StatusCode)
+	}
+	received := (<-inbox).(*clientRequest)
+	assertEqual(t, received.Addr, netip.MustParseAddr(ipv4Addr))
+	assertEqual(t, len(received.bytes()), ipv4Len)
+
+	// The reject policy refuses them.
+	rejectSrv := httptest.NewServer(newRouter(inbox, func() addrPolicy { return addrPolicyReject }, noEvaluator, noKeyLog, false))
+	defer rejectSrv.Close()
+	resp = makeReq(t, rejectSrv, http.MethodGet, path, h)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected HTTP status code %d but got %d.", http.StatusBadRequest, resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	assertEqual(t, strings.TrimSpace(string(body)), errEmbeddedFastlyAddr.Error())
+}
+
 func TestIsValidApiVersion(t *testing.T) {
 	assertEqual(t, isValidApiVersion("1"), true)
 	assertEqual(t, isValidApiVersion("2"), true)
@@ -134,3 +173,55 @@ func TestIsValidApiVersion(t *testing.T) {
 	assertEqual(t, isValidApiVersion("1.1"), false)
 	assertEqual(t, isValidApiVersion("foo"), false)
 }
+
+func TestRecordRequest(t *testing.T) {
+	inbox := make(chan serializer, 1)
+	srv := httptest.NewServer(newRouter(inbox, defaultPolicy, noEvaluator, noKeyLog, true))
+	defer srv.Close()
+
+	for body, code := range map[string]int{
+		`{"ts": 1}`: http.StatusOK,
+		`[1, 2]`:    http.StatusBadRequest,
+		`null`:      http.StatusBadRequest,
+		`foo`:       http.StatusBadRequest,
+	} {
+		resp, err := http.Post(srv.URL+recordPath, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to make HTTP request: %v", err)
+		}
+		assertEqual(t, resp.StatusCode, code)
+	}
+	assertEqual(t, string((<-inbox).bytes()), `{"ts": 1}`)
+}
+
+func TestRecordRequestWithoutRecordAggregator(t *testing.T) {
+	for _, aggregator := range []string{defaultAggregator, aggregatorAddr} {
+		w := newWebReceiver().(*webReceiver)
+		w.setConfig(&config{aggregatorName: aggregator})
+		srv := httptest.NewServer(w.router)
+
+		resp, err := http.Post(srv.URL+recordPath, "application/json", strings.NewReader(`{"ts": 1}`))
+		if err != nil {
+			t.Fatalf("Failed to make HTTP request: %v", err)
+		}
+		assertEqual(t, resp.StatusCode, http.StatusNotFound)
+		srv.Close()
+	}
+}
+
+func TestWebReceiverFormsBatches(t *testing.T) {
+	w := newWebReceiver().(*webReceiver)
+	srv := httptest.NewServer(w.router)
+	defer srv.Close()
+
+	// Nobody reads from the inbox yet, so the requests must not block until
+	// the inbox is full.
+	path := fmt.Sprintf("/v2/confirmation/token/%s", newV4(t))
+	for i := 0; i < inboxSize; i++ {
+		resp := makeReq(t, srv, http.MethodGet, path, http.Header{fastlyClientIP: []string{ipv4Addr}})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected HTTP status code %d but got %d.", http.StatusOK, resp.StatusCode)
+		}
+	}
+	assertEqual(t, len(drainInbox(<-w.in, w.in)), maxBatchSize)
+}
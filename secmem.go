@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// lockedMemory hands out byte slices that live outside of Go's heap, in
+// anonymous memory mappings that are locked into RAM.  The garbage collector
+// never copies or moves these slices, and the kernel never swaps them to disk.
+// We use locked memory for key material, so a key is really gone once we
+// free its buffer.
+type lockedMemory struct {
+	sync.Mutex
+	// regions maps the first byte of each live buffer to the memory mapping
+	// that backs it.
+	regions  map[*byte][]byte
+	wipeHook func([]byte)
+	warnOnce sync.Once
+}
+
+var locked = &lockedMemory{regions: make(map[*byte][]byte)}
+
+// alloc returns a zeroed buffer of the given size in locked memory.  If the
+// kernel refuses to lock the buffer, e.g., because we exceed RLIMIT_MEMLOCK,
+// we log a warning and use the buffer regardless.
+func (p *lockedMemory) alloc(n int) ([]byte, error) {
+	if n == 0 {
+		return []byte{}, nil
+	}
+	pageSize := os.Getpagesize()
+	size := (n + pageSize - 1) / pageSize * pageSize
+	region, err := syscall.Mmap(-1, 0, size,
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Mlock(region); err != nil {
+		p.warnOnce.Do(func() {
+			l.Printf("Failed to lock key memory; keys may be swapped to disk: %v", err)
+		})
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.regions[&region[0]] = region
+	return region[:n:n], nil
+}
+
+// copyOf returns a copy of the given slice in locked memory.
+func (p *lockedMemory) copyOf(b []byte) ([]byte, error) {
+	c, err := p.alloc(len(b))
+	if err != nil {
+		return nil, err
+	}
+	copy(c, b)
+	return c, nil
+}
+
+// free zeroizes and unmaps the given buffer, which must have been returned by
+// alloc or copyOf.  The buffer must not be used afterwards.
+func (p *lockedMemory) free(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	region, exists := p.regions[&b[0]]
+	if !exists {
+		zeroize(b)
+		return
+	}
+	delete(p.regions, &b[0])
+	zeroize(region)
+	if p.wipeHook != nil {
+		p.wipeHook(b)
+	}
+	_ = syscall.Munlock(region)
+	if err := syscall.Munmap(region); err != nil {
+		l.Printf("Failed to unmap key memory: %v", err)
+	}
+}
+
+// wipeAll zeroizes all live buffers without unmapping them.  We call it when
+// the process stops, right before exiting.
+func (p *lockedMemory) wipeAll() {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, region := range p.regions {
+		zeroize(region)
+	}
+}
+
+// setWipeHook sets a function that's called with each buffer right after it
+// was zeroized and before it's unmapped.  Tests use the hook to verify that
+// rotated keys are really gone.
+func (p *lockedMemory) setWipeHook(f func([]byte)) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.wipeHook = f
+}
+
+// disableCoreDumps makes sure that our process never dumps core, so core
+// dumps cannot leak keys.  On Linux, we also mark the process as not
+// dumpable, which additionally prevents other processes of the same user
+// from attaching to us or reading our memory via /proc.
+func disableCoreDumps() error {
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{}); err != nil {
+		return err
+	}
+	return setNotDumpable()
+}
+
+// wipeOnSignal waits for SIGINT or SIGTERM, wipes all keys, and exits.
+func wipeOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-c
+	locked.wipeAll()
+	l.Printf("Received %s.  Wiped keys and exiting.", sig)
+	os.Exit(0)
+}
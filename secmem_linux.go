@@ -0,0 +1,11 @@
+package main
+
+import "syscall"
+
+// setNotDumpable sets PR_SET_DUMPABLE to 0 for our process.
+func setNotDumpable() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_DUMPABLE, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
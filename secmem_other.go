@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// setNotDumpable is a no-op because PR_SET_DUMPABLE only exists on Linux.
+func setNotDumpable() error {
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/gtank/ristretto255"
+)
+
+// watchWipes records the buffers that are wiped until the test ends, and
+// fails the test if a wiped buffer isn't all zeros.  The returned function
+// reports whether the given buffer was wiped.
+func watchWipes(t *testing.T) func([]byte) bool {
+	t.Helper()
+	var (
+		mu    sync.Mutex
+		wiped = make(map[*byte]bool)
+	)
+	locked.setWipeHook(func(b []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		wiped[&b[0]] = bytes.Equal(b, make([]byte, len(b)))
+	})
+	t.Cleanup(func() { locked.setWipeHook(nil) })
+
+	return func(b []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		zeroized, exists := wiped[&b[0]]
+		if exists && !zeroized {
+			t.Fatal("Expected wiped buffer to be all zeros.")
+		}
+		return exists
+	}
+}
+
+// liveRegions returns the number of buffers in locked memory that haven't been
+// freed yet.
+func liveRegions() int {
+	locked.Lock()
+	defer locked.Unlock()
+	return len(locked.regions)
+}
+
+func TestLockedMemory(t *testing.T) {
+	wiped := watchWipes(t)
+	b, err := locked.copyOf([]byte("foobar"))
+	if err != nil {
+		t.Fatalf("Failed to allocate locked memory: %v", err)
+	}
+	assertEqual(t, string(b), "foobar")
+	assertEqual(t, cap(b), len("foobar"))
+
+	locked.free(b)
+	if !wiped(b) {
+		t.Fatal("Expected freed buffer to be wiped.")
+	}
+}
+
+func TestRotationWipesKeys(t *testing.T) {
+	wiped := watchWipes(t)
+	for name, newTokenizer := range ourTokenizers {
+		tkzr := newTokenizer()
+		tkzr.(configurer).setConfig(&config{contextLabel: defaultContextLabel})
+		if err := tkzr.resetKey(); err != nil {
+			t.Fatalf("%s: Failed to reset key: %v", name, err)
+		}
+		key, release, err := tkzr.(interface {
+			acquireKey(*keyID) (*epochKey, func(), error)
+		}).acquireKey(nil)
+		if err != nil {
+			t.Fatalf("%s: Failed to acquire key: %v", name, err)
+		}
+		material, subkey, state := key.material, key.subkey, key.state
+		release()
+		// Derived state must not keep key schedules on Go's heap, so it must
+		// free its keys along with the key it was derived from.
+		if _, ok := state.(freer); state != nil && !ok {
+			t.Fatalf("%s: Expected derived state of type %T to be freeable.", name, state)
+		}
+
+		live := liveRegions()
+		if err := tkzr.resetKey(); err != nil {
+			t.Fatalf("%s: Failed to reset key: %v", name, err)
+		}
+		if !wiped(material) || !wiped(subkey) {
+			t.Fatalf("%s: Expected rotated key to be wiped.", name)
+		}
+		// The new key and its state replace the old ones, so the rotation
+		// must not leave any locked buffers behind.
+		if n := liveRegions(); n > live {
+			t.Fatalf("%s: Expected at most %d live locked buffers but got %d.", name, live, n)
+		}
+		if k, ok := state.(*oprfKey); ok && k.sk.Equal(ristretto255.NewScalar()) != 1 {
+			t.Fatalf("%s: Expected rotated private key to be zeroized.", name)
+		}
+		if key.material != nil || key.subkey != nil || key.state != nil {
+			t.Fatalf("%s: Expected rotated key to be dropped.", name)
+		}
+	}
+}
+
+// envDisableCoreDumps tells the test binary that it's the child process of
+// TestDisableCoreDumps.
+const envDisableCoreDumps = "TKZR_TEST_DISABLE_CORE_DUMPS"
+
+func TestDisableCoreDumps(t *testing.T) {
+	// Disabling core dumps cannot be undone by an unprivileged process, so we
+	// do it in a child process instead of in the test binary itself.
+	if os.Getenv(envDisableCoreDumps) == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDisableCoreDumps$")
+		cmd.Env = append(os.Environ(), envDisableCoreDumps+"=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Child process failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	if err := disableCoreDumps(); err != nil {
+		t.Fatalf("Failed to disable core dumps: %v", err)
+	}
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &limit); err != nil {
+		t.Fatalf("Failed to get core dump limit: %v", err)
+	}
+	if limit.Cur != 0 || limit.Max != 0 {
+		t.Fatalf("Expected core dump limit of 0 but got %d (max %d).", limit.Cur, limit.Max)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestKnownAnswerTests(t *testing.T) {
+	for name := range ourTokenizers {
+		_, isKAT := knownAnswerTests[name]
+		_, isRegression := regressionTests[name]
+		if isKAT == isRegression {
+			t.Fatalf("Expected either a known-answer or a regression test for tokenizer %q.", name)
+		}
+	}
+	if err := runKnownAnswerTests(); err != nil {
+		t.Fatalf("Failed known-answer tests: %v", err)
+	}
+}
+
+func TestKnownAnswerTestsMetrics(t *testing.T) {
+	tokenized := metricsFor(pipelinePrimary).numTokenized.WithLabelValues
+	before := testutil.ToFloat64(tokenized(success))
+	if err := runKnownAnswerTests(); err != nil {
+		t.Fatalf("Failed known-answer tests: %v", err)
+	}
+	assertEqual(t, testutil.ToFloat64(tokenized(success)), before)
+
+	selfTest := metricsFor(pipelineSelfTest).numTokenized.WithLabelValues
+	if testutil.ToFloat64(selfTest(success)) == 0 {
+		t.Fatal("Expected known-answer tests to count as self-test tokenizations.")
+	}
+}
+
+func TestWrongAnswer(t *testing.T) {
+	test := vectorTest(tokenizerHmac, []knownAnswer{
+		{[]byte("Jefe"), []byte("what do ya want for nothing?"), []byte("foo")},
+	})
+	if err := test(); !errors.Is(err, errWrongAnswer) {
+		t.Fatalf("Expected error %v but got %v.", errWrongAnswer, err)
+	}
+}
+
+func TestCheckProductionKey(t *testing.T) {
+	for name, newTokenizer := range ourTokenizers {
+		tkzr := newTokenizer()
+		if err := tkzr.resetKey(); err != nil {
+			t.Fatalf("%s: Failed to reset key: %v", name, err)
+		}
+		if err := checkProductionKey(tkzr, &config{tokenizerName: name}); err != nil {
+			t.Fatalf("%s: Failed production key check: %v", name, err)
+		}
+	}
+
+	// The verbatim tokenizer's tokens equal their input, which is only
+	// acceptable if we know that we're dealing with the verbatim tokenizer.
+	tkzr := newVerbatimTokenizer()
+	_ = tkzr.resetKey()
+	if err := checkProductionKey(tkzr, &config{}); !errors.Is(err, errIdentityTokens) {
+		t.Fatalf("Expected error %v but got %v.", errIdentityTokens, err)
+	}
+}
+
+func TestCheckProductionKeyBinaryAlphabet(t *testing.T) {
+	comp, c, err := parseFlags("tkzr", []string{"-tokenizer", tokenizerFF1, "-ff1-alphabet", "01"})
+	if err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	assertEqual(t, len(productionProbe(c)), ff1MinLen(2))
+
+	comp.t.(configurer).setConfig(c)
+	if err := comp.t.resetKey(); err != nil {
+		t.Fatalf("Failed to reset key: %v", err)
+	}
+	if err := checkProductionKey(keyedStage(comp.t), c); err != nil {
+		t.Fatalf("Failed production key check: %v", err)
+	}
+}
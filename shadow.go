@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// shadowInboxSize is the number of inputs that may wait for the shadow
+	// pipeline.  Once they pile up beyond that, we drop inputs rather than
+	// slow down the primary pipeline.
+	shadowInboxSize = 1024
+
+	// The stages of the shadow pipeline whose errors we count.
+	shadowStageQueue    = "queue"
+	shadowStageSelfTest = "self-test"
+	shadowStageTokenize = "tokenize"
+	shadowStageForward  = "forward"
+)
+
+var (
+	errShadowSameTokenizer = errors.New("shadow tokenizer must differ from tokenizer")
+	errShadowAggregator    = errors.New("shadow tokenizer requires the simple or address aggregator")
+	errShadowKafkaTopic    = errors.New("shadow Kafka topic must be set and differ from Kafka topic")
+	errShadowForwarder     = errors.New("shadow forwarder must be set")
+	errShadowStdout        = errors.New("shadow forwarder cannot share stdout with forwarder")
+)
+
+// shadowPipeline runs a shadow tokenizer side by side with our primary
+// tokenizer, e.g., to migrate from one tokenizer to another.  The shadow
+// pipeline gets a copy of all input, tokenizes it using its own aggregator
+// and tokenizer, under its own key, and sends the tokens to its own
+// forwarder.  Downstream consumers can then backfill and validate the shadow
+// tokens before switching over.
+//
+// The shadow pipeline never holds up the primary pipeline: if it falls
+// behind, inputs are dropped.  Its errors are counted separately from the
+// primary pipeline's.
+type shadowPipeline struct {
+	conf *config
+	a    aggregator
+	t    tokenizer
+	f    forwarder
+	in   chan serializer
+	done chan empty
+}
+
+// newShadowPipeline returns a new shadow pipeline for the given tokenizer
+// chain, whose tokens are processed by the given aggregator and sent to the
+// given forwarder.  The pipeline's configuration is a copy of the given
+// primary configuration.  If the forwarder is Kafka, tokens are sent to the
+// given topic.
+func newShadowPipeline(c *config, chain, aggregator, forwarder, kafkaTopic string) (*shadowPipeline, error) {
+	name, newTokenizer, err := parseChain(chain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse shadow tokenizer: %w", err)
+	}
+	// Tokenizers persist, escrow, and log their keys by name, so the shadow
+	// tokenizer cannot be the same tokenizer.
+	if name == c.tokenizerName {
+		return nil, errShadowSameTokenizer
+	}
+	// The record aggregator creates its field policy's tokenizers, whose
+	// names would clash with the primary pipeline's.
+	if aggregator != aggregatorSimple && aggregator != aggregatorAddr {
+		return nil, errShadowAggregator
+	}
+	if forwarder == "" {
+		return nil, errShadowForwarder
+	}
+	newForwarder, exists := ourForwarders[forwarder]
+	if !exists {
+		return nil, errors.New("shadow forwarder does not exist")
+	}
+	// Both pipelines' tokens would end up interleaved on stdout, and
+	// downstream consumers couldn't tell them apart.
+	if forwarder == forwarderStdout && c.forwarderName == forwarderStdout {
+		return nil, errShadowStdout
+	}
+
+	sc := *c
+	sc.tokenizerName = name
+	sc.shadow = true
+	if forwarder == forwarderKafka {
+		if kafkaTopic == "" || kafkaTopic == c.kafkaConfig.topic {
+			return nil, errShadowKafkaTopic
+		}
+		kc := *c.kafkaConfig
+		kc.topic = kafkaTopic
+		sc.kafkaConfig = &kc
+	}
+
+	s := &shadowPipeline{
+		conf: &sc,
+		a:    ourAggregators[aggregator](),
+		t:    newTokenizer(),
+		f:    newForwarder(),
+		in:   make(chan serializer, shadowInboxSize),
+		done: make(chan empty),
+	}
+	if c.ipv4Prefixes != nil || c.ipv6Prefixes != nil {
+		s.t = newSubnetTokenizer(s.t, c.ipv4Prefixes, c.ipv6Prefixes)
+	}
+	l.Printf("Using shadow tokenizer=%s, forwarder=%s.", chain, forwarder)
+	return s, nil
+}
+
+// start configures and starts the shadow pipeline.  If the shadow tokenizer's
+// production key fails its self-test, the pipeline doesn't start, but the
+// primary pipeline is unaffected.
+func (s *shadowPipeline) start() error {
+	s.a.setConfig(s.conf)
+	s.f.setConfig(s.conf)
+	if t, ok := s.t.(configurer); ok {
+		t.setConfig(s.conf)
+	}
+	s.a.use(s.t)
+	s.a.connect(s.in, s.f.outbox())
+
+	s.a.start()
+	err := checkProductionKey(keyedStage(s.t), s.conf)
+	reportSelfTest(s.conf.tokenizerName, selfTestProduction, err)
+	if err != nil {
+		countShadowError(shadowStageSelfTest, err)
+		s.a.stop()
+		return err
+	}
+	s.f.start()
+	return nil
+}
+
+// stop stops the shadow pipeline, including the tee that feeds it.
+func (s *shadowPipeline) stop() {
+	close(s.done)
+	s.a.stop()
+	s.f.stop()
+	l.Println("Stopped shadow pipeline.")
+}
+
+// tee copies all input from the given inbox to the shadow pipeline and
+// returns the inbox that the primary pipeline must read from instead.
+func (s *shadowPipeline) tee(inbox chan serializer) chan serializer {
+	primary := make(chan serializer, inboxSize)
+	go func() {
+		for {
+			select {
+			case <-s.done:
+				return
+			case in := <-inbox:
+				select {
+				case s.in <- in:
+				default:
+					countShadowError(shadowStageQueue, errors.New("shadow inbox is full"))
+				}
+				select {
+				case <-s.done:
+					return
+				case primary <- in:
+				}
+			}
+		}
+	}()
+	return primary
+}
+
+// countShadowError counts the given error that the given stage of the shadow
+// pipeline ran into.  A batchError counts once per failed item.
+func countShadowError(stage string, err error) {
+	n := 1
+	var errs batchError
+	if errors.As(err, &errs) {
+		n = len(errs)
+	}
+	m.shadowErrors.With(prometheus.Labels{shadowStage: stage}).Add(float64(n))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// captureForwarder implements a forwarder that keeps tokens in its outbox, so
+// tests can inspect them.
+type captureForwarder struct {
+	out chan token
+}
+
+func newCaptureForwarder() *captureForwarder {
+	return &captureForwarder{out: make(chan token, 10)}
+}
+
+func (c *captureForwarder) setConfig(*config)  {}
+func (c *captureForwarder) outbox() chan token { return c.out }
+func (c *captureForwarder) start()             {}
+func (c *captureForwarder) stop()              {}
+
+func newTestShadow(t *testing.T) *shadowPipeline {
+	t.Helper()
+	c := &config{
+		tokenizerName: tokenizerVerbatim,
+		keyExpiry:     time.Hour,
+		fwdInterval:   time.Hour,
+	}
+	s, err := newShadowPipeline(c, tokenizerHmac, aggregatorSimple, forwarderStdout, "")
+	if err != nil {
+		t.Fatalf("Failed to create shadow pipeline: %v", err)
+	}
+	return s
+}
+
+func TestShadowPipeline(t *testing.T) {
+	s := newTestShadow(t)
+	f := newCaptureForwarder()
+	s.f = f
+	if err := s.start(); err != nil {
+		t.Fatalf("Failed to start shadow pipeline: %v", err)
+	}
+	defer s.stop()
+
+	inbox := make(chan serializer)
+	primary := s.tee(inbox)
+	in := blob("foo")
+	inbox <- in
+
+	// The primary pipeline gets the input as is while the shadow pipeline
+	// tokenizes it under its own key.
+	if got := <-primary; !bytes.Equal(got.bytes(), in) {
+		t.Fatalf("Expected %q but got %q.", in, got.bytes())
+	}
+	expected, err := s.t.tokenize(in)
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	select {
+	case got := <-f.out:
+		if !bytes.Equal(got, expected) {
+			t.Fatalf("Expected %x but got %x.", expected, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected shadow token but got none.")
+	}
+}
+
+func TestShadowQueueFull(t *testing.T) {
+	s := newTestShadow(t)
+	// Nobody reads the shadow pipeline's inbox.
+	s.in = make(chan serializer)
+	defer close(s.done)
+
+	dropped := m.shadowErrors.With(prometheus.Labels{shadowStage: shadowStageQueue})
+	before := testutil.ToFloat64(dropped)
+	inbox := make(chan serializer)
+	primary := s.tee(inbox)
+	for i := 0; i < 3; i++ {
+		inbox <- blob("foo")
+		<-primary
+	}
+	assertEqual(t, testutil.ToFloat64(dropped)-before, float64(3))
+}
+
+func TestNewShadowPipeline(t *testing.T) {
+	c := &config{
+		tokenizerName: tokenizerCryptoPAn,
+		forwarderName: forwarderStdout,
+		kafkaConfig:   &kafkaConfig{topic: "primary"},
+	}
+	tests := []struct {
+		chain      string
+		aggregator string
+		forwarder  string
+		topic      string
+		err        error
+	}{
+		{tokenizerCryptoPAn, aggregatorAddr, forwarderStdout, "", errShadowSameTokenizer},
+		{"mask:/24 | " + tokenizerCryptoPAn, aggregatorAddr, forwarderStdout, "", errShadowSameTokenizer},
+		{tokenizerIPCryptPfx, aggregatorRecord, forwarderStdout, "", errShadowAggregator},
+		{tokenizerIPCryptPfx, aggregatorAddr, "", "", errShadowForwarder},
+		{tokenizerIPCryptPfx, aggregatorAddr, forwarderStdout, "", errShadowStdout},
+		{tokenizerIPCryptPfx, aggregatorAddr, forwarderKafka, "", errShadowKafkaTopic},
+		{tokenizerIPCryptPfx, aggregatorAddr, forwarderKafka, "primary", errShadowKafkaTopic},
+		{tokenizerIPCryptPfx, aggregatorAddr, forwarderKafka, "shadow", nil},
+	}
+	for _, test := range tests {
+		s, err := newShadowPipeline(c, test.chain, test.aggregator, test.forwarder, test.topic)
+		if !errors.Is(err, test.err) {
+			t.Fatalf("Expected error '%v' but got '%v'.", test.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		assertEqual(t, s.conf.tokenizerName, tokenizerIPCryptPfx)
+		assertEqual(t, s.conf.shadow, true)
+		assertEqual(t, s.conf.kafkaConfig.topic, "shadow")
+		// The primary pipeline's configuration must remain untouched.
+		assertEqual(t, c.shadow, false)
+		assertEqual(t, c.kafkaConfig.topic, "primary")
+	}
+}
+
+func TestShadowMetrics(t *testing.T) {
+	c := &config{
+		keyExpiry:   time.Hour,
+		fwdInterval: time.Hour,
+		shadow:      true,
+	}
+	primary, shadow := metricsFor(pipelinePrimary), metricsFor(pipelineShadow)
+	primaryAddrs := testutil.ToFloat64(primary.numAddrs)
+	primaryTokenized := testutil.ToFloat64(primary.tokenized(success))
+	shadowTokenized := testutil.ToFloat64(shadow.tokenized(success))
+
+	tkzr := newCryptoPAnTokenizer()
+	tkzr.(configurer).setConfig(c)
+	_ = tkzr.resetKey()
+	a := newAddrAggregator().(*addrAggregator)
+	a.setConfig(c)
+	a.use(tkzr)
+	req := &clientRequest{Addr: netip.MustParseAddr("1.2.3.4"), Wallet: newV4(t)}
+	if err := a.processRequest(req); err != nil {
+		t.Fatalf("Failed to process request: %v", err)
+	}
+
+	// The shadow pipeline's metrics must leave the primary pipeline's alone.
+	assertEqual(t, testutil.ToFloat64(shadow.numAddrs), float64(1))
+	assertEqual(t, testutil.ToFloat64(shadow.tokenized(success))-shadowTokenized, float64(1))
+	assertEqual(t, testutil.ToFloat64(primary.numAddrs), primaryAddrs)
+	assertEqual(t, testutil.ToFloat64(primary.tokenized(success)), primaryTokenized)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// shamirMaxShares is the largest number of shares, because each share's x
+// coordinate is a non-zero element of GF(2^8).
+const shamirMaxShares = 255
+
+var (
+	errBadThreshold   = errors.New("threshold must be at least 2 and at most the number of shares")
+	errTooManyShares  = errors.New("Shamir's scheme supports at most 255 shares")
+	errTooFewShares   = errors.New("not enough shares to reconstruct secret")
+	errBadShare       = errors.New("share is malformed")
+	errDuplicateShare = errors.New("share appears more than once")
+)
+
+// shamirShare represents one share of a secret that was split using Shamir's
+// secret sharing scheme over GF(2^8).  Each byte of the secret is split
+// independently, so a share's y coordinates are as long as the secret.
+type shamirShare struct {
+	x byte
+	y []byte
+}
+
+// shamirSplit splits the given secret into n shares, any t of which can
+// reconstruct the secret while fewer than t reveal nothing about it.
+func shamirSplit(secret []byte, n, t int) ([]*shamirShare, error) {
+	if n > shamirMaxShares {
+		return nil, errTooManyShares
+	}
+	if t < 2 || t > n {
+		return nil, errBadThreshold
+	}
+
+	shares := make([]*shamirShare, n)
+	for i := range shares {
+		shares[i] = &shamirShare{x: byte(i + 1), y: make([]byte, len(secret))}
+	}
+	// For each byte of the secret, we pick a random polynomial of degree t-1
+	// whose constant term is the byte, and evaluate it at each share's x.
+	coeffs := make([]byte, t)
+	defer zeroize(coeffs)
+	for i, b := range secret {
+		coeffs[0] = b
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for _, s := range shares {
+			s.y[i] = gfEval(coeffs, s.x)
+		}
+	}
+	return shares, nil
+}
+
+// shamirCombine reconstructs the secret from the given shares using Lagrange
+// interpolation at x = 0.  The caller must provide at least as many shares as
+// the secret's threshold; fewer shares result in garbage rather than an
+// error, which is the point of the scheme.
+func shamirCombine(shares []*shamirShare) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errTooFewShares
+	}
+	seen := make(map[byte]bool)
+	for _, s := range shares {
+		if s.x == 0 || len(s.y) != len(shares[0].y) {
+			return nil, errBadShare
+		}
+		if seen[s.x] {
+			return nil, errDuplicateShare
+		}
+		seen[s.x] = true
+	}
+
+	secret := make([]byte, len(shares[0].y))
+	for i, s := range shares {
+		// The Lagrange basis polynomial of share i at x = 0 is the product
+		// of x_j / (x_j - x_i) over all other shares j.  Subtraction is
+		// addition (XOR) in GF(2^8).
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = gfMul(basis, gfDiv(other.x, other.x^s.x))
+			}
+		}
+		for k := range secret {
+			secret[k] ^= gfMul(basis, s.y[k])
+		}
+	}
+	return secret, nil
+}
+
+// gfEval evaluates the polynomial with the given coefficients, lowest degree
+// first, at x using Horner's method.
+func gfEval(coeffs []byte, x byte) byte {
+	var y byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coeffs[i]
+	}
+	return y
+}
+
+// gfMul multiplies a and b in GF(2^8) modulo AES's polynomial
+// x^8 + x^4 + x^3 + x + 1.  We don't use lookup tables, so the running time
+// doesn't depend on secret-dependent memory accesses.
+func gfMul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		a = (a << 1) ^ (-(a >> 7) & 0x1b)
+		b >>= 1
+	}
+	return p
+}
+
+// gfDiv divides a by b in GF(2^8), which must not be zero.  We multiply a by
+// b's inverse, which is b^254.
+func gfDiv(a, b byte) byte {
+	inv := byte(1)
+	for i := 0; i < 254; i++ {
+		inv = gfMul(inv, b)
+	}
+	return gfMul(a, inv)
+}
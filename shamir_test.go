@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestShamirRoundTrip(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := shamirSplit(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("Failed to split secret: %v", err)
+	}
+	assertEqual(t, len(shares), 5)
+
+	// Any three shares reconstruct the secret.
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var some []*shamirShare
+		for _, i := range subset {
+			some = append(some, shares[i])
+		}
+		combined, err := shamirCombine(some)
+		if err != nil {
+			t.Fatalf("Failed to combine shares %v: %v", subset, err)
+		}
+		if !bytes.Equal(combined, secret) {
+			t.Fatalf("Expected shares %v to reconstruct secret.", subset)
+		}
+	}
+
+	// Two shares don't.
+	combined, err := shamirCombine(shares[:2])
+	if err != nil {
+		t.Fatalf("Failed to combine shares: %v", err)
+	}
+	if bytes.Equal(combined, secret) {
+		t.Fatal("Expected two shares not to reconstruct secret.")
+	}
+}
+
+func TestShamirBadParameters(t *testing.T) {
+	for _, p := range []struct{ n, t int }{{3, 1}, {3, 4}, {1, 1}} {
+		if _, err := shamirSplit([]byte("secret"), p.n, p.t); !errors.Is(err, errBadThreshold) {
+			t.Fatalf("Expected error '%v' for n=%d, t=%d but got '%v'.", errBadThreshold, p.n, p.t, err)
+		}
+	}
+	if _, err := shamirSplit([]byte("secret"), shamirMaxShares+1, 2); !errors.Is(err, errTooManyShares) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errTooManyShares, err)
+	}
+}
+
+func TestShamirBadShares(t *testing.T) {
+	shares, err := shamirSplit([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatalf("Failed to split secret: %v", err)
+	}
+	for _, test := range []struct {
+		shares []*shamirShare
+		err    error
+	}{
+		{shares[:1], errTooFewShares},
+		{[]*shamirShare{shares[0], shares[0]}, errDuplicateShare},
+		{[]*shamirShare{shares[0], {x: 0, y: shares[1].y}}, errBadShare},
+		{[]*shamirShare{shares[0], {x: 2, y: []byte("short")}}, errBadShare},
+	} {
+		if _, err := shamirCombine(test.shares); !errors.Is(err, test.err) {
+			t.Fatalf("Expected error '%v' but got '%v'.", test.err, err)
+		}
+	}
+}
+
+func TestGFArithmetic(t *testing.T) {
+	// The example of FIPS 197, section 4.2.
+	assertEqual(t, gfMul(0x57, 0x83), byte(0xc1))
+	for a := 1; a < 256; a++ {
+		assertEqual(t, gfMul(gfDiv(1, byte(a)), byte(a)), byte(1))
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+var (
+	errBadSIVKeySize = errors.New("AES-SIV requires a 32, 48, or 64-byte key")
+	errSIVOpen       = errors.New("AES-SIV authentication failed")
+)
+
+// aesSIV implements AES-SIV as specified in RFC 5297.  AES-SIV is a
+// deterministic authenticated encryption scheme: a given plaintext and
+// associated data always result in the same ciphertext.
+type aesSIV struct {
+	// key is the concatenation of the S2V key and the CTR key.  It lives in
+	// locked memory.
+	key []byte
+}
+
+// newAESSIV returns a new AES-SIV instance using a copy of the given key.
+// The first half of the key is used for S2V and the second half for CTR mode.
+func newAESSIV(key []byte) (*aesSIV, error) {
+	if len(key) != 32 && len(key) != 48 && len(key) != 64 {
+		return nil, errBadSIVKeySize
+	}
+	c, err := locked.copyOf(key)
+	if err != nil {
+		return nil, err
+	}
+	return &aesSIV{key: c}, nil
+}
+
+// ciphers returns the AES instances for S2V and CTR mode.  We expand the keys
+// for each operation instead of keeping their key schedules around, so the
+// subkeys never outlive the operation on Go's heap.
+func (s *aesSIV) ciphers() (mac, ctr cipher.Block, err error) {
+	half := len(s.key) / 2
+	if mac, err = aes.NewCipher(s.key[:half]); err != nil {
+		return nil, nil, err
+	}
+	if ctr, err = aes.NewCipher(s.key[half:]); err != nil {
+		return nil, nil, err
+	}
+	return mac, ctr, nil
+}
+
+// seal encrypts and authenticates the given plaintext and authenticates the
+// given associated data.  The result is the concatenation of the synthetic IV
+// and the ciphertext.
+func (s *aesSIV) seal(plaintext []byte, ad ...[]byte) ([]byte, error) {
+	mac, ctr, err := s.ciphers()
+	if err != nil {
+		return nil, err
+	}
+	v := s2v(mac, plaintext, ad...)
+	out := make([]byte, aes.BlockSize+len(plaintext))
+	copy(out, v[:])
+	xorKeyStream(ctr, out[aes.BlockSize:], plaintext, v)
+	return out, nil
+}
+
+// open authenticates and decrypts the given ciphertext, which must have been
+// created by seal.
+func (s *aesSIV) open(ciphertext []byte, ad ...[]byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errSIVOpen
+	}
+	mac, ctr, err := s.ciphers()
+	if err != nil {
+		return nil, err
+	}
+	var v [aes.BlockSize]byte
+	copy(v[:], ciphertext)
+	plaintext := make([]byte, len(ciphertext)-aes.BlockSize)
+	xorKeyStream(ctr, plaintext, ciphertext[aes.BlockSize:], v)
+
+	expected := s2v(mac, plaintext, ad...)
+	if subtle.ConstantTimeCompare(expected[:], v[:]) != 1 {
+		return nil, errSIVOpen
+	}
+	return plaintext, nil
+}
+
+// free zeroizes and frees the key.
+func (s *aesSIV) free() {
+	locked.free(s.key)
+	s.key = nil
+}
+
+// xorKeyStream runs AES-CTR over src, using the synthetic IV with its 31st
+// and 63rd bit cleared as counter.
+func xorKeyStream(ctr cipher.Block, dst, src []byte, v [aes.BlockSize]byte) {
+	v[8] &= 0x7f
+	v[12] &= 0x7f
+	cipher.NewCTR(ctr, v[:]).XORKeyStream(dst, src)
+}
+
+// s2v implements the S2V construction from RFC 5297, section 2.4.
+func s2v(mac cipher.Block, plaintext []byte, ad ...[]byte) [aes.BlockSize]byte {
+	var zero [aes.BlockSize]byte
+	d := cmac(mac, zero[:])
+	for _, a := range ad {
+		d = dbl(d)
+		m := cmac(mac, a)
+		subtle.XORBytes(d[:], d[:], m[:])
+	}
+
+	var t []byte
+	if len(plaintext) >= aes.BlockSize {
+		t = make([]byte, len(plaintext))
+		copy(t, plaintext)
+		end := t[len(t)-aes.BlockSize:]
+		subtle.XORBytes(end, end, d[:])
+	} else {
+		d = dbl(d)
+		t = make([]byte, aes.BlockSize)
+		copy(t, plaintext)
+		t[len(plaintext)] = 0x80
+		subtle.XORBytes(t, t, d[:])
+	}
+	return cmac(mac, t)
+}
+
+// cmac implements AES-CMAC as specified in RFC 4493.
+func cmac(b cipher.Block, msg []byte) [aes.BlockSize]byte {
+	var l, x [aes.BlockSize]byte
+	b.Encrypt(l[:], l[:])
+	k1 := dbl(l)
+	k2 := dbl(k1)
+
+	// Process all but the last block.
+	n := (len(msg) + aes.BlockSize - 1) / aes.BlockSize
+	if n == 0 {
+		n = 1
+	}
+	for i := 0; i < n-1; i++ {
+		subtle.XORBytes(x[:], x[:], msg[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		b.Encrypt(x[:], x[:])
+	}
+
+	// The last block is either complete, in which case we XOR it with k1, or
+	// incomplete, in which case we pad it and XOR it with k2.
+	var last [aes.BlockSize]byte
+	rest := msg[(n-1)*aes.BlockSize:]
+	copy(last[:], rest)
+	if len(rest) == aes.BlockSize {
+		subtle.XORBytes(last[:], last[:], k1[:])
+	} else {
+		last[len(rest)] = 0x80
+		subtle.XORBytes(last[:], last[:], k2[:])
+	}
+	subtle.XORBytes(x[:], x[:], last[:])
+	b.Encrypt(x[:], x[:])
+	return x
+}
+
+// dbl multiplies the given block by x in GF(2^128).
+func dbl(b [aes.BlockSize]byte) [aes.BlockSize]byte {
+	var out [aes.BlockSize]byte
+	for i := 0; i < aes.BlockSize-1; i++ {
+		out[i] = b[i]<<1 | b[i+1]>>7
+	}
+	out[aes.BlockSize-1] = b[aes.BlockSize-1] << 1
+	if b[0]&0x80 != 0 {
+		out[aes.BlockSize-1] ^= 0x87
+	}
+	return out
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestCMAC(t *testing.T) {
+	// Test vectors are taken from RFC 4493, section 4.
+	key := mustDecodeHex(t, "2b7e151628aed2a6abf7158809cf4f3c")
+	tests := []struct {
+		msg, expected string
+	}{
+		{"", "bb1d6929e95937287fa37d129b756746"},
+		{"6bc1bee22e409f96e93d7e117393172a", "070a16b46b4d4144f79bdd9dd04a287c"},
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("Failed to create AES cipher: %v", err)
+	}
+	for _, test := range tests {
+		mac := cmac(b, mustDecodeHex(t, test.msg))
+		assertEqual(t, hex.EncodeToString(mac[:]), test.expected)
+	}
+}
+
+func TestAESSIV(t *testing.T) {
+	// Test vector is taken from RFC 5297, appendix A.1.
+	key := mustDecodeHex(t, "fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	ad := mustDecodeHex(t, "101112131415161718191a1b1c1d1e1f2021222324252627")
+	plaintext := mustDecodeHex(t, "112233445566778899aabbccddee")
+	expected := "85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c"
+
+	s, err := newAESSIV(key)
+	if err != nil {
+		t.Fatalf("Failed to create AES-SIV: %v", err)
+	}
+	defer s.free()
+	ct, err := s.seal(plaintext, ad)
+	if err != nil {
+		t.Fatalf("Failed to seal plaintext: %v", err)
+	}
+	assertEqual(t, hex.EncodeToString(ct), expected)
+
+	pt, err := s.open(ct, ad)
+	if err != nil {
+		t.Fatalf("Failed to open ciphertext: %v", err)
+	}
+	assertEqual(t, hex.EncodeToString(pt), hex.EncodeToString(plaintext))
+
+	// Tampering with the ciphertext or the associated data must be detected.
+	ct[len(ct)-1] ^= 1
+	if _, err := s.open(ct, ad); !errors.Is(err, errSIVOpen) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errSIVOpen, err)
+	}
+	ct[len(ct)-1] ^= 1
+	if _, err := s.open(ct, []byte("foo")); !errors.Is(err, errSIVOpen) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errSIVOpen, err)
+	}
+}
+
+func TestAESSIVBadKeySize(t *testing.T) {
+	if _, err := newAESSIV(make([]byte, 16)); !errors.Is(err, errBadSIVKeySize) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadSIVKeySize, err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+// runDetokenize implements the "detokenize" subcommand, which asks a running
+// tkzr's admin API to turn the given token back into its original data.  We
+// authenticate using a client certificate or the detokenization bearer token,
+// which is read from an environment variable rather than a flag, to keep it
+// out of our shell history.
+func runDetokenize(progname string, args []string) error {
+	var adminURL, rawKeyID, rawToken, caFile, certFile, keyFile string
+
+	fs := flag.NewFlagSet(progname+" "+subcommandDetokenize, flag.ContinueOnError)
+	fs.StringVar(&adminURL, "admin-url", "https://127.0.0.1:8081",
+		"The URL of tkzr's admin API.  Detokenization requires HTTPS.")
+	fs.StringVar(&rawKeyID, "keyid", "",
+		"The key ID that the token was created with.")
+	fs.StringVar(&rawToken, "token", "",
+		"The base64-encoded token to detokenize.")
+	fs.StringVar(&caFile, "ca-file", "",
+		"File containing the CAs that the admin API's certificate chains to, if not the system's.")
+	fs.StringVar(&certFile, "cert-file", "",
+		"File containing our client certificate, for mutual TLS.")
+	fs.StringVar(&keyFile, "key-file", "",
+		"File containing our client certificate's private key.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	authToken, exists := os.LookupEnv(envDetokenizeToken)
+	if !exists && certFile == "" {
+		return fmt.Errorf("%s: %w", envDetokenizeToken, errEnvVarUnset)
+	}
+	client, err := newDetokenizeClient(caFile, certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	id, err := uuid.Parse(rawKeyID)
+	if err != nil {
+		return fmt.Errorf("failed to parse key ID: %w", err)
+	}
+	t, err := base64.StdEncoding.DecodeString(rawToken)
+	if err != nil {
+		return fmt.Errorf("failed to decode token: %w", err)
+	}
+
+	data, err := requestDetokenize(client, adminURL, authToken, &detokenizeRequest{
+		KeyID: id,
+		Token: t,
+	})
+	if err != nil {
+		return err
+	}
+	// IP addresses are the most common kind of data that we tokenize, so we
+	// print them in a human-readable format.
+	if len(data) == net.IPv4len || len(data) == net.IPv6len {
+		fmt.Println(net.IP(data))
+	} else {
+		fmt.Println(string(data))
+	}
+	return nil
+}
+
+// newDetokenizeClient returns an HTTP client that trusts the CAs in the given
+// file, or the system's if no file is given, and presents the given client
+// certificate, if any.
+func newDetokenizeClient(caFile, certFile, keyFile string) (*http.Client, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		caBundle, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, errBadCABundle
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: conf},
+	}, nil
+}
+
+// requestDetokenize uses the given client to send the given detokenize
+// request to the admin API at the given URL and returns the detokenized data.
+// The bearer token is optional if the client presents a certificate.
+func requestDetokenize(client *http.Client, adminURL, authToken string, req *detokenizeRequest) ([]byte, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest(
+		http.MethodPost,
+		strings.TrimSuffix(adminURL, "/")+adminDetokenizePath,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if authToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+authToken)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, errors.New(strings.TrimSpace(string(msg)))
+	}
+	var detokenized detokenizeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&detokenized); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return detokenized.Data, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	uuid "github.com/google/uuid"
+)
+
+const (
+	escrowKeygen  = "keygen"
+	escrowCombine = "combine"
+	escrowVerify  = "verify"
+)
+
+var errNoEscrowCommand = errors.New("escrow requires one of the commands: keygen, combine, verify")
+
+// runEscrow implements the "escrow" subcommand, which custodians use to
+// create their key pairs and to reconstruct escrowed keys.  None of its
+// commands talk to a running tkzr.
+func runEscrow(progname string, args []string) error {
+	if len(args) == 0 {
+		return errNoEscrowCommand
+	}
+	name := progname + " " + subcommandEscrow + " " + args[0]
+	switch args[0] {
+	case escrowKeygen:
+		return runEscrowKeygen(name, args[1:])
+	case escrowCombine, escrowVerify:
+		return runEscrowRecover(name, args[0], args[1:])
+	default:
+		return errNoEscrowCommand
+	}
+}
+
+// runEscrowKeygen creates a custodian's X25519 key pair.  The private key is
+// written to the given file, which must not exist yet, and the public key is
+// printed, so it can be added to tkzr's custodian file.
+func runEscrowKeygen(name string, args []string) error {
+	var out string
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&out, "out", "",
+		"File to write the hex-encoded private key to.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if out == "" {
+		return errors.New("-out is required")
+	}
+
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(identity.Bytes())); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Println(hex.EncodeToString(identity.PublicKey().Bytes()))
+	return nil
+}
+
+// runEscrowRecover reconstructs the key in the given escrow bundle from the
+// given custodians' private keys.  The "combine" command prints the
+// hex-encoded key while the "verify" command only makes sure that the bundle
+// can be opened and that it contains the key with the given ID.
+func runEscrowRecover(name, command string, args []string) error {
+	var bundleFile, identityFiles, rawKeyID string
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&bundleFile, "bundle", "",
+		"The escrow bundle's file.")
+	fs.StringVar(&identityFiles, "identities", "",
+		"Comma-separated list of files that contain the custodians' hex-encoded private keys.")
+	if command == escrowVerify {
+		fs.StringVar(&rawKeyID, "keyid", "",
+			"The key ID that the bundle must contain, e.g., as reported by tkzr.  If unset, the bundle's key ID is checked.")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	b, err := loadEscrowBundle(bundleFile)
+	if err != nil {
+		return fmt.Errorf("failed to load escrow bundle: %w", err)
+	}
+	if rawKeyID != "" {
+		id, err := uuid.Parse(rawKeyID)
+		if err != nil {
+			return fmt.Errorf("failed to parse key ID: %w", err)
+		}
+		if id != b.KeyID {
+			return fmt.Errorf("%w: bundle contains key %s", errEscrowKeyMismatch, b.KeyID)
+		}
+	}
+	var identities []*ecdh.PrivateKey
+	for _, path := range strings.Split(identityFiles, ",") {
+		if path == "" {
+			continue
+		}
+		identity, err := loadIdentity(path)
+		if err != nil {
+			return fmt.Errorf("failed to load private key %s: %w", path, err)
+		}
+		identities = append(identities, identity)
+	}
+
+	material, err := b.recover(identities)
+	if err != nil {
+		return err
+	}
+	defer zeroize(material)
+	if command == escrowCombine {
+		fmt.Println(hex.EncodeToString(material))
+		return nil
+	}
+	fmt.Printf("Escrow bundle of %s key %s is intact and opens with %d of %d shares.\n",
+		b.Tokenizer, b.KeyID, len(identities), len(b.Shares))
+	return nil
+}
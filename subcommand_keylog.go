@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+const (
+	keyLogVerify = "verify"
+	// keyLogSlack is how late a key may be replaced before we consider its
+	// rotation late.
+	keyLogSlack = time.Minute
+)
+
+var (
+	errNoKeyLogCommand = errors.New("keylog requires the command: verify")
+	errBadPublicKey    = fmt.Errorf("public key must be a hex-encoded %d-byte Ed25519 key", ed25519.PublicKeySize)
+	errLateRotation    = errors.New("key was rotated after it expired")
+	errKeyIDNotLogged  = errors.New("key ID is not in key log")
+)
+
+// runKeyLog implements the "keylog" subcommand, which verifies a key log that
+// tkzr serves or wrote to disk.
+func runKeyLog(progname string, args []string) error {
+	if len(args) == 0 || args[0] != keyLogVerify {
+		return errNoKeyLogCommand
+	}
+	var logLocation, rawPubKey, rawKeyID string
+
+	fs := flag.NewFlagSet(progname+" "+subcommandKeyLog+" "+keyLogVerify, flag.ContinueOnError)
+	fs.StringVar(&logLocation, "log", "",
+		"The key log's file or URL, e.g. \"https://tkzr.example/v1/keylog\".")
+	fs.StringVar(&rawPubKey, "pubkey", "",
+		"The hex-encoded Ed25519 public key that the key log's entries must be signed with.")
+	fs.StringVar(&rawKeyID, "keyid", "",
+		"Report when the key with the given ID was created and replaced.")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	pub, err := hex.DecodeString(rawPubKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errBadPublicKey
+	}
+	r, err := openKeyLog(logLocation)
+	if err != nil {
+		return fmt.Errorf("failed to open key log: %w", err)
+	}
+	defer r.Close()
+	entries, err := verifyKeyLog(r, pub)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Verified %d key log entries.\n", len(entries))
+
+	if rawKeyID != "" {
+		id, err := uuid.Parse(rawKeyID)
+		if err != nil {
+			return fmt.Errorf("failed to parse key ID: %w", err)
+		}
+		if err := reportKey(entries, id); err != nil {
+			return err
+		}
+	}
+	late := lateRotations(entries, time.Now())
+	for _, e := range late {
+		fmt.Printf("Late: %s key %s expired at %s.\n", e.Tokenizer, e.KeyID, e.Expires)
+	}
+	if len(late) > 0 {
+		return fmt.Errorf("%w: %d key(s)", errLateRotation, len(late))
+	}
+	return nil
+}
+
+// openKeyLog opens the key log at the given location, which is either a file
+// or an HTTP(S) URL.
+func openKeyLog(location string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return os.Open(location)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server responded with %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// reportKey prints when the key with the given ID was logged and, if it was,
+// when it was replaced.
+func reportKey(entries []*keyLogEntry, id uuid.UUID) error {
+	for i, e := range entries {
+		if e.KeyID != id {
+			continue
+		}
+		fmt.Printf("%s key %s was logged at %s for the epoch from %s to %s.\n",
+			e.Tokenizer, e.KeyID, e.Time, e.Starts, e.Expires)
+		for _, next := range entries[i+1:] {
+			if next.PrevKeyID != nil && *next.PrevKeyID == id {
+				fmt.Printf("It was replaced by key %s at %s.\n", next.KeyID, next.Time)
+				return nil
+			}
+		}
+		fmt.Println("It has not been replaced.")
+		return nil
+	}
+	return errKeyIDNotLogged
+}
+
+// lateRotations returns the entries whose keys were replaced, or are still
+// not replaced at the given time, more than keyLogSlack after they expired.
+func lateRotations(entries []*keyLogEntry, now time.Time) []*keyLogEntry {
+	var late []*keyLogEntry
+	for i, e := range entries {
+		if e.Expires.IsZero() {
+			continue
+		}
+		replaced := now
+		for _, next := range entries[i+1:] {
+			if next.PrevKeyID != nil && *next.PrevKeyID == e.KeyID {
+				replaced = next.Time
+				break
+			}
+		}
+		if replaced.After(e.Expires.Add(keyLogSlack)) {
+			late = append(late, e)
+		}
+	}
+	return late
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// The separator of a chain's stages, e.g. "mask:/24 | cryptopan | ip".
+	chainSeparator = "|"
+	// The separator of a stage's name and its argument, e.g. "truncate:64".
+	stageArgSeparator = ":"
+
+	stageMask           = "mask"
+	stageNormalizeEmail = "normalize-email"
+	stageTruncate       = "truncate"
+	stageBase32         = "base32"
+	stageBase64         = "base64"
+	stageHex            = "hex"
+	stageIP             = "ip"
+)
+
+var (
+	errNoSuchStage        = errors.New("no such tokenizer or transform")
+	errNoKeyedStage       = errors.New("chain must contain exactly one tokenizer")
+	errStageAfterEncoding = errors.New("no stage may follow an encoding")
+	errBadStageArg        = errors.New("bad stage argument")
+	errBadEmail           = errors.New("not an email address")
+	errShortToken         = errors.New("token is shorter than truncation length")
+	errNotAnAddr          = errors.New("token is neither of length IPv4 nor IPv6")
+
+	// ourStages maps the names of our transforms to functions that build the
+	// transform from its (possibly empty) argument.
+	ourStages = map[string]func(arg string) (*chainStage, error){
+		stageMask:           newMaskStage,
+		stageNormalizeEmail: withoutArg(normalizeEmailStage),
+		stageTruncate:       newTruncateStage,
+		stageBase32:         withoutArg(encodingStage(stageBase32, base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString)),
+		stageBase64:         withoutArg(encodingStage(stageBase64, base64.StdEncoding.EncodeToString)),
+		stageHex:            withoutArg(encodingStage(stageHex, hex.EncodeToString)),
+		stageIP:             withoutArg(ipStage),
+	}
+)
+
+// chainStage represents a keyless transform that is part of a tokenizer
+// chain.  Stages before the chain's tokenizer transform its input while stages
+// after the tokenizer transform its tokens.
+type chainStage struct {
+	name      string
+	transform func([]byte) ([]byte, error)
+	// Does the transform's output have the same length as its input?
+	keepsLen bool
+	// Is the transform's output printable?  No stage may follow a stage
+	// whose output is printable.
+	encodes bool
+}
+
+// chainTokenizer implements a tokenizer that is a pipeline of transforms
+// around a single tokenizer, e.g. "mask:/24 | cryptopan | ip".  Key management
+// is left to the wrapped tokenizer, so the chain's key IDs and key rotation
+// are the wrapped tokenizer's.  Transforms are one-way, so a chain cannot
+// detokenize.
+type chainTokenizer struct {
+	tokenizer
+	pre, post []*chainStage
+}
+
+// granularChainTokenizer implements a chain whose tokenizer is granular.
+type granularChainTokenizer struct {
+	*chainTokenizer
+}
+
+// newChainTokenizer returns a new chain that applies the given stages before
+// and after the given tokenizer.  If the tokenizer is granular, so is the
+// chain.
+func newChainTokenizer(pre []*chainStage, t tokenizer, post []*chainStage) tokenizer {
+	c := &chainTokenizer{tokenizer: t, pre: pre, post: post}
+	if _, ok := t.(granularTokenizer); ok {
+		return &granularChainTokenizer{c}
+	}
+	return c
+}
+
+// asChain returns the given tokenizer as a chain, if it is one.
+func asChain(t tokenizer) (*chainTokenizer, bool) {
+	switch c := t.(type) {
+	case *chainTokenizer:
+		return c, true
+	case *granularChainTokenizer:
+		return c.chainTokenizer, true
+	default:
+		return nil, false
+	}
+}
+
+// keyedStage returns the tokenizer that the given chain wraps, or the given
+// tokenizer if it isn't a chain.
+func keyedStage(t tokenizer) tokenizer {
+	if c, ok := asChain(t); ok {
+		return c.tokenizer
+	}
+	return t
+}
+
+// emitsText returns true if the given tokenizer's tokens are printable text,
+// either because the tokenizer emits text or because it's a chain that ends in
+// an encoding stage.
+func emitsText(t tokenizer) bool {
+	if c, ok := asChain(t); ok {
+		if c.encodes() {
+			return true
+		}
+		if len(c.post) > 0 {
+			return false
+		}
+		t = c.tokenizer
+	}
+	tt, ok := t.(textTokenizer)
+	return ok && tt.emitsText()
+}
+
+// printable returns a tokenizer whose tokens are printable.  If the given
+// tokenizer's tokens aren't printable already, we append an encoding stage:
+// tokens that have the length of an IP address become IP addresses again and
+// all other tokens are base64-encoded.
+func printable(t tokenizer) tokenizer {
+	if emitsText(t) {
+		return t
+	}
+	c, ok := asChain(t)
+	if !ok {
+		c = &chainTokenizer{tokenizer: t}
+	}
+	stage := encodingStage(stageBase64, base64.StdEncoding.EncodeToString)
+	if t.preservesLen() {
+		stage = ipStage
+	}
+	post := append(append([]*chainStage{}, c.post...), stage)
+	return newChainTokenizer(c.pre, c.tokenizer, post)
+}
+
+// chainSpecOf returns the spec of the given tokenizer, whose keyed stage has
+// the given name, e.g. "mask:/24|cryptopan|ip".  Subnet tokenizers don't show
+// up in the spec; they are described by the tokenizer that they wrap.
+func chainSpecOf(t tokenizer, keyed string) string {
+	if s, ok := t.(*subnetTokenizer); ok {
+		return chainSpecOf(s.tokenizer, keyed)
+	}
+	c, ok := asChain(t)
+	if !ok {
+		return keyed
+	}
+	var stages []string
+	for _, stage := range c.pre {
+		stages = append(stages, stage.name)
+	}
+	stages = append(stages, chainSpecOf(c.tokenizer, keyed))
+	for _, stage := range c.post {
+		stages = append(stages, stage.name)
+	}
+	return strings.Join(stages, chainSeparator)
+}
+
+// chainSpec represents a parsed chain: the name of the chain's tokenizer and
+// the stages before and after it.
+type chainSpec struct {
+	keyed     string
+	pre, post []*chainStage
+}
+
+// parseChain parses the given chain of stages, e.g. "hmac | truncate:64 |
+// base32", and returns the name of the chain's tokenizer and a function that
+// creates the chain.  A chain that consists of nothing but a tokenizer results
+// in the tokenizer itself.
+func parseChain(spec string) (string, func() tokenizer, error) {
+	s, err := parseChainSpec(spec)
+	if err != nil {
+		return "", nil, err
+	}
+	newTokenizer := ourTokenizers[s.keyed]
+	return s.keyed, func() tokenizer {
+		return s.around(newTokenizer())
+	}, nil
+}
+
+// parseChainSpec parses the given chain of stages.
+func parseChainSpec(spec string) (*chainSpec, error) {
+	var (
+		s    = &chainSpec{}
+		last *chainStage
+	)
+	for _, rawStage := range strings.Split(spec, chainSeparator) {
+		name, arg, _ := strings.Cut(strings.TrimSpace(rawStage), stageArgSeparator)
+		if last != nil && last.encodes {
+			return nil, fmt.Errorf("%w: %s", errStageAfterEncoding, last.name)
+		}
+		if _, exists := ourTokenizers[name]; exists {
+			if s.keyed != "" {
+				return nil, errNoKeyedStage
+			}
+			if arg != "" {
+				return nil, fmt.Errorf("%w: %s takes no argument", errBadStageArg, name)
+			}
+			s.keyed = name
+			continue
+		}
+		newStage, exists := ourStages[name]
+		if !exists {
+			return nil, fmt.Errorf("%w: %q", errNoSuchStage, name)
+		}
+		stage, err := newStage(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if s.keyed == "" {
+			s.pre = append(s.pre, stage)
+		} else {
+			s.post = append(s.post, stage)
+		}
+		last = stage
+	}
+	if s.keyed == "" {
+		return nil, errNoKeyedStage
+	}
+	return s, nil
+}
+
+// around returns the chain's stages around the given tokenizer, which must be
+// the chain's tokenizer.  If the chain has no stages, we return the tokenizer
+// itself.
+func (s *chainSpec) around(t tokenizer) tokenizer {
+	if len(s.pre) == 0 && len(s.post) == 0 {
+		return t
+	}
+	return newChainTokenizer(s.pre, t, s.post)
+}
+
+// encodes returns true if the chain's tokens are printable.
+func (c *chainTokenizer) encodes() bool {
+	return len(c.post) > 0 && c.post[len(c.post)-1].encodes
+}
+
+// setConfig hands the given configuration to the wrapped tokenizer, if it's
+// configurable.
+func (c *chainTokenizer) setConfig(conf *config) {
+	if t, ok := c.tokenizer.(configurer); ok {
+		t.setConfig(conf)
+	}
+}
+
+// keyEpoch returns the epoch of the wrapped tokenizer's given key, if known.
+func (c *chainTokenizer) keyEpoch(id *keyID) (epoch, bool) {
+	if e, ok := c.tokenizer.(epochTracker); ok {
+		return e.keyEpoch(id)
+	}
+	return epoch{}, false
+}
+
+func (c *chainTokenizer) tokenize(s serializer) (token, error) {
+	t, _, err := c.tokenizeAndKeyID(s)
+	return t, err
+}
+
+func (c *chainTokenizer) tokenizeAndKeyID(s serializer) (token, *keyID, error) {
+	b, err := applyStages(c.pre, s.bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	t, id, err := c.tokenizer.tokenizeAndKeyID(blob(b))
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err = applyStages(c.post, t)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, id, nil
+}
+
+func (c *chainTokenizer) tokenizeWithKeyID(s serializer, id *keyID) (token, error) {
+	b, err := applyStages(c.pre, s.bytes())
+	if err != nil {
+		return nil, err
+	}
+	t, err := c.tokenizer.tokenizeWithKeyID(blob(b), id)
+	if err != nil {
+		return nil, err
+	}
+	return applyStages(c.post, t)
+}
+
+// tokenizeBatch transforms each of the given serializers, tokenizes the
+// results using the active key with the given ID, and transforms each token.
+func (c *chainTokenizer) tokenizeBatch(ss []serializer, id *keyID) ([]token, *keyID, error) {
+	var (
+		transformed = make([]serializer, 0, len(ss))
+		indices     = make([]int, 0, len(ss))
+		errs        batchError
+	)
+	fail := func(i int, err error) {
+		if errs == nil {
+			errs = make(batchError)
+		}
+		errs[i] = err
+	}
+	for i, s := range ss {
+		b, err := applyStages(c.pre, s.bytes())
+		if err != nil {
+			fail(i, err)
+			continue
+		}
+		transformed = append(transformed, blob(b))
+		indices = append(indices, i)
+	}
+
+	innerTokens, kID, err := c.tokenizer.tokenizeBatch(transformed, id)
+	var innerErrs batchError
+	if err != nil && !errors.As(err, &innerErrs) {
+		return nil, nil, err
+	}
+	tokens := make([]token, len(ss))
+	for j, i := range indices {
+		if e, failed := innerErrs[j]; failed {
+			fail(i, e)
+			continue
+		}
+		if tokens[i], err = applyStages(c.post, innerTokens[j]); err != nil {
+			fail(i, err)
+		}
+	}
+	if errs != nil {
+		return tokens, kID, errs
+	}
+	return tokens, kID, nil
+}
+
+// preservesLen returns true if the wrapped tokenizer and all of the chain's
+// stages preserve length.
+func (c *chainTokenizer) preservesLen() bool {
+	for _, s := range append(append([]*chainStage{}, c.pre...), c.post...) {
+		if !s.keepsLen {
+			return false
+		}
+	}
+	return c.tokenizer.preservesLen()
+}
+
+// tokenizeGranular transforms the given serializer, has the wrapped
+// tokenizer tokenize it once per prefix length, and transforms each token.
+func (g *granularChainTokenizer) tokenizeGranular(s serializer, id *keyID) ([]granularToken, error) {
+	b, err := applyStages(g.pre, s.bytes())
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := g.tokenizer.(granularTokenizer).tokenizeGranular(blob(b), id)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tokens {
+		if tokens[i].token, err = applyStages(g.post, tokens[i].token); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+// applyStages applies the given stages to the given bytes, in order.
+func applyStages(stages []*chainStage, b []byte) ([]byte, error) {
+	var err error
+	for _, s := range stages {
+		if b, err = s.transform(b); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.name, err)
+		}
+	}
+	return b, nil
+}
+
+// withoutArg turns the given stage into a function that builds the stage and
+// rejects arguments.
+func withoutArg(s *chainStage) func(string) (*chainStage, error) {
+	return func(arg string) (*chainStage, error) {
+		if arg != "" {
+			return nil, fmt.Errorf("%w: %s takes no argument", errBadStageArg, s.name)
+		}
+		return s, nil
+	}
+}
+
+// newMaskStage returns a stage that masks IP addresses to the given prefix
+// lengths, e.g. "/24" for IPv4 addresses or "/24,/48" for IPv4 and IPv6
+// addresses.  If no prefix length is given for IPv6 addresses, they aren't
+// masked.
+func newMaskStage(arg string) (*chainStage, error) {
+	rawIPv4, rawIPv6, _ := strings.Cut(arg, ",")
+	parse := func(raw string, max int) (int, error) {
+		if raw == "" {
+			return max, nil
+		}
+		prefix, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(raw), "/"))
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", errBadStageArg, err)
+		}
+		if prefix < 0 || prefix > max {
+			return 0, fmt.Errorf("%w: %d not in [0, %d]", errBadPrefixLen, prefix, max)
+		}
+		return prefix, nil
+	}
+	if rawIPv4 == "" {
+		return nil, fmt.Errorf("%w: %s requires a prefix length", errBadStageArg, stageMask)
+	}
+	ipv4Prefix, err := parse(rawIPv4, ipv4Len*8)
+	if err != nil {
+		return nil, err
+	}
+	ipv6Prefix, err := parse(rawIPv6, ipv6Len*8)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chainStage{
+		name:     stageMask + stageArgSeparator + arg,
+		keepsLen: true,
+		transform: func(addr []byte) ([]byte, error) {
+			switch {
+			case len(addr) == ipv4Len || len(addr) == ipv6Len && isIPv4Mapped(addr):
+				return maskAddr(addr, ipv4Prefix), nil
+			case len(addr) == ipv6Len:
+				return maskAddr(addr, ipv6Prefix), nil
+			default:
+				return nil, errBadBlobLen
+			}
+		},
+	}, nil
+}
+
+// normalizeEmailStage normalizes email addresses, so that different spellings
+// of the same mailbox result in the same token: we remove surrounding white
+// space, lower-case the address, and remove the "+tag" suffix of the local
+// part.
+var normalizeEmailStage = &chainStage{
+	name:      stageNormalizeEmail,
+	transform: normalizeEmail,
+}
+
+func normalizeEmail(b []byte) ([]byte, error) {
+	if !utf8.Valid(b) {
+		return nil, errInvalidUTF8
+	}
+	addr := strings.ToLower(strings.TrimSpace(string(b)))
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return nil, errBadEmail
+	}
+	local, domain := addr[:i], addr[i+1:]
+	local, _, _ = strings.Cut(local, "+")
+	if local == "" || domain == "" {
+		return nil, errBadEmail
+	}
+	return []byte(local + "@" + domain), nil
+}
+
+// newTruncateStage returns a stage that truncates tokens to the given number
+// of bits.
+func newTruncateStage(arg string) (*chainStage, error) {
+	bits, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadStageArg, err)
+	}
+	if bits < 1 {
+		return nil, fmt.Errorf("%w: %s requires a positive number of bits", errBadStageArg, stageTruncate)
+	}
+	return &chainStage{
+		name: stageTruncate + stageArgSeparator + arg,
+		transform: func(b []byte) ([]byte, error) {
+			if len(b)*8 < bits {
+				return nil, errShortToken
+			}
+			return truncateBits(append([]byte{}, b...), bits), nil
+		},
+	}, nil
+}
+
+// encodingStage returns a stage that encodes tokens using the given function.
+func encodingStage(name string, encode func([]byte) string) *chainStage {
+	return &chainStage{
+		name:    name,
+		encodes: true,
+		transform: func(b []byte) ([]byte, error) {
+			return []byte(encode(b)), nil
+		},
+	}
+}
+
+// ipStage turns tokens that have the length of an IP address into the
+// address's string representation.
+var ipStage = &chainStage{
+	name:    stageIP,
+	encodes: true,
+	transform: func(b []byte) ([]byte, error) {
+		if len(b) != net.IPv4len && len(b) != net.IPv6len {
+			return nil, errNotAnAddr
+		}
+		return []byte(net.IP(b).String()), nil
+	},
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"net"
+	"testing"
+)
+
+func newTestChain(t *testing.T, spec string) tokenizer {
+	t.Helper()
+	_, newTokenizer, err := parseChain(spec)
+	if err != nil {
+		t.Fatalf("Failed to parse chain %q: %v", spec, err)
+	}
+	c := newTokenizer()
+	if err := c.resetKey(); err != nil {
+		t.Fatalf("Failed to reset key: %v", err)
+	}
+	return c
+}
+
+func TestParseChain(t *testing.T) {
+	for spec, keyed := range map[string]string{
+		"hmac":                         tokenizerHmac,
+		"mask:/24 | cryptopan":         tokenizerCryptoPAn,
+		"mask:/24,/48|cryptopan|ip":    tokenizerCryptoPAn,
+		"normalize-email | hmac":       tokenizerHmac,
+		" hmac | truncate:64 | base32": tokenizerHmac,
+	} {
+		name, _, err := parseChain(spec)
+		if err != nil {
+			t.Fatalf("Failed to parse chain %q: %v", spec, err)
+		}
+		assertEqual(t, name, keyed)
+	}
+
+	// A lone tokenizer must not be wrapped in a chain.
+	_, newTokenizer, _ := parseChain(tokenizerHmac)
+	if _, ok := asChain(newTokenizer()); ok {
+		t.Fatal("Expected lone tokenizer not to be a chain.")
+	}
+
+	for spec, expected := range map[string]error{
+		"foo":                  errNoSuchStage,
+		"hmac | foo":           errNoSuchStage,
+		"truncate:64":          errNoKeyedStage,
+		"hmac | cryptopan":     errNoKeyedStage,
+		"hmac:1":               errBadStageArg,
+		"hmac | truncate:0":    errBadStageArg,
+		"hmac | truncate:foo":  errBadStageArg,
+		"hmac | base64:1":      errBadStageArg,
+		"mask | cryptopan":     errBadStageArg,
+		"mask:/33 | cryptopan": errBadPrefixLen,
+		"hmac | base64 | hex":  errStageAfterEncoding,
+		"base64 | hmac":        errStageAfterEncoding,
+	} {
+		if _, _, err := parseChain(spec); !errors.Is(err, expected) {
+			t.Fatalf("Expected error '%v' for chain %q but got '%v'.", expected, spec, err)
+		}
+	}
+}
+
+func TestChainKeys(t *testing.T) {
+	c := newTestChain(t, "mask:/24 | cryptopan")
+	keyed := keyedStage(c)
+	if keyed == c {
+		t.Fatal("Expected chain to wrap a tokenizer.")
+	}
+	// Key management is left to the chain's tokenizer.
+	assertEqual(t, *c.keyID(), *keyed.keyID())
+	oldID := *c.keyID()
+	if err := c.resetKey(); err != nil {
+		t.Fatalf("Failed to reset key: %v", err)
+	}
+	if *c.keyID() == oldID {
+		t.Fatal("Expected key ID to change after key reset.")
+	}
+	assertEqual(t, *c.keyID(), *keyed.keyID())
+
+	assertEqual(t, c.preservesLen(), true)
+	assertEqual(t, newTestChain(t, "cryptopan | ip").preservesLen(), false)
+	assertEqual(t, newTestChain(t, "hmac | truncate:64").preservesLen(), false)
+}
+
+func TestChainMask(t *testing.T) {
+	c := newTestChain(t, "mask:/24 | cryptopan")
+
+	t1, err := c.tokenize(blob(ipBytes("1.2.3.4")))
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	t2, _ := c.tokenize(blob(ipBytes("1.2.3.5")))
+	assertEqual(t, string(t1), string(t2))
+	// The chain's tokens must equal the tokens of its tokenizer, given the
+	// masked address.
+	t3, _ := keyedStage(c).tokenize(blob(ipBytes("1.2.3.0")))
+	assertEqual(t, string(t1), string(t3))
+
+	if _, err := c.tokenize(blob("foo")); !errors.Is(err, errBadBlobLen) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadBlobLen, err)
+	}
+}
+
+func TestChainTruncateAndEncode(t *testing.T) {
+	c := newTestChain(t, "hmac | truncate:64 | base32")
+
+	tkn, id, err := c.tokenizeAndKeyID(blob("brave.com"))
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	assertEqual(t, *id, *c.keyID())
+	raw, _ := keyedStage(c).tokenize(blob("brave.com"))
+	assertEqual(t, string(tkn), base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw[:8]))
+}
+
+func TestChainBatch(t *testing.T) {
+	c := newTestChain(t, "normalize-email | hmac | hex")
+
+	tokens, _, err := c.tokenizeBatch([]serializer{
+		blob(" Alice+news@Example.COM"),
+		blob("not an address"),
+		blob("alice@example.com"),
+	}, nil)
+	var errs batchError
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected batch error but got '%v'.", err)
+	}
+	assertEqual(t, len(errs), 1)
+	if !errors.Is(errs[1], errBadEmail) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadEmail, errs[1])
+	}
+	if tokens[1] != nil {
+		t.Fatalf("Expected no token for failed input but got %q.", tokens[1])
+	}
+	assertEqual(t, string(tokens[0]), string(tokens[2]))
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	for in, expected := range map[string]string{
+		"alice@example.com":           "alice@example.com",
+		" Alice@Example.COM\n":        "alice@example.com",
+		"alice+news@example.com":      "alice@example.com",
+		"\"a@b\"@example.com":         "\"a@b\"@example.com",
+		"alice+news+more@example.com": "alice@example.com",
+	} {
+		out, err := normalizeEmail([]byte(in))
+		if err != nil {
+			t.Fatalf("Failed to normalize %q: %v", in, err)
+		}
+		assertEqual(t, string(out), expected)
+	}
+	for _, in := range []string{"alice", "@example.com", "alice@", "+news@example.com"} {
+		if _, err := normalizeEmail([]byte(in)); !errors.Is(err, errBadEmail) {
+			t.Fatalf("Expected error '%v' for %q but got '%v'.", errBadEmail, in, err)
+		}
+	}
+}
+
+func TestPrintable(t *testing.T) {
+	// Tokenizers that preserve length result in IP addresses.
+	c := newCryptoPAnTokenizer()
+	_ = c.resetKey()
+	tkn, err := printable(c).tokenize(blob(ipBytes("1.2.3.4")))
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	if net.ParseIP(string(tkn)) == nil {
+		t.Fatalf("Expected IP address but got %q.", tkn)
+	}
+
+	// All other tokenizers result in base64.
+	h := newHmacTokenizer()
+	_ = h.resetKey()
+	tkn, _ = printable(h).tokenize(blob("brave.com"))
+	raw, _ := h.tokenize(blob("brave.com"))
+	assertEqual(t, string(tkn), base64.StdEncoding.EncodeToString(raw))
+
+	// Chains that already encode their tokens remain as they are.
+	e := newTestChain(t, "hmac | hex")
+	if printable(e) != e {
+		t.Fatal("Expected encoding chain to remain as it is.")
+	}
+
+	// Granular tokenizers remain granular.
+	s := newSubnetTokenizer(newVerbatimTokenizer(), []int{24}, nil)
+	_ = s.resetKey()
+	g, ok := printable(s).(granularTokenizer)
+	if !ok {
+		t.Fatal("Expected chain around granular tokenizer to be granular.")
+	}
+	tokens, err := g.tokenizeGranular(blob(ipBytes("1.2.3.4")), s.keyID())
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	assertEqual(t, string(tokens[0].token), "1.2.3.0")
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	clkKeySize = 32 // In bytes.
+	// The default number of symbols per q-gram, number of hash functions, and
+	// filter length in bits.
+	defaultCLKQ = 2
+	defaultCLKK = 20
+	defaultCLKM = 1024
+	// The bounds of the number of hash functions and the filter length.
+	clkMaxK = 64
+	clkMaxM = 1 << 16
+	// The HKDF info prefix of the hash functions' keys.
+	clkInfoPrefix = "tkzr clk hash"
+)
+
+var (
+	errEmptyCLKInput = errors.New("input must not be empty")
+	errBadCLKQ       = errors.New("q-gram length must be positive")
+	errBadCLKK       = fmt.Errorf("number of hash functions must be in interval [1, %d]", clkMaxK)
+	errBadCLKM       = fmt.Errorf("filter length must be a multiple of 8 in interval [8, %d]", clkMaxM)
+)
+
+// clkTokenizer implements a tokenizer that encodes strings as cryptographic
+// long-term key (CLK) Bloom filters, as proposed by Schnell et al.: the input
+// is split into q-grams, each of which sets k bits of an m-bit filter.  Which
+// bits a q-gram sets is determined by k HMACs under different keys.  Similar
+// inputs share most of their q-grams, so their filters are similar too, which
+// allows for fuzzy matching of tokens, e.g., using the Dice coefficient.  Key
+// management is left to the embedded key provider.
+type clkTokenizer struct {
+	sync.RWMutex
+	*keyProvider
+	q, k, m int
+}
+
+// clkState represents the state that we derive from each key: one HMAC per
+// hash function, and the q-gram length and filter length that were configured
+// when the state was derived.
+type clkState struct {
+	hashes []*hmacState
+	q, m   int
+}
+
+func newCLKTokenizer() tokenizer {
+	c := &clkTokenizer{
+		q: defaultCLKQ,
+		k: defaultCLKK,
+		m: defaultCLKM,
+	}
+	c.keyProvider = newKeyProvider(tokenizerCLK, clkKeySize, c.deriveState)
+	return c
+}
+
+// setConfig configures the key provider and sets the tokenizer's q-gram
+// length, number of hash functions, and filter length.  The configuration is
+// validated while parsing flags, so we don't expect errors here.
+func (c *clkTokenizer) setConfig(conf *config) {
+	c.keyProvider.setConfig(conf)
+
+	c.Lock()
+	if conf.clkQ != 0 {
+		c.q = conf.clkQ
+	}
+	if conf.clkK != 0 {
+		c.k = conf.clkK
+	}
+	if conf.clkM != 0 {
+		c.m = conf.clkM
+	}
+	c.Unlock()
+
+	if err := c.rederive(); err != nil {
+		l.Printf("Failed to re-initialize CLK hash functions: %v", err)
+	}
+}
+
+// deriveState derives a key for each of the configured number of hash
+// functions from the given key.
+func (c *clkTokenizer) deriveState(key []byte) (interface{}, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	s := &clkState{q: c.q, m: c.m}
+	for i := 0; i < c.k; i++ {
+		k := make([]byte, len(key))
+		info := []byte(fmt.Sprintf("%s %d", clkInfoPrefix, i))
+		if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, info), k); err != nil {
+			s.free()
+			return nil, err
+		}
+		h, err := newHmacState(sha256.New, k)
+		zeroize(k)
+		if err != nil {
+			s.free()
+			return nil, err
+		}
+		s.hashes = append(s.hashes, h)
+	}
+	return s, nil
+}
+
+func (c *clkTokenizer) tokenize(s serializer) (token, error) {
+	t, _, err := c.tokenizeUsing(s, nil)
+	return t, err
+}
+
+func (c *clkTokenizer) tokenizeAndKeyID(s serializer) (token, *keyID, error) {
+	return c.tokenizeUsing(s, nil)
+}
+
+func (c *clkTokenizer) tokenizeWithKeyID(s serializer, id *keyID) (token, error) {
+	t, _, err := c.tokenizeUsing(s, id)
+	return t, err
+}
+
+// tokenizeUsing tokenizes the given serializer using the active key with the
+// given ID, or the current key if the ID is nil.
+func (c *clkTokenizer) tokenizeUsing(s serializer, id *keyID) (token, *keyID, error) {
+	key, release, err := c.acquireKey(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	t, err := key.state.(*clkState).encode(s.bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, key.id, nil
+}
+
+func (c *clkTokenizer) tokenizeBatch(ss []serializer, id *keyID) ([]token, *keyID, error) {
+	key, release, err := c.acquireKey(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	state := key.state.(*clkState)
+	tokens, err := tokenizeEach(ss, func(s serializer) (token, error) {
+		return state.encode(s.bytes())
+	})
+	return tokens, key.id, err
+}
+
+func (c *clkTokenizer) preservesLen() bool {
+	return false
+}
+
+// checkCLKConfig makes sure that the given q-gram length, number of hash
+// functions, and filter length are valid.
+func checkCLKConfig(q, k, m int) error {
+	if q < 1 {
+		return errBadCLKQ
+	}
+	if k < 1 || k > clkMaxK {
+		return errBadCLKK
+	}
+	if m < 8 || m > clkMaxM || m%8 != 0 {
+		return errBadCLKM
+	}
+	return nil
+}
+
+// encode turns the given UTF-8 string into a Bloom filter.  The filter's
+// first bit is the most significant bit of its first byte.
+func (s *clkState) encode(b []byte) (token, error) {
+	// Our stdin receiver hands us lines including their terminator.
+	str := strings.TrimRight(string(b), "\r\n")
+	if !utf8.ValidString(str) {
+		return nil, errInvalidUTF8
+	}
+	grams := qgrams(str, s.q)
+	if len(grams) == 0 {
+		return nil, errEmptyCLKInput
+	}
+
+	filter := make(token, s.m/8)
+	for _, gram := range grams {
+		for _, h := range s.hashes {
+			sum, err := h.sum([]byte(gram))
+			if err != nil {
+				return nil, err
+			}
+			bit := binary.BigEndian.Uint64(sum) % uint64(s.m)
+			filter[bit/8] |= 0x80 >> (bit % 8)
+		}
+	}
+	return filter, nil
+}
+
+// free zeroizes and frees the keys of all hash functions.
+func (s *clkState) free() {
+	for _, h := range s.hashes {
+		h.free()
+	}
+	s.hashes = nil
+}
+
+// qgrams returns the overlapping substrings of q symbols of the given string.
+// A string that's shorter than q symbols is its only q-gram.
+func qgrams(s string, q int) []string {
+	symbols := []rune(s)
+	if len(symbols) == 0 {
+		return nil
+	}
+	if len(symbols) <= q {
+		return []string{s}
+	}
+	grams := make([]string, 0, len(symbols)-q+1)
+	for i := 0; i+q <= len(symbols); i++ {
+		grams = append(grams, string(symbols[i:i+q]))
+	}
+	return grams
+}
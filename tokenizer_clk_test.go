@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"math/bits"
+	"reflect"
+	"testing"
+)
+
+// dice returns the Dice coefficient of the given Bloom filters, i.e., twice
+// the number of bits that both filters set, divided by the number of bits
+// that each filter sets.
+func dice(t *testing.T, a, b token) float64 {
+	t.Helper()
+	if len(a) != len(b) {
+		t.Fatalf("Expected filters of identical length but got %d and %d.", len(a), len(b))
+	}
+	var both, total int
+	for i := range a {
+		both += bits.OnesCount8(a[i] & b[i])
+		total += bits.OnesCount8(a[i]) + bits.OnesCount8(b[i])
+	}
+	if total == 0 {
+		return 0
+	}
+	return 2 * float64(both) / float64(total)
+}
+
+func TestCLKSimilarity(t *testing.T) {
+	c := newCLKTokenizer()
+	_ = c.resetKey()
+	tokenize := func(s string) token {
+		tkn, err := c.tokenize(blob(s))
+		if err != nil {
+			t.Fatalf("Failed to tokenize %q: %v", s, err)
+		}
+		assertEqual(t, len(tkn), defaultCLKM/8)
+		return tkn
+	}
+
+	orig := tokenize("search.brave.com")
+	assertEqual(t, dice(t, orig, tokenize("search.brave.com\n")), float64(1))
+	// A typo must result in a similar filter while an unrelated string must
+	// not.
+	similar := dice(t, orig, tokenize("serach.brave.com"))
+	dissimilar := dice(t, orig, tokenize("example.org"))
+	if similar < 0.7 {
+		t.Fatalf("Expected Dice coefficient of similar input to be at least 0.7 but got %f.", similar)
+	}
+	if dissimilar > 0.5 {
+		t.Fatalf("Expected Dice coefficient of dissimilar input to be at most 0.5 but got %f.", dissimilar)
+	}
+}
+
+func TestCLKConfig(t *testing.T) {
+	c := newCLKTokenizer()
+	c.(configurer).setConfig(&config{clkQ: 3, clkK: 10, clkM: 512})
+	_ = c.resetKey()
+
+	tkn, err := c.tokenize(blob("brave.com"))
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	assertEqual(t, len(tkn), 512/8)
+	// Each of the seven trigrams sets at most ten bits.
+	set := 0
+	for _, b := range tkn {
+		set += bits.OnesCount8(b)
+	}
+	if set == 0 || set > 7*10 {
+		t.Fatalf("Expected between 1 and 70 bits to be set but got %d.", set)
+	}
+}
+
+func TestCLKBadInput(t *testing.T) {
+	c := newCLKTokenizer()
+	_ = c.resetKey()
+
+	if _, err := c.tokenize(blob("\n")); !errors.Is(err, errEmptyCLKInput) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errEmptyCLKInput, err)
+	}
+	if _, err := c.tokenize(blob([]byte{0xff, 0xfe})); !errors.Is(err, errInvalidUTF8) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errInvalidUTF8, err)
+	}
+}
+
+func TestQgrams(t *testing.T) {
+	assertEqual(t, len(qgrams("", 2)), 0)
+	if grams := qgrams("a", 2); !reflect.DeepEqual(grams, []string{"a"}) {
+		t.Fatalf("Expected q-grams %v but got %v.", []string{"a"}, grams)
+	}
+	expected := []string{"äb", "bc"}
+	if grams := qgrams("äbc", 2); !reflect.DeepEqual(grams, expected) {
+		t.Fatalf("Expected q-grams %v but got %v.", expected, grams)
+	}
+}
+
+func TestCheckCLKConfig(t *testing.T) {
+	tests := []struct {
+		q, k, m int
+		err     error
+	}{
+		{defaultCLKQ, defaultCLKK, defaultCLKM, nil},
+		{0, defaultCLKK, defaultCLKM, errBadCLKQ},
+		{defaultCLKQ, 0, defaultCLKM, errBadCLKK},
+		{defaultCLKQ, clkMaxK + 1, defaultCLKM, errBadCLKK},
+		{defaultCLKQ, defaultCLKK, 1001, errBadCLKM},
+		{defaultCLKQ, defaultCLKK, 0, errBadCLKM},
+	}
+	for _, test := range tests {
+		if err := checkCLKConfig(test.q, test.k, test.m); !errors.Is(err, test.err) {
+			t.Fatalf("Expected error '%v' but got '%v'.", test.err, err)
+		}
+	}
+}
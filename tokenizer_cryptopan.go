@@ -1,14 +1,9 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/sha256"
 	"errors"
-	"sync"
 
 	"github.com/Yawning/cryptopan"
-	uuid "github.com/google/uuid"
-	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
@@ -22,15 +17,47 @@ var (
 )
 
 // cryptoPAnTokenizer implements a tokenizer that uses Crypto-PAn to anonymize
-// IP addresses.
+// IP addresses.  Key management is left to the embedded key provider, which
+// keeps a locked copy of the Crypto-PAn key alongside each key.
 type cryptoPAnTokenizer struct {
-	sync.RWMutex
-	cryptoPAn *cryptopan.Cryptopan
-	key       []byte
+	*keyProvider
+}
+
+// cryptoPAnState represents the state that we derive from each key: the
+// Crypto-PAn key in locked memory.  Crypto-PAn keeps its AES key schedule on
+// Go's heap, so we initialize it for each operation (or batch) instead of
+// keeping it around.
+type cryptoPAnState struct {
+	key []byte
 }
 
 func newCryptoPAnTokenizer() tokenizer {
-	return &cryptoPAnTokenizer{}
+	return &cryptoPAnTokenizer{
+		keyProvider: newKeyProvider(tokenizerCryptoPAn, cryptopan.Size, newCryptoPAnState),
+	}
+}
+
+// newCryptoPAnState returns the Crypto-PAn state using a copy of the given key.
+func newCryptoPAnState(key []byte) (interface{}, error) {
+	if len(key) != cryptopan.Size {
+		return nil, cryptopan.KeySizeError(len(key))
+	}
+	c, err := locked.copyOf(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptoPAnState{key: c}, nil
+}
+
+// cryptopan returns an initialized Crypto-PAn instance.
+func (k *cryptoPAnState) cryptopan() (*cryptopan.Cryptopan, error) {
+	return cryptopan.New(k.key)
+}
+
+// free zeroizes and frees the key.
+func (k *cryptoPAnState) free() {
+	locked.free(k.key)
+	k.key = nil
 }
 
 func (c *cryptoPAnTokenizer) isBlobSupported(b []byte) bool {
@@ -38,64 +65,71 @@ func (c *cryptoPAnTokenizer) isBlobSupported(b []byte) bool {
 }
 
 func (c *cryptoPAnTokenizer) tokenize(s serializer) (token, error) {
-	c.RLock()
-	defer c.RUnlock()
-
-	if len(c.key) == 0 {
-		m.numTokenized.With(prometheus.Labels{outcome: failBecause(errNoKey)}).Inc()
-		return nil, errNoKey
-	}
-	blob := s.bytes()
-	if !c.isBlobSupported(blob) {
-		m.numTokenized.With(prometheus.Labels{outcome: failBecause(errBadBlobLen)}).Inc()
-		return nil, errBadBlobLen
-	}
-	m.numTokenized.With(prometheus.Labels{outcome: success}).Inc()
-	return token(c.cryptoPAn.Anonymize(blob)), nil
+	t, _, err := c.tokenizeUsing(s, nil)
+	return t, err
 }
 
 func (c *cryptoPAnTokenizer) tokenizeAndKeyID(s serializer) (token, *keyID, error) {
-	c.RLock()
-	defer c.RUnlock()
+	return c.tokenizeUsing(s, nil)
+}
 
-	if len(c.key) == 0 {
-		m.numTokenized.With(prometheus.Labels{outcome: failBecause(errNoKey)}).Inc()
-		return nil, nil, errNoKey
-	}
-	blob := s.bytes()
-	if !c.isBlobSupported(blob) {
-		m.numTokenized.With(prometheus.Labels{outcome: failBecause(errBadBlobLen)}).Inc()
-		return nil, nil, errBadBlobLen
-	}
-	m.numTokenized.With(prometheus.Labels{outcome: success}).Inc()
-	return token(c.cryptoPAn.Anonymize(blob)), c.keyID(), nil
+func (c *cryptoPAnTokenizer) tokenizeWithKeyID(s serializer, id *keyID) (token, error) {
+	t, _, err := c.tokenizeUsing(s, id)
+	return t, err
 }
 
-func (c *cryptoPAnTokenizer) keyID() *keyID {
-	c.RLock()
-	defer c.RUnlock()
+// tokenizeUsing tokenizes the given serializer using the active key with the
+// given ID, or the current key if the ID is nil.
+func (c *cryptoPAnTokenizer) tokenizeUsing(s serializer, id *keyID) (token, *keyID, error) {
+	key, release, err := c.acquireKey(id)
+	if err != nil {
+		c.tokenized(failBecause(err)).Inc()
+		return nil, nil, err
+	}
+	defer release()
 
-	// A v5 UUID is supposed to hash the given name (in our case: the key)
-	// using SHA-1 but let's be extra careful and hash the key using SHA-256
-	// before handing it over to the uuid package.
-	sum := sha256.Sum256(c.key)
-	return &keyID{UUID: uuid.NewSHA1(uuidNamespace, sum[:])}
+	cp, err := key.state.(*cryptoPAnState).cryptopan()
+	if err != nil {
+		c.tokenized(failBecause(err)).Inc()
+		return nil, nil, err
+	}
+	t, err := c.anonymize(cp, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, key.id, nil
 }
 
-func (c *cryptoPAnTokenizer) resetKey() error {
-	c.Lock()
-	defer c.Unlock()
-
-	var err error
-	c.key = make([]byte, cryptopan.Size)
-	if _, err = rand.Read(c.key); err != nil {
-		return err
+func (c *cryptoPAnTokenizer) tokenizeBatch(ss []serializer, id *keyID) ([]token, *keyID, error) {
+	key, release, err := c.acquireKey(id)
+	if err != nil {
+		c.tokenized(failBecause(err)).Add(float64(len(ss)))
+		return nil, nil, err
 	}
-	c.cryptoPAn, err = cryptopan.New(c.key)
+	defer release()
+
+	// We initialize Crypto-PAn once for the entire batch.
+	cp, err := key.state.(*cryptoPAnState).cryptopan()
 	if err != nil {
-		return err
+		c.tokenized(failBecause(err)).Add(float64(len(ss)))
+		return nil, nil, err
+	}
+	tokens, err := tokenizeEach(ss, func(s serializer) (token, error) {
+		return c.anonymize(cp, s)
+	})
+	return tokens, key.id, err
+}
+
+// anonymize anonymizes the given IP address using the given Crypto-PAn
+// instance.
+func (c *cryptoPAnTokenizer) anonymize(cp *cryptopan.Cryptopan, s serializer) (token, error) {
+	blob := s.bytes()
+	if !c.isBlobSupported(blob) {
+		c.tokenized(failBecause(errBadBlobLen)).Inc()
+		return nil, errBadBlobLen
 	}
-	return nil
+	c.tokenized(success).Inc()
+	return token(cp.Anonymize(blob)), nil
 }
 
 func (c *cryptoPAnTokenizer) preservesLen() bool {
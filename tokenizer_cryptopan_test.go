@@ -47,3 +47,7 @@ func BenchmarkCryptoPAn(b *testing.B) {
 		_, _ = c.tokenize(v)
 	}
 }
+
+func BenchmarkCryptoPAnBatch(b *testing.B) {
+	benchmarkBatch(b, newCryptoPAnTokenizer())
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	emailKeySize = 32 // In bytes.
+	// The number of base32 symbols of the tokens that replace local parts and
+	// domains, i.e., 80 bits.
+	emailTokenLen = 16
+	// RFC 5321, section 4.5.3.1.
+	maxEmailLocalLen  = 64
+	maxEmailDomainLen = 255
+	maxDomainLabelLen = 63
+	// The top-level domain of tokenized domains.  It's reserved by RFC 2606,
+	// so tokenized addresses never route anywhere.
+	tokenizedTLD = "invalid"
+	// The info prefix that we derive the subkeys of local parts and domains
+	// with.
+	emailInfoPrefix = "tkzr email"
+
+	emailDomainKeep        = "keep"
+	emailDomainTokenize    = "tokenize"
+	defaultEmailDomainMode = emailDomainKeep
+)
+
+var (
+	errBadEmailDomainMode = errors.New("email domain mode must be \"keep\" or \"tokenize\"")
+
+	// emailEncoding encodes tokens using symbols that are valid in local
+	// parts and domain labels.
+	emailEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+)
+
+// emailTokenizer implements a tokenizer that preserves the structure of email
+// addresses: it normalizes an address and replaces its local part with a
+// token while keeping the domain, or replacing it with a separate token.
+// Either way, tokens can still be broken down by domain.  Key management is
+// left to the embedded key provider.
+type emailTokenizer struct {
+	sync.RWMutex
+	*keyProvider
+	tokenizeDomain bool
+}
+
+// emailState represents the state that we derive from each key: HMACs for
+// local parts and domains under different subkeys, whether domains were
+// configured to be tokenized when the state was derived, and the tokenizer's
+// counter of tokenization outcomes.
+type emailState struct {
+	local, domain  *hmacState
+	tokenizeDomain bool
+	tokenized      func(string) prometheus.Counter
+}
+
+func newEmailTokenizer() tokenizer {
+	e := &emailTokenizer{}
+	e.keyProvider = newKeyProvider(tokenizerEmail, emailKeySize, e.deriveState)
+	return e
+}
+
+// setConfig configures the key provider and sets whether the tokenizer
+// tokenizes domains.
+func (e *emailTokenizer) setConfig(c *config) {
+	e.keyProvider.setConfig(c)
+
+	e.Lock()
+	e.tokenizeDomain = c.emailDomainMode == emailDomainTokenize
+	e.Unlock()
+
+	if err := e.rederive(); err != nil {
+		l.Printf("Failed to re-initialize email HMACs: %v", err)
+	}
+}
+
+// deriveState derives the subkeys of local parts and domains from the given
+// key.
+func (e *emailTokenizer) deriveState(key []byte) (interface{}, error) {
+	e.RLock()
+	defer e.RUnlock()
+
+	s := &emailState{tokenizeDomain: e.tokenizeDomain, tokenized: e.tokenized}
+	for _, part := range []struct {
+		name  string
+		state **hmacState
+	}{
+		{"local", &s.local},
+		{"domain", &s.domain},
+	} {
+		k := make([]byte, len(key))
+		info := []byte(emailInfoPrefix + " " + part.name)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, info), k); err != nil {
+			s.free()
+			return nil, err
+		}
+		h, err := newHmacState(sha256.New, k)
+		zeroize(k)
+		if err != nil {
+			s.free()
+			return nil, err
+		}
+		*part.state = h
+	}
+	return s, nil
+}
+
+func (e *emailTokenizer) tokenize(s serializer) (token, error) {
+	t, _, err := e.tokenizeUsing(s, nil)
+	return t, err
+}
+
+func (e *emailTokenizer) tokenizeAndKeyID(s serializer) (token, *keyID, error) {
+	return e.tokenizeUsing(s, nil)
+}
+
+func (e *emailTokenizer) tokenizeWithKeyID(s serializer, id *keyID) (token, error) {
+	t, _, err := e.tokenizeUsing(s, id)
+	return t, err
+}
+
+// tokenizeUsing tokenizes the given serializer using the active key with the
+// given ID, or the current key if the ID is nil.
+func (e *emailTokenizer) tokenizeUsing(s serializer, id *keyID) (token, *keyID, error) {
+	key, release, err := e.acquireKey(id)
+	if err != nil {
+		e.tokenized(failBecause(err)).Inc()
+		return nil, nil, err
+	}
+	defer release()
+
+	t, err := key.state.(*emailState).encode(s.bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, key.id, nil
+}
+
+func (e *emailTokenizer) tokenizeBatch(ss []serializer, id *keyID) ([]token, *keyID, error) {
+	key, release, err := e.acquireKey(id)
+	if err != nil {
+		e.tokenized(failBecause(err)).Add(float64(len(ss)))
+		return nil, nil, err
+	}
+	defer release()
+
+	state := key.state.(*emailState)
+	tokens, err := tokenizeEach(ss, func(s serializer) (token, error) {
+		return state.encode(s.bytes())
+	})
+	return tokens, key.id, err
+}
+
+// encode turns the given email address into a token.  The local part's token
+// depends on the entire normalized address, so identical local parts at
+// different domains don't result in identical tokens.
+func (s *emailState) encode(b []byte) (token, error) {
+	addr, err := normalizeEmail(b)
+	if err == nil {
+		err = checkEmail(string(addr))
+	}
+	if err != nil {
+		s.tokenized(failBecause(err)).Inc()
+		return nil, err
+	}
+	domain := string(addr[strings.LastIndex(string(addr), "@")+1:])
+
+	local, err := s.local.sum(addr)
+	if err != nil {
+		s.tokenized(failBecause(err)).Inc()
+		return nil, err
+	}
+	if s.tokenizeDomain {
+		d, err := s.domain.sum([]byte(domain))
+		if err != nil {
+			s.tokenized(failBecause(err)).Inc()
+			return nil, err
+		}
+		domain = emailEncoding.EncodeToString(d)[:emailTokenLen] + "." + tokenizedTLD
+	}
+	s.tokenized(success).Inc()
+	return token(emailEncoding.EncodeToString(local)[:emailTokenLen] + "@" + domain), nil
+}
+
+func (s *emailState) free() {
+	if s.local != nil {
+		s.local.free()
+	}
+	if s.domain != nil {
+		s.domain.free()
+	}
+}
+
+// checkEmail returns errBadEmail if the given normalized email address has a
+// local part that's too long or contains white space, or a domain that isn't
+// a valid host name of at least two labels.  We don't accept internationalized
+// domains, which must be encoded using Punycode.
+func checkEmail(addr string) error {
+	i := strings.LastIndex(addr, "@")
+	local, domain := addr[:i], addr[i+1:]
+	if len(local) > maxEmailLocalLen || strings.ContainsAny(local, " \t\r\n") {
+		return errBadEmail
+	}
+	labels := strings.Split(domain, ".")
+	if len(domain) > maxEmailDomainLen || len(labels) < 2 {
+		return errBadEmail
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > maxDomainLabelLen ||
+			label[0] == '-' || label[len(label)-1] == '-' {
+			return errBadEmail
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return errBadEmail
+			}
+		}
+	}
+	return nil
+}
+
+func (e *emailTokenizer) preservesLen() bool {
+	return false
+}
+
+func (e *emailTokenizer) emitsText() bool {
+	return true
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEmailKeepsDomain(t *testing.T) {
+	e := newEmailTokenizer()
+	e.(configurer).setConfig(&config{emailDomainMode: emailDomainKeep})
+	_ = e.resetKey()
+
+	tkn, err := e.tokenize(blob("Alice@Example.com"))
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	local, domain, _ := strings.Cut(string(tkn), "@")
+	assertEqual(t, len(local), emailTokenLen)
+	assertEqual(t, domain, "example.com")
+
+	// Tags and case don't matter.
+	same, err := e.tokenize(blob(" alice+news@EXAMPLE.com "))
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	assertEqual(t, string(same), string(tkn))
+
+	// The same local part at a different domain results in a different token.
+	other, err := e.tokenize(blob("alice@example.org"))
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	if strings.HasPrefix(string(other), local) {
+		t.Fatal("Expected different local tokens for different domains.")
+	}
+}
+
+func TestEmailTokenizesDomain(t *testing.T) {
+	e := newEmailTokenizer()
+	e.(configurer).setConfig(&config{emailDomainMode: emailDomainTokenize})
+	_ = e.resetKey()
+
+	t1, err := e.tokenize(blob("alice@example.com"))
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	t2, err := e.tokenize(blob("bob@example.com"))
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	_, d1, _ := strings.Cut(string(t1), "@")
+	_, d2, _ := strings.Cut(string(t2), "@")
+	assertEqual(t, d1, d2)
+	assertEqual(t, len(d1), emailTokenLen+len("."+tokenizedTLD))
+	if !strings.HasSuffix(d1, "."+tokenizedTLD) {
+		t.Fatalf("Expected domain to end in %q but got %q.", tokenizedTLD, d1)
+	}
+	if err := checkEmail(string(t1)); err != nil {
+		t.Fatalf("Expected token to be a valid email address but got '%v'.", err)
+	}
+}
+
+func TestCheckEmail(t *testing.T) {
+	for _, bad := range []string{
+		"alice@localhost",
+		"alice@example..com",
+		"alice@-example.com",
+		"alice@example-.com",
+		"alice@exa_mple.com",
+		"al ice@example.com",
+		strings.Repeat("a", maxEmailLocalLen+1) + "@example.com",
+		"alice@" + strings.Repeat("a", maxDomainLabelLen+1) + ".com",
+	} {
+		if err := checkEmail(bad); !errors.Is(err, errBadEmail) {
+			t.Fatalf("Expected error '%v' for %q but got '%v'.", errBadEmail, bad, err)
+		}
+	}
+	for _, good := range []string{
+		"alice@example.com",
+		"a.b-c@mail.example-1.co.uk",
+	} {
+		if err := checkEmail(good); err != nil {
+			t.Fatalf("Expected no error for %q but got '%v'.", good, err)
+		}
+	}
+}
+
+func TestEmailBadInput(t *testing.T) {
+	e := newEmailTokenizer()
+	_ = e.resetKey()
+
+	for _, bad := range []string{"", "alice", "alice@", "@example.com"} {
+		if _, err := e.tokenize(blob(bad)); !errors.Is(err, errBadEmail) {
+			t.Fatalf("Expected error '%v' for %q but got '%v'.", errBadEmail, bad, err)
+		}
+	}
+}
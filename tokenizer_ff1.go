@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	ff1KeySize         = 32 // In bytes, for AES-256.
+	defaultFF1Alphabet = "0123456789"
+)
+
+var (
+	errOutOfAlphabet    = errors.New("input contains symbol outside of alphabet")
+	errBadAlphabet      = errors.New("alphabet must consist of at least two unique symbols")
+	errAlphabetTooLarge = fmt.Errorf("alphabet must not contain more than %d symbols", ff1MaxRadix)
+	errInvalidUTF8      = errors.New("input is not valid UTF-8")
+)
+
+// outOfAlphabetError is returned when the tokenizer encounters a symbol that's
+// not part of the configured alphabet.  We deliberately don't include the
+// offending symbol because it's part of sensitive input.
+type outOfAlphabetError struct {
+	pos int
+}
+
+func (e *outOfAlphabetError) Error() string {
+	return fmt.Sprintf("%s at position %d", errOutOfAlphabet, e.pos)
+}
+
+func (e *outOfAlphabetError) Is(target error) bool {
+	return target == errOutOfAlphabet
+}
+
+// alphabet maps symbols to numerals and back.  The radix of our
+// format-preserving encryption is the number of symbols in the alphabet.
+type alphabet struct {
+	symbols  []rune
+	numerals map[rune]uint16
+}
+
+// newAlphabet returns a new alphabet that consists of the given symbols.
+func newAlphabet(s string) (*alphabet, error) {
+	a := &alphabet{
+		symbols:  []rune(s),
+		numerals: make(map[rune]uint16),
+	}
+	if len(a.symbols) > ff1MaxRadix {
+		return nil, errAlphabetTooLarge
+	}
+	for i, r := range a.symbols {
+		if _, exists := a.numerals[r]; exists {
+			return nil, errBadAlphabet
+		}
+		a.numerals[r] = uint16(i)
+	}
+	if len(a.symbols) < 2 {
+		return nil, errBadAlphabet
+	}
+	return a, nil
+}
+
+// toNumerals turns the given string into a numeral string.
+func (a *alphabet) toNumerals(s string) ([]uint16, error) {
+	if !utf8.ValidString(s) {
+		return nil, errInvalidUTF8
+	}
+	x := make([]uint16, 0, len(s))
+	for pos, r := range []rune(s) {
+		n, exists := a.numerals[r]
+		if !exists {
+			return nil, &outOfAlphabetError{pos: pos}
+		}
+		x = append(x, n)
+	}
+	return x, nil
+}
+
+// toString turns the given numeral string back into a string.
+func (a *alphabet) toString(x []uint16) string {
+	var b strings.Builder
+	for _, n := range x {
+		b.WriteRune(a.symbols[n])
+	}
+	return b.String()
+}
+
+// ff1Tokenizer implements a format-preserving tokenizer that uses FF1.  The
+// resulting tokens have the same length and consist of the same alphabet as
+// the input, which makes the tokenizer suitable for account numbers and
+// device IDs whose format is validated downstream.
+type ff1Tokenizer struct {
+	sync.RWMutex
+	*keyProvider
+	alphabet *alphabet
+	tweak    []byte
+}
+
+// ff1State represents the state that we derive from each key: an FF1
+// instance whose radix matches the alphabet, the alphabet and tweak that were
+// configured when the state was derived, and the tokenizer's counter of
+// tokenization outcomes.
+type ff1State struct {
+	ff1       *ff1
+	alphabet  *alphabet
+	tweak     []byte
+	tokenized func(string) prometheus.Counter
+}
+
+// free zeroizes and frees the FF1 key.
+func (f *ff1State) free() {
+	f.ff1.free()
+}
+
+func newFF1Tokenizer() tokenizer {
+	a, _ := newAlphabet(defaultFF1Alphabet)
+	f := &ff1Tokenizer{alphabet: a}
+	f.keyProvider = newKeyProvider(tokenizerFF1, ff1KeySize, f.deriveState)
+	return f
+}
+
+// setConfig configures the key provider and sets the tokenizer's alphabet and
+// tweak.  The configuration is validated while parsing flags, so we don't
+// expect errors here.
+func (f *ff1Tokenizer) setConfig(c *config) {
+	f.keyProvider.setConfig(c)
+
+	f.Lock()
+	if c.ff1Alphabet != "" {
+		if a, err := newAlphabet(c.ff1Alphabet); err != nil {
+			l.Printf("Ignoring invalid FF1 alphabet: %v", err)
+		} else {
+			f.alphabet = a
+		}
+	}
+	f.tweak = c.ff1Tweak
+	f.Unlock()
+
+	// The radix depends on the alphabet, so we may have to re-initialize FF1.
+	if err := f.rederive(); err != nil {
+		l.Printf("Failed to re-initialize FF1: %v", err)
+	}
+}
+
+// deriveState initializes FF1 using the given key and the configured
+// alphabet.
+func (f *ff1Tokenizer) deriveState(key []byte) (interface{}, error) {
+	f.RLock()
+	defer f.RUnlock()
+
+	c, err := newFF1(key, len(f.alphabet.symbols))
+	if err != nil {
+		return nil, err
+	}
+	return &ff1State{ff1: c, alphabet: f.alphabet, tweak: f.tweak, tokenized: f.tokenized}, nil
+}
+
+func (f *ff1Tokenizer) tokenize(s serializer) (token, error) {
+	t, _, err := f.tokenizeUsing(s, nil)
+	return t, err
+}
+
+func (f *ff1Tokenizer) tokenizeAndKeyID(s serializer) (token, *keyID, error) {
+	return f.tokenizeUsing(s, nil)
+}
+
+func (f *ff1Tokenizer) tokenizeWithKeyID(s serializer, id *keyID) (token, error) {
+	t, _, err := f.tokenizeUsing(s, id)
+	return t, err
+}
+
+// tokenizeUsing tokenizes the given serializer using the active key with the
+// given ID, or the current key if the ID is nil.
+func (f *ff1Tokenizer) tokenizeUsing(s serializer, id *keyID) (token, *keyID, error) {
+	key, release, err := f.acquireKey(id)
+	if err != nil {
+		f.tokenized(failBecause(err)).Inc()
+		return nil, nil, err
+	}
+	defer release()
+
+	t, err := key.state.(*ff1State).encrypt(s.bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, key.id, nil
+}
+
+func (f *ff1Tokenizer) tokenizeBatch(ss []serializer, id *keyID) ([]token, *keyID, error) {
+	key, release, err := f.acquireKey(id)
+	if err != nil {
+		f.tokenized(failBecause(err)).Add(float64(len(ss)))
+		return nil, nil, err
+	}
+	defer release()
+
+	state := key.state.(*ff1State)
+	tokens, err := tokenizeEach(ss, func(s serializer) (token, error) {
+		return state.encrypt(s.bytes())
+	})
+	return tokens, key.id, err
+}
+
+// encrypt turns the given blob into a token.
+func (f *ff1State) encrypt(b []byte) (token, error) {
+	// Our stdin receiver hands us lines including their terminator, which is
+	// not part of the alphabet.
+	s := strings.TrimRight(string(b), "\r\n")
+
+	x, err := f.alphabet.toNumerals(s)
+	if err != nil {
+		// Our typed error carries the position of the offending symbol, which
+		// would result in a new label value for each position.
+		labelErr := err
+		if errors.Is(err, errOutOfAlphabet) {
+			labelErr = errOutOfAlphabet
+		}
+		f.tokenized(failBecause(labelErr)).Inc()
+		return nil, err
+	}
+	y, err := f.ff1.encrypt(x, f.tweak)
+	if err != nil {
+		f.tokenized(failBecause(err)).Inc()
+		return nil, err
+	}
+	f.tokenized(success).Inc()
+	return token(f.alphabet.toString(y)), nil
+}
+
+func (f *ff1Tokenizer) preservesLen() bool {
+	return true
+}
+
+func (f *ff1Tokenizer) emitsText() bool {
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFF1PreservesFormat(t *testing.T) {
+	f := newFF1Tokenizer()
+	f.(configurer).setConfig(&config{ff1Alphabet: "0123456789abcdef"})
+	_ = f.resetKey()
+
+	in := "00000000deadbeef"
+	tkn, err := f.tokenize(blob(in + "\n"))
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	assertEqual(t, len(tkn), len(in))
+	if _, err := f.(*ff1Tokenizer).alphabet.toNumerals(string(tkn)); err != nil {
+		t.Fatalf("Token %q is not part of the alphabet.", tkn)
+	}
+	if string(tkn) == in {
+		t.Fatal("Token is identical to input.")
+	}
+}
+
+func TestFF1OutOfAlphabet(t *testing.T) {
+	f := newFF1Tokenizer()
+	_ = f.resetKey()
+	labels := metricsFor(pipelinePrimary).numTokenized.WithLabelValues
+	failed := testutil.ToFloat64(labels(failBecause(errOutOfAlphabet)))
+
+	_, err := f.tokenize(blob("1234x6789"))
+	if !errors.Is(err, errOutOfAlphabet) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errOutOfAlphabet, err)
+	}
+	var alphabetErr *outOfAlphabetError
+	if !errors.As(err, &alphabetErr) {
+		t.Fatalf("Expected error of type %T but got %T.", alphabetErr, err)
+	}
+	assertEqual(t, alphabetErr.pos, 4)
+	assertEqual(t, testutil.ToFloat64(labels(failBecause(errOutOfAlphabet))), failed+1)
+}
+
+func TestNewAlphabet(t *testing.T) {
+	for _, bad := range []string{"", "0", "00", "0120"} {
+		if _, err := newAlphabet(bad); !errors.Is(err, errBadAlphabet) {
+			t.Fatalf("Expected error '%v' for %q but got '%v'.", errBadAlphabet, bad, err)
+		}
+	}
+	a, err := newAlphabet("äöü")
+	if err != nil {
+		t.Fatalf("Failed to create alphabet: %v", err)
+	}
+	assertEqual(t, len(a.symbols), 3)
+}
@@ -1,72 +1,520 @@
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
 	"sync"
 
-	uuid "github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
 )
 
 const (
-	hmacKeySize = 20 // In bytes.
+	hmacKeySize    = 20 // In bytes.  The default key size.
+	hmacMinKeySize = 16 // In bytes.
+	hmacOutputBits = 256
+	hmacIPad       = 0x36
+	hmacOPad       = 0x5c
+
+	// The keyed-hash families that the HMAC tokenizer supports.
+	hmacSHA256    = "hmac-sha256"
+	hmacSHA512256 = "hmac-sha512-256"
+	keyedBLAKE2b  = "blake2b"
+	kmac256       = "kmac256"
+
+	defaultHmacFamily = hmacSHA256
+
+	// We only track collisions of tokens that are truncated to at most this
+	// many bits.  Collisions of longer tokens are too unlikely to matter.
+	maxTrackedTokenBits = 64
+	// The number of distinct inputs per epoch after which we stop tracking
+	// collisions, which bounds the tracker's memory.
+	maxTrackedInputs = 1 << 20
+
+	// cSHAKE256's rate in bytes.
+	kmacRate = 136
+)
+
+var (
+	errBadHmacFamily  = errors.New("unknown keyed-hash family")
+	errBadHmacKeySize = errors.New("invalid key size for keyed-hash family")
+	errBadHmacBits    = fmt.Errorf("number of token bits must be in interval [1, %d]", hmacOutputBits)
+
+	// hmacFamilies maps the names of keyed-hash families to functions that
+	// absorb a key.  All families have a 256-bit output.
+	hmacFamilies = map[string]func(key []byte) (keyedHash, error){
+		hmacSHA256: func(key []byte) (keyedHash, error) {
+			return newHmacState(sha256.New, key)
+		},
+		hmacSHA512256: func(key []byte) (keyedHash, error) {
+			return newHmacState(sha512.New512_256, key)
+		},
+		keyedBLAKE2b: newBlake2bMAC,
+		kmac256: func(key []byte) (keyedHash, error) {
+			return &kmacState{h: newKMAC256(key, nil)}, nil
+		},
+	}
 )
 
-// hmacTokenizer implements a tokenizer that uses HMAC-SHA256.
+// hmacTokenizer implements a tokenizer that uses a keyed hash function,
+// HMAC-SHA256 by default.  Tokens can be truncated to fewer bits, which
+// results in shorter tokens and deliberate collisions.  Key management is
+// left to the embedded key provider.
 type hmacTokenizer struct {
 	sync.RWMutex
+	*keyProvider
+	family string
+	bits   int
+}
+
+// keyedHash represents a keyed hash function whose key was already absorbed.
+type keyedHash interface {
+	sum(data []byte) ([]byte, error)
+	freer
+}
+
+// macState represents the state that we derive from each key: the keyed
+// hash, the number of bits that its output is truncated to, and the key's
+// collision tracker.  Each key has its own tracker because collisions only
+// matter within an epoch.
+type macState struct {
+	mac        keyedHash
+	bits       int
+	collisions *collisionTracker
+}
+
+// hmacState represents the inner and outer hash states of HMAC (RFC 2104)
+// after they absorbed the padded key.  We compute both states once per key
+// instead of once per token.  The states are as sensitive as the key, so they
+// live in locked memory.
+type hmacState struct {
+	newHash func() hash.Hash
+	inner   []byte
+	outer   []byte
+}
+
+// blake2bMAC represents BLAKE2b-256 in keyed mode.  The package we use
+// doesn't let us save the state of a keyed BLAKE2b hash, so we keep the key
+// in locked memory and absorb it for each token.
+type blake2bMAC struct {
 	key []byte
 }
 
+// kmacState represents KMAC256 (NIST SP 800-185) after it absorbed the key.
+type kmacState struct {
+	h sha3.ShakeHash
+}
+
 func newHmacTokenizer() tokenizer {
-	return &hmacTokenizer{}
+	h := &hmacTokenizer{
+		family: defaultHmacFamily,
+		bits:   hmacOutputBits,
+	}
+	h.keyProvider = newKeyProvider(tokenizerHmac, hmacKeySize, h.deriveState)
+	return h
 }
 
-func (h *hmacTokenizer) tokenize(s serializer) (token, error) {
-	h.RLock()
-	defer h.RUnlock()
+// setConfig configures the key provider and sets the tokenizer's keyed-hash
+// family, key size, and token length.  The configuration is validated while
+// parsing flags, so we don't expect errors here.
+func (h *hmacTokenizer) setConfig(c *config) {
+	h.keyProvider.setConfig(c)
+	if c.hmacKeySize != 0 {
+		h.setKeySize(c.hmacKeySize)
+	}
 
-	if len(h.key) == 0 {
-		return nil, errNoKey
+	h.Lock()
+	if c.hmacFamily != "" {
+		h.family = c.hmacFamily
+	}
+	if c.hmacBits != 0 {
+		h.bits = c.hmacBits
+	}
+	h.Unlock()
+
+	if err := h.rederive(); err != nil {
+		l.Printf("Failed to re-initialize keyed hash: %v", err)
 	}
-	t := hmac.New(sha256.New, h.key)
-	t.Write(s.bytes())
-	return t.Sum(nil), nil
 }
 
-func (h *hmacTokenizer) tokenizeAndKeyID(s serializer) (token, *keyID, error) {
+// deriveState absorbs the given key into the configured keyed hash.
+func (h *hmacTokenizer) deriveState(key []byte) (interface{}, error) {
 	h.RLock()
 	defer h.RUnlock()
 
-	if len(h.key) == 0 {
-		return nil, nil, errNoKey
+	newMAC, exists := hmacFamilies[h.family]
+	if !exists {
+		return nil, errBadHmacFamily
 	}
-	t := hmac.New(sha256.New, h.key)
-	t.Write(s.bytes())
-	return t.Sum(nil), h.keyID(), nil
+	mac, err := newMAC(key)
+	if err != nil {
+		return nil, err
+	}
+	return &macState{
+		mac:        mac,
+		bits:       h.bits,
+		collisions: newCollisionTracker(h.bits, h.metrics().tokenCollisionRate),
+	}, nil
 }
 
-func (h *hmacTokenizer) keyID() *keyID {
-	h.RLock()
-	defer h.RUnlock()
+func (h *hmacTokenizer) tokenize(s serializer) (token, error) {
+	t, _, err := h.tokenizeUsing(s, nil)
+	return t, err
+}
 
-	// A v5 UUID is supposed to hash the given name (in our case: the key)
-	// using SHA-1 but let's be extra careful and hash the key using SHA-256
-	// before handing it over to the uuid package.
-	sum := sha256.Sum256(h.key)
-	return &keyID{UUID: uuid.NewSHA1(uuidNamespace, sum[:])}
+func (h *hmacTokenizer) tokenizeAndKeyID(s serializer) (token, *keyID, error) {
+	return h.tokenizeUsing(s, nil)
 }
 
-func (h *hmacTokenizer) resetKey() error {
-	h.Lock()
-	defer h.Unlock()
+func (h *hmacTokenizer) tokenizeWithKeyID(s serializer, id *keyID) (token, error) {
+	t, _, err := h.tokenizeUsing(s, id)
+	return t, err
+}
+
+// tokenizeUsing tokenizes the given serializer using the active key with the
+// given ID, or the current key if the ID is nil.
+func (h *hmacTokenizer) tokenizeUsing(s serializer, id *keyID) (token, *keyID, error) {
+	key, release, err := h.acquireKey(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
 
-	h.key = make([]byte, hmacKeySize)
-	_, err := rand.Read(h.key)
-	return err
+	t, err := key.state.(*macState).sum(s.bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, key.id, nil
+}
+
+func (h *hmacTokenizer) tokenizeBatch(ss []serializer, id *keyID) ([]token, *keyID, error) {
+	key, release, err := h.acquireKey(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	state := key.state.(*macState)
+	tokens, err := tokenizeEach(ss, func(s serializer) (token, error) {
+		return state.sum(s.bytes())
+	})
+	return tokens, key.id, err
 }
 
 func (h *hmacTokenizer) preservesLen() bool {
 	return false
 }
+
+// checkHmacConfig makes sure that the given keyed-hash family exists, that it
+// accepts keys of the given size, and that tokens can be truncated to the
+// given number of bits.
+func checkHmacConfig(family string, keySize, bits int) error {
+	if _, exists := hmacFamilies[family]; !exists {
+		return fmt.Errorf("%w %q; must be one of: %s", errBadHmacFamily, family, hmacFamilyList())
+	}
+	maxKeySize := 0
+	if family == keyedBLAKE2b {
+		maxKeySize = blake2b.Size
+	}
+	if keySize < hmacMinKeySize || (maxKeySize != 0 && keySize > maxKeySize) {
+		return fmt.Errorf("%w %s: %d bytes", errBadHmacKeySize, family, keySize)
+	}
+	if bits < 1 || bits > hmacOutputBits {
+		return errBadHmacBits
+	}
+	return nil
+}
+
+// hmacFamilyList returns a comma-separated list of all keyed-hash families.
+func hmacFamilyList() string {
+	var names []string
+	for n := range hmacFamilies {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// sum returns the given data's keyed hash, truncated to the configured number
+// of bits, and records the token with the collision tracker.
+func (s *macState) sum(data []byte) (token, error) {
+	full, err := s.mac.sum(data)
+	if err != nil {
+		return nil, err
+	}
+	t := truncateBits(full, s.bits)
+	s.collisions.observe(t, full)
+	return t, nil
+}
+
+// free frees the keyed hash.
+func (s *macState) free() {
+	s.mac.free()
+}
+
+// truncateBits returns the first n bits of the given slice.  If n isn't a
+// multiple of eight, the trailing bits of the last byte are zero.  Note that
+// the returned slice shares the given slice's memory.
+func truncateBits(b []byte, n int) []byte {
+	t := b[: (n+7)/8 : (n+7)/8]
+	if r := n % 8; r != 0 {
+		t[len(t)-1] &= 0xff << (8 - r)
+	}
+	return t
+}
+
+// newHmacState absorbs the given key into the inner and outer states of HMAC
+// using the given hash function, which must support saving its state.
+func newHmacState(newHash func() hash.Hash, key []byte) (*hmacState, error) {
+	blockSize := newHash().BlockSize()
+	// Keys that are longer than the block size are hashed first.
+	padded := make([]byte, blockSize)
+	defer zeroize(padded)
+	if len(key) > blockSize {
+		d := newHash()
+		d.Write(key)
+		sum := d.Sum(nil)
+		copy(padded, sum)
+		zeroize(sum)
+	} else {
+		copy(padded, key)
+	}
+
+	absorb := func(pad byte) ([]byte, error) {
+		block := make([]byte, blockSize)
+		defer zeroize(block)
+		for i := range padded {
+			block[i] = padded[i] ^ pad
+		}
+		d := newHash()
+		d.Write(block)
+		marshaled, err := d.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		defer zeroize(marshaled)
+		return locked.copyOf(marshaled)
+	}
+	inner, err := absorb(hmacIPad)
+	if err != nil {
+		return nil, err
+	}
+	outer, err := absorb(hmacOPad)
+	if err != nil {
+		locked.free(inner)
+		return nil, err
+	}
+	return &hmacState{newHash: newHash, inner: inner, outer: outer}, nil
+}
+
+// sum returns the HMAC of the given data.
+func (h *hmacState) sum(data []byte) ([]byte, error) {
+	inner, err := h.restore(h.inner)
+	if err != nil {
+		return nil, err
+	}
+	inner.Write(data)
+	outer, err := h.restore(h.outer)
+	if err != nil {
+		return nil, err
+	}
+	outer.Write(inner.Sum(nil))
+	return outer.Sum(nil), nil
+}
+
+// restore returns a hash whose state is the given marshaled state.
+func (h *hmacState) restore(state []byte) (hash.Hash, error) {
+	d := h.newHash()
+	if err := d.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// free zeroizes and frees the inner and outer states.
+func (h *hmacState) free() {
+	locked.free(h.inner)
+	locked.free(h.outer)
+	h.inner, h.outer = nil, nil
+}
+
+// newBlake2bMAC returns keyed BLAKE2b-256 using a copy of the given key.
+func newBlake2bMAC(key []byte) (keyedHash, error) {
+	if len(key) > blake2b.Size {
+		return nil, errBadHmacKeySize
+	}
+	c, err := locked.copyOf(key)
+	if err != nil {
+		return nil, err
+	}
+	return &blake2bMAC{key: c}, nil
+}
+
+// sum returns the keyed BLAKE2b-256 hash of the given data.
+func (b *blake2bMAC) sum(data []byte) ([]byte, error) {
+	d, err := blake2b.New256(b.key)
+	if err != nil {
+		return nil, err
+	}
+	d.Write(data)
+	return d.Sum(nil), nil
+}
+
+// free zeroizes and frees the key.
+func (b *blake2bMAC) free() {
+	locked.free(b.key)
+	b.key = nil
+}
+
+// sum returns the 256-bit KMAC256 of the given data.
+func (k *kmacState) sum(data []byte) ([]byte, error) {
+	return kmacSum(k.h, data, hmacOutputBits/8), nil
+}
+
+// free resets cSHAKE256, which forgets the absorbed key.
+func (k *kmacState) free() {
+	k.h.Reset()
+}
+
+// newKMAC256 returns cSHAKE256 after it absorbed the given key for KMAC256
+// with the given customization string, as specified in NIST SP 800-185,
+// section 4.3.
+func newKMAC256(key, custom []byte) sha3.ShakeHash {
+	h := sha3.NewCShake256([]byte("KMAC"), custom)
+	h.Write(bytepad(encodeString(key), kmacRate))
+	return h
+}
+
+// kmacSum returns the KMAC of the given data, which is outLen bytes long.
+// The given cSHAKE256 instance must have absorbed the key and isn't modified.
+func kmacSum(h sha3.ShakeHash, data []byte, outLen int) []byte {
+	d := h.Clone()
+	d.Write(data)
+	d.Write(rightEncode(uint64(outLen) * 8))
+	out := make([]byte, outLen)
+	_, _ = d.Read(out)
+	return out
+}
+
+// leftEncode and rightEncode encode the given integer as specified in NIST SP
+// 800-185, section 2.3.1.
+func leftEncode(x uint64) []byte {
+	b := encodeUint(x)
+	return append([]byte{byte(len(b))}, b...)
+}
+
+func rightEncode(x uint64) []byte {
+	b := encodeUint(x)
+	return append(b, byte(len(b)))
+}
+
+// encodeUint returns the big-endian encoding of the given integer without
+// leading zero bytes, but at least one byte.
+func encodeUint(x uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], x)
+	i := 0
+	for i < len(b)-1 && b[i] == 0 {
+		i++
+	}
+	return b[i:]
+}
+
+// encodeString and bytepad are specified in NIST SP 800-185, section 2.3.
+func encodeString(s []byte) []byte {
+	return append(leftEncode(uint64(len(s))*8), s...)
+}
+
+func bytepad(x []byte, w int) []byte {
+	b := append(leftEncode(uint64(w)), x...)
+	if r := len(b) % w; r != 0 {
+		b = append(b, make([]byte, w-r)...)
+	}
+	return b
+}
+
+// collisionTracker counts how many distinct inputs result in a truncated
+// token that another input already resulted in.  We don't keep inputs
+// around; instead, we tell inputs apart by their untruncated keyed hash, which
+// we can assume to be collision-free.  Once the tracker has seen
+// maxTrackedInputs distinct inputs, it stops tracking, so the collision rate
+// of the remainder of the epoch is an estimate based on its first inputs.
+type collisionTracker struct {
+	sync.Mutex
+	// tokens maps each token to the fingerprint of the first input that
+	// resulted in it.
+	tokens map[uint64]uint64
+	// collided contains the fingerprints of all other inputs.
+	collided map[uint64]empty
+	inputs   int
+	// gauge is what we report the collision rate to.
+	gauge prometheus.Gauge
+}
+
+// newCollisionTracker returns a new collision tracker for tokens of the given
+// length that reports to the given gauge, or nil if tokens are too long to
+// bother.
+func newCollisionTracker(bits int, rate prometheus.Gauge) *collisionTracker {
+	if bits > maxTrackedTokenBits {
+		return nil
+	}
+	rate.Set(0)
+	return &collisionTracker{
+		tokens:   make(map[uint64]uint64),
+		collided: make(map[uint64]empty),
+		gauge:    rate,
+	}
+}
+
+// observe records the given token, which resulted from an input whose
+// untruncated keyed hash is full, and updates the collision rate metric.
+func (c *collisionTracker) observe(t token, full []byte) {
+	if c == nil {
+		return
+	}
+	var padded [8]byte
+	copy(padded[:], t)
+	tkn := binary.BigEndian.Uint64(padded[:])
+	fingerprint := binary.BigEndian.Uint64(full[len(full)-8:])
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.inputs >= maxTrackedInputs {
+		return
+	}
+	first, exists := c.tokens[tkn]
+	switch {
+	case !exists:
+		c.tokens[tkn] = fingerprint
+	case first == fingerprint:
+		return
+	default:
+		if _, seen := c.collided[fingerprint]; seen {
+			return
+		}
+		c.collided[fingerprint] = empty{}
+	}
+	c.inputs++
+	c.gauge.Set(c.rate())
+	if c.inputs == maxTrackedInputs {
+		l.Printf("Tracked collisions of %d distinct inputs.  Not tracking more inputs this epoch.", c.inputs)
+	}
+}
+
+// rate returns the fraction of distinct inputs whose token collides with the
+// token of a previous input.  The caller must hold the lock.
+func (c *collisionTracker) rate() float64 {
+	if c.inputs == 0 {
+		return 0
+	}
+	return float64(len(c.collided)) / float64(c.inputs)
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
 	"errors"
+	"fmt"
+	"hash"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/blake2b"
 )
 
 func TestEmptyHMACKey(t *testing.T) {
 	v := blob([]byte{1, 2, 3, 4})
-	h := &hmacTokenizer{}
+	h := newHmacTokenizer()
 	_, err := h.tokenize(v)
 	if !errors.Is(err, errNoKey) {
 		t.Fatalf("Expected error '%v' but got '%v'.", errNoKey, err)
@@ -15,14 +24,174 @@ func TestEmptyHMACKey(t *testing.T) {
 }
 
 func TestHMACPreservesLen(t *testing.T) {
-	h := &hmacTokenizer{}
+	h := newHmacTokenizer()
 	if h.preservesLen() {
 		t.Fatalf("HMAC tokenizer not expected to preserve length but it does.")
 	}
 }
 
+func TestHmacState(t *testing.T) {
+	// Our precomputed states must agree with the standard library, including
+	// for keys that exceed the hash function's block size.
+	data := []byte("foo")
+	for _, newHash := range []func() hash.Hash{sha256.New, sha512.New512_256} {
+		blockSize := newHash().BlockSize()
+		for _, keyLen := range []int{0, hmacKeySize, blockSize, blockSize + 1} {
+			key := bytes.Repeat([]byte{0x42}, keyLen)
+			state, err := newHmacState(newHash, key)
+			if err != nil {
+				t.Fatalf("Failed to create HMAC state: %v", err)
+			}
+			tkn, err := state.sum(data)
+			if err != nil {
+				t.Fatalf("Failed to compute HMAC: %v", err)
+			}
+			h := hmac.New(newHash, key)
+			h.Write(data)
+			if !bytes.Equal(tkn, h.Sum(nil)) {
+				t.Fatalf("Expected HMAC to match standard library for key length %d.", keyLen)
+			}
+			state.free()
+		}
+	}
+}
+
+func TestBlake2bMAC(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, blake2b.Size)
+	mac, err := newBlake2bMAC(key)
+	if err != nil {
+		t.Fatalf("Failed to create keyed BLAKE2b: %v", err)
+	}
+	defer mac.free()
+	sum, err := mac.sum([]byte("foo"))
+	if err != nil {
+		t.Fatalf("Failed to compute keyed BLAKE2b: %v", err)
+	}
+	d, _ := blake2b.New256(key)
+	d.Write([]byte("foo"))
+	if !bytes.Equal(sum, d.Sum(nil)) {
+		t.Fatal("Expected keyed BLAKE2b to match the BLAKE2b package.")
+	}
+
+	_, err = newBlake2bMAC(append(key, 0x42))
+	assertEqual(t, err, errBadHmacKeySize)
+}
+
+func TestKMAC256(t *testing.T) {
+	// NIST SP 800-185's KMAC samples, sample 4:
+	// https://csrc.nist.gov/CSRC/media/Projects/Cryptographic-Standards-and-Guidelines/documents/examples/KMAC_samples.pdf
+	h := newKMAC256(unhex("404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f"),
+		[]byte("My Tagged Application"))
+	sum := kmacSum(h, unhex("00010203"), 64)
+	expected := unhex("20c570c31346f703c9ac36c61c03cb64c3970d0cfc787e9b79599d273a68d2f7" +
+		"f69d4cc3de9d104a351689f27cf6f5951f0103f33f4f24871024d9c27773a8dd")
+	if !bytes.Equal(sum, expected) {
+		t.Fatalf("Expected KMAC256 %x but got %x.", expected, sum)
+	}
+	// Computing a sum must not modify the keyed state.
+	if !bytes.Equal(kmacSum(h, unhex("00010203"), 64), expected) {
+		t.Fatal("Expected KMAC256 state to be reusable.")
+	}
+}
+
+func TestHMACFamilies(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, hmacKeySize)
+	tokens := make(map[string]bool)
+	for family := range hmacFamilies {
+		h := newHmacTokenizer()
+		h.(configurer).setConfig(&config{hmacFamily: family})
+		if err := h.(keyUser).useKey(key); err != nil {
+			t.Fatalf("Failed to use key: %v", err)
+		}
+		tkn, err := h.tokenize(blob("foo"))
+		if err != nil {
+			t.Fatalf("Failed to tokenize using %s: %v", family, err)
+		}
+		assertEqual(t, len(tkn), hmacOutputBits/8)
+		tokens[string(tkn)] = true
+	}
+	// Each family must result in different tokens.
+	assertEqual(t, len(tokens), len(hmacFamilies))
+}
+
+func TestHMACKeySize(t *testing.T) {
+	h := newHmacTokenizer()
+	h.(configurer).setConfig(&config{hmacKeySize: 32})
+	if err := h.resetKey(); err != nil {
+		t.Fatalf("Failed to reset key: %v", err)
+	}
+	key, release, err := h.(*hmacTokenizer).acquireKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to acquire key: %v", err)
+	}
+	defer release()
+	assertEqual(t, len(key.material), 32)
+}
+
+func TestCheckHmacConfig(t *testing.T) {
+	tests := []struct {
+		family  string
+		keySize int
+		bits    int
+		err     error
+	}{
+		{hmacSHA256, hmacKeySize, hmacOutputBits, nil},
+		{kmac256, 128, 1, nil},
+		{keyedBLAKE2b, blake2b.Size, 64, nil},
+		{"md5", hmacKeySize, hmacOutputBits, errBadHmacFamily},
+		{keyedBLAKE2b, blake2b.Size + 1, hmacOutputBits, errBadHmacKeySize},
+		{hmacSHA256, hmacMinKeySize - 1, hmacOutputBits, errBadHmacKeySize},
+		{hmacSHA256, hmacKeySize, 0, errBadHmacBits},
+		{hmacSHA256, hmacKeySize, hmacOutputBits + 1, errBadHmacBits},
+	}
+	for _, test := range tests {
+		err := checkHmacConfig(test.family, test.keySize, test.bits)
+		if !errors.Is(err, test.err) {
+			t.Fatalf("Expected error '%v' but got '%v'.", test.err, err)
+		}
+	}
+}
+
+func TestTruncateBits(t *testing.T) {
+	b := []byte{0xff, 0xff, 0xff}
+	assertEqual(t, fmt.Sprintf("%x", truncateBits(append([]byte{}, b...), 24)), "ffffff")
+	assertEqual(t, fmt.Sprintf("%x", truncateBits(append([]byte{}, b...), 16)), "ffff")
+	assertEqual(t, fmt.Sprintf("%x", truncateBits(append([]byte{}, b...), 12)), "fff0")
+	assertEqual(t, fmt.Sprintf("%x", truncateBits(append([]byte{}, b...), 1)), "80")
+}
+
+func TestHMACCollisions(t *testing.T) {
+	const bits, numInputs = 8, 100
+	h := newHmacTokenizer()
+	h.(configurer).setConfig(&config{hmacBits: bits})
+	if err := h.resetKey(); err != nil {
+		t.Fatalf("Failed to reset key: %v", err)
+	}
+
+	// Tokenize each input twice.  Repeated inputs must not count as
+	// collisions.
+	tokens := make(map[string]bool)
+	for i := 0; i < numInputs*2; i++ {
+		tkn, err := h.tokenize(blob(fmt.Sprintf("input %d", i%numInputs)))
+		if err != nil {
+			t.Fatalf("Failed to tokenize: %v", err)
+		}
+		assertEqual(t, len(tkn), 1)
+		tokens[string(tkn)] = true
+	}
+	// Each distinct token has exactly one input that isn't a collision.
+	expected := float64(numInputs-len(tokens)) / numInputs
+	assertEqual(t, testutil.ToFloat64(metricsFor(pipelinePrimary).tokenCollisionRate), expected)
+
+	// A new key starts a new epoch.
+	if err := h.resetKey(); err != nil {
+		t.Fatalf("Failed to reset key: %v", err)
+	}
+	assertEqual(t, testutil.ToFloat64(metricsFor(pipelinePrimary).tokenCollisionRate), float64(0))
+}
+
 func BenchmarkHMAC(b *testing.B) {
-	h := hmacTokenizer{}
+	h := newHmacTokenizer()
 	_ = h.resetKey()
 	v := blob([]byte{1, 2, 3, 4})
 
@@ -30,3 +199,20 @@ func BenchmarkHMAC(b *testing.B) {
 		_, _ = h.tokenize(v)
 	}
 }
+
+// BenchmarkHMACStdlib measures what we did before precomputing HMAC states:
+// initializing HMAC-SHA256 for each token.
+func BenchmarkHMACStdlib(b *testing.B) {
+	key := bytes.Repeat([]byte{0x42}, hmacKeySize)
+	v := blob([]byte{1, 2, 3, 4})
+
+	for i := 0; i < b.N; i++ {
+		h := hmac.New(sha256.New, key)
+		h.Write(v)
+		_ = h.Sum(nil)
+	}
+}
+
+func BenchmarkHMACBatch(b *testing.B) {
+	benchmarkBatch(b, newHmacTokenizer())
+}
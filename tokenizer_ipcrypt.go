@@ -0,0 +1,411 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// The ipcrypt family of IP address encryption methods is specified in:
+// https://datatracker.ietf.org/doc/draft-denis-ipcrypt/
+const (
+	ipcryptDeterministic ipcryptMode = iota
+	ipcryptPfx
+	ipcryptND
+	ipcryptNDX
+
+	ipcryptNDXTweakSize = 16 // In bytes.
+)
+
+var errIdenticalKeyHalves = errors.New("both halves of the key must not be identical")
+
+// ipcryptMode represents one of ipcrypt's modes of operation.
+type ipcryptMode int
+
+// keySize returns the key size (in bytes) of the given mode.
+func (m ipcryptMode) keySize() int {
+	switch m {
+	case ipcryptPfx, ipcryptNDX:
+		return 2 * aes.BlockSize
+	default:
+		return aes.BlockSize
+	}
+}
+
+// name returns the tokenizer name of the given mode.
+func (m ipcryptMode) name() string {
+	switch m {
+	case ipcryptPfx:
+		return tokenizerIPCryptPfx
+	case ipcryptND:
+		return tokenizerIPCryptND
+	case ipcryptNDX:
+		return tokenizerIPCryptNDX
+	default:
+		return tokenizerIPCryptDet
+	}
+}
+
+// ipcryptTokenizer implements a tokenizer that uses ipcrypt to encrypt IP
+// addresses.  The deterministic and prefix-preserving modes turn an IP
+// address into another IP address while the non-deterministic modes turn an
+// IP address into an opaque byte string that contains a random tweak.  Tokens
+// of the non-deterministic modes are therefore unlinkable.
+type ipcryptTokenizer struct {
+	*keyProvider
+	mode ipcryptMode
+}
+
+// ipcryptState represents the state that we derive from each key: the mode
+// and the key in locked memory.  We initialize the mode's ciphers for each
+// operation (or batch) instead of keeping their key schedules around on Go's
+// heap.
+type ipcryptState struct {
+	mode ipcryptMode
+	key  []byte
+}
+
+// ipcryptKey represents the ciphers that the given mode requires, initialized
+// using the same key.
+type ipcryptKey struct {
+	mode  ipcryptMode
+	k1    cipher.Block
+	k2    cipher.Block
+	kiasu *kiasuBC
+}
+
+// newIPCryptTokenizer returns a new ipcrypt tokenizer for the given mode.
+func newIPCryptTokenizer(mode ipcryptMode) *ipcryptTokenizer {
+	return &ipcryptTokenizer{
+		keyProvider: newKeyProvider(mode.name(), mode.keySize(), func(key []byte) (interface{}, error) {
+			return newIPCryptState(mode, key)
+		}),
+		mode: mode,
+	}
+}
+
+func newIPCryptDeterministicTokenizer() tokenizer {
+	return newIPCryptTokenizer(ipcryptDeterministic)
+}
+
+func newIPCryptPfxTokenizer() tokenizer {
+	return newIPCryptTokenizer(ipcryptPfx)
+}
+
+func newIPCryptNDTokenizer() tokenizer {
+	return newIPCryptTokenizer(ipcryptND)
+}
+
+func newIPCryptNDXTokenizer() tokenizer {
+	return newIPCryptTokenizer(ipcryptNDX)
+}
+
+func (c *ipcryptTokenizer) isBlobSupported(b []byte) bool {
+	return len(b) == ipv4Len || len(b) == ipv6Len
+}
+
+func (c *ipcryptTokenizer) tokenize(s serializer) (token, error) {
+	t, _, err := c.tokenizeUsing(s, nil)
+	return t, err
+}
+
+func (c *ipcryptTokenizer) tokenizeAndKeyID(s serializer) (token, *keyID, error) {
+	return c.tokenizeUsing(s, nil)
+}
+
+func (c *ipcryptTokenizer) tokenizeWithKeyID(s serializer, id *keyID) (token, error) {
+	t, _, err := c.tokenizeUsing(s, id)
+	return t, err
+}
+
+// tokenizeUsing encrypts the given IP address using the active key with the
+// given ID, or the current key if the ID is nil.
+func (c *ipcryptTokenizer) tokenizeUsing(s serializer, id *keyID) (token, *keyID, error) {
+	key, release, err := c.acquireKey(id)
+	if err != nil {
+		c.tokenized(failBecause(err)).Inc()
+		return nil, nil, err
+	}
+	defer release()
+
+	k, err := key.state.(*ipcryptState).ciphers()
+	if err != nil {
+		c.tokenized(failBecause(err)).Inc()
+		return nil, nil, err
+	}
+	t, err := c.encryptUsing(k, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, key.id, nil
+}
+
+func (c *ipcryptTokenizer) tokenizeBatch(ss []serializer, id *keyID) ([]token, *keyID, error) {
+	key, release, err := c.acquireKey(id)
+	if err != nil {
+		c.tokenized(failBecause(err)).Add(float64(len(ss)))
+		return nil, nil, err
+	}
+	defer release()
+
+	// We initialize the ciphers once for the entire batch.
+	k, err := key.state.(*ipcryptState).ciphers()
+	if err != nil {
+		c.tokenized(failBecause(err)).Add(float64(len(ss)))
+		return nil, nil, err
+	}
+	tokens, err := tokenizeEach(ss, func(s serializer) (token, error) {
+		return c.encryptUsing(k, s)
+	})
+	return tokens, key.id, err
+}
+
+// encryptUsing encrypts the given IP address using the given ciphers.
+func (c *ipcryptTokenizer) encryptUsing(k *ipcryptKey, s serializer) (token, error) {
+	blob := s.bytes()
+	if !c.isBlobSupported(blob) {
+		c.tokenized(failBecause(errBadBlobLen)).Inc()
+		return nil, errBadBlobLen
+	}
+	t, err := k.encrypt(blob)
+	if err != nil {
+		c.tokenized(failBecause(err)).Inc()
+		return nil, err
+	}
+	c.tokenized(success).Inc()
+	return t, nil
+}
+
+// encrypt encrypts the given IP address using the key's mode.
+func (c *ipcryptKey) encrypt(blob []byte) (token, error) {
+	switch c.mode {
+	case ipcryptPfx:
+		return c.encryptPfx(blob), nil
+	case ipcryptND:
+		return c.encryptND(blob)
+	case ipcryptNDX:
+		return c.encryptNDX(blob)
+	default:
+		return c.encryptDeterministic(blob), nil
+	}
+}
+
+// encryptDeterministic implements ipcrypt-deterministic, which encrypts the
+// 16-byte representation of the given address using AES-128.
+func (c *ipcryptKey) encryptDeterministic(blob []byte) token {
+	t := make(token, ipv6Len)
+	c.k1.Encrypt(t, to16(blob))
+	return t
+}
+
+// encryptPfx implements ipcrypt-pfx, which preserves the network prefix of
+// the given address, i.e., two addresses that share a prefix of n bits result
+// in two encrypted addresses that also share a prefix of n bits.  IPv4
+// addresses remain IPv4 addresses.
+func (c *ipcryptKey) encryptPfx(blob []byte) token {
+	addr := to16(blob)
+	encrypted := make([]byte, ipv6Len)
+	prefixStart := 0
+	if isIPv4Mapped(addr) {
+		prefixStart = 96
+		copy(encrypted, addr[:12])
+	}
+
+	var e1, e2 [aes.BlockSize]byte
+	padded := padPrefix(addr, prefixStart)
+	for prefixLen := prefixStart; prefixLen < 128; prefixLen++ {
+		c.k1.Encrypt(e1[:], padded[:])
+		c.k2.Encrypt(e2[:], padded[:])
+		cipherBit := (e1[15] ^ e2[15]) & 1
+		origBit := getBit(addr, 127-prefixLen)
+		setBit(encrypted, 127-prefixLen, cipherBit^origBit)
+
+		shiftLeft(&padded)
+		setBit(padded[:], 0, origBit)
+	}
+
+	if len(blob) == ipv4Len {
+		return token(encrypted[12:])
+	}
+	return token(encrypted)
+}
+
+// encryptND implements ipcrypt-nd, which encrypts the given address using
+// KIASU-BC and a random 8-byte tweak.
+func (c *ipcryptKey) encryptND(blob []byte) (token, error) {
+	tweak := make([]byte, kiasuTweakSize)
+	if _, err := rand.Read(tweak); err != nil {
+		return nil, err
+	}
+	return c.encryptNDWithTweak(blob, tweak), nil
+}
+
+// encryptNDWithTweak returns the concatenation of the given tweak and the
+// KIASU-BC encryption of the given address.
+func (c *ipcryptKey) encryptNDWithTweak(blob, tweak []byte) token {
+	t := make(token, kiasuTweakSize+aes.BlockSize)
+	copy(t, tweak)
+	c.kiasu.encrypt(t[kiasuTweakSize:], to16(blob), tweak)
+	return t
+}
+
+// encryptNDX implements ipcrypt-ndx, which encrypts the given address using
+// AES-XTS and a random 16-byte tweak.
+func (c *ipcryptKey) encryptNDX(blob []byte) (token, error) {
+	tweak := make([]byte, ipcryptNDXTweakSize)
+	if _, err := rand.Read(tweak); err != nil {
+		return nil, err
+	}
+	return c.encryptNDXWithTweak(blob, tweak), nil
+}
+
+// encryptNDXWithTweak returns the concatenation of the given tweak and the
+// AES-XTS encryption of the given address.  As we only ever encrypt a single
+// block, XTS boils down to E_K1(P ^ E_K2(T)) ^ E_K2(T).
+func (c *ipcryptKey) encryptNDXWithTweak(blob, tweak []byte) token {
+	var encTweak [aes.BlockSize]byte
+	c.k2.Encrypt(encTweak[:], tweak)
+
+	t := make(token, ipcryptNDXTweakSize+aes.BlockSize)
+	copy(t, tweak)
+	ct := t[ipcryptNDXTweakSize:]
+	addr := to16(blob)
+	for i := range ct {
+		ct[i] = addr[i] ^ encTweak[i]
+	}
+	c.k1.Encrypt(ct, ct)
+	for i := range ct {
+		ct[i] ^= encTweak[i]
+	}
+	return t
+}
+
+// newIPCryptState returns the state of the given mode using a copy of the
+// given key.
+func newIPCryptState(mode ipcryptMode, key []byte) (*ipcryptState, error) {
+	if err := checkIPCryptKey(mode, key); err != nil {
+		return nil, err
+	}
+	c, err := locked.copyOf(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ipcryptState{mode: mode, key: c}, nil
+}
+
+// ciphers initializes the ciphers that the state's mode requires.
+func (s *ipcryptState) ciphers() (*ipcryptKey, error) {
+	return newIPCryptKey(s.mode, s.key)
+}
+
+// free zeroizes and frees the key.
+func (s *ipcryptState) free() {
+	locked.free(s.key)
+	s.key = nil
+}
+
+// checkIPCryptKey returns an error if the given key is unfit for the given
+// mode.  The two-key modes require two distinct halves.
+func checkIPCryptKey(mode ipcryptMode, key []byte) error {
+	if len(key) != mode.keySize() {
+		return aes.KeySizeError(len(key))
+	}
+	half := aes.BlockSize
+	if (mode == ipcryptPfx || mode == ipcryptNDX) && string(key[:half]) == string(key[half:]) {
+		return errIdenticalKeyHalves
+	}
+	return nil
+}
+
+// newIPCryptKey initializes the ciphers that the given mode requires using
+// the given key.
+func newIPCryptKey(mode ipcryptMode, key []byte) (*ipcryptKey, error) {
+	if err := checkIPCryptKey(mode, key); err != nil {
+		return nil, err
+	}
+	var (
+		c    = &ipcryptKey{mode: mode}
+		err  error
+		half = aes.BlockSize
+	)
+	switch mode {
+	case ipcryptDeterministic:
+		c.k1, err = aes.NewCipher(key)
+	case ipcryptND:
+		c.kiasu, err = newKiasuBC(key)
+	case ipcryptPfx, ipcryptNDX:
+		if c.k1, err = aes.NewCipher(key[:half]); err != nil {
+			return nil, err
+		}
+		c.k2, err = aes.NewCipher(key[half:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *ipcryptTokenizer) preservesLen() bool {
+	return c.mode == ipcryptDeterministic || c.mode == ipcryptPfx
+}
+
+// to16 returns the 16-byte representation of the given IP address.  IPv4
+// addresses are turned into IPv4-mapped IPv6 addresses.
+func to16(blob []byte) []byte {
+	if len(blob) == ipv6Len {
+		return blob
+	}
+	addr := make([]byte, ipv6Len)
+	addr[10], addr[11] = 0xff, 0xff
+	copy(addr[12:], blob)
+	return addr
+}
+
+// isIPv4Mapped returns true if the given 16-byte address is an IPv4-mapped
+// IPv6 address.
+func isIPv4Mapped(addr []byte) bool {
+	for _, b := range addr[:10] {
+		if b != 0 {
+			return false
+		}
+	}
+	return addr[10] == 0xff && addr[11] == 0xff
+}
+
+// padPrefix returns a 16-byte block that contains the first prefixLen bits of
+// the given address in its least significant bits, preceded by a single 1 bit
+// that separates the prefix from the zero padding.
+func padPrefix(addr []byte, prefixLen int) [aes.BlockSize]byte {
+	var padded [aes.BlockSize]byte
+	setBit(padded[:], prefixLen, 1)
+	for i := 0; i < prefixLen; i++ {
+		setBit(padded[:], prefixLen-1-i, getBit(addr, 127-i))
+	}
+	return padded
+}
+
+// getBit returns the bit at the given position, which counts from the least
+// significant bit of the last byte.
+func getBit(b []byte, pos int) byte {
+	return (b[len(b)-1-pos/8] >> (pos % 8)) & 1
+}
+
+// setBit sets the bit at the given position, which counts from the least
+// significant bit of the last byte.
+func setBit(b []byte, pos int, bit byte) {
+	i, mask := len(b)-1-pos/8, byte(1)<<(pos%8)
+	if bit == 0 {
+		b[i] &^= mask
+	} else {
+		b[i] |= mask
+	}
+}
+
+// shiftLeft shifts the given block by one bit to the left.
+func shiftLeft(b *[aes.BlockSize]byte) {
+	for i := 0; i < len(b)-1; i++ {
+		b[i] = b[i]<<1 | b[i+1]>>7
+	}
+	b[len(b)-1] <<= 1
+}
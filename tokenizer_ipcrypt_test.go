@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("Failed to decode hex string: %v", err)
+	}
+	return b
+}
+
+func newIPCryptWithKey(t *testing.T, mode ipcryptMode, key string) *ipcryptTokenizer {
+	t.Helper()
+	c := newIPCryptTokenizer(mode)
+	if err := c.useKey(mustDecodeHex(t, key)); err != nil {
+		t.Fatalf("Failed to set key: %v", err)
+	}
+	return c
+}
+
+// The following test vectors are taken from the ipcrypt specification:
+// https://datatracker.ietf.org/doc/draft-denis-ipcrypt/
+
+func TestIPCryptDeterministicVectors(t *testing.T) {
+	tests := []struct {
+		key, addr, expected string
+	}{
+		{"0123456789abcdeffedcba9876543210", "0.0.0.0", "bde9:6789:d353:824c:d7c6:f58a:6bd2:26eb"},
+		{"1032547698badcfeefcdab8967452301", "255.255.255.255", "aed2:92f6:ea23:58c3:48fd:8b8:74e8:45d8"},
+		{"2b7e151628aed2a6abf7158809cf4f3c", "192.0.2.1", "1dbd:c1b9:fff1:7586:7d0b:67b4:e76e:4777"},
+	}
+	for _, test := range tests {
+		c := newIPCryptWithKey(t, ipcryptDeterministic, test.key)
+		tkn, err := c.tokenize(blob(net.ParseIP(test.addr)))
+		if err != nil {
+			t.Fatalf("Failed to tokenize: %v", err)
+		}
+		assertEqual(t, net.IP(tkn).String(), test.expected)
+	}
+}
+
+func TestIPCryptPfxVectors(t *testing.T) {
+	key := "0123456789abcdeffedcba98765432101032547698badcfeefcdab8967452301"
+	tests := []struct {
+		addr, expected string
+	}{
+		{"0.0.0.0", "151.82.155.134"},
+		{"255.255.255.255", "94.185.169.89"},
+		{"192.0.2.1", "100.115.72.131"},
+		{"2001:db8::1", "c180:5dd4:2587:3524:30ab:fa65:6ab6:f88"},
+	}
+	c := newIPCryptWithKey(t, ipcryptPfx, key)
+	for _, test := range tests {
+		tkn, err := c.tokenize(blob(net.ParseIP(test.addr)))
+		if err != nil {
+			t.Fatalf("Failed to tokenize: %v", err)
+		}
+		assertEqual(t, net.IP(tkn).String(), test.expected)
+	}
+}
+
+func TestIPCryptPfxPreservesPrefix(t *testing.T) {
+	c := newIPCryptPfxTokenizer()
+	_ = c.resetKey()
+
+	t1, _ := c.tokenize(blob(net.ParseIP("10.0.0.47").To4()))
+	t2, _ := c.tokenize(blob(net.ParseIP("10.0.0.129").To4()))
+	t3, _ := c.tokenize(blob(net.ParseIP("10.0.1.1").To4()))
+	assertEqual(t, len(t1), ipv4Len)
+	if !net.IP(t1).Mask(net.CIDRMask(24, 32)).Equal(net.IP(t2).Mask(net.CIDRMask(24, 32))) {
+		t.Fatalf("Expected %s and %s to share a /24 prefix.", net.IP(t1), net.IP(t2))
+	}
+	if net.IP(t1).Mask(net.CIDRMask(24, 32)).Equal(net.IP(t3).Mask(net.CIDRMask(24, 32))) {
+		t.Fatalf("Expected %s and %s to not share a /24 prefix.", net.IP(t1), net.IP(t3))
+	}
+}
+
+func TestIPCryptNDVectors(t *testing.T) {
+	tests := []struct {
+		key, addr, tweak, expected string
+	}{
+		{
+			"0123456789abcdeffedcba9876543210",
+			"0.0.0.0",
+			"08e0c289bff23b7c",
+			"08e0c289bff23b7cb349aadfe3bcef56221c384c7c217b16",
+		},
+	}
+	for _, test := range tests {
+		c, err := newIPCryptKey(ipcryptND, mustDecodeHex(t, test.key))
+		if err != nil {
+			t.Fatalf("Failed to initialize ciphers: %v", err)
+		}
+		tkn := c.encryptNDWithTweak(net.ParseIP(test.addr), mustDecodeHex(t, test.tweak))
+		assertEqual(t, hex.EncodeToString(tkn), test.expected)
+	}
+}
+
+func TestIPCryptNDXVectors(t *testing.T) {
+	tests := []struct {
+		key, addr, tweak, expected string
+	}{
+		{
+			"0123456789abcdeffedcba98765432101032547698badcfeefcdab8967452301",
+			"0.0.0.0",
+			"21bd1834bc088cd2b4ecbe30b70898d7",
+			"21bd1834bc088cd2b4ecbe30b70898d782db0d4125fdace61db35b8339f20ee5",
+		},
+	}
+	for _, test := range tests {
+		c, err := newIPCryptKey(ipcryptNDX, mustDecodeHex(t, test.key))
+		if err != nil {
+			t.Fatalf("Failed to initialize ciphers: %v", err)
+		}
+		tkn := c.encryptNDXWithTweak(net.ParseIP(test.addr), mustDecodeHex(t, test.tweak))
+		assertEqual(t, hex.EncodeToString(tkn), test.expected)
+	}
+}
+
+func TestIPCryptNonDeterministic(t *testing.T) {
+	for _, newTokenizer := range []func() tokenizer{
+		newIPCryptNDTokenizer,
+		newIPCryptNDXTokenizer,
+	} {
+		c := newTokenizer()
+		_ = c.resetKey()
+		t1, _ := c.tokenize(value1)
+		t2, _ := c.tokenize(value1)
+		if string(t1) == string(t2) {
+			t.Fatal("Expected non-deterministic tokens but got identical tokens.")
+		}
+		if c.preservesLen() {
+			t.Fatal("Non-deterministic tokenizer not expected to preserve length.")
+		}
+	}
+}
+
+func TestIPCryptIdenticalKeyHalves(t *testing.T) {
+	c := newIPCryptTokenizer(ipcryptPfx)
+	if err := c.useKey(make([]byte, 32)); err != errIdenticalKeyHalves {
+		t.Fatalf("Expected error '%v' but got '%v'.", errIdenticalKeyHalves, err)
+	}
+}
+
+func BenchmarkIPCryptPfxBatch(b *testing.B) {
+	benchmarkBatch(b, newIPCryptPfxTokenizer())
+}
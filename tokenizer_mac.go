@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	macKeySize = ff1KeySize
+	// The length of an organizationally unique identifier (OUI), in bytes.
+	ouiLen = 3
+)
+
+var errBadMAC = errors.New("not an EUI-48 or EUI-64 MAC address")
+
+// macTokenizer implements a tokenizer that preserves the structure of MAC
+// addresses: it keeps the organizationally unique identifier (OUI), i.e., the
+// vendor prefix, and encrypts the network interface controller (NIC) part
+// using FF1, so tokens are MAC addresses of the same vendor and can still be
+// broken down by vendor.  The OUI is FF1's tweak, so identical NIC parts of
+// different vendors result in different tokens.  Key management is left to
+// the embedded key provider.
+type macTokenizer struct {
+	*keyProvider
+}
+
+func newMACTokenizer() tokenizer {
+	return &macTokenizer{
+		keyProvider: newKeyProvider(tokenizerMAC, macKeySize, func(key []byte) (interface{}, error) {
+			return newFF1(key, 16)
+		}),
+	}
+}
+
+func (c *macTokenizer) tokenize(s serializer) (token, error) {
+	t, _, err := c.tokenizeUsing(s, nil)
+	return t, err
+}
+
+func (c *macTokenizer) tokenizeAndKeyID(s serializer) (token, *keyID, error) {
+	return c.tokenizeUsing(s, nil)
+}
+
+func (c *macTokenizer) tokenizeWithKeyID(s serializer, id *keyID) (token, error) {
+	t, _, err := c.tokenizeUsing(s, id)
+	return t, err
+}
+
+// tokenizeUsing tokenizes the given serializer using the active key with the
+// given ID, or the current key if the ID is nil.
+func (c *macTokenizer) tokenizeUsing(s serializer, id *keyID) (token, *keyID, error) {
+	key, release, err := c.acquireKey(id)
+	if err != nil {
+		c.tokenized(failBecause(err)).Inc()
+		return nil, nil, err
+	}
+	defer release()
+
+	t, err := encryptMAC(key.state.(*ff1), s.bytes(), c.tokenized)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, key.id, nil
+}
+
+func (c *macTokenizer) tokenizeBatch(ss []serializer, id *keyID) ([]token, *keyID, error) {
+	key, release, err := c.acquireKey(id)
+	if err != nil {
+		c.tokenized(failBecause(err)).Add(float64(len(ss)))
+		return nil, nil, err
+	}
+	defer release()
+
+	f := key.state.(*ff1)
+	tokens, err := tokenizeEach(ss, func(s serializer) (token, error) {
+		return encryptMAC(f, s.bytes(), c.tokenized)
+	})
+	return tokens, key.id, err
+}
+
+// encryptMAC turns the given MAC address into a token, i.e., a MAC address in
+// colon-separated, lower-case hexadecimal notation.  We encrypt the NIC part
+// one hexadecimal digit at a time, and count the outcome using tokenized.
+func encryptMAC(f *ff1, b []byte, tokenized func(string) prometheus.Counter) (token, error) {
+	addr, err := net.ParseMAC(strings.TrimSpace(string(b)))
+	if err != nil || (len(addr) != 6 && len(addr) != 8) {
+		tokenized(failBecause(errBadMAC)).Inc()
+		return nil, errBadMAC
+	}
+	oui, nic := addr[:ouiLen], addr[ouiLen:]
+
+	x := make([]uint16, 0, 2*len(nic))
+	for _, b := range nic {
+		x = append(x, uint16(b>>4), uint16(b&0x0f))
+	}
+	y, err := f.encrypt(x, oui)
+	if err != nil {
+		tokenized(failBecause(err)).Inc()
+		return nil, err
+	}
+	t := append(net.HardwareAddr{}, oui...)
+	for i := 0; i < len(y); i += 2 {
+		t = append(t, byte(y[i]<<4|y[i+1]))
+	}
+	tokenized(success).Inc()
+	return token(t.String()), nil
+}
+
+func (c *macTokenizer) preservesLen() bool {
+	return false
+}
+
+func (c *macTokenizer) emitsText() bool {
+	return true
+}
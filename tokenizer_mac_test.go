@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestMACKeepsOUI(t *testing.T) {
+	c := newMACTokenizer()
+	_ = c.resetKey()
+
+	for _, in := range []string{
+		"00:00:5e:00:53:01",
+		"00-00-5E-00-53-01",
+		"0000.5e00.5301",
+		"02:00:5e:10:00:00:00:01",
+	} {
+		tkn, err := c.tokenize(blob(in))
+		if err != nil {
+			t.Fatalf("Failed to tokenize %q: %v", in, err)
+		}
+		addr, err := net.ParseMAC(string(tkn))
+		if err != nil {
+			t.Fatalf("Expected token to be a MAC address but got '%v'.", err)
+		}
+		orig, _ := net.ParseMAC(in)
+		assertEqual(t, len(addr), len(orig))
+		assertEqual(t, addr[:ouiLen].String(), orig[:ouiLen].String())
+		if addr.String() == orig.String() {
+			t.Fatal("Token is identical to input.")
+		}
+		assertEqual(t, string(tkn), addr.String())
+	}
+
+	// Different notations of the same address result in the same token.
+	t1, _ := c.tokenize(blob("00:00:5e:00:53:01"))
+	t2, _ := c.tokenize(blob("00-00-5E-00-53-01"))
+	assertEqual(t, string(t1), string(t2))
+}
+
+func TestMACBadInput(t *testing.T) {
+	c := newMACTokenizer()
+	_ = c.resetKey()
+
+	for _, bad := range []string{
+		"",
+		"00:00:5e:00:53",
+		"00:00:5e:00:53:zz",
+		// IP over InfiniBand link-layer addresses are valid but not EUI-48 or
+		// EUI-64.
+		"00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01",
+	} {
+		if _, err := c.tokenize(blob(bad)); !errors.Is(err, errBadMAC) {
+			t.Fatalf("Expected error '%v' for %q but got '%v'.", errBadMAC, bad, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+const (
+	// The OPRF tokenizer's key is the seed from which we derive its OPRF key
+	// pair.
+	oprfSeedSize = 32 // In bytes.
+)
+
+// oprfInfo is the info string that we derive OPRF key pairs with.
+var oprfInfo = []byte("tkzr")
+
+// oprfPublicKey represents the public key that belongs to one of the OPRF
+// tokenizer's keys, along with the key's ID and epoch.  Clients use the
+// public key to verify evaluations.
+type oprfPublicKey struct {
+	key   []byte
+	id    *keyID
+	epoch epoch
+}
+
+// oprfTokenizer implements a tokenizer whose tokens are the output of a
+// verifiable oblivious PRF.  Besides tokenizing input that it sees, the
+// tokenizer evaluates the PRF on blinded input, which lets clients compute the
+// token of their own input without revealing it to us.  Both ways result in
+// the same token.  Key management is left to the embedded key provider.
+type oprfTokenizer struct {
+	*keyProvider
+}
+
+func newOPRFTokenizer() tokenizer {
+	return &oprfTokenizer{
+		keyProvider: newKeyProvider(tokenizerOPRF, oprfSeedSize, func(seed []byte) (interface{}, error) {
+			return deriveOPRFKey(seed, oprfInfo)
+		}),
+	}
+}
+
+func (o *oprfTokenizer) tokenize(s serializer) (token, error) {
+	t, _, err := o.tokenizeUsing(s, nil)
+	return t, err
+}
+
+func (o *oprfTokenizer) tokenizeAndKeyID(s serializer) (token, *keyID, error) {
+	return o.tokenizeUsing(s, nil)
+}
+
+func (o *oprfTokenizer) tokenizeWithKeyID(s serializer, id *keyID) (token, error) {
+	t, _, err := o.tokenizeUsing(s, id)
+	return t, err
+}
+
+// tokenizeUsing tokenizes the given serializer using the active key with the
+// given ID, or the current key if the ID is nil.
+func (o *oprfTokenizer) tokenizeUsing(s serializer, id *keyID) (token, *keyID, error) {
+	key, release, err := o.acquireKey(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	t, err := key.state.(*oprfKey).evaluate(s.bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, key.id, nil
+}
+
+func (o *oprfTokenizer) tokenizeBatch(ss []serializer, id *keyID) ([]token, *keyID, error) {
+	key, release, err := o.acquireKey(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	k := key.state.(*oprfKey)
+	tokens, err := tokenizeEach(ss, func(s serializer) (token, error) {
+		return k.evaluate(s.bytes())
+	})
+	return tokens, key.id, err
+}
+
+// blindEvaluate evaluates the PRF on the given blinded elements using the
+// current key.
+func (o *oprfTokenizer) blindEvaluate(blinded [][]byte) (*oprfEvaluation, *oprfPublicKey, error) {
+	key, release, err := o.acquireKey(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	k := key.state.(*oprfKey)
+	e, err := k.blindEvaluate(blinded)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e, &oprfPublicKey{key: k.publicKey(), id: key.id, epoch: key.epoch()}, nil
+}
+
+// publicKey returns the public key that belongs to the current key.
+func (o *oprfTokenizer) publicKey() (*oprfPublicKey, error) {
+	key, release, err := o.acquireKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return &oprfPublicKey{
+		key:   key.state.(*oprfKey).publicKey(),
+		id:    key.id,
+		epoch: key.epoch(),
+	}, nil
+}
+
+func (o *oprfTokenizer) preservesLen() bool {
+	return false
+}
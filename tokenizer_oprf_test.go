@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gtank/ristretto255"
+)
+
+func TestOPRFTokenizerBlindEvaluate(t *testing.T) {
+	o := newOPRFTokenizer()
+	if _, _, err := o.(blindEvaluator).blindEvaluate(nil); err != errNoKey {
+		t.Fatalf("Expected error '%v' but got '%v'.", errNoKey, err)
+	}
+	_ = o.resetKey()
+
+	// A client that blinds its input and finalizes our evaluation must end
+	// up with the token that we compute ourselves.
+	input := []byte("192.0.2.1")
+	blind := ristretto255.NewScalar().FromUniformBytes(bytes.Repeat([]byte{0x42}, oprfUniformSize))
+	blinded := [][]byte{oprfBlind(input, blind)}
+	e, pk, err := o.(blindEvaluator).blindEvaluate(blinded)
+	if err != nil {
+		t.Fatalf("Failed to evaluate: %v", err)
+	}
+	assertEqual(t, *pk.id, *o.keyID())
+	if !oprfVerify(t, pk.key, blinded, e) {
+		t.Fatal("Expected proof to verify.")
+	}
+	tkn, err := o.tokenize(blob(input))
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	if !bytes.Equal(oprfUnblind(t, input, e.elements[0], blind), tkn) {
+		t.Fatal("Expected client's output to equal token.")
+	}
+
+	// Once the key rotates, so does the public key.
+	_ = o.resetKey()
+	newPK, err := o.(blindEvaluator).publicKey()
+	if err != nil {
+		t.Fatalf("Failed to get public key: %v", err)
+	}
+	if bytes.Equal(newPK.key, pk.key) {
+		t.Fatal("Expected public key to change after key rotation.")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	phoneKeySize = ff1KeySize
+	// E.164 numbers consist of at most 15 digits, including the country code.
+	maxE164Digits = 15
+	// The separators that we remove from phone numbers before normalizing
+	// them, e.g. "+1 (202) 555-0100".
+	phoneSeparators = " -./()"
+)
+
+var (
+	errBadPhone      = errors.New("not a phone number in international format")
+	errShortPhone    = errors.New("subscriber number is too short to tokenize")
+	errLongPhone     = errors.New("phone number exceeds 15 digits")
+	errNoCountryCode = errors.New("phone number has no valid country code")
+
+	// twoDigitCountryCodes contains the country calling codes that consist of
+	// two digits.  Country calling codes are prefix-free: 1 and 7 are the only
+	// one-digit codes and all codes that start with neither 1, 7, nor one of
+	// the following codes consist of three digits.
+	twoDigitCountryCodes = map[string]bool{
+		"20": true, "27": true, "30": true, "31": true, "32": true, "33": true,
+		"34": true, "36": true, "39": true, "40": true, "41": true, "43": true,
+		"44": true, "45": true, "46": true, "47": true, "48": true, "49": true,
+		"51": true, "52": true, "53": true, "54": true, "55": true, "56": true,
+		"57": true, "58": true, "60": true, "61": true, "62": true, "63": true,
+		"64": true, "65": true, "66": true, "81": true, "82": true, "84": true,
+		"86": true, "90": true, "91": true, "92": true, "93": true, "94": true,
+		"95": true, "98": true,
+	}
+)
+
+// phoneTokenizer implements a tokenizer that preserves the structure of phone
+// numbers: it normalizes a number to E.164, keeps its country code, and
+// encrypts the subscriber number using FF1, so tokens are E.164 numbers of the
+// same country and can still be broken down by country.  The country code is
+// FF1's tweak, so identical subscriber numbers in different countries result
+// in different tokens.  Key management is left to the embedded key provider.
+type phoneTokenizer struct {
+	*keyProvider
+}
+
+func newPhoneTokenizer() tokenizer {
+	return &phoneTokenizer{
+		keyProvider: newKeyProvider(tokenizerPhone, phoneKeySize, func(key []byte) (interface{}, error) {
+			return newFF1(key, 10)
+		}),
+	}
+}
+
+func (p *phoneTokenizer) tokenize(s serializer) (token, error) {
+	t, _, err := p.tokenizeUsing(s, nil)
+	return t, err
+}
+
+func (p *phoneTokenizer) tokenizeAndKeyID(s serializer) (token, *keyID, error) {
+	return p.tokenizeUsing(s, nil)
+}
+
+func (p *phoneTokenizer) tokenizeWithKeyID(s serializer, id *keyID) (token, error) {
+	t, _, err := p.tokenizeUsing(s, id)
+	return t, err
+}
+
+// tokenizeUsing tokenizes the given serializer using the active key with the
+// given ID, or the current key if the ID is nil.
+func (p *phoneTokenizer) tokenizeUsing(s serializer, id *keyID) (token, *keyID, error) {
+	key, release, err := p.acquireKey(id)
+	if err != nil {
+		p.tokenized(failBecause(err)).Inc()
+		return nil, nil, err
+	}
+	defer release()
+
+	t, err := encryptPhone(key.state.(*ff1), s.bytes(), p.tokenized)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, key.id, nil
+}
+
+func (p *phoneTokenizer) tokenizeBatch(ss []serializer, id *keyID) ([]token, *keyID, error) {
+	key, release, err := p.acquireKey(id)
+	if err != nil {
+		p.tokenized(failBecause(err)).Add(float64(len(ss)))
+		return nil, nil, err
+	}
+	defer release()
+
+	f := key.state.(*ff1)
+	tokens, err := tokenizeEach(ss, func(s serializer) (token, error) {
+		return encryptPhone(f, s.bytes(), p.tokenized)
+	})
+	return tokens, key.id, err
+}
+
+// encryptPhone turns the given phone number into a token and counts the
+// outcome using tokenized.
+func encryptPhone(f *ff1, b []byte, tokenized func(string) prometheus.Counter) (token, error) {
+	cc, subscriber, err := normalizePhone(string(b))
+	if err == nil && len(subscriber) < f.minLen {
+		err = errShortPhone
+	}
+	if err != nil {
+		tokenized(failBecause(err)).Inc()
+		return nil, err
+	}
+	x := make([]uint16, len(subscriber))
+	for i := range subscriber {
+		x[i] = uint16(subscriber[i] - '0')
+	}
+	y, err := f.encrypt(x, []byte(cc))
+	if err != nil {
+		tokenized(failBecause(err)).Inc()
+		return nil, err
+	}
+	var t strings.Builder
+	t.WriteString("+" + cc)
+	for _, n := range y {
+		t.WriteByte(byte('0' + n))
+	}
+	tokenized(success).Inc()
+	return token(t.String()), nil
+}
+
+// normalizePhone normalizes the given phone number to E.164 and returns its
+// country code and subscriber number.  We accept numbers in international
+// format only, i.e., numbers that start with "+" or the international call
+// prefix "00", because we cannot tell the country of other numbers.
+func normalizePhone(s string) (string, string, error) {
+	s = strings.TrimSpace(s)
+	s = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(phoneSeparators, r) {
+			return -1
+		}
+		return r
+	}, s)
+	switch {
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	case strings.HasPrefix(s, "00"):
+		s = s[2:]
+	default:
+		return "", "", errBadPhone
+	}
+	if s == "" {
+		return "", "", errBadPhone
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return "", "", errBadPhone
+		}
+	}
+	if len(s) > maxE164Digits {
+		return "", "", errLongPhone
+	}
+
+	ccLen := 3
+	switch {
+	case s[0] == '0':
+		return "", "", errNoCountryCode
+	case s[0] == '1' || s[0] == '7':
+		ccLen = 1
+	case len(s) >= 2 && twoDigitCountryCodes[s[:2]]:
+		ccLen = 2
+	}
+	if len(s) <= ccLen {
+		return "", "", errNoCountryCode
+	}
+	return s[:ccLen], s[ccLen:], nil
+}
+
+func (p *phoneTokenizer) preservesLen() bool {
+	return false
+}
+
+func (p *phoneTokenizer) emitsText() bool {
+	return true
+}
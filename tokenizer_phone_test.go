@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	for _, test := range []struct {
+		in, cc, subscriber string
+		err                error
+	}{
+		{"+1 (202) 555-0100", "1", "2025550100", nil},
+		{"0044 20 7946 0000", "44", "2079460000", nil},
+		{"+353.1.555.0100", "353", "15550100", nil},
+		{"+7 495 555 01 00", "7", "4955550100", nil},
+		{"202 555 0100", "", "", errBadPhone},
+		{"+", "", "", errBadPhone},
+		{"+1 202 555 O100", "", "", errBadPhone},
+		{"+1234567890123456", "", "", errLongPhone},
+		{"+0 202 555 0100", "", "", errNoCountryCode},
+		{"+44", "", "", errNoCountryCode},
+	} {
+		cc, subscriber, err := normalizePhone(test.in)
+		if !errors.Is(err, test.err) {
+			t.Fatalf("Expected error '%v' for %q but got '%v'.", test.err, test.in, err)
+		}
+		assertEqual(t, cc, test.cc)
+		assertEqual(t, subscriber, test.subscriber)
+	}
+}
+
+func TestPhoneKeepsCountryCode(t *testing.T) {
+	p := newPhoneTokenizer()
+	_ = p.resetKey()
+
+	tkn, err := p.tokenize(blob("+44 20 7946 0000"))
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	cc, subscriber, err := normalizePhone(string(tkn))
+	if err != nil {
+		t.Fatalf("Expected token to be an E.164 number but got '%v'.", err)
+	}
+	assertEqual(t, cc, "44")
+	assertEqual(t, len(subscriber), len("2079460000"))
+	if subscriber == "2079460000" {
+		t.Fatal("Token is identical to input.")
+	}
+
+	// The same subscriber number in a different country results in a
+	// different token.
+	other, err := p.tokenize(blob("+43 20 7946 0000"))
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	if strings.TrimPrefix(string(other), "+43") == subscriber {
+		t.Fatal("Expected different tokens for different countries.")
+	}
+}
+
+func TestPhoneTooShort(t *testing.T) {
+	p := newPhoneTokenizer()
+	_ = p.resetKey()
+	labels := metricsFor(pipelinePrimary).numTokenized.WithLabelValues
+	failed := testutil.ToFloat64(labels(failBecause(errShortPhone)))
+
+	if _, err := p.tokenize(blob("+1 5")); !errors.Is(err, errShortPhone) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errShortPhone, err)
+	}
+	assertEqual(t, testutil.ToFloat64(labels(failBecause(errShortPhone))), failed+1)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	sivKeySize = 64 // In bytes, for AES-256-SIV.
+)
+
+var (
+	errUnknownKeyID = errors.New("token's key ID is neither current nor retained")
+	errBadToken     = errors.New("token failed authentication")
+)
+
+// sivKey represents a retained AES-SIV key and its key ID.  The key provider
+// frees its keys when it retires them, so retained keys are copies that we
+// free ourselves once we stop retaining them.
+type sivKey struct {
+	id  keyID
+	siv *aesSIV
+}
+
+// sivTokenizer implements a reversible tokenizer that uses AES-SIV.  Tokens
+// are deterministic and authenticated, and can be turned back into their
+// original data by calling detokenize, provided that the token's key is still
+// active or retained.
+type sivTokenizer struct {
+	sync.RWMutex
+	*keyProvider
+	retained    []*sivKey
+	numRetained int
+}
+
+func newSIVTokenizer() tokenizer {
+	return &sivTokenizer{
+		keyProvider: newKeyProvider(tokenizerSIV, sivKeySize, func(key []byte) (interface{}, error) {
+			return newAESSIV(key)
+		}),
+	}
+}
+
+// setConfig configures the key provider and sets the number of previous keys
+// that we retain for the sake of detokenization.
+func (s *sivTokenizer) setConfig(c *config) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.keyProvider.setConfig(c)
+	s.numRetained = c.sivRetainedKeys
+}
+
+func (s *sivTokenizer) tokenize(t serializer) (token, error) {
+	tkn, _, err := s.tokenizeUsing(t, nil)
+	return tkn, err
+}
+
+func (s *sivTokenizer) tokenizeAndKeyID(t serializer) (token, *keyID, error) {
+	return s.tokenizeUsing(t, nil)
+}
+
+func (s *sivTokenizer) tokenizeWithKeyID(t serializer, id *keyID) (token, error) {
+	tkn, _, err := s.tokenizeUsing(t, id)
+	return tkn, err
+}
+
+// tokenizeUsing tokenizes the given serializer using the active key with the
+// given ID, or the current key if the ID is nil.
+func (s *sivTokenizer) tokenizeUsing(t serializer, id *keyID) (token, *keyID, error) {
+	key, release, err := s.acquireKey(id)
+	if err != nil {
+		s.tokenized(failBecause(err)).Inc()
+		return nil, nil, err
+	}
+	defer release()
+
+	tkn, err := s.seal(key, t)
+	if err != nil {
+		s.tokenized(failBecause(err)).Inc()
+		return nil, nil, err
+	}
+	return tkn, key.id, nil
+}
+
+func (s *sivTokenizer) tokenizeBatch(ts []serializer, id *keyID) ([]token, *keyID, error) {
+	key, release, err := s.acquireKey(id)
+	if err != nil {
+		s.tokenized(failBecause(err)).Add(float64(len(ts)))
+		return nil, nil, err
+	}
+	defer release()
+
+	tokens, err := tokenizeEach(ts, func(t serializer) (token, error) {
+		tkn, err := s.seal(key, t)
+		if err != nil {
+			s.tokenized(failBecause(err)).Inc()
+		}
+		return tkn, err
+	})
+	return tokens, key.id, err
+}
+
+// seal encrypts the given serializer using the given key.
+func (s *sivTokenizer) seal(key *epochKey, t serializer) (token, error) {
+	// We use the key ID as associated data, which binds each token to the
+	// key that created it.
+	tkn, err := key.state.(*aesSIV).seal(t.bytes(), key.id.UUID[:])
+	if err != nil {
+		return nil, err
+	}
+	s.tokenized(success).Inc()
+	return token(tkn), nil
+}
+
+// detokenize turns the given token back into the data that it was created
+// from.  The given key ID must belong to an active key or to one of the
+// retained keys.
+func (s *sivTokenizer) detokenize(t token, id *keyID) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var (
+		data []byte
+		err  error
+	)
+	if key, release, keyErr := s.acquireKey(id); keyErr == nil {
+		data, err = key.state.(*aesSIV).open(t, key.id.UUID[:])
+		release()
+	} else if k := s.retainedKey(id); k != nil {
+		data, err = k.siv.open(t, k.id.UUID[:])
+	} else {
+		m.numDetokenized.With(prometheus.Labels{outcome: failBecause(errUnknownKeyID)}).Inc()
+		return nil, errUnknownKeyID
+	}
+	if err != nil {
+		m.numDetokenized.With(prometheus.Labels{outcome: failBecause(errBadToken)}).Inc()
+		return nil, errBadToken
+	}
+	m.numDetokenized.With(prometheus.Labels{outcome: success}).Inc()
+	return data, nil
+}
+
+// retainedKey returns the retained key with the given ID, or nil if we don't
+// retain such a key.  The caller must hold the read lock.
+func (s *sivTokenizer) retainedKey(id *keyID) *sivKey {
+	for _, k := range s.retained {
+		if k.id == *id {
+			return k
+		}
+	}
+	return nil
+}
+
+// resetKey rotates the key provider's key and retains the previous key, if
+// so configured.
+func (s *sivTokenizer) resetKey() error {
+	s.Lock()
+	defer s.Unlock()
+
+	var prev *sivKey
+	if key, release, err := s.acquireKey(nil); err == nil {
+		if s.numRetained > 0 {
+			siv, err := newAESSIV(key.state.(*aesSIV).key)
+			if err != nil {
+				release()
+				return err
+			}
+			prev = &sivKey{id: *key.id, siv: siv}
+		}
+		release()
+	}
+	if err := s.keyProvider.resetKey(); err != nil {
+		if prev != nil {
+			prev.siv.free()
+		}
+		return err
+	}
+
+	// Retain the previous key (if any) and discard the oldest retained keys if
+	// we exceed the configured number of retained keys.
+	if prev != nil {
+		s.retained = append([]*sivKey{prev}, s.retained...)
+	}
+	if len(s.retained) > s.numRetained {
+		for _, k := range s.retained[s.numRetained:] {
+			k.siv.free()
+		}
+		s.retained = s.retained[:s.numRetained]
+	}
+	return nil
+}
+
+func (s *sivTokenizer) preservesLen() bool {
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSIVDetokenize(t *testing.T) {
+	s := newSIVTokenizer().(*sivTokenizer)
+	s.setConfig(&config{sivRetainedKeys: 1})
+	_ = s.resetKey()
+
+	t1, k1, err := s.tokenizeAndKeyID(value1)
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	data, err := s.detokenize(t1, k1)
+	if err != nil {
+		t.Fatalf("Failed to detokenize: %v", err)
+	}
+	if !bytes.Equal(data, value1) {
+		t.Fatalf("Expected %v but got %v.", value1, data)
+	}
+
+	// After one key rotation, the previous key must still be retained.
+	_ = s.resetKey()
+	if _, err := s.detokenize(t1, k1); err != nil {
+		t.Fatalf("Failed to detokenize using retained key: %v", err)
+	}
+
+	// After two key rotations, the key must be gone.
+	_ = s.resetKey()
+	if _, err := s.detokenize(t1, k1); !errors.Is(err, errUnknownKeyID) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errUnknownKeyID, err)
+	}
+}
+
+func TestSIVDetokenizeWrongKeyID(t *testing.T) {
+	s := newSIVTokenizer().(*sivTokenizer)
+	s.setConfig(&config{sivRetainedKeys: 1})
+	_ = s.resetKey()
+	t1, k1, _ := s.tokenizeAndKeyID(value1)
+	_ = s.resetKey()
+	k2 := s.keyID()
+
+	// A token must not be decrypted by a key other than the one that created
+	// it, even if the key is known to us.
+	if _, err := s.detokenize(t1, k2); !errors.Is(err, errBadToken) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadToken, err)
+	}
+	if _, err := s.detokenize(t1, k1); err != nil {
+		t.Fatalf("Failed to detokenize: %v", err)
+	}
+}
+
+func TestSIVNoRetention(t *testing.T) {
+	s := newSIVTokenizer().(*sivTokenizer)
+	_ = s.resetKey()
+	t1, k1, _ := s.tokenizeAndKeyID(value1)
+	_ = s.resetKey()
+
+	if _, err := s.detokenize(t1, k1); !errors.Is(err, errUnknownKeyID) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errUnknownKeyID, err)
+	}
+}
+
+func TestSIVRetiredKeysWiped(t *testing.T) {
+	wiped := watchWipes(t)
+	s := newSIVTokenizer().(*sivTokenizer)
+	s.setConfig(&config{sivRetainedKeys: 1})
+	_ = s.resetKey()
+	key, release, err := s.acquireKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to acquire key: %v", err)
+	}
+	active := key.state.(*aesSIV).key
+	release()
+
+	// Once rotated, the active key's subkeys are wiped while we retain a
+	// copy of them.
+	_ = s.resetKey()
+	if !wiped(active) {
+		t.Fatal("Expected rotated key's subkeys to be wiped.")
+	}
+	retained := s.retained[0].siv.key
+	if wiped(retained) {
+		t.Fatal("Expected retained key's subkeys to be intact.")
+	}
+
+	// Once we stop retaining the key, its copy is wiped as well.
+	_ = s.resetKey()
+	if !wiped(retained) {
+		t.Fatal("Expected discarded key's subkeys to be wiped.")
+	}
+}
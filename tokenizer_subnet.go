@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errBadPrefixLen = errors.New("prefix length out of range")
+
+// granularToken represents a token of an IP address that was masked to the
+// given prefix length before tokenization.
+type granularToken struct {
+	prefixLen int
+	token     token
+}
+
+// subnetTokenizer implements a tokenizer that wraps another tokenizer.  It
+// masks IP addresses to one or more prefix lengths before handing them to the
+// wrapped tokenizer, which lets us store subnet-level information without
+// storing full addresses.  Key management is left to the wrapped tokenizer.
+type subnetTokenizer struct {
+	tokenizer
+	ipv4Prefixes []int
+	ipv6Prefixes []int
+}
+
+// newSubnetTokenizer returns a new subnet tokenizer that wraps the given
+// tokenizer.  If no prefixes are given for an address family, addresses of
+// that family are tokenized in full.
+func newSubnetTokenizer(t tokenizer, ipv4Prefixes, ipv6Prefixes []int) tokenizer {
+	if len(ipv4Prefixes) == 0 {
+		ipv4Prefixes = []int{ipv4Len * 8}
+	}
+	if len(ipv6Prefixes) == 0 {
+		ipv6Prefixes = []int{ipv6Len * 8}
+	}
+	return &subnetTokenizer{
+		tokenizer:    t,
+		ipv4Prefixes: ipv4Prefixes,
+		ipv6Prefixes: ipv6Prefixes,
+	}
+}
+
+// setConfig hands the given configuration to the wrapped tokenizer, if it's
+// configurable.
+func (s *subnetTokenizer) setConfig(c *config) {
+	if t, ok := s.tokenizer.(configurer); ok {
+		t.setConfig(c)
+	}
+}
+
+// keyEpoch returns the epoch of the wrapped tokenizer's given key, if known.
+func (s *subnetTokenizer) keyEpoch(id *keyID) (epoch, bool) {
+	if e, ok := s.tokenizer.(epochTracker); ok {
+		return e.keyEpoch(id)
+	}
+	return epoch{}, false
+}
+
+// prefixesFor returns the prefix lengths that apply to the given address.
+func (s *subnetTokenizer) prefixesFor(addr []byte) ([]int, error) {
+	switch {
+	case len(addr) == ipv4Len || len(addr) == ipv6Len && isIPv4Mapped(addr):
+		return s.ipv4Prefixes, nil
+	case len(addr) == ipv6Len:
+		return s.ipv6Prefixes, nil
+	default:
+		return nil, errBadBlobLen
+	}
+}
+
+// tokenize masks the given address to the first configured prefix length and
+// tokenizes the result.
+func (s *subnetTokenizer) tokenize(b serializer) (token, error) {
+	t, _, err := s.tokenizeAndKeyID(b)
+	return t, err
+}
+
+// tokenizeAndKeyID masks the given address to the first configured prefix
+// length and tokenizes the result.
+func (s *subnetTokenizer) tokenizeAndKeyID(b serializer) (token, *keyID, error) {
+	addr := b.bytes()
+	prefixes, err := s.prefixesFor(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.tokenizer.tokenizeAndKeyID(blob(maskAddr(addr, prefixes[0])))
+}
+
+// tokenizeWithKeyID masks the given address to the first configured prefix
+// length and tokenizes the result using the active key with the given ID.
+func (s *subnetTokenizer) tokenizeWithKeyID(b serializer, id *keyID) (token, error) {
+	addr := b.bytes()
+	prefixes, err := s.prefixesFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.tokenizer.tokenizeWithKeyID(blob(maskAddr(addr, prefixes[0])), id)
+}
+
+// tokenizeBatch masks each of the given addresses to the first configured
+// prefix length and tokenizes the results using the active key with the given
+// ID.
+func (s *subnetTokenizer) tokenizeBatch(bs []serializer, id *keyID) ([]token, *keyID, error) {
+	var (
+		masked  = make([]serializer, 0, len(bs))
+		indices = make([]int, 0, len(bs))
+		errs    batchError
+	)
+	for i, b := range bs {
+		addr := b.bytes()
+		prefixes, err := s.prefixesFor(addr)
+		if err != nil {
+			if errs == nil {
+				errs = make(batchError)
+			}
+			errs[i] = err
+			continue
+		}
+		masked = append(masked, blob(maskAddr(addr, prefixes[0])))
+		indices = append(indices, i)
+	}
+
+	maskedTokens, kID, err := s.tokenizer.tokenizeBatch(masked, id)
+	var maskedErrs batchError
+	if err != nil && !errors.As(err, &maskedErrs) {
+		return nil, nil, err
+	}
+	tokens := make([]token, len(bs))
+	for j, i := range indices {
+		if e, failed := maskedErrs[j]; failed {
+			if errs == nil {
+				errs = make(batchError)
+			}
+			errs[i] = e
+			continue
+		}
+		tokens[i] = maskedTokens[j]
+	}
+	if errs != nil {
+		return tokens, kID, errs
+	}
+	return tokens, kID, nil
+}
+
+// tokenizeGranular tokenizes the given address once for each of the configured
+// prefix lengths, using the active key with the given ID.
+func (s *subnetTokenizer) tokenizeGranular(b serializer, id *keyID) ([]granularToken, error) {
+	addr := b.bytes()
+	prefixes, err := s.prefixesFor(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]granularToken, len(prefixes))
+	for i, prefixLen := range prefixes {
+		tokens[i].prefixLen = prefixLen
+		tokens[i].token, err = s.tokenizer.tokenizeWithKeyID(blob(maskAddr(addr, prefixLen)), id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+// maskAddr returns a copy of the given address whose bits after the given
+// prefix length are set to zero.  For IPv4-mapped IPv6 addresses, the prefix
+// length refers to the IPv4 part of the address.
+func maskAddr(addr []byte, prefixLen int) []byte {
+	masked := make([]byte, len(addr))
+	copy(masked, addr)
+	if len(addr) == ipv6Len && isIPv4Mapped(addr) {
+		prefixLen += 96
+	}
+	for i := range masked {
+		switch {
+		case prefixLen >= 8*(i+1):
+			continue
+		case prefixLen <= 8*i:
+			masked[i] = 0
+		default:
+			masked[i] &= ^byte(0xff >> (prefixLen - 8*i))
+		}
+	}
+	return masked
+}
+
+// parsePrefixes parses the given comma-separated list of prefix lengths, e.g.
+// "32,24,16".  Each prefix length must be in the interval [0, max].
+func parsePrefixes(s string, max int) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var prefixes []int
+	for _, rawPrefix := range strings.Split(s, ",") {
+		prefix, err := strconv.Atoi(strings.TrimSpace(rawPrefix))
+		if err != nil {
+			return nil, err
+		}
+		if prefix < 0 || prefix > max {
+			return nil, fmt.Errorf("%w: %d not in [0, %d]", errBadPrefixLen, prefix, max)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
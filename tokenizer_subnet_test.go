@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestMaskAddr(t *testing.T) {
+	tests := []struct {
+		addr      net.IP
+		prefixLen int
+		expected  string
+	}{
+		{net.ParseIP("1.2.3.4").To4(), 32, "1.2.3.4"},
+		{net.ParseIP("1.2.3.4").To4(), 24, "1.2.3.0"},
+		{net.ParseIP("1.2.255.4").To4(), 20, "1.2.240.0"},
+		{net.ParseIP("1.2.3.4").To4(), 0, "0.0.0.0"},
+		{net.ParseIP("1.2.3.4"), 16, "1.2.0.0"},
+		{net.ParseIP("2001:db8:1:2:3::1"), 48, "2001:db8:1::"},
+		{net.ParseIP("2001:db8:1:2:3::1"), 64, "2001:db8:1:2::"},
+	}
+	for _, test := range tests {
+		masked := maskAddr(test.addr, test.prefixLen)
+		assertEqual(t, len(masked), len(test.addr))
+		assertEqual(t, net.IP(masked).String(), test.expected)
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := parsePrefixes("32, 24,16", 32)
+	if err != nil {
+		t.Fatalf("Failed to parse prefixes: %v", err)
+	}
+	assertEqual(t, len(prefixes), 3)
+	assertEqual(t, prefixes[1], 24)
+
+	if _, err := parsePrefixes("33", 32); !errors.Is(err, errBadPrefixLen) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadPrefixLen, err)
+	}
+	if _, err := parsePrefixes("foo", 32); err == nil {
+		t.Fatal("Expected error but got none.")
+	}
+	if prefixes, _ := parsePrefixes("", 32); prefixes != nil {
+		t.Fatalf("Expected no prefixes but got %v.", prefixes)
+	}
+}
+
+func TestSubnetTokenizeGranular(t *testing.T) {
+	s := newSubnetTokenizer(newVerbatimTokenizer(), []int{32, 24}, []int{48})
+	_ = s.resetKey()
+
+	tokens, err := s.(granularTokenizer).tokenizeGranular(blob(net.ParseIP("1.2.3.4")), s.keyID())
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	assertEqual(t, len(tokens), 2)
+	assertEqual(t, tokens[0].prefixLen, 32)
+	assertEqual(t, net.IP(tokens[0].token).String(), "1.2.3.4")
+	assertEqual(t, tokens[1].prefixLen, 24)
+	assertEqual(t, net.IP(tokens[1].token).String(), "1.2.3.0")
+
+	tkn, err := s.tokenize(blob(net.ParseIP("2001:db8:1:2::1")))
+	if err != nil {
+		t.Fatalf("Failed to tokenize: %v", err)
+	}
+	assertEqual(t, net.IP(tkn).String(), "2001:db8:1::")
+
+	if _, err := s.tokenize(blob("foo")); !errors.Is(err, errBadBlobLen) {
+		t.Fatalf("Expected error '%v' but got '%v'.", errBadBlobLen, err)
+	}
+}
+
+func TestSubnetTokenizeBatch(t *testing.T) {
+	s := newSubnetTokenizer(newVerbatimTokenizer(), []int{24}, []int{48})
+	_ = s.resetKey()
+
+	tokens, _, err := s.tokenizeBatch([]serializer{
+		blob(net.ParseIP("1.2.3.4")),
+		blob("foo"),
+		blob(net.ParseIP("2001:db8:1:2::1")),
+	}, nil)
+	var errs batchError
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected batch error but got '%v'.", err)
+	}
+	assertEqual(t, errs[1], errBadBlobLen)
+	assertEqual(t, net.IP(tokens[0]).String(), "1.2.3.0")
+	if tokens[1] != nil {
+		t.Fatal("Expected no token for bad address.")
+	}
+	assertEqual(t, net.IP(tokens[2]).String(), "2001:db8:1::")
+}
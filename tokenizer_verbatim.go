@@ -1,59 +1,60 @@
 package main
 
 import (
-	"sync"
-
 	uuid "github.com/google/uuid"
 )
 
 // verbatimTokenizer implements a pseudo tokenizer that returns the same data
-// that it was given.
+// that it was given.  We don't need a key, but we still need a key ID, which
+// the embedded key provider derives from key material, like it does for other
+// tokenizers.
 type verbatimTokenizer struct {
-	sync.RWMutex
-	key *keyID
+	*keyProvider
 }
 
 func newVerbatimTokenizer() tokenizer {
-	return &verbatimTokenizer{}
+	return &verbatimTokenizer{
+		keyProvider: newKeyProvider(tokenizerVerbatim, len(uuid.UUID{}), nil),
+	}
 }
 
 func (v *verbatimTokenizer) tokenize(s serializer) (token, error) {
-	v.RLock()
-	defer v.RUnlock()
-
-	if v.key == nil {
-		return nil, errNoKey
-	}
-	return token(s.bytes()), nil
+	t, _, err := v.tokenizeUsing(s, nil)
+	return t, err
 }
 
 func (v *verbatimTokenizer) tokenizeAndKeyID(s serializer) (token, *keyID, error) {
-	v.RLock()
-	defer v.RUnlock()
+	return v.tokenizeUsing(s, nil)
+}
 
-	if v.key == nil {
-		return nil, nil, errNoKey
-	}
-	return token(s.bytes()), v.key, nil
+func (v *verbatimTokenizer) tokenizeWithKeyID(s serializer, id *keyID) (token, error) {
+	t, _, err := v.tokenizeUsing(s, id)
+	return t, err
 }
 
-func (v *verbatimTokenizer) keyID() *keyID {
-	v.RLock()
-	defer v.RUnlock()
+// tokenizeUsing returns the given serializer's bytes and the ID of the active
+// key with the given ID, or the current key if the ID is nil.
+func (v *verbatimTokenizer) tokenizeUsing(s serializer, id *keyID) (token, *keyID, error) {
+	key, release, err := v.acquireKey(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
 
-	return v.key
+	return token(s.bytes()), key.id, nil
 }
 
-func (v *verbatimTokenizer) resetKey() error {
-	v.Lock()
-	defer v.Unlock()
-
-	u, err := uuid.NewRandom()
+func (v *verbatimTokenizer) tokenizeBatch(ss []serializer, id *keyID) ([]token, *keyID, error) {
+	key, release, err := v.acquireKey(id)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	v.key = &keyID{UUID: u}
-	return nil
+	defer release()
+
+	tokens, err := tokenizeEach(ss, func(s serializer) (token, error) {
+		return token(s.bytes()), nil
+	})
+	return tokens, key.id, err
 }
 
 func (v *verbatimTokenizer) preservesLen() bool {
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"syscall"
 
 	"github.com/linkedin/goavro/v2"
@@ -34,3 +36,26 @@ func maxSoftFdLimit() error {
 
 	return nil
 }
+
+// writeFileAtomically writes the given data to the given file in the given
+// directory.  We write to a temporary file first and then rename it, so a
+// crash cannot leave us with a truncated file.
+func writeFileAtomically(dir, name string, data []byte) error {
+	tmp, err := os.CreateTemp(dir, name+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}